@@ -1,18 +1,38 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"os"
+	"time"
 
 	"github.com/demtoni/tade/internal/api"
 	"github.com/demtoni/tade/internal/config"
+	"github.com/demtoni/tade/internal/database"
 )
 
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [migrate up|down|status]\n", os.Args[0])
+	os.Exit(2)
+}
+
 func main() {
 	cfg, err := config.New()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if len(os.Args) > 1 {
+		if os.Args[1] != "migrate" || len(os.Args) != 3 {
+			usage()
+		}
+		if err := migrate(cfg, os.Args[2]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	srv, err := api.New(cfg)
 	if err != nil {
 		log.Fatal(err)
@@ -20,3 +40,60 @@ func main() {
 
 	log.Fatal(srv.Run())
 }
+
+func migrate(cfg *config.Config, cmd string) error {
+	db, err := database.Open(cfg.PathToDB)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrator, err := database.NewMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	switch cmd {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("database is up to date")
+		}
+		return err
+	case "down":
+		m, err := migrator.Down(ctx)
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			fmt.Println("nothing to revert")
+		} else {
+			fmt.Printf("reverted %04d_%s\n", m.Version, m.Name)
+		}
+		return nil
+	case "status":
+		list, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, m := range list {
+			state := "pending"
+			switch {
+			case m.Version > migrator.Latest():
+				state = "unknown, applied by a newer binary"
+			case m.AppliedAt > 0:
+				state = "applied at " + time.Unix(m.AppliedAt, 0).UTC().Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", m.Version, m.Name, state)
+		}
+		return nil
+	}
+
+	usage()
+	return nil
+}
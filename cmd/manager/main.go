@@ -16,6 +16,30 @@ var (
 	flagSecret   = flag.String("secret", "", "server secret to protect api (required)")
 	flagHostname = flag.String("hostname", "", "public hostname/ip of the machine to generate config URIs, defaults to server address")
 	flagState    = flag.String("state", "", "path to state file (required)")
+	flagRotate   = flag.Int64("rotate", 0, "port rotation interval in seconds of services deployed without one, 0 disables it")
+	flagThrottle = flag.Int64("throttle", manager.ThrottleRate, "speed in bytes per second of services which used up their traffic")
+
+	// wireguard related flags
+	flagWG          = flag.String("wg", manager.WGCommand, "path to the wg command")
+	flagWGInterface = flag.String("wg-interface", manager.WGInterface, "wireguard interface owned by the manager")
+	flagWGSubnet    = flag.String("wg-subnet", "", "subnet to allocate peer addresses from, e.g. 10.8.0.0/24, empty disables wireguard")
+	flagWGPort      = flag.Int("wg-port", manager.WGPort, "listen port of the wireguard interface")
+	flagWGDNS       = flag.String("wg-dns", manager.WGDNS, "dns server pushed to wireguard clients")
+
+	// xray related flags
+	flagXray          = flag.String("xray", manager.XrayCommand, "path to the xray command")
+	flagXrayAPIPort   = flag.Int("xray-api-port", manager.XrayAPIPort, "local port of the xray api")
+	flagXrayVLESSPort = flag.Int("xray-vless-port", manager.XrayVLESSPort, "port of the vless inbound")
+	flagXrayVMessPort = flag.Int("xray-vmess-port", manager.XrayVMessPort, "port of the vmess inbound")
+	flagXrayDest      = flag.String("xray-dest", manager.XrayDest, "site the reality inbound pretends to be")
+	flagXraySNI       = flag.String("xray-sni", manager.XraySNI, "server name of the reality inbound")
+	flagXrayCert      = flag.String("xray-cert", "", "tls certificate of the vless inbound, reality is used when empty")
+	flagXrayKey       = flag.String("xray-key", "", "tls key of the vless inbound")
+
+	// enrollment related flags
+	flagJoin    = flag.String("join", "", "api server url to join and send heartbeats to")
+	flagToken   = flag.String("token", "", "one-time join token generated by the api server admin")
+	flagControl = flag.String("control", "", "base url the api server uses to reach the manager, defaults to http://hostname:port")
 )
 
 func usage() {
@@ -27,13 +51,29 @@ func usage() {
 func main() {
 	flag.Parse()
 
-	if *flagManager == "" || *flagSecret == "" || *flagState == "" {
+	if *flagManager == "" || *flagSecret == "" || *flagState == "" || *flagThrottle <= 0 ||
+		(*flagXrayCert == "") != (*flagXrayKey == "") {
 		usage()
 	}
 
 	manager.Addr = *flagManager
 	manager.Secret = *flagSecret
 	manager.PathToState = *flagState
+	manager.ThrottleRate = *flagThrottle
+	manager.RotateEvery = *flagRotate
+	manager.WGCommand = *flagWG
+	manager.WGInterface = *flagWGInterface
+	manager.WGSubnet = *flagWGSubnet
+	manager.WGPort = *flagWGPort
+	manager.WGDNS = *flagWGDNS
+	manager.XrayCommand = *flagXray
+	manager.XrayAPIPort = *flagXrayAPIPort
+	manager.XrayVLESSPort = *flagXrayVLESSPort
+	manager.XrayVMessPort = *flagXrayVMessPort
+	manager.XrayDest = *flagXrayDest
+	manager.XraySNI = *flagXraySNI
+	manager.XrayCert = *flagXrayCert
+	manager.XrayKey = *flagXrayKey
 
 	var err error
 
@@ -44,11 +84,20 @@ func main() {
 	}
 
 	manager.Hostname = *flagHostname
+	manager.APIAddr = *flagJoin
+	manager.JoinToken = *flagToken
+	manager.ControlAddr = *flagControl
 
 	m, err := manager.New()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if *flagJoin != "" {
+		if err := m.Join(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	log.Fatal(m.Serve())
 }
@@ -10,6 +10,7 @@ require (
 	github.com/gorilla/sessions v1.4.0
 	github.com/rvinnie/yookassa-sdk-go v0.0.0-20240629113713-dfd7cc31b343
 	github.com/sethvargo/go-password v0.3.1
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	golang.org/x/crypto v0.28.0
 	modernc.org/sqlite v1.33.1
 )
@@ -3,16 +3,14 @@ package api
 import (
 	"context"
 	"errors"
+	"log"
 	"net/http"
 	"regexp"
-	"strconv"
-	"time"
 
 	"github.com/demtoni/tade/internal/database"
+	"github.com/demtoni/tade/internal/payment"
 	"github.com/go-chi/render"
 	"github.com/google/uuid"
-	yoocommon "github.com/rvinnie/yookassa-sdk-go/yookassa/common"
-	yoopayment "github.com/rvinnie/yookassa-sdk-go/yookassa/payment"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -119,6 +117,19 @@ func (s *Server) AuthCtx(h http.Handler) http.Handler {
 	})
 }
 
+func (s *Server) AdminCtx(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := r.Context().Value("user").(*database.User)
+
+		if u.Admin == 0 {
+			s.SendError(w, r, nil, http.StatusForbidden, ErrorForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
 type LoginRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
@@ -206,12 +217,21 @@ const (
 	TransactionInProcess = "in_process"
 	TransactionCanceled  = "canceled"
 	TransactionCompleted = "completed"
+	// some of the money was given back
+	TransactionPartiallyRefunded = "partially_refunded"
+	TransactionRefunded          = "refunded"
+	// paid, but not credited as the amount differs, left for the admins
+	TransactionFlagged = "flagged"
 )
 
 type BalanceRequest struct {
 	Amount        int    `json:"amount"`
 	PaymentMethod string `json:"payment_method"`
 	ReturnURL     string `json:"return_url"`
+	// the method is saved to pay for renewals
+	SaveMethod bool `json:"save_method"`
+	// email or phone receipts are sent to, the last one is used if empty
+	ReceiptContact string `json:"receipt_contact"`
 }
 
 type BalanceResponse struct {
@@ -241,97 +261,78 @@ func (s *Server) AddBalance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	payment, err := s.kassa.CreatePayment(&yoopayment.Payment{
-		Amount: &yoocommon.Amount{
-			Value:    strconv.Itoa(data.Amount),
-			Currency: "RUB",
-		},
-		PaymentMethod: yoopayment.PaymentMethodType(data.PaymentMethod),
-		Confirmation: yoopayment.Redirect{
-			Type:      "redirect",
-			ReturnURL: data.ReturnURL,
-		},
+	var contact string
+	if s.config.Receipts {
+		contact = u.ReceiptContact
+		if data.ReceiptContact != "" {
+			v, ok := normalizeContact(data.ReceiptContact)
+			if !ok {
+				s.SendError(w, r, nil, http.StatusBadRequest, ErrorBadReceiptContact)
+				return
+			}
+			contact = v
+		}
+		if contact == "" {
+			s.SendError(w, r, nil, http.StatusBadRequest, ErrorNoReceiptContact)
+			return
+		}
+		if contact != u.ReceiptContact {
+			if err := s.queries.SetReceiptContact(r.Context(), database.SetReceiptContactParams{
+				ReceiptContact: contact,
+				ID:             u.ID,
+			}); err != nil {
+				s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+				return
+			}
+		}
+	}
+
+	p, err := s.payments.Create(r.Context(), &payment.Request{
+		Amount:    int64(data.Amount),
+		Method:    data.PaymentMethod,
+		ReturnURL: data.ReturnURL,
+		Save:      data.SaveMethod,
+		Receipt:   s.receipt(contact, int64(data.Amount)),
 	})
 	if err != nil {
 		s.SendError(w, r, nil, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	paymentUrl, err := s.kassa.ParsePaymentLink(payment)
-	if err != nil {
-		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
-		return
-	}
 	_, err = s.queries.CreateTransaction(r.Context(), database.CreateTransactionParams{
-		PaymentID: payment.ID,
+		PaymentID: p.ID,
 		Amount:    int64(data.Amount),
 		Status:    TransactionInProcess,
-		Timestamp: payment.CreatedAt.Unix(),
-		Url:       paymentUrl,
+		Timestamp: p.CreatedAt.Unix(),
+		Url:       p.URL,
 		UserID:    u.ID,
+		Provider:  s.payments.Name(),
+		Receipt:   string(p.ReceiptStatus),
+		// refunds send their receipts there as well
+		ReceiptContact: contact,
 	})
 	if err != nil {
-		// TODO: cancel payment if for some reason we can't save transaction to the db
+		// YooKassa only cancels paid payments, so this may fail, those are
+		// canceled by processPayment once paid as they have no transaction
+		if _, err := s.payments.Cancel(context.TODO(), p.ID); err != nil {
+			log.Printf("couldn't cancel payment %s: %s", p.ID, err)
+		}
 		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
 		return
 	}
 
-	render.Render(w, r, &BalanceResponse{paymentUrl})
-}
-
-const transactionTimeLimit int64 = 3600
-
-func (s *Server) ProcessPayments() error {
-	_, err := s.queries.CancelExpiredTransactions(context.TODO(), time.Now().Unix()-transactionTimeLimit)
-	if err != nil {
-		return err
-	}
-
-	var cursor string
-	for {
-		captureBatch, err := s.kassa.FindPayments(&yoopayment.PaymentListFilter{
-			Cursor: cursor,
-			Status: yoopayment.WaitingForCapture,
-		})
-		if err != nil {
-			return err
-		}
-
-		for _, payment := range captureBatch.Items {
-			p, err := s.kassa.CapturePayment(&payment)
-			if err != nil {
-				return err
-			}
-			meta, err := s.queries.UpdateTransaction(context.TODO(), database.UpdateTransactionParams{
-				Status:    TransactionCompleted,
-				PaymentID: p.ID,
-			})
-			if err != nil {
-				return err
-			}
-			u, err := s.queries.GetUser(context.TODO(), meta.UserID)
-			if err != nil {
-				return err
-			}
-			if err := s.queries.UpdateBalance(context.TODO(), database.UpdateBalanceParams{
-				Balance: u.Balance + meta.Amount,
-				ID:      u.ID,
-			}); err != nil {
-				return err
-			}
-		}
-		if cursor == "" {
-			break
-		}
-	}
-	return nil
+	render.Render(w, r, &BalanceResponse{p.URL})
 }
 
 type TransactionResponse struct {
+	PaymentID string `json:"payment_id"`
 	URL       string `json:"url"`
 	Amount    int64  `json:"amount"`
+	Refunded  int64  `json:"refunded,omitempty"`
 	Timestamp int64  `json:"timestamp"`
 	Status    string `json:"status"`
+	// registration of the fiscal receipt, succeeded once it is issued
+	Receipt string `json:"receipt,omitempty"`
 }
 
 func (r *TransactionResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
@@ -342,7 +343,7 @@ func NewTransactionListResponse(transactions *[]database.Transaction) []render.R
 	list := []render.Renderer{}
 	for _, trans := range *transactions {
 		list = append(list, &TransactionResponse{
-			trans.Url, trans.Amount, trans.Timestamp, trans.Status,
+			trans.PaymentID, trans.Url, trans.Amount, trans.Refunded, trans.Timestamp, trans.Status, trans.Receipt,
 		})
 	}
 	return list
@@ -364,6 +365,10 @@ type UserInfoResponse struct {
 	Username string `json:"username"`
 	Balance  int64  `json:"balance"`
 	Invites  int64  `json:"invites"`
+	Admin    bool   `json:"admin,omitempty"`
+	// top-ups require a receipt contact if set
+	Receipts       bool   `json:"receipts,omitempty"`
+	ReceiptContact string `json:"receipt_contact,omitempty"`
 }
 
 func (r *UserInfoResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
@@ -372,7 +377,9 @@ func (r *UserInfoResponse) Render(_ http.ResponseWriter, _ *http.Request) error
 
 func (s *Server) GetUserInfo(w http.ResponseWriter, r *http.Request) {
 	u := r.Context().Value("user").(*database.User)
-	render.Render(w, r, &UserInfoResponse{u.Name, u.Balance, u.Invites})
+	render.Render(w, r, &UserInfoResponse{
+		u.Name, u.Balance, u.Invites, u.Admin > 0, s.config.Receipts, u.ReceiptContact,
+	})
 }
 
 type InviteResponse struct {
@@ -0,0 +1,343 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/demtoni/tade/internal/database"
+	"github.com/demtoni/tade/internal/payment"
+	"github.com/go-chi/render"
+)
+
+const JobAutopay = "autopay"
+
+const (
+	AutopayPending   = "pending"
+	AutopaySucceeded = "succeeded"
+	AutopayFailed    = "failed"
+)
+
+// the service isn't suspended for that long while its charge is pending
+const autopayTimeout = time.Hour
+
+// When a renewal lacks money and the user has saved a payment method, the
+// method is charged for the shortfall once per term of the service. The
+// service is left as is until the charge settles, the next check renews it
+// with the money topped up or suspends it as usual.
+
+type autopayJob struct {
+	ChargeID int64 `json:"charge_id"`
+}
+
+func init() {
+	registerJob(JobAutopay, &jobHandler{
+		run:         (*Server).runAutopay,
+		dead:        (*Server).failAutopay,
+		maxAttempts: 5,
+	})
+}
+
+// monthStart returns the start of the calendar month limits are counted in.
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// requestAutopay queues the charge of the saved method for the renewal of
+// the service, it reports whether the renewal should wait for the charge.
+func (s *Server) requestAutopay(ctx context.Context, q *database.Queries, srv *database.GetExpiredServicesRow, now int64) (bool, error) {
+	method, err := q.GetPaymentMethod(ctx, srv.UserID)
+	if err == sql.ErrNoRows || (err == nil && method.Provider != s.payments.Name()) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	charge, err := q.GetTermAutopayCharge(ctx, database.GetTermAutopayChargeParams{
+		ServiceID: srv.ID,
+		ExpiresAt: srv.ExpiresAt,
+	})
+	if err == nil {
+		// charged already, the money went elsewhere if it isn't enough
+		return charge.Status == AutopayPending && charge.CreatedAt > now-int64(autopayTimeout.Seconds()), nil
+	}
+	if err != sql.ErrNoRows {
+		return false, err
+	}
+
+	user, err := q.GetUser(ctx, srv.UserID)
+	if err != nil {
+		return false, err
+	}
+	shortfall := srv.ProlongPrice - user.Balance
+
+	// the renewal doesn't wait for a charge that can't be made
+	spent, err := q.SumAutopayCharges(ctx, database.SumAutopayChargesParams{
+		UserID: srv.UserID,
+		Since:  monthStart(time.Unix(now, 0)).Unix(),
+	})
+	if err != nil {
+		return false, err
+	}
+	if spent+shortfall > method.MonthlyLimit {
+		return false, nil
+	}
+
+	id, err := q.CreateAutopayCharge(ctx, database.CreateAutopayChargeParams{
+		UserID:    srv.UserID,
+		ServiceID: srv.ID,
+		ExpiresAt: srv.ExpiresAt,
+		Amount:    shortfall,
+		CreatedAt: now,
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := enqueue(ctx, q, JobAutopay, jobKey(JobAutopay, id), &autopayJob{ChargeID: id}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// runAutopay creates the payment, it is captured and credited by
+// processPayment like any other.
+func (s *Server) runAutopay(ctx context.Context, payload []byte) error {
+	job := &autopayJob{}
+	if err := json.Unmarshal(payload, job); err != nil {
+		return permanent(err)
+	}
+
+	charge, err := s.queries.GetAutopayCharge(ctx, job.ChargeID)
+	if err != nil {
+		return err
+	}
+	if charge.Status != AutopayPending {
+		return nil
+	}
+
+	var p *payment.Payment
+	if charge.PaymentID != "" {
+		// created by the previous attempt
+		if p, err = s.payments.Get(ctx, charge.PaymentID); err != nil {
+			return err
+		}
+		return s.processPayment(ctx, p)
+	}
+
+	method, err := s.queries.GetPaymentMethod(ctx, charge.UserID)
+	if err == sql.ErrNoRows {
+		return permanent(errors.New("payment method was removed"))
+	}
+	if err != nil {
+		return err
+	}
+	if method.Provider != s.payments.Name() {
+		return permanent(fmt.Errorf("payment method of %s can't be charged", method.Provider))
+	}
+
+	spent, err := s.queries.SumAutopayCharges(ctx, database.SumAutopayChargesParams{
+		UserID:  charge.UserID,
+		Since:   monthStart(time.Now()).Unix(),
+		Exclude: charge.ID,
+	})
+	if err != nil {
+		return err
+	}
+	if spent+charge.Amount > method.MonthlyLimit {
+		return permanent(fmt.Errorf("monthly limit of %d is reached", method.MonthlyLimit))
+	}
+
+	var contact string
+	if s.config.Receipts {
+		user, err := s.queries.GetUser(ctx, charge.UserID)
+		if err != nil {
+			return err
+		}
+		if user.ReceiptContact == "" {
+			return permanent(errors.New("no receipt contact"))
+		}
+		contact = user.ReceiptContact
+	}
+
+	p, err = s.payments.Create(ctx, &payment.Request{
+		Amount:   charge.Amount,
+		MethodID: method.MethodID,
+		// the payment is created once however many times the job runs
+		IdempotenceKey: jobKey(JobAutopay, charge.ID),
+		Receipt:        s.receipt(contact, charge.Amount),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = s.withTx(ctx, func(q *database.Queries) error {
+		if _, err := q.CreateTransaction(ctx, database.CreateTransactionParams{
+			PaymentID:      p.ID,
+			Amount:         charge.Amount,
+			Status:         TransactionInProcess,
+			Timestamp:      p.CreatedAt.Unix(),
+			UserID:         charge.UserID,
+			Provider:       s.payments.Name(),
+			Receipt:        string(p.ReceiptStatus),
+			ReceiptContact: contact,
+		}); err != nil {
+			return err
+		}
+		return q.SetAutopayChargePayment(ctx, database.SetAutopayChargePaymentParams{
+			PaymentID: p.ID,
+			ID:        charge.ID,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.processPayment(ctx, p)
+}
+
+func (s *Server) failAutopay(ctx context.Context, q *database.Queries, payload []byte) error {
+	job := &autopayJob{}
+	if err := json.Unmarshal(payload, job); err != nil {
+		return err
+	}
+	_, err := s.settleAutopay(ctx, q, job.ChargeID, "", AutopayFailed)
+	return err
+}
+
+// settleAutopay finishes the charge found by its id or by its payment, it
+// reports whether there was a pending charge.
+func (s *Server) settleAutopay(ctx context.Context, q *database.Queries, id int64, paymentID, status string) (bool, error) {
+	charge, err := q.SettleAutopayCharge(ctx, database.SettleAutopayChargeParams{
+		Status:    status,
+		ID:        id,
+		PaymentID: paymentID,
+	})
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	event := EventAutopaySucceeded
+	if status == AutopayFailed {
+		event = EventAutopayFailed
+	}
+	return true, s.notifyTx(ctx, q, charge.UserID, charge.ServiceID, event)
+}
+
+// saveMethod remembers the method the user paid with, the limit is kept if
+// the method is replaced.
+func (s *Server) saveMethod(ctx context.Context, q *database.Queries, userID int64, method *payment.SavedMethod) error {
+	return q.SavePaymentMethod(ctx, database.SavePaymentMethodParams{
+		UserID:       userID,
+		Provider:     s.payments.Name(),
+		MethodID:     method.ID,
+		Title:        method.Title,
+		MonthlyLimit: s.config.AutopayLimit,
+		CreatedAt:    time.Now().Unix(),
+	})
+}
+
+type AutopayResponse struct {
+	Title        string `json:"title"`
+	MonthlyLimit int64  `json:"monthly_limit"`
+	// charged this month
+	Spent     int64 `json:"spent"`
+	CreatedAt int64 `json:"created_at"`
+}
+
+func (r *AutopayResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	return nil
+}
+
+func (s *Server) GetAutopay(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value("user").(*database.User)
+
+	method, err := s.queries.GetPaymentMethod(r.Context(), u.ID)
+	if err == sql.ErrNoRows {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorNoPaymentMethod)
+		return
+	}
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	spent, err := s.queries.SumAutopayCharges(r.Context(), database.SumAutopayChargesParams{
+		UserID: u.ID,
+		Since:  monthStart(time.Now()).Unix(),
+	})
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	render.Render(w, r, &AutopayResponse{method.Title, method.MonthlyLimit, spent, method.CreatedAt})
+}
+
+type AutopayLimitRequest struct {
+	MonthlyLimit int64 `json:"monthly_limit"`
+}
+
+func (r *AutopayLimitRequest) Bind(_ *http.Request) error {
+	if r.MonthlyLimit < 0 {
+		return errors.New(ErrorBadAutopayLimit)
+	}
+	return nil
+}
+
+// SetAutopayLimit changes how much the saved method may be charged in a
+// month, zero turns the charges off without forgetting the method.
+func (s *Server) SetAutopayLimit(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value("user").(*database.User)
+
+	data := &AutopayLimitRequest{}
+	if err := render.Bind(r, data); err != nil {
+		s.SendError(w, r, nil, http.StatusBadRequest, err.Error())
+		return
+	}
+	if data.MonthlyLimit > s.config.AutopayLimit {
+		s.SendError(w, r, nil, http.StatusBadRequest, ErrorBadAutopayLimit)
+		return
+	}
+
+	n, err := s.queries.SetAutopayLimit(r.Context(), database.SetAutopayLimitParams{
+		MonthlyLimit: data.MonthlyLimit,
+		UserID:       u.ID,
+	})
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+	if n == 0 {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorNoPaymentMethod)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+}
+
+// DeleteAutopay forgets the saved method, charges already made aren't
+// affected.
+func (s *Server) DeleteAutopay(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value("user").(*database.User)
+
+	n, err := s.queries.DeletePaymentMethod(r.Context(), u.ID)
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+	if n == 0 {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorNoPaymentMethod)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+}
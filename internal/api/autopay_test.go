@@ -0,0 +1,144 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/demtoni/tade/internal/database"
+	"github.com/demtoni/tade/internal/payment"
+)
+
+// saveSandboxCard tops the balance up with a card that is saved for
+// automatic payments.
+func saveSandboxCard(t *testing.T, s *Server, ts *httptest.Server, userID, amount int64) {
+	t.Helper()
+	ctx := context.Background()
+
+	p := paySandbox(t, s, ts, createTopUp(t, s, userID, amount, true).ID)
+	if err := s.processPayment(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.queries.GetPaymentMethod(ctx, userID); err != nil {
+		t.Fatalf("card wasn't saved: %s", err)
+	}
+}
+
+func expiredService(userID, price int64) *database.GetExpiredServicesRow {
+	return &database.GetExpiredServicesRow{
+		ID:           1,
+		UserID:       userID,
+		ProlongPrice: price,
+		ExpiresAt:    time.Now().Unix(),
+	}
+}
+
+func TestRunAutopay(t *testing.T) {
+	s, ts := newTestServer(t)
+	ctx := context.Background()
+	user := createTestUser(t, s, "alice")
+	saveSandboxCard(t, s, ts, user, 100)
+
+	wait, err := s.requestAutopay(ctx, s.queries, expiredService(user, 250), time.Now().Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wait {
+		t.Fatal("renewal doesn't wait for the charge")
+	}
+	var charge database.AutopayCharge
+	if charge, err = s.queries.GetAutopayCharge(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if charge.Amount != 150 {
+		t.Errorf("charged %d, want 150", charge.Amount)
+	}
+
+	payload, _ := json.Marshal(&autopayJob{ChargeID: charge.ID})
+	if err := s.runAutopay(ctx, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if charge, err = s.queries.GetAutopayCharge(ctx, charge.ID); err != nil {
+		t.Fatal(err)
+	}
+	if charge.Status != AutopaySucceeded {
+		t.Errorf("charge is %s, want %s", charge.Status, AutopaySucceeded)
+	}
+	if b := balanceOf(t, s, user); b != 250 {
+		t.Errorf("balance is %d, want 250", b)
+	}
+}
+
+// The provider may report the charge before runAutopay records the
+// payment, it must not be canceled as unknown then.
+func TestRunAutopayEarlyNotification(t *testing.T) {
+	s, ts := newTestServer(t)
+	ctx := context.Background()
+	user := createTestUser(t, s, "alice")
+	saveSandboxCard(t, s, ts, user, 100)
+
+	if _, err := s.requestAutopay(ctx, s.queries, expiredService(user, 250), time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+	method, err := s.queries.GetPaymentMethod(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// what runAutopay asks for, the sandbox notifies right away
+	p, err := s.payments.Create(ctx, &payment.Request{
+		Amount:         150,
+		MethodID:       method.MethodID,
+		IdempotenceKey: jobKey(JobAutopay, 1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.processPayment(ctx, p); err == nil {
+		t.Error("unrecorded charge was processed")
+	}
+	if got, _ := s.payments.Get(ctx, p.ID); got.Status != payment.WaitingForCapture {
+		t.Fatalf("payment is %s, want %s", got.Status, payment.WaitingForCapture)
+	}
+
+	payload, _ := json.Marshal(&autopayJob{ChargeID: 1})
+	if err := s.runAutopay(ctx, payload); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.payments.Get(ctx, p.ID); got.Status != payment.Succeeded {
+		t.Errorf("payment is %s, want %s", got.Status, payment.Succeeded)
+	}
+	if b := balanceOf(t, s, user); b != 250 {
+		t.Errorf("balance is %d, want 250", b)
+	}
+}
+
+func TestRequestAutopayLimit(t *testing.T) {
+	s, ts := newTestServer(t)
+	ctx := context.Background()
+	user := createTestUser(t, s, "alice")
+	saveSandboxCard(t, s, ts, user, 100)
+
+	for _, limit := range []int64{0, 149} {
+		if _, err := s.queries.SetAutopayLimit(ctx, database.SetAutopayLimitParams{
+			MonthlyLimit: limit,
+			UserID:       user,
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		wait, err := s.requestAutopay(ctx, s.queries, expiredService(user, 250), time.Now().Unix())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait {
+			t.Errorf("renewal waits for a charge over the limit of %d", limit)
+		}
+		if _, err := s.queries.GetAutopayCharge(ctx, 1); err == nil {
+			t.Errorf("charge over the limit of %d was created", limit)
+		}
+	}
+}
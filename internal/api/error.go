@@ -19,6 +19,7 @@ const (
 	ErrorUsernameTaken        = "this username is already taken."
 	ErrorInternal             = "internal server error, try again later."
 	ErrorUnauthorized         = "you are not authorized to make this request."
+	ErrorForbidden            = "you don't have permission to make this request."
 	ErrorUserNotFound         = "user with this combination of username and password doesn't exist."
 	ErrorBadInvite            = "this invite couldn't be used for registration."
 	ErrorEmptyField           = "fields can't be empty."
@@ -26,6 +27,13 @@ const (
 	ErrorServiceUnknown       = "unknown service type."
 	ErrorServiceNotFound      = "service with that id doesn't exist."
 	ErrorLocationNotSupported = "location doesn't support this type of service."
+	ErrorLocationNotFound     = "location with that id doesn't exist."
+	ErrorBadHostname          = "hostname should be a valid ip address or domain name."
+	ErrorNodeNotFound         = "node with that id doesn't exist."
+	ErrorLocationUnavailable  = "location is currently unavailable, try again later."
+	ErrorLocationFull         = "location has no free slots left."
+	ErrorMethodNotSupported   = "location doesn't support this encryption method."
+	ErrorPluginNotSupported   = "location doesn't support this plugin."
 	ErrorLongServiceName      = "service name is too long (max 72 char)."
 	ErrorNegativePeriod       = "service period must be > 0."
 	ErrorLowBalance           = "your balance is too low."
@@ -33,6 +41,35 @@ const (
 	ErrorNoServices           = "no services found."
 	ErrorNoInvites            = "you can't generate any invites."
 	ErrorNoUnusedInvites      = "you don't have any unused invites."
+	ErrorBadWeight            = "node weight must be > 0."
+	ErrorBadJoinToken         = "join token is invalid, already used or expired."
+	ErrorBadPolicy            = "policy is invalid."
+	ErrorPolicyNotFound       = "policy not found."
+	ErrorPolicyInUse          = "policy is used by services."
+	ErrorPolicyUnsupported    = "policy can't be enforced by services using it."
+	ErrorBadTrafficPacks      = "number of traffic packs must be > 0."
+	ErrorNoTrafficPacks       = "traffic packs are not sold for this service."
+	ErrorRotating             = "service port was changed recently, try again later."
+	ErrorBadRotation          = "port rotation interval must be at least an hour."
+	ErrorNotRotatable         = "service doesn't support port rotation."
+	ErrorBadProtocol          = "protocol must be either vless or vmess."
+	ErrorNoSuchUser           = "user with that id doesn't exist."
+	ErrorBadAdjustment        = "adjustment amount can't be zero."
+	ErrorJobNotFound          = "job with that id doesn't exist."
+	ErrorJobNotRetryable      = "only dead or canceled jobs can be retried."
+	ErrorJobNotQueued         = "only queued jobs can be canceled."
+	ErrorBadNotification      = "notification is malformed."
+	ErrorUnknownProvider      = "unknown payment provider."
+	ErrorServiceNotActive     = "service isn't active."
+	ErrorTransactionNotFound  = "transaction with that id doesn't exist."
+	ErrorNotRefundable        = "only completed top-ups can be refunded."
+	ErrorBadRefund            = "refund amount must be > 0 and not exceed what is left of the payment."
+	ErrorRefundFailed         = "payment provider rejected the refund."
+	ErrorReportNotFound       = "report with that id doesn't exist."
+	ErrorNoPaymentMethod      = "no payment method is saved."
+	ErrorBadAutopayLimit      = "monthly limit must be >= 0 and not exceed the allowed maximum."
+	ErrorNoReceiptContact     = "email or phone for the receipt is required."
+	ErrorBadReceiptContact    = "receipt contact must be an email or a phone number."
 )
 
 func (e *ErrorResponse) Render(w http.ResponseWriter, r *http.Request) error {
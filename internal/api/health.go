@@ -0,0 +1,142 @@
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/demtoni/tade/internal/database"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+const (
+	healthCheckInterval = 30 * time.Second
+	// how long up/down history of the nodes is kept
+	healthHistory int64 = 7 * 86400
+	// node is taken off sale after failing that many checks in a row, a
+	// single success brings it back
+	healthFailures = 3
+)
+
+// checkNode probes the manager and decides whether the node can be used for
+// the customers. Enrolled nodes also have to keep sending heartbeats, a node
+// is only marked down after several failed checks.
+func (s *Server) checkNode(node *database.ListNodesRow) error {
+	now := time.Now()
+
+	latency, err := s.client(node.Address).Ping(context.TODO())
+	up := err == nil
+	if up && node.HeartbeatKey != "" {
+		up = node.LastSeen >= now.Add(-heartbeatMisses*heartbeatInterval).Unix()
+	}
+
+	if err := s.queries.CreateNodeCheck(context.TODO(), database.CreateNodeCheckParams{
+		NodeID:    node.ID,
+		Timestamp: now.Unix(),
+		Up:        boolToInt(up),
+		Latency:   latency.Milliseconds(),
+	}); err != nil {
+		return err
+	}
+
+	if up {
+		if err := s.syncExpirations(node); err != nil {
+			log.Printf("node %d: couldn't sync expirations: %s", node.ID, err)
+		}
+		if err := s.syncPolicies(node); err != nil {
+			log.Printf("node %d: couldn't sync policies: %s", node.ID, err)
+		}
+	}
+
+	if up == (node.Online > 0) {
+		return nil
+	}
+	if !up {
+		failures, err := s.queries.CountNodeFailures(context.TODO(), node.ID)
+		if err != nil || failures < healthFailures {
+			return err
+		}
+	}
+
+	if up {
+		log.Printf("node %d in %s is up", node.ID, node.Location)
+	} else {
+		log.Printf("node %d in %s is down", node.ID, node.Location)
+	}
+
+	return s.queries.SetNodeOnline(context.TODO(), database.SetNodeOnlineParams{
+		Online: boolToInt(up),
+		ID:     node.ID,
+	})
+}
+
+func (s *Server) CheckNodes() error {
+	nodes, err := s.queries.ListNodes(context.TODO())
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for i := range nodes {
+		wg.Add(1)
+		go func(node *database.ListNodesRow) {
+			defer wg.Done()
+			if err := s.checkNode(node); err != nil {
+				log.Printf("node %d: %s", node.ID, err)
+			}
+		}(&nodes[i])
+	}
+	wg.Wait()
+
+	return s.queries.DeleteOldNodeChecks(context.TODO(), time.Now().Unix()-healthHistory)
+}
+
+func boolToInt(v bool) int64 {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+type NodeCheckResponse struct {
+	Timestamp int64 `json:"timestamp"`
+	Up        bool  `json:"up"`
+	Latency   int64 `json:"latency"`
+}
+
+func (r *NodeCheckResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	return nil
+}
+
+func (s *Server) ListNodeChecks(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorNodeNotFound)
+		return
+	}
+
+	since := time.Now().Unix() - 86400
+	if v, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64); err == nil {
+		since = v
+	}
+
+	checks, err := s.queries.ListNodeChecks(r.Context(), database.ListNodeChecksParams{
+		NodeID:    int64(id),
+		Timestamp: since,
+	})
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	list := []render.Renderer{}
+	for _, check := range checks {
+		list = append(list, &NodeCheckResponse{check.Timestamp, check.Up > 0, check.Latency})
+	}
+
+	render.RenderList(w, r, list)
+}
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/demtoni/tade/internal/database"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+const (
+	HostnameIPv4   = "ipv4"
+	HostnameIPv6   = "ipv6"
+	HostnameDomain = "domain"
+)
+
+var validDomain = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]{2,63}$`)
+
+// hostnameKind tells what kind of public endpoint the hostname is, empty
+// string is returned for invalid ones.
+func hostnameKind(hostname string) string {
+	if ip := net.ParseIP(hostname); ip != nil {
+		if ip.To4() != nil {
+			return HostnameIPv4
+		}
+		return HostnameIPv6
+	}
+	if validDomain.MatchString(hostname) {
+		return HostnameDomain
+	}
+	return ""
+}
+
+type HostnameRequest struct {
+	Kind     string `json:"kind"`
+	Hostname string `json:"hostname"`
+}
+
+type HostnameListRequest struct {
+	Hostnames []*HostnameRequest `json:"hostnames"`
+}
+
+func (r *HostnameListRequest) Bind(_ *http.Request) error {
+	for _, h := range r.Hostnames {
+		kind := hostnameKind(h.Hostname)
+		if kind == "" {
+			return errors.New(ErrorBadHostname)
+		}
+		// domain can point to both ipv4 and ipv6 addresses, so only
+		// domain kind could be overridden
+		if h.Kind != "" && h.Kind != kind && kind != HostnameDomain {
+			return errors.New(ErrorBadHostname)
+		}
+		if h.Kind == "" {
+			h.Kind = kind
+		}
+	}
+	return nil
+}
+
+type HostnameResponse struct {
+	Kind     string `json:"kind"`
+	Hostname string `json:"hostname"`
+}
+
+func (r *HostnameResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	return nil
+}
+
+func (s *Server) SetNodeHostnames(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorNodeNotFound)
+		return
+	}
+
+	data := &HostnameListRequest{}
+	if err := render.Bind(r, data); err != nil {
+		s.SendError(w, r, nil, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.withTx(r.Context(), func(q *database.Queries) error {
+		if err := q.DeleteNodeHostnames(r.Context(), int64(id)); err != nil {
+			return err
+		}
+		for _, h := range data.Hostnames {
+			if err := q.CreateNodeHostname(r.Context(), database.CreateNodeHostnameParams{
+				NodeID:   int64(id),
+				Kind:     h.Kind,
+				Hostname: h.Hostname,
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+}
+
+func (s *Server) SetLocationHostnames(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorLocationNotFound)
+		return
+	}
+
+	data := &HostnameListRequest{}
+	if err := render.Bind(r, data); err != nil {
+		s.SendError(w, r, nil, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.withTx(r.Context(), func(q *database.Queries) error {
+		if err := q.DeleteLocationHostnames(r.Context(), int64(id)); err != nil {
+			return err
+		}
+		for _, h := range data.Hostnames {
+			if err := q.CreateLocationHostname(r.Context(), database.CreateLocationHostnameParams{
+				LocationID: int64(id),
+				Kind:       h.Kind,
+				Hostname:   h.Hostname,
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+}
+
+func (s *Server) ListLocationHostnames(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorLocationNotFound)
+		return
+	}
+
+	hostnames, err := s.queries.ListLocationHostnames(r.Context(), int64(id))
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	list := []render.Renderer{}
+	for _, h := range hostnames {
+		list = append(list, &HostnameResponse{h.Kind, h.Hostname})
+	}
+
+	render.RenderList(w, r, list)
+}
+
+type Endpoint struct {
+	Kind       string `json:"kind"`
+	Hostname   string `json:"hostname"`
+	ConnectURL string `json:"connect_url"`
+}
+
+// endpoints returns every public hostname customers can use to reach the
+// service, node hostnames go first.
+func (s *Server) endpoints(ctx context.Context, nodeID, locationID int64, url func(host string) string) ([]*Endpoint, error) {
+	hostnames, err := s.queries.ListServiceHostnames(ctx, database.ListServiceHostnamesParams{
+		NodeID:     nodeID,
+		LocationID: locationID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*Endpoint, 0)
+	for _, h := range hostnames {
+		list = append(list, &Endpoint{h.Kind, h.Hostname, url(h.Hostname)})
+	}
+	return list, nil
+}
+
+// pickEndpoint returns the endpoint of the preferred kind, falling back to
+// the first one.
+func pickEndpoint(list []*Endpoint, kind string) *Endpoint {
+	if len(list) == 0 {
+		return nil
+	}
+	for _, e := range list {
+		if e.Kind == kind {
+			return e
+		}
+	}
+	return list[0]
+}
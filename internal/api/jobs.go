@@ -0,0 +1,380 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/demtoni/tade/internal/database"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+const (
+	JobQueued   = "queued"
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobDead     = "dead"
+	JobCanceled = "canceled"
+)
+
+const (
+	jobPollInterval = time.Second
+	jobTimeout      = time.Minute
+	jobBackoff      = 10 * time.Second
+	jobMaxBackoff   = 30 * time.Minute
+	// finished jobs are kept for a week to be looked at
+	jobRetention = 7 * 24 * time.Hour
+
+	jobListLimit    = 50
+	jobListMaxLimit = 500
+)
+
+// jobHandler runs the jobs of a single kind. Jobs are retried with growing
+// delay until they succeed, return a permanent error or run out of
+// attempts, then they are dead-lettered.
+type jobHandler struct {
+	run func(s *Server, ctx context.Context, payload []byte) error
+	// dead undoes whatever the job was meant to do once it won't be retried,
+	// it runs in the transaction marking the job dead or canceled, may be nil
+	dead        func(s *Server, ctx context.Context, q *database.Queries, payload []byte) error
+	maxAttempts int64
+}
+
+var jobHandlers = make(map[string]*jobHandler, 0)
+
+func registerJob(kind string, h *jobHandler) {
+	if _, ok := jobHandlers[kind]; ok {
+		panic("handler of " + kind + " jobs is already registered")
+	}
+	jobHandlers[kind] = h
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// permanent marks the error as not worth retrying.
+func permanent(err error) error {
+	return &permanentError{err}
+}
+
+// enqueue adds the job to the queue, it is ignored if an unfinished job
+// with the same unique key exists. Workers should be woken up with
+// wakeWorkers once the transaction is committed.
+func enqueue(ctx context.Context, q *database.Queries, kind, key string, payload interface{}) error {
+	return enqueueAt(ctx, q, kind, key, payload, time.Now())
+}
+
+// enqueueAt is enqueue for jobs that shouldn't run before runAt.
+func enqueueAt(ctx context.Context, q *database.Queries, kind, key string, payload interface{}, runAt time.Time) error {
+	h, ok := jobHandlers[kind]
+	if !ok {
+		return fmt.Errorf("unknown job kind %s", kind)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	_, err = q.EnqueueJob(ctx, database.EnqueueJobParams{
+		Kind:        kind,
+		UniqueKey:   key,
+		Payload:     string(data),
+		MaxAttempts: h.maxAttempts,
+		RunAt:       runAt.Unix(),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	})
+	return err
+}
+
+// jobKey returns the unique key of the job done to the service.
+func jobKey(kind string, serviceID int64) string {
+	return kind + ":" + strconv.FormatInt(serviceID, 10)
+}
+
+// enqueue is enqueue outside of a transaction.
+func (s *Server) enqueue(ctx context.Context, kind, key string, payload interface{}) error {
+	if err := enqueue(ctx, s.queries, kind, key, payload); err != nil {
+		return err
+	}
+	s.wakeWorkers()
+	return nil
+}
+
+func (s *Server) wakeWorkers() {
+	select {
+	case s.jobWake <- struct{}{}:
+	default:
+	}
+}
+
+// RunJobs starts the workers, jobs left running by the previous process
+// are started over.
+func (s *Server) RunJobs() error {
+	if err := s.queries.RequeueRunningJobs(context.TODO(), time.Now().Unix()); err != nil {
+		return err
+	}
+
+	for i := 0; i < s.config.JobWorkers; i++ {
+		go s.jobWorker()
+	}
+	return nil
+}
+
+func (s *Server) jobWorker() {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for s.runNextJob() {
+		}
+		select {
+		case <-s.jobWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// runNextJob reports whether there was a job to run.
+func (s *Server) runNextJob() bool {
+	job, err := s.queries.ClaimJob(context.TODO(), time.Now().Unix())
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		log.Printf("couldn't claim job: %s", err)
+		return false
+	}
+
+	s.runJob(&job)
+	return true
+}
+
+func (s *Server) runJob(job *database.Job) {
+	h, ok := jobHandlers[job.Kind]
+
+	var err error
+	if !ok {
+		err = permanent(fmt.Errorf("unknown job kind %s", job.Kind))
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), jobTimeout)
+		err = h.run(s, ctx, []byte(job.Payload))
+		cancel()
+	}
+
+	now := time.Now().Unix()
+	if err == nil {
+		if err := s.queries.FinishJob(context.TODO(), database.FinishJobParams{
+			UpdatedAt: now,
+			ID:        job.ID,
+		}); err != nil {
+			log.Printf("job %d: %s", job.ID, err)
+		}
+		return
+	}
+
+	var perr *permanentError
+	if !errors.As(err, &perr) && job.Attempts < job.MaxAttempts {
+		log.Printf("job %d (%s) failed, attempt %d of %d: %s", job.ID, job.Kind, job.Attempts, job.MaxAttempts, err)
+		if err := s.queries.RescheduleJob(context.TODO(), database.RescheduleJobParams{
+			RunAt:     now + int64(backoff(job.Attempts).Seconds()),
+			LastError: err.Error(),
+			UpdatedAt: now,
+			ID:        job.ID,
+		}); err != nil {
+			log.Printf("job %d: %s", job.ID, err)
+		}
+		return
+	}
+
+	log.Printf("job %d (%s) is dead: %s", job.ID, job.Kind, err)
+	msg := err.Error()
+	if err := s.withTx(context.TODO(), func(q *database.Queries) error {
+		if err := q.KillJob(context.TODO(), database.KillJobParams{
+			LastError: msg,
+			UpdatedAt: now,
+			ID:        job.ID,
+		}); err != nil {
+			return err
+		}
+		if ok && h.dead != nil {
+			return h.dead(s, context.TODO(), q, []byte(job.Payload))
+		}
+		return nil
+	}); err != nil {
+		log.Printf("job %d: %s", job.ID, err)
+	}
+	s.wakeWorkers()
+}
+
+// backoff returns the delay before the next attempt.
+func backoff(attempts int64) time.Duration {
+	d := jobBackoff * time.Duration(math.Pow(2, float64(attempts-1)))
+	if d <= 0 || d > jobMaxBackoff {
+		return jobMaxBackoff
+	}
+	return d
+}
+
+// DeleteFinishedJobs removes jobs done before the retention period.
+func (s *Server) DeleteFinishedJobs() error {
+	return s.queries.DeleteFinishedJobs(context.TODO(), time.Now().Add(-jobRetention).Unix())
+}
+
+type JobResponse struct {
+	ID          int64           `json:"id"`
+	Kind        string          `json:"kind"`
+	UniqueKey   string          `json:"unique_key,omitempty"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int64           `json:"attempts"`
+	MaxAttempts int64           `json:"max_attempts"`
+	RunAt       int64           `json:"run_at"`
+	LastError   string          `json:"last_error,omitempty"`
+	CreatedAt   int64           `json:"created_at"`
+	UpdatedAt   int64           `json:"updated_at"`
+}
+
+func (r *JobResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	return nil
+}
+
+func NewJobResponse(job *database.Job) *JobResponse {
+	return &JobResponse{
+		ID:          job.ID,
+		Kind:        job.Kind,
+		UniqueKey:   job.UniqueKey,
+		Payload:     json.RawMessage(job.Payload),
+		Status:      job.Status,
+		Attempts:    job.Attempts,
+		MaxAttempts: job.MaxAttempts,
+		RunAt:       job.RunAt,
+		LastError:   job.LastError,
+		CreatedAt:   job.CreatedAt,
+		UpdatedAt:   job.UpdatedAt,
+	}
+}
+
+// ListJobs lists jobs newest first, optionally only the ones with the given
+// status. Older pages are requested with the id of the last job as before.
+func (s *Server) ListJobs(w http.ResponseWriter, r *http.Request) {
+	before := int64(math.MaxInt64)
+	if v, err := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64); err == nil && v > 0 {
+		before = v
+	}
+	limit := int64(jobListLimit)
+	if v, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64); err == nil && v > 0 {
+		limit = min(v, jobListMaxLimit)
+	}
+
+	jobs, err := s.queries.ListJobs(r.Context(), database.ListJobsParams{
+		Status: r.URL.Query().Get("status"),
+		Before: before,
+		Limit:  limit,
+	})
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	list := []render.Renderer{}
+	for i := range jobs {
+		list = append(list, NewJobResponse(&jobs[i]))
+	}
+
+	render.RenderList(w, r, list)
+}
+
+// RetryJob puts a dead or canceled job back to the queue with a fresh set
+// of attempts.
+func (s *Server) RetryJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorJobNotFound)
+		return
+	}
+
+	if _, err := s.queries.GetJob(r.Context(), int64(id)); err != nil {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorJobNotFound)
+		return
+	}
+
+	n, err := s.queries.RetryJob(r.Context(), database.RetryJobParams{
+		Now: time.Now().Unix(),
+		ID:  int64(id),
+	})
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+	// either still in the queue or another job with the same key is
+	if n == 0 {
+		s.SendError(w, r, nil, http.StatusConflict, ErrorJobNotRetryable)
+		return
+	}
+	s.wakeWorkers()
+
+	render.Status(r, http.StatusOK)
+}
+
+// CancelJob removes a queued job from the queue, running jobs can't be
+// canceled.
+func (s *Server) CancelJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorJobNotFound)
+		return
+	}
+
+	job, err := s.queries.GetJob(r.Context(), int64(id))
+	if err != nil {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorJobNotFound)
+		return
+	}
+
+	canceled := false
+	err = s.withTx(r.Context(), func(q *database.Queries) error {
+		n, err := q.CancelJob(r.Context(), database.CancelJobParams{
+			UpdatedAt: time.Now().Unix(),
+			ID:        job.ID,
+		})
+		if err != nil || n == 0 {
+			return err
+		}
+		canceled = true
+		if h, ok := jobHandlers[job.Kind]; ok && h.dead != nil {
+			return h.dead(s, r.Context(), q, []byte(job.Payload))
+		}
+		return nil
+	})
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+	if !canceled {
+		s.SendError(w, r, nil, http.StatusConflict, ErrorJobNotQueued)
+		return
+	}
+	s.wakeWorkers()
+
+	render.Status(r, http.StatusOK)
+}
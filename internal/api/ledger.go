@@ -0,0 +1,197 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/demtoni/tade/internal/database"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+// reasons of the ledger entries, opening entries are made by the migration
+// for balances that existed before the ledger
+const (
+	LedgerTopUp    = "topup"
+	LedgerPurchase = "purchase"
+	LedgerRenewal  = "renewal"
+	LedgerTraffic  = "traffic"
+	LedgerRefund   = "refund"
+	// refund of a top-up made by the payment provider
+	LedgerPaymentRefund = "payment_refund"
+	// unused time of a canceled service
+	LedgerCancellation = "cancellation"
+	LedgerAdjustment   = "adjustment"
+	LedgerOpening      = "opening"
+)
+
+const (
+	statementLimit    = 50
+	statementMaxLimit = 500
+)
+
+var errLowBalance = errors.New(ErrorLowBalance)
+
+// postEntry changes the balance of the user and records the change in the
+// ledger, amount is negative for debits. Debits that would make the balance
+// negative fail with errLowBalance. It should be called inside of withTx for
+// the entry to be written along with whatever it pays for.
+func postEntry(ctx context.Context, q *database.Queries, userID, amount int64, reason, reference string) (int64, error) {
+	balance, err := q.AddBalance(ctx, database.AddBalanceParams{
+		Amount: amount,
+		ID:     userID,
+	})
+	if err == sql.ErrNoRows {
+		return 0, errLowBalance
+	}
+	if err != nil {
+		return 0, err
+	}
+	return balance, recordEntry(ctx, q, userID, amount, balance, reason, reference)
+}
+
+// postCharge is postEntry that lets the balance go negative, it is used for
+// money the payment provider has already taken back.
+func postCharge(ctx context.Context, q *database.Queries, userID, amount int64, reason, reference string) (int64, error) {
+	balance, err := q.ChargeBalance(ctx, database.ChargeBalanceParams{
+		Amount: amount,
+		ID:     userID,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return balance, recordEntry(ctx, q, userID, amount, balance, reason, reference)
+}
+
+func recordEntry(ctx context.Context, q *database.Queries, userID, amount, balance int64, reason, reference string) error {
+	_, err := q.CreateLedgerEntry(ctx, database.CreateLedgerEntryParams{
+		UserID:    userID,
+		Amount:    amount,
+		Balance:   balance,
+		Reason:    reason,
+		Reference: reference,
+		CreatedAt: time.Now().Unix(),
+	})
+	return err
+}
+
+// post is postEntry in a transaction of its own.
+func (s *Server) post(ctx context.Context, userID, amount int64, reason, reference string) error {
+	return s.withTx(ctx, func(q *database.Queries) error {
+		_, err := postEntry(ctx, q, userID, amount, reason, reference)
+		return err
+	})
+}
+
+func serviceReference(id int64) string {
+	return "service:" + strconv.FormatInt(id, 10)
+}
+
+type LedgerEntryResponse struct {
+	ID        int64  `json:"id"`
+	Amount    int64  `json:"amount"`
+	Balance   int64  `json:"balance"`
+	Reason    string `json:"reason"`
+	Reference string `json:"reference,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+func (r *LedgerEntryResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	return nil
+}
+
+// GetStatement lists the balance changes of the user, newest first. Older
+// pages are requested with the id of the last entry as before.
+func (s *Server) GetStatement(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value("user").(*database.User)
+
+	before := int64(math.MaxInt64)
+	if v, err := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64); err == nil && v > 0 {
+		before = v
+	}
+	limit := int64(statementLimit)
+	if v, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64); err == nil && v > 0 {
+		limit = min(v, statementMaxLimit)
+	}
+
+	entries, err := s.queries.ListLedgerEntries(r.Context(), database.ListLedgerEntriesParams{
+		UserID: u.ID,
+		ID:     before,
+		Limit:  limit,
+	})
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	list := []render.Renderer{}
+	for _, e := range entries {
+		list = append(list, &LedgerEntryResponse{
+			ID:        e.ID,
+			Amount:    e.Amount,
+			Balance:   e.Balance,
+			Reason:    e.Reason,
+			Reference: e.Reference,
+			CreatedAt: e.CreatedAt,
+		})
+	}
+
+	render.RenderList(w, r, list)
+}
+
+type AdjustmentRequest struct {
+	Amount  int64  `json:"amount"`
+	Comment string `json:"comment"`
+}
+
+func (r *AdjustmentRequest) Bind(_ *http.Request) error {
+	if r.Amount == 0 {
+		return errors.New(ErrorBadAdjustment)
+	}
+	if r.Comment == "" {
+		return errors.New(ErrorEmptyField)
+	}
+	return nil
+}
+
+// AdjustBalance credits or debits the user by hand, the admin and the
+// comment are kept as the reference of the entry.
+func (s *Server) AdjustBalance(w http.ResponseWriter, r *http.Request) {
+	admin := r.Context().Value("user").(*database.User)
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorNoSuchUser)
+		return
+	}
+
+	data := &AdjustmentRequest{}
+	if err := render.Bind(r, data); err != nil {
+		s.SendError(w, r, nil, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if _, err := s.queries.GetUser(r.Context(), int64(id)); err != nil {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorNoSuchUser)
+		return
+	}
+
+	reference := fmt.Sprintf("%s: %s", admin.Name, data.Comment)
+	err = s.post(r.Context(), int64(id), data.Amount, LedgerAdjustment, reference)
+	if err == errLowBalance {
+		s.SendError(w, r, nil, http.StatusForbidden, ErrorLowBalance)
+		return
+	}
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+}
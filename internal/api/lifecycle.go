@@ -0,0 +1,153 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/demtoni/tade/internal/database"
+	manager "github.com/demtoni/tade/internal/manager/sdk"
+)
+
+const (
+	JobDelete  = "delete"
+	JobSuspend = "suspend"
+	JobRenew   = "renew"
+)
+
+// deleteJob removes the service from the node, the record is deleted as
+// well if Remove is set, failed services keep it for the ledger.
+type deleteJob struct {
+	ServiceID int64 `json:"service_id"`
+	Remove    bool  `json:"remove,omitempty"`
+}
+
+type suspendJob struct {
+	ServiceID int64 `json:"service_id"`
+}
+
+// renewJob pushes the current expiry of the service to the node.
+type renewJob struct {
+	ServiceID int64 `json:"service_id"`
+}
+
+func init() {
+	registerJob(JobDelete, &jobHandler{run: (*Server).runDelete, maxAttempts: 10})
+	registerJob(JobSuspend, &jobHandler{run: (*Server).runSuspend, maxAttempts: 10})
+	registerJob(JobRenew, &jobHandler{run: (*Server).runRenew, maxAttempts: 10})
+}
+
+// serviceProvider returns the provider of the service, calls every node
+// handles the same way are used for unknown types.
+func serviceProvider(service string) ServiceProvider {
+	if p, ok := providers[service]; ok {
+		return p
+	}
+	return unknownService{}
+}
+
+type unknownService struct {
+	nodeService
+}
+
+func (unknownService) Validate(_ map[string]interface{}) error {
+	return errors.New(ErrorServiceUnknown)
+}
+
+func (unknownService) Deploy(_ context.Context, _ *manager.Client, _ *Deployment) error {
+	return errors.New(ErrorServiceUnknown)
+}
+
+func (unknownService) Config(_ context.Context, _ *manager.Client, _, _ string) (*ServiceConfig, error) {
+	return nil, errors.New(ErrorServiceUnknown)
+}
+
+// nodeError makes errors other than unavailable nodes permanent.
+func nodeError(err error) error {
+	if err == nil || errors.Is(err, manager.ErrUnavailable) {
+		return err
+	}
+	return permanent(err)
+}
+
+func (s *Server) runDelete(ctx context.Context, payload []byte) error {
+	job := &deleteJob{}
+	if err := json.Unmarshal(payload, job); err != nil {
+		return permanent(err)
+	}
+
+	srv, err := s.queries.GetServiceNode(ctx, job.ServiceID)
+	// deleted in the meantime
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = serviceProvider(srv.Type).Delete(ctx, s.client(srv.Address), srv.RemoteName)
+	if err != nil && !errors.Is(err, manager.ErrNotFound) {
+		return nodeError(err)
+	}
+	if !job.Remove {
+		return nil
+	}
+
+	return s.withTx(ctx, func(q *database.Queries) error {
+		if err := q.DeleteService(ctx, srv.ID); err != nil {
+			return err
+		}
+		return s.notifyTx(ctx, q, srv.UserID, srv.ID, EventServiceDeleted)
+	})
+}
+
+func (s *Server) runSuspend(ctx context.Context, payload []byte) error {
+	job := &suspendJob{}
+	if err := json.Unmarshal(payload, job); err != nil {
+		return permanent(err)
+	}
+
+	srv, err := s.queries.GetServiceNode(ctx, job.ServiceID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// renewed before the job ran
+	if srv.Status != ServiceSuspended {
+		return nil
+	}
+
+	err = serviceProvider(srv.Type).Suspend(ctx, s.client(srv.Address), srv.RemoteName)
+	if err != nil {
+		return nodeError(err)
+	}
+	return s.notify(ctx, srv.UserID, srv.ID, EventServiceSuspended)
+}
+
+func (s *Server) runRenew(ctx context.Context, payload []byte) error {
+	job := &renewJob{}
+	if err := json.Unmarshal(payload, job); err != nil {
+		return permanent(err)
+	}
+
+	srv, err := s.queries.GetServiceNode(ctx, job.ServiceID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if srv.Status != ServiceActive {
+		return permanent(fmt.Errorf("service %d is %s", srv.ID, srv.Status))
+	}
+
+	err = s.client(srv.Address).Renew(ctx, srv.RemoteName, srv.ExpiresAt, s.config.GracePeriod)
+	if err != nil {
+		return nodeError(err)
+	}
+	return s.notify(ctx, srv.UserID, srv.ID, EventServiceRenewed)
+}
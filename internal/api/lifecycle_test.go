@@ -0,0 +1,88 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/demtoni/tade/internal/manager/sdk/managertest"
+)
+
+// expireTestService deploys the service of alice and makes it expire at
+// the given time, balance of alice is left as given.
+func expireTestService(t *testing.T, s *Server, expiresAt, balance int64) (*managertest.Server, int64, string) {
+	t.Helper()
+
+	s.config.GracePeriod = 3600
+	m, user, id := purchaseTestService(t, s)
+	runJobs(t, s)
+	if status := serviceStatus(t, s, id); status != ServiceActive {
+		t.Fatalf("service is %s, want %s", status, ServiceActive)
+	}
+
+	// renewals add the period between the creation and the expiry
+	if _, err := s.db.Exec("UPDATE services SET created_at = ?, expires_at = ? WHERE id = ?",
+		expiresAt-30*24*3600, expiresAt, id); err != nil {
+		t.Fatal(err)
+	}
+	setBalance(t, s, user, balance)
+
+	if err := s.CheckServices(); err != nil {
+		t.Fatal(err)
+	}
+	runJobs(t, s)
+
+	return m, id, fmt.Sprintf("alice-%d", id)
+}
+
+func TestRenewJob(t *testing.T) {
+	s, _ := newTestServer(t)
+	m, id, name := expireTestService(t, s, time.Now().Unix()-10, 100)
+
+	srv, err := s.queries.GetServiceNode(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.Status != ServiceActive || srv.ExpiresAt <= time.Now().Unix() {
+		t.Fatalf("service is %s until %d", srv.Status, srv.ExpiresAt)
+	}
+	if status := jobStatus(t, s, jobKey(JobRenew, id)); status != "done" {
+		t.Errorf("renew job is %s, want done", status)
+	}
+	if got := m.Service(name); got.ExpiresAt != srv.ExpiresAt || got.Grace != s.config.GracePeriod {
+		t.Errorf("node has %d with grace %d, want %d", got.ExpiresAt, got.Grace, srv.ExpiresAt)
+	}
+}
+
+func TestSuspendJob(t *testing.T) {
+	s, _ := newTestServer(t)
+	m, id, name := expireTestService(t, s, time.Now().Unix()-10, 0)
+
+	if status := serviceStatus(t, s, id); status != ServiceSuspended {
+		t.Fatalf("service is %s, want %s", status, ServiceSuspended)
+	}
+	if status := jobStatus(t, s, jobKey(JobSuspend, id)); status != "done" {
+		t.Errorf("suspend job is %s, want done", status)
+	}
+	// the node stops services past their expiry
+	if got := m.Service(name); got.ExpiresAt > time.Now().Unix() || got.Grace != 0 {
+		t.Errorf("node has %d with grace %d", got.ExpiresAt, got.Grace)
+	}
+}
+
+func TestDeleteJob(t *testing.T) {
+	s, _ := newTestServer(t)
+	m, id, name := expireTestService(t, s, time.Now().Unix()-7200, 0)
+
+	if status := jobStatus(t, s, jobKey(JobDelete, id)); status != "done" {
+		t.Errorf("delete job is %s, want done", status)
+	}
+	if m.Service(name) != nil {
+		t.Error("service is left on the node")
+	}
+	if _, err := s.queries.GetServiceNode(context.Background(), id); err != sql.ErrNoRows {
+		t.Errorf("service record: got %v, want %v", err, sql.ErrNoRows)
+	}
+}
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/demtoni/tade/internal/database"
+	manager "github.com/demtoni/tade/internal/manager/sdk"
+	"github.com/go-chi/render"
+)
+
+const nodeInfoTTL = 60 * time.Second
+
+type cachedInfo struct {
+	info      *manager.Info
+	fetchedAt time.Time
+}
+
+// infoCache keeps the last known capabilities of every node so that we
+// don't have to ask the manager on every request.
+type infoCache struct {
+	entries map[int64]*cachedInfo
+	mutex   sync.RWMutex
+}
+
+func newInfoCache() *infoCache {
+	return &infoCache{entries: make(map[int64]*cachedInfo, 0)}
+}
+
+func (c *infoCache) set(id int64, info *manager.Info) {
+	c.mutex.Lock()
+	c.entries[id] = &cachedInfo{info, time.Now()}
+	c.mutex.Unlock()
+}
+
+func (s *Server) nodeInfo(id int64, addr string) (*manager.Info, error) {
+	s.infos.mutex.RLock()
+	cached, ok := s.infos.entries[id]
+	s.infos.mutex.RUnlock()
+
+	if ok && time.Since(cached.fetchedAt) < nodeInfoTTL {
+		return cached.info, nil
+	}
+
+	info, err := s.client(addr).Info(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+
+	s.infos.set(id, info)
+
+	return info, nil
+}
+
+func contains(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	errLocationUnavailable  = errors.New(ErrorLocationUnavailable)
+	errLocationNotSupported = errors.New(ErrorLocationNotSupported)
+	errMethodNotSupported   = errors.New(ErrorMethodNotSupported)
+	errPluginNotSupported   = errors.New(ErrorPluginNotSupported)
+	errLocationFull         = errors.New(ErrorLocationFull)
+)
+
+// placeService picks the least loaded healthy node of the location that is
+// able to run the service. Load is estimated from the free ports and active
+// connections of the node and scaled by its weight. supported checks the
+// requirements specific to the service type.
+func (s *Server) placeService(ctx context.Context, locationID int64, service string, supported func(info *manager.Info) error) (*database.Node, error) {
+	nodes, err := s.queries.ListLocationNodes(ctx, locationID)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, errLocationUnavailable
+	}
+
+	var (
+		best      *database.Node
+		bestScore float64
+		reason    = errLocationUnavailable
+	)
+
+	for i := range nodes {
+		info, err := s.nodeInfo(nodes[i].ID, nodes[i].Address)
+		if err != nil {
+			log.Printf("node %d: %s", nodes[i].ID, err)
+			continue
+		}
+
+		if !contains(info.Services, service) {
+			reason = errLocationNotSupported
+			continue
+		}
+		if err := supported(info); err != nil {
+			reason = err
+			continue
+		}
+
+		free := info.Ports.Total - info.Ports.Used
+		if free <= 0 {
+			reason = errLocationFull
+			continue
+		}
+
+		score := float64(nodes[i].Weight) * float64(free) / float64(1+info.Connections)
+		if best == nil || score > bestScore {
+			best, bestScore = &nodes[i], score
+		}
+	}
+
+	if best == nil {
+		return nil, reason
+	}
+
+	return best, nil
+}
+
+type LocationResponse struct {
+	Location string   `json:"name"`
+	Services []string `json:"services"`
+	Methods  []string `json:"methods"`
+	Plugins  []string `json:"plugins"`
+}
+
+func (r *LocationResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	return nil
+}
+
+func merge(list []string, values []string) []string {
+	for _, v := range values {
+		if !contains(list, v) {
+			list = append(list, v)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (s *Server) ListLocations(w http.ResponseWriter, r *http.Request) {
+	nodes, err := s.queries.ListAvailableNodes(r.Context())
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	locations := make(map[string]*LocationResponse, 0)
+	names := make([]string, 0)
+
+	for _, node := range nodes {
+		info, err := s.nodeInfo(node.ID, node.Address)
+		if err != nil {
+			log.Printf("node %d: %s", node.ID, err)
+			continue
+		}
+		if len(info.Services) == 0 || info.Ports.Used >= info.Ports.Total {
+			continue
+		}
+
+		l, ok := locations[node.Location]
+		if !ok {
+			l = &LocationResponse{Location: node.Location}
+			locations[node.Location] = l
+			names = append(names, node.Location)
+		}
+		l.Services = merge(l.Services, info.Services)
+		l.Methods = merge(l.Methods, info.Methods)
+		l.Plugins = merge(l.Plugins, info.Plugins)
+	}
+
+	sort.Strings(names)
+
+	list := []render.Renderer{}
+	for _, name := range names {
+		list = append(list, locations[name])
+	}
+
+	render.RenderList(w, r, list)
+}
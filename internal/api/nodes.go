@@ -0,0 +1,313 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/demtoni/tade/internal/database"
+	manager "github.com/demtoni/tade/internal/manager/sdk"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+)
+
+const (
+	joinTokenTTL      int64 = 86400
+	heartbeatInterval       = 30 * time.Second
+	// location is considered offline after missing that many heartbeats
+	heartbeatMisses = 3
+)
+
+var errBadJoinToken = errors.New(ErrorBadJoinToken)
+
+type JoinTokenRequest struct {
+	Location string `json:"location"`
+}
+
+func (r *JoinTokenRequest) Bind(_ *http.Request) error {
+	if r.Location == "" {
+		return errors.New(ErrorEmptyField)
+	}
+	return nil
+}
+
+type JoinTokenResponse struct {
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+func (r *JoinTokenResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	return nil
+}
+
+func (s *Server) GenerateJoinToken(w http.ResponseWriter, r *http.Request) {
+	data := &JoinTokenRequest{}
+	if err := render.Bind(r, data); err != nil {
+		s.SendError(w, r, nil, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	token := uuid.New().String()
+	now := time.Now().Unix()
+
+	if err := s.queries.CreateJoinToken(r.Context(), database.CreateJoinTokenParams{
+		Token:     token,
+		Location:  data.Location,
+		CreatedAt: now,
+		ExpiresAt: now + joinTokenTTL,
+	}); err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, &JoinTokenResponse{token, now + joinTokenTTL})
+}
+
+type NodeRequest struct {
+	Token    string        `json:"token,omitempty"`
+	Hostname string        `json:"hostname"`
+	Address  string        `json:"address"`
+	Info     *manager.Info `json:"info"`
+}
+
+func (r *NodeRequest) Bind(_ *http.Request) error {
+	if r.Hostname == "" || r.Address == "" || r.Info == nil {
+		return errors.New(ErrorEmptyField)
+	}
+	if !strings.HasSuffix(r.Address, "/") {
+		r.Address += "/"
+	}
+	return nil
+}
+
+type JoinResponse struct {
+	ID                int64  `json:"id"`
+	Key               string `json:"key"`
+	HeartbeatInterval int64  `json:"heartbeat_interval"`
+}
+
+func (r *JoinResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	return nil
+}
+
+func (s *Server) JoinNode(w http.ResponseWriter, r *http.Request) {
+	data := &NodeRequest{}
+	if err := render.Bind(r, data); err != nil {
+		s.SendError(w, r, nil, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	now := time.Now().Unix()
+	key := uuid.New().String()
+
+	// the token is only used up if the node is enrolled
+	var name string
+	var node database.Node
+	err := s.withTx(r.Context(), func(q *database.Queries) error {
+		var err error
+		name, err = q.UseJoinToken(r.Context(), database.UseJoinTokenParams{
+			Token:     data.Token,
+			ExpiresAt: now,
+		})
+		if err == sql.ErrNoRows {
+			return errBadJoinToken
+		}
+		if err != nil {
+			return err
+		}
+
+		location, err := q.GetLocation(r.Context(), name)
+		if err == sql.ErrNoRows {
+			location.ID, err = q.CreateLocation(r.Context(), name)
+		}
+		if err != nil {
+			return err
+		}
+
+		node, err = q.GetNodeByAddress(r.Context(), database.GetNodeByAddressParams{
+			LocationID: location.ID,
+			Address:    data.Address,
+		})
+		switch err {
+		case nil:
+			err = q.EnrollNode(r.Context(), database.EnrollNodeParams{
+				HeartbeatKey: key,
+				LastSeen:     now,
+				ID:           node.ID,
+			})
+		case sql.ErrNoRows:
+			node.ID, err = q.CreateNode(r.Context(), database.CreateNodeParams{
+				LocationID:   location.ID,
+				Address:      data.Address,
+				HeartbeatKey: key,
+				LastSeen:     now,
+			})
+		}
+		if err != nil {
+			return err
+		}
+
+		// hostname of the manager is only used as a default public endpoint,
+		// admins are free to change the list afterwards
+		hostnames, err := q.ListNodeHostnames(r.Context(), node.ID)
+		if kind := hostnameKind(data.Hostname); err == nil && len(hostnames) == 0 && kind != "" {
+			err = q.CreateNodeHostname(r.Context(), database.CreateNodeHostnameParams{
+				NodeID:   node.ID,
+				Kind:     kind,
+				Hostname: data.Hostname,
+			})
+		}
+		return err
+	})
+	if err == errBadJoinToken {
+		s.SendError(w, r, nil, http.StatusUnauthorized, ErrorBadJoinToken)
+		return
+	}
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	s.infos.set(node.ID, data.Info)
+	log.Printf("node %d joined %s from %s", node.ID, name, data.Hostname)
+
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, &JoinResponse{node.ID, key, int64(heartbeatInterval.Seconds())})
+}
+
+// enrolledNode authenticates the manager by the key it got on enrollment.
+func (s *Server) enrolledNode(r *http.Request) (*database.Node, error) {
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || key == "" {
+		return nil, errors.New(ErrorUnauthorized)
+	}
+
+	node, err := s.queries.GetNodeByKey(r.Context(), key)
+	if err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+func (s *Server) NodeHeartbeat(w http.ResponseWriter, r *http.Request) {
+	node, err := s.enrolledNode(r)
+	if err != nil {
+		s.SendError(w, r, err, http.StatusUnauthorized, ErrorUnauthorized)
+		return
+	}
+
+	data := &NodeRequest{}
+	if err := render.Bind(r, data); err != nil {
+		s.SendError(w, r, nil, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.queries.UpdateHeartbeat(r.Context(), database.UpdateHeartbeatParams{
+		Address:  data.Address,
+		LastSeen: time.Now().Unix(),
+		ID:       node.ID,
+	}); err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	s.infos.set(node.ID, data.Info)
+
+	render.Status(r, http.StatusOK)
+}
+
+type NodeResponse struct {
+	ID         int64               `json:"id"`
+	LocationID int64               `json:"location_id"`
+	Location   string              `json:"location"`
+	Hostnames  []*HostnameResponse `json:"hostnames"`
+	LastSeen   int64               `json:"last_seen"`
+	Online     bool                `json:"online"`
+	Weight     int64               `json:"weight"`
+	Draining   bool                `json:"draining"`
+	Info       *manager.Info       `json:"info,omitempty"`
+}
+
+func (r *NodeResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	return nil
+}
+
+func (s *Server) ListNodes(w http.ResponseWriter, r *http.Request) {
+	nodes, err := s.queries.ListNodes(r.Context())
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	list := []render.Renderer{}
+	for _, node := range nodes {
+		hostnames, err := s.queries.ListNodeHostnames(r.Context(), node.ID)
+		if err != nil {
+			s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+			return
+		}
+
+		resp := &NodeResponse{
+			ID:         node.ID,
+			LocationID: node.LocationID,
+			Location:   node.Location,
+			Hostnames:  make([]*HostnameResponse, 0),
+			LastSeen:   node.LastSeen,
+			Online:     node.Online > 0,
+			Weight:     node.Weight,
+			Draining:   node.Draining > 0,
+		}
+		for _, h := range hostnames {
+			resp.Hostnames = append(resp.Hostnames, &HostnameResponse{h.Kind, h.Hostname})
+		}
+		if node.Online > 0 {
+			resp.Info, _ = s.nodeInfo(node.ID, node.Address)
+		}
+		list = append(list, resp)
+	}
+
+	render.RenderList(w, r, list)
+}
+
+type NodeUpdateRequest struct {
+	Weight   int64 `json:"weight"`
+	Draining bool  `json:"draining"`
+}
+
+func (r *NodeUpdateRequest) Bind(_ *http.Request) error {
+	if r.Weight <= 0 {
+		return errors.New(ErrorBadWeight)
+	}
+	return nil
+}
+
+func (s *Server) UpdateNode(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorNodeNotFound)
+		return
+	}
+
+	data := &NodeUpdateRequest{}
+	if err := render.Bind(r, data); err != nil {
+		s.SendError(w, r, nil, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.queries.UpdateNode(r.Context(), database.UpdateNodeParams{
+		Weight:   data.Weight,
+		Draining: boolToInt(data.Draining),
+		ID:       int64(id),
+	}); err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+}
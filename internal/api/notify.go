@@ -0,0 +1,92 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/demtoni/tade/internal/database"
+)
+
+const JobNotify = "notify"
+
+// events posted to the notification url
+const (
+	EventServiceActive    = "service.active"
+	EventServiceFailed    = "service.failed"
+	EventServiceRenewed   = "service.renewed"
+	EventServiceSuspended = "service.suspended"
+	EventServiceDeleted   = "service.deleted"
+	EventServiceCanceled  = "service.canceled"
+	EventAutopaySucceeded = "autopay.succeeded"
+	EventAutopayFailed    = "autopay.failed"
+)
+
+const notifyTimeout = 10 * time.Second
+
+var notifyClient = &http.Client{Timeout: notifyTimeout}
+
+type notifyJob struct {
+	Event     string `json:"event"`
+	UserID    int64  `json:"user_id"`
+	ServiceID int64  `json:"service_id"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+func init() {
+	registerJob(JobNotify, &jobHandler{run: (*Server).runNotify, maxAttempts: 5})
+}
+
+// notifyTx queues the event, nothing is sent if the notification url isn't
+// configured.
+func (s *Server) notifyTx(ctx context.Context, q *database.Queries, userID, serviceID int64, event string) error {
+	if s.config.NotifyURL == "" {
+		return nil
+	}
+	return enqueue(ctx, q, JobNotify, "", &notifyJob{
+		Event:     event,
+		UserID:    userID,
+		ServiceID: serviceID,
+		Timestamp: time.Now().Unix(),
+	})
+}
+
+func (s *Server) notify(ctx context.Context, userID, serviceID int64, event string) error {
+	if err := s.notifyTx(ctx, s.queries, userID, serviceID, event); err != nil {
+		return err
+	}
+	s.wakeWorkers()
+	return nil
+}
+
+// runNotify posts the event as is.
+func (s *Server) runNotify(ctx context.Context, payload []byte) error {
+	if s.config.NotifyURL == "" {
+		return nil
+	}
+
+	job := &notifyJob{}
+	if err := json.Unmarshal(payload, job); err != nil {
+		return permanent(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.NotifyURL, bytes.NewReader(payload))
+	if err != nil {
+		return permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("notify %s: %s", job.Event, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/demtoni/tade/internal/config"
+	"github.com/demtoni/tade/internal/database"
+	"github.com/demtoni/tade/internal/payment"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+const (
+	transactionTimeLimit int64 = 3600
+	// payments created earlier than that aren't looked at by the reconciler
+	reconcileWindow = 48 * time.Hour
+)
+
+func newPaymentProvider(cfg *config.Config) (payment.Provider, error) {
+	switch cfg.PaymentProvider {
+	case "yookassa":
+		return payment.NewYooKassa(cfg.YooShopID, cfg.YooApiKey, cfg.YooWebhookIPs, cfg.TrustProxy)
+	case "sandbox":
+		return payment.NewSandbox(cfg.PublicURL), nil
+	}
+	return nil, fmt.Errorf("unknown payment provider %q", cfg.PaymentProvider)
+}
+
+// PaymentWebhook handles notifications of the payment provider, the object
+// is fetched from the provider as the notification only tells its id.
+// Anything but 200 makes the provider send the notification again later.
+func (s *Server) PaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	notifier, ok := s.payments.(payment.Notifier)
+	if !ok || chi.URLParam(r, "provider") != s.payments.Name() {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorUnknownProvider)
+		return
+	}
+
+	n, err := notifier.ParseNotification(r)
+	if errors.Is(err, payment.ErrForbidden) {
+		s.SendError(w, r, nil, http.StatusForbidden, ErrorForbidden)
+		return
+	}
+	if err != nil {
+		s.SendError(w, r, nil, http.StatusBadRequest, ErrorBadNotification)
+		return
+	}
+	if n == nil {
+		render.Status(r, http.StatusOK)
+		return
+	}
+
+	switch n.Event {
+	case payment.PaymentEvent:
+		p, err := s.payments.Get(r.Context(), n.ID)
+		if err != nil {
+			s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+			return
+		}
+		if err := s.processPayment(r.Context(), p); err != nil {
+			s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+			return
+		}
+	case payment.RefundEvent:
+		rf, err := s.payments.GetRefund(r.Context(), n.ID)
+		if err != nil {
+			s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+			return
+		}
+		if err := s.processRefund(r.Context(), rf); err != nil {
+			s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+			return
+		}
+	default:
+		log.Printf("ignoring %s notification %s for %s", s.payments.Name(), n.Event, n.ID)
+	}
+
+	render.Status(r, http.StatusOK)
+}
+
+// processPayment brings the transaction in line with the payment, it can be
+// called any number of times for the same payment.
+func (s *Server) processPayment(ctx context.Context, p *payment.Payment) error {
+	if p.Status == payment.WaitingForCapture {
+		// AddBalance couldn't record the payment and the provider didn't let
+		// it be canceled, the money is released instead of captured
+		_, err := s.queries.GetTransaction(ctx, p.ID)
+		if err == sql.ErrNoRows && p.SavedMethod != nil {
+			// the charge of a saved method may be reported before runAutopay
+			// records it, runAutopay captures it then
+			n, err := s.queries.CountUnrecordedAutopayCharges(ctx, p.Amount)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				return fmt.Errorf("payment %s may be an autopay charge not recorded yet", p.ID)
+			}
+		}
+		if err == sql.ErrNoRows {
+			log.Printf("payment %s has no transaction, canceling it", p.ID)
+			_, err = s.payments.Cancel(ctx, p.ID)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if p, err = s.payments.Capture(ctx, p.ID); err != nil {
+			return err
+		}
+	}
+
+	switch p.Status {
+	case payment.Succeeded:
+		return s.withTx(ctx, func(q *database.Queries) error {
+			if p.ReceiptStatus != "" {
+				if err := q.SetTransactionReceipt(ctx, database.SetTransactionReceiptParams{
+					Receipt:   string(p.ReceiptStatus),
+					PaymentID: p.ID,
+				}); err != nil {
+					return err
+				}
+			}
+
+			meta, err := q.CompleteTransaction(ctx, p.ID)
+			// not ours or already completed
+			if err == sql.ErrNoRows {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if p.Amount != meta.Amount {
+				// retrying won't change the amount, the reconciliation
+				// reports the payment
+				log.Printf("payment %s: paid %d instead of %d", p.ID, p.Amount, meta.Amount)
+				if err := q.FlagTransaction(ctx, p.ID); err != nil {
+					return err
+				}
+				_, err := s.settleAutopay(ctx, q, 0, p.ID, AutopayFailed)
+				return err
+			}
+
+			if _, err := postEntry(ctx, q, meta.UserID, meta.Amount, LedgerTopUp, p.ID); err != nil {
+				return err
+			}
+
+			charged, err := s.settleAutopay(ctx, q, 0, p.ID, AutopaySucceeded)
+			if err != nil || charged || p.SavedMethod == nil {
+				return err
+			}
+			return s.saveMethod(ctx, q, meta.UserID, p.SavedMethod)
+		})
+	case payment.Canceled:
+		return s.withTx(ctx, func(q *database.Queries) error {
+			if err := q.CancelTransaction(ctx, p.ID); err != nil {
+				return err
+			}
+			_, err := s.settleAutopay(ctx, q, 0, p.ID, AutopayFailed)
+			return err
+		})
+	}
+	return nil
+}
+
+// processRefund takes the refunded money back from the balance, the balance
+// may become negative if it was spent already. Refunds made from the
+// dashboard of the provider end up here as well.
+func (s *Server) processRefund(ctx context.Context, rf *payment.Refund) error {
+	if rf.Status != payment.Succeeded {
+		return nil
+	}
+
+	t, err := s.queries.GetTransaction(ctx, rf.PaymentID)
+	// made for a payment that isn't ours
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.withTx(ctx, func(q *database.Queries) error {
+		n, err := q.CountLedgerEntries(ctx, database.CountLedgerEntriesParams{
+			Reason:    LedgerPaymentRefund,
+			Reference: rf.ID,
+		})
+		if err != nil || n > 0 {
+			return err
+		}
+		if _, err := postCharge(ctx, q, t.UserID, -rf.Amount, LedgerPaymentRefund, rf.ID); err != nil {
+			return err
+		}
+		return q.RefundTransaction(ctx, database.RefundTransactionParams{
+			Amount:    rf.Amount,
+			PaymentID: rf.PaymentID,
+		})
+	})
+}
+
+// ProcessPayments is the fallback for notifications that never arrived. Open
+// transactions are checked one by one and canceled once they are too old,
+// a payment completed later still tops the balance up. Payments waiting to
+// be captured are listed as well as their transactions may be canceled by
+// then.
+func (s *Server) ProcessPayments() error {
+	ctx := context.TODO()
+
+	open, err := s.queries.ListOpenTransactions(ctx, s.payments.Name())
+	if err != nil {
+		return err
+	}
+	expired := time.Now().Unix() - transactionTimeLimit
+	for _, t := range open {
+		if err := s.reconcileTransaction(ctx, &t, expired); err != nil {
+			log.Printf("payment %s: %s", t.PaymentID, err)
+		}
+	}
+
+	pending, err := s.payments.ListPending(ctx, time.Now().Add(-reconcileWindow))
+	if err != nil {
+		return err
+	}
+	for _, p := range pending {
+		if err := s.processPayment(ctx, p); err != nil {
+			log.Printf("payment %s: %s", p.ID, err)
+		}
+	}
+	return nil
+}
+
+func (s *Server) reconcileTransaction(ctx context.Context, t *database.Transaction, expired int64) error {
+	p, err := s.payments.Get(ctx, t.PaymentID)
+	// lost by the provider, the sandbox forgets payments on restart
+	if errors.Is(err, payment.ErrNotFound) {
+		return s.queries.CancelTransaction(ctx, t.PaymentID)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.processPayment(ctx, p); err != nil {
+		return err
+	}
+	if p.Status == payment.Pending && t.Timestamp < expired {
+		return s.queries.CancelTransaction(ctx, t.PaymentID)
+	}
+	return nil
+}
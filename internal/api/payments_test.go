@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/demtoni/tade/internal/payment"
+)
+
+func TestProcessPayment(t *testing.T) {
+	s, ts := newTestServer(t)
+	ctx := context.Background()
+	user := createTestUser(t, s, "alice")
+
+	p := paySandbox(t, s, ts, createTopUp(t, s, user, 100, false).ID)
+	if p.Status != payment.WaitingForCapture {
+		t.Fatalf("paid payment is %s", p.Status)
+	}
+	if err := s.processPayment(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	// notifications may come more than once
+	p, _ = s.payments.Get(ctx, p.ID)
+	if err := s.processPayment(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := s.payments.Get(ctx, p.ID); got.Status != payment.Succeeded {
+		t.Errorf("payment is %s, want %s", got.Status, payment.Succeeded)
+	}
+	tr, err := s.queries.GetTransaction(ctx, p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Status != TransactionCompleted {
+		t.Errorf("transaction is %s, want %s", tr.Status, TransactionCompleted)
+	}
+	if b := balanceOf(t, s, user); b != 100 {
+		t.Errorf("balance is %d, want 100", b)
+	}
+}
+
+func TestProcessPaymentCancelsUnknown(t *testing.T) {
+	s, ts := newTestServer(t)
+	ctx := context.Background()
+
+	p, err := s.payments.Create(ctx, &payment.Request{Amount: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = paySandbox(t, s, ts, p.ID)
+	if err := s.processPayment(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := s.payments.Get(ctx, p.ID); got.Status != payment.Canceled {
+		t.Errorf("payment is %s, want %s", got.Status, payment.Canceled)
+	}
+}
+
+func TestProcessPaymentAmountMismatch(t *testing.T) {
+	s, ts := newTestServer(t)
+	ctx := context.Background()
+	user := createTestUser(t, s, "alice")
+
+	p := paySandbox(t, s, ts, createTopUp(t, s, user, 100, false).ID)
+	if _, err := s.db.Exec("UPDATE transactions SET amount = 500 WHERE payment_id = ?", p.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// retrying wouldn't help, so the payment is processed without an error
+	if err := s.processPayment(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := s.queries.GetTransaction(ctx, p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Status != TransactionFlagged {
+		t.Errorf("transaction is %s, want %s", tr.Status, TransactionFlagged)
+	}
+	if b := balanceOf(t, s, user); b != 0 {
+		t.Errorf("balance is %d, want 0", b)
+	}
+}
@@ -0,0 +1,252 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/demtoni/tade/internal/database"
+	manager "github.com/demtoni/tade/internal/manager/sdk"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+var validPolicyName = regexp.MustCompile(`^[[:word:]-]{1,64}$`)
+
+// PolicyRequest describes outbound restrictions of the location. Policy
+// named "default" is applied by the nodes to every new shadowsocks and proxy
+// service, wireguard and xray services aren't restricted by policies.
+// Blocked ports are only enforced by proxy services, nodes refuse to apply
+// a policy blocking ports to shadowsocks services, including the default
+// one on the nodes running shadowsocks.
+type PolicyRequest struct {
+	BlockedPorts []int    `json:"blocked_ports"`
+	CIDRs        []string `json:"cidrs"`
+	Domains      []string `json:"domains"`
+}
+
+func (r *PolicyRequest) Bind(_ *http.Request) error {
+	for _, port := range r.BlockedPorts {
+		if port <= 0 || port > 0xffff {
+			return errors.New(ErrorBadPolicy)
+		}
+	}
+	for _, cidr := range r.CIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return errors.New(ErrorBadPolicy)
+		}
+	}
+	for _, domain := range r.Domains {
+		if !validDomain.MatchString(domain) {
+			return errors.New(ErrorBadPolicy)
+		}
+	}
+	return nil
+}
+
+type PolicyResponse struct {
+	*manager.Policy
+}
+
+func (r *PolicyResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	return nil
+}
+
+// newPolicy decodes the lists stored as json in the database.
+func newPolicy(p *database.AclPolicy) (*manager.Policy, error) {
+	policy := &manager.Policy{Name: p.Name}
+	if err := json.Unmarshal([]byte(p.BlockedPorts), &policy.BlockedPorts); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(p.Cidrs), &policy.CIDRs); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(p.Domains), &policy.Domains); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func (s *Server) locationPolicies(ctx context.Context, locationID int64) ([]*manager.Policy, error) {
+	rows, err := s.queries.ListLocationPolicies(ctx, locationID)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*manager.Policy, 0, len(rows))
+	for i := range rows {
+		p, err := newPolicy(&rows[i])
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, nil
+}
+
+func (s *Server) ListPolicies(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorLocationNotFound)
+		return
+	}
+
+	policies, err := s.locationPolicies(r.Context(), int64(id))
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	list := []render.Renderer{}
+	for _, p := range policies {
+		list = append(list, &PolicyResponse{p})
+	}
+
+	render.RenderList(w, r, list)
+}
+
+// SetPolicy pushes the policy to the nodes of the location and stores it,
+// nodes that couldn't be reached get it on the next health check. Nothing
+// is stored when a node refuses the policy, nodes that took it already get
+// the stored one back on the next health check.
+func (s *Server) SetPolicy(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorLocationNotFound)
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+	if !validPolicyName.MatchString(name) {
+		s.SendError(w, r, nil, http.StatusBadRequest, ErrorBadPolicy)
+		return
+	}
+
+	data := &PolicyRequest{}
+	if err := render.Bind(r, data); err != nil {
+		s.SendError(w, r, nil, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	nodes, err := s.queries.ListLocationNodes(r.Context(), int64(id))
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	policy := &manager.Policy{
+		Name:         name,
+		BlockedPorts: data.BlockedPorts,
+		CIDRs:        data.CIDRs,
+		Domains:      data.Domains,
+	}
+	for _, node := range nodes {
+		err := s.client(node.Address).PutPolicy(r.Context(), policy)
+		if errors.Is(err, manager.ErrPolicyUnsupported) {
+			s.SendError(w, r, nil, http.StatusConflict, ErrorPolicyUnsupported)
+			return
+		}
+		if err != nil {
+			log.Printf("node %d: couldn't update policy %s: %s", node.ID, name, err)
+		}
+	}
+
+	ports, _ := json.Marshal(data.BlockedPorts)
+	cidrs, _ := json.Marshal(data.CIDRs)
+	domains, _ := json.Marshal(data.Domains)
+
+	if err := s.queries.SetPolicy(r.Context(), database.SetPolicyParams{
+		LocationID:   int64(id),
+		Name:         name,
+		BlockedPorts: string(ports),
+		Cidrs:        string(cidrs),
+		Domains:      string(domains),
+	}); err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+}
+
+func (s *Server) DeletePolicy(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorLocationNotFound)
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+
+	nodes, err := s.queries.ListLocationNodes(r.Context(), int64(id))
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	for _, node := range nodes {
+		err := s.client(node.Address).DeletePolicy(r.Context(), name)
+		if errors.Is(err, manager.ErrPolicyInUse) {
+			s.SendError(w, r, nil, http.StatusConflict, ErrorPolicyInUse)
+			return
+		}
+		if err != nil {
+			log.Printf("node %d: couldn't delete policy %s: %s", node.ID, name, err)
+		}
+	}
+
+	if err := s.queries.DeletePolicy(r.Context(), database.DeletePolicyParams{
+		LocationID: int64(id),
+		Name:       name,
+	}); err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+}
+
+// syncPolicies brings the policies of the node in line with its location,
+// policies still used by the services are left on the node.
+func (s *Server) syncPolicies(node *database.ListNodesRow) error {
+	want, err := s.locationPolicies(context.TODO(), node.LocationID)
+	if err != nil {
+		return err
+	}
+
+	have, err := s.client(node.Address).ListPolicies(context.TODO())
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string][]byte, len(have))
+	for _, p := range have {
+		current[p.Name], _ = json.Marshal(p)
+	}
+
+	for _, p := range want {
+		data, _ := json.Marshal(p)
+		if bytes.Equal(current[p.Name], data) {
+			delete(current, p.Name)
+			continue
+		}
+		delete(current, p.Name)
+		if err := s.client(node.Address).PutPolicy(context.TODO(), p); err != nil {
+			return err
+		}
+	}
+
+	for name := range current {
+		if err := s.client(node.Address).DeletePolicy(context.TODO(), name); err != nil && !errors.Is(err, manager.ErrPolicyInUse) {
+			return err
+		}
+	}
+
+	return nil
+}
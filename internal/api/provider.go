@@ -0,0 +1,98 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/demtoni/tade/internal/database"
+	manager "github.com/demtoni/tade/internal/manager/sdk"
+	"github.com/skip2/go-qrcode"
+)
+
+// Deployment is everything a provider needs to create the service on the
+// node. Metadata was checked by Validate beforehand.
+type Deployment struct {
+	Name      string
+	Metadata  map[string]interface{}
+	Price     *database.ServicePrice
+	Anchor    int64
+	ExpiresAt int64
+	Grace     int64
+}
+
+// ServiceConfig describes the running service to the customer.
+type ServiceConfig struct {
+	// shown as is, endpoints and usage are added by the handler
+	Metadata map[string]interface{}
+	Usage    *manager.Usage
+	// URL builds the connect url for the public hostname of the node
+	URL func(host string) string
+	// Endpoint adds fields specific to the endpoint chosen by the customer,
+	// may be nil
+	Endpoint func(meta map[string]interface{}, host string)
+}
+
+// ServiceProvider implements everything that differs between the service
+// types, handlers look the provider up by the type of the service.
+type ServiceProvider interface {
+	// Validate checks metadata of the order, the error is shown to the
+	// customer.
+	Validate(meta map[string]interface{}) error
+	// Supported checks whether the node is able to run the service.
+	Supported(info *manager.Info, meta map[string]interface{}) error
+	Deploy(ctx context.Context, c *manager.Client, d *Deployment) error
+	// Config fetches the service from the node, label is the name given by
+	// the customer.
+	Config(ctx context.Context, c *manager.Client, name, label string) (*ServiceConfig, error)
+	// Suspend stops the service keeping it on the node until it is renewed
+	// or deleted.
+	Suspend(ctx context.Context, c *manager.Client, name string) error
+	Delete(ctx context.Context, c *manager.Client, name string) error
+}
+
+var providers = make(map[string]ServiceProvider, 0)
+
+func registerProvider(service string, p ServiceProvider) {
+	if _, ok := providers[service]; ok {
+		panic("provider of " + service + " is already registered")
+	}
+	providers[service] = p
+}
+
+// nodeService implements the calls every manager handles the same way
+// regardless of the service type.
+type nodeService struct{}
+
+func (nodeService) Supported(_ *manager.Info, _ map[string]interface{}) error {
+	return nil
+}
+
+func (nodeService) Suspend(ctx context.Context, c *manager.Client, name string) error {
+	// the node stops services past their expiry on its own
+	return c.Renew(ctx, name, time.Now().Unix(), 0)
+}
+
+func (nodeService) Delete(ctx context.Context, c *manager.Client, name string) error {
+	return c.Delete(ctx, name)
+}
+
+// rotateEvery returns the port rotation interval requested in the order.
+func rotateEvery(meta map[string]interface{}) (int64, error) {
+	v, _ := meta["rotate_every"].(float64)
+	if v != 0 && v < minRotateEvery {
+		return 0, errors.New(ErrorBadRotation)
+	}
+	return int64(v), nil
+}
+
+// qrCode encodes the text as png data url, empty string is returned if the
+// text doesn't fit.
+func qrCode(text string) string {
+	png, err := qrcode.Encode(text, qrcode.Medium, 512)
+	if err != nil {
+		return ""
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+}
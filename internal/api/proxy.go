@@ -0,0 +1,57 @@
+package api
+
+import (
+	"context"
+	manager "github.com/demtoni/tade/internal/manager/sdk"
+)
+
+type proxyProvider struct{ nodeService }
+
+func init() {
+	registerProvider("proxy", proxyProvider{})
+}
+
+func (proxyProvider) Validate(meta map[string]interface{}) error {
+	_, err := rotateEvery(meta)
+	return err
+}
+
+func (proxyProvider) Deploy(ctx context.Context, c *manager.Client, d *Deployment) error {
+	every, _ := rotateEvery(d.Metadata)
+
+	return c.DeployProxy(ctx, &manager.Proxy{
+		Name:        d.Name,
+		MaxIPs:      int(d.Price.MaxIps),
+		Quota:       d.Price.Quota,
+		QuotaMode:   d.Price.QuotaMode,
+		Anchor:      d.Anchor,
+		RotateEvery: every,
+		ExpiresAt:   d.ExpiresAt,
+		Grace:       d.Grace,
+	})
+}
+
+func (proxyProvider) Config(ctx context.Context, c *manager.Client, name, _ string) (*ServiceConfig, error) {
+	cfg, err := c.GetProxy(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ServiceConfig{
+		Metadata: map[string]interface{}{
+			"username": cfg.Username,
+			"password": cfg.Password,
+			"port":     cfg.Port,
+		},
+		Usage: &cfg.Usage,
+		URL:   func(host string) string { return cfg.URL("socks5", host) },
+		Endpoint: func(meta map[string]interface{}, host string) {
+			meta["host"] = host
+			meta["http_url"] = cfg.URL("http", host)
+		},
+	}, nil
+}
+
+func (proxyProvider) Rotate(ctx context.Context, c *manager.Client, name string) (*manager.Rotation, error) {
+	return c.Rotate(ctx, name)
+}
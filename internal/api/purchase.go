@@ -0,0 +1,157 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/demtoni/tade/internal/database"
+	manager "github.com/demtoni/tade/internal/manager/sdk"
+)
+
+const (
+	ServicePending   = "pending"
+	ServiceActive    = "active"
+	ServiceSuspended = "suspended"
+	ServiceFailed    = "failed"
+	ServiceCanceled  = "canceled"
+)
+
+const JobDeploy = "deploy"
+
+// Buying a service is done in steps so that the customer is never charged
+// without getting the service and the other way around: the pending service
+// is created along with the debit and the deploy job in one transaction,
+// the job deploys and activates it. Once the job is dead the service is
+// marked as failed, the money is refunded and the node is cleaned up by a
+// delete job.
+
+type deployJob struct {
+	ServiceID int64                  `json:"service_id"`
+	Metadata  map[string]interface{} `json:"metadata"`
+	// price at the moment of purchase
+	Price database.ServicePrice `json:"price"`
+}
+
+func init() {
+	registerJob(JobDeploy, &jobHandler{
+		run:         (*Server).runDeploy,
+		dead:        (*Server).failDeploy,
+		maxAttempts: 5,
+	})
+}
+
+// reservePurchase creates the pending service, debits its price and queues
+// the deploy.
+func (s *Server) reservePurchase(ctx context.Context, params database.CreateServiceParams, userName string, meta map[string]interface{}, price *database.ServicePrice) (int64, error) {
+	params.Status = ServicePending
+
+	var id int64
+	err := s.withTx(ctx, func(q *database.Queries) error {
+		var err error
+		if id, err = q.CreateService(ctx, params); err != nil {
+			return err
+		}
+		// the id makes the name unique on the node, so a retried deploy
+		// can't collide with another service
+		if err := q.SetServiceRemoteName(ctx, database.SetServiceRemoteNameParams{
+			RemoteName: fmt.Sprintf("%s-%d", userName, id),
+			ID:         id,
+		}); err != nil {
+			return err
+		}
+		if _, err := postEntry(ctx, q, params.UserID, -params.ProlongPrice, LedgerPurchase, serviceReference(id)); err != nil {
+			return err
+		}
+		return enqueue(ctx, q, JobDeploy, jobKey(JobDeploy, id), &deployJob{
+			ServiceID: id,
+			Metadata:  meta,
+			Price:     *price,
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.wakeWorkers()
+
+	return id, nil
+}
+
+func (s *Server) runDeploy(ctx context.Context, payload []byte) error {
+	job := &deployJob{}
+	if err := json.Unmarshal(payload, job); err != nil {
+		return permanent(err)
+	}
+
+	srv, err := s.queries.GetServiceNode(ctx, job.ServiceID)
+	if err != nil {
+		return err
+	}
+	if srv.Status != ServicePending {
+		return permanent(fmt.Errorf("service %d is %s", srv.ID, srv.Status))
+	}
+	provider, ok := providers[srv.Type]
+	if !ok {
+		return permanent(fmt.Errorf("service %d: unknown type %s", srv.ID, srv.Type))
+	}
+
+	err = provider.Deploy(ctx, s.client(srv.Address), &Deployment{
+		Name:      srv.RemoteName,
+		Metadata:  job.Metadata,
+		Price:     &job.Price,
+		Anchor:    srv.CreatedAt,
+		ExpiresAt: srv.ExpiresAt,
+		Grace:     s.config.GracePeriod,
+	})
+	// the name is unique to the service, so the previous attempt reached
+	// the node but the response was lost
+	if errors.Is(err, manager.ErrConflict) {
+		err = nil
+	}
+	if err != nil && !errors.Is(err, manager.ErrUnavailable) {
+		return permanent(err)
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.withTx(ctx, func(q *database.Queries) error {
+		if _, err := q.ActivateService(ctx, srv.ID); err != nil {
+			return err
+		}
+		return s.notifyTx(ctx, q, srv.UserID, srv.ID, EventServiceActive)
+	})
+}
+
+// failDeploy refunds the service, it may be on the node if the deploy
+// timed out, so the node is cleaned up as well.
+func (s *Server) failDeploy(ctx context.Context, q *database.Queries, payload []byte) error {
+	job := &deployJob{}
+	if err := json.Unmarshal(payload, job); err != nil {
+		return err
+	}
+
+	n, err := q.FailPendingService(ctx, job.ServiceID)
+	if err != nil {
+		return err
+	}
+	// already activated or failed
+	if n == 0 {
+		return nil
+	}
+
+	srv, err := q.GetServiceNode(ctx, job.ServiceID)
+	if err != nil {
+		return err
+	}
+	if _, err := postEntry(ctx, q, srv.UserID, srv.ProlongPrice, LedgerRefund, serviceReference(srv.ID)); err != nil {
+		return err
+	}
+	if err := enqueue(ctx, q, JobDelete, jobKey(JobDelete, srv.ID), &deleteJob{
+		ServiceID: srv.ID,
+	}); err != nil {
+		return err
+	}
+	return s.notifyTx(ctx, q, srv.UserID, srv.ID, EventServiceFailed)
+}
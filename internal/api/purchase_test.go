@@ -0,0 +1,144 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/demtoni/tade/internal/database"
+	manager "github.com/demtoni/tade/internal/manager/sdk"
+	"github.com/demtoni/tade/internal/manager/sdk/managertest"
+)
+
+// purchaseTestService reserves the shadowsocks service of alice for 100,
+// which is all she has.
+func purchaseTestService(t *testing.T, s *Server) (*managertest.Server, int64, int64) {
+	t.Helper()
+
+	m, params := newTestNode(t, s)
+	params.UserID = createTestUser(t, s, "alice")
+	setBalance(t, s, params.UserID, 100)
+
+	id, err := s.reservePurchase(context.Background(), params, "alice", map[string]interface{}{"method": "aes-256-gcm"},
+		&database.ServicePrice{Amount: 100, Type: "shadowsocks"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := balanceOf(t, s, params.UserID); b != 0 {
+		t.Fatalf("balance is %d after the purchase, want 0", b)
+	}
+	return m, params.UserID, id
+}
+
+func serviceStatus(t *testing.T, s *Server, id int64) string {
+	t.Helper()
+
+	srv, err := s.queries.GetServiceNode(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv.Status
+}
+
+func countRequests(m *managertest.Server, method string) int {
+	n := 0
+	for _, r := range m.Requests() {
+		if strings.HasPrefix(r, method+" ") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestDeploy(t *testing.T) {
+	s, _ := newTestServer(t)
+	m, _, id := purchaseTestService(t, s)
+
+	runJobs(t, s)
+
+	if status := serviceStatus(t, s, id); status != ServiceActive {
+		t.Fatalf("service is %s, want %s", status, ServiceActive)
+	}
+	srv := m.Service(fmt.Sprintf("alice-%d", id))
+	if srv == nil {
+		t.Fatal("service isn't on the node")
+	}
+	if srv.Form.Get("method") != "aes-256-gcm" || srv.ExpiresAt == 0 {
+		t.Errorf("deployed with %v", srv.Form)
+	}
+}
+
+func TestDeployRetry(t *testing.T) {
+	s, _ := newTestServer(t)
+	m, _, id := purchaseTestService(t, s)
+
+	m.Fail(1)
+	runJobs(t, s)
+	if status := serviceStatus(t, s, id); status != ServicePending {
+		t.Fatalf("service is %s after the failed attempt, want %s", status, ServicePending)
+	}
+
+	runJobs(t, s)
+	if status := serviceStatus(t, s, id); status != ServiceActive {
+		t.Fatalf("service is %s, want %s", status, ServiceActive)
+	}
+	if n := countRequests(m, "POST"); n != 2 {
+		t.Errorf("deploy was sent %d times, want 2", n)
+	}
+}
+
+// The node deployed the service, but its response was lost.
+func TestDeployLostResponse(t *testing.T) {
+	s, _ := newTestServer(t)
+	m, _, id := purchaseTestService(t, s)
+
+	name := fmt.Sprintf("alice-%d", id)
+	if err := m.Client().DeployShadowsocks(context.Background(), &manager.Shadowsocks{Name: name}); err != nil {
+		t.Fatal(err)
+	}
+
+	runJobs(t, s)
+	if status := serviceStatus(t, s, id); status != ServiceActive {
+		t.Fatalf("service is %s, want %s", status, ServiceActive)
+	}
+	if status := jobStatus(t, s, jobKey(JobDeploy, id)); status != "done" {
+		t.Errorf("deploy job is %s", status)
+	}
+}
+
+func TestDeployDead(t *testing.T) {
+	s, _ := newTestServer(t)
+	m, user, id := purchaseTestService(t, s)
+
+	// the first attempt deployed the service, but no response came back
+	name := fmt.Sprintf("alice-%d", id)
+	if err := m.Client().DeployShadowsocks(context.Background(), &manager.Shadowsocks{Name: name}); err != nil {
+		t.Fatal(err)
+	}
+	m.Fail(1000)
+	for i := 0; i < 5; i++ {
+		runJobs(t, s)
+	}
+	if status := jobStatus(t, s, jobKey(JobDeploy, id)); status != "dead" {
+		t.Fatalf("deploy job is %s, want dead", status)
+	}
+	if status := serviceStatus(t, s, id); status != ServiceFailed {
+		t.Errorf("service is %s, want %s", status, ServiceFailed)
+	}
+	if b := balanceOf(t, s, user); b != 100 {
+		t.Errorf("balance is %d, want the refunded 100", b)
+	}
+
+	m.Fail(0)
+	runJobs(t, s)
+	if status := jobStatus(t, s, jobKey(JobDelete, id)); status != "done" {
+		t.Errorf("delete job is %s, want done", status)
+	}
+	if m.Service(name) != nil {
+		t.Error("service is left on the node")
+	}
+	if _, err := s.queries.GetServiceNode(context.Background(), id); err != nil {
+		t.Errorf("failed service wasn't kept for the ledger: %s", err)
+	}
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"net/mail"
+	"strings"
+
+	"github.com/demtoni/tade/internal/payment"
+)
+
+// normalizeContact checks the email or phone receipts are sent to, phones
+// are reduced to digits with the country code as YooKassa expects them.
+func normalizeContact(contact string) (string, bool) {
+	contact = strings.TrimSpace(contact)
+	if strings.Contains(contact, "@") {
+		addr, err := mail.ParseAddress(contact)
+		if err != nil || addr.Address != contact {
+			return "", false
+		}
+		return contact, true
+	}
+
+	phone := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '(', ')':
+			return -1
+		}
+		return r
+	}, strings.TrimPrefix(contact, "+"))
+	if len(phone) < 11 || len(phone) > 15 {
+		return "", false
+	}
+	for _, r := range phone {
+		if r < '0' || r > '9' {
+			return "", false
+		}
+	}
+	// russian numbers are often written with the trunk prefix
+	if len(phone) == 11 && phone[0] == '8' {
+		phone = "7" + phone[1:]
+	}
+	return phone, true
+}
+
+// receipt makes the fiscal receipt of the top-up, nil is returned for an
+// empty contact.
+func (s *Server) receipt(contact string, amount int64) *payment.Receipt {
+	if contact == "" {
+		return nil
+	}
+
+	r := &payment.Receipt{
+		TaxSystem: s.config.ReceiptTaxSystem,
+		Items: []*payment.ReceiptItem{{
+			Description:    s.config.ReceiptDescription,
+			Amount:         amount,
+			VatCode:        s.config.ReceiptVatCode,
+			PaymentSubject: s.config.ReceiptPaymentSubject,
+			PaymentMode:    s.config.ReceiptPaymentMode,
+		}},
+	}
+	if strings.Contains(contact, "@") {
+		r.Email = contact
+	} else {
+		r.Phone = contact
+	}
+	return r
+}
@@ -0,0 +1,364 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/demtoni/tade/internal/database"
+	"github.com/demtoni/tade/internal/payment"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+const JobReconcile = "reconcile"
+
+const (
+	reconcilePeriod = 24 * time.Hour
+	// late notifications are given time to arrive before the day is checked
+	reconcileDelay = time.Hour
+
+	reportListLimit    = 50
+	reportListMaxLimit = 500
+)
+
+// mismatches found by the reconciliation
+const (
+	// paid, but the balance wasn't topped up
+	IssueNotCredited = "not_credited"
+	// paid, but the money is still held
+	IssueNotCaptured = "not_captured"
+	// the payment has no transaction
+	IssueUnknownPayment = "unknown_payment"
+	IssueAmountMismatch = "amount_mismatch"
+	// refunded by the provider, but not taken from the balance
+	IssueRefundNotRecorded = "refund_not_recorded"
+	// the balance was topped up, but the payment didn't go through
+	IssueNotPaid = "credited_not_paid"
+	// the transaction has no payment
+	IssueMissingPayment = "missing_payment"
+	// the fiscal receipt of the payment wasn't registered
+	IssueReceiptFailed = "receipt_failed"
+)
+
+// reconcileJob compares the payments created in [From, To) with the
+// transactions, every run queues the check of the next period.
+type reconcileJob struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+type reconciliationIssue struct {
+	PaymentID string
+	Kind      string
+	Detail    string
+	Fixed     bool
+}
+
+func init() {
+	registerJob(JobReconcile, &jobHandler{
+		run:         (*Server).runReconcile,
+		dead:        (*Server).skipReconcile,
+		maxAttempts: 5,
+	})
+}
+
+// scheduleReconcile queues the check of the period starting at from, it is
+// run once the period is over.
+func scheduleReconcile(ctx context.Context, q *database.Queries, from time.Time) error {
+	to := from.Add(reconcilePeriod)
+	return enqueueAt(ctx, q, JobReconcile, JobReconcile+":"+from.UTC().Format(time.DateOnly), &reconcileJob{
+		From: from.Unix(),
+		To:   to.Unix(),
+	}, to.Add(reconcileDelay))
+}
+
+// ScheduleReconciliation makes sure the previous day is checked, the runs
+// keep queueing the next days from then on.
+func (s *Server) ScheduleReconciliation() error {
+	today := time.Now().UTC().Truncate(reconcilePeriod)
+	from := today.Add(-reconcilePeriod)
+
+	_, err := s.queries.GetReconciliationReportByPeriod(context.TODO(), database.GetReconciliationReportByPeriodParams{
+		Provider:    s.payments.Name(),
+		PeriodStart: from.Unix(),
+	})
+	if err == nil {
+		from = today
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
+	return s.withTx(context.TODO(), func(q *database.Queries) error {
+		return scheduleReconcile(context.TODO(), q, from)
+	})
+}
+
+func (s *Server) runReconcile(ctx context.Context, payload []byte) error {
+	job := &reconcileJob{}
+	if err := json.Unmarshal(payload, job); err != nil {
+		return permanent(err)
+	}
+
+	payments, err := s.payments.List(ctx, time.Unix(job.From, 0), time.Unix(job.To, 0))
+	if err != nil {
+		return err
+	}
+	transactions, err := s.queries.ListPeriodTransactions(ctx, database.ListPeriodTransactionsParams{
+		Provider: s.payments.Name(),
+		From:     job.From,
+		To:       job.To,
+	})
+	if err != nil {
+		return err
+	}
+
+	byPayment := make(map[string]*database.Transaction, len(transactions))
+	for i := range transactions {
+		byPayment[transactions[i].PaymentID] = &transactions[i]
+	}
+
+	var issues []*reconciliationIssue
+	listed := make(map[string]bool, len(payments))
+	for _, p := range payments {
+		listed[p.ID] = true
+		if issue := s.reconcilePayment(ctx, p, byPayment[p.ID]); issue != nil {
+			issues = append(issues, issue)
+		}
+
+		// receipts are registered after the payment, the status is caught up
+		// with here
+		if t := byPayment[p.ID]; t != nil && p.ReceiptStatus != "" && string(p.ReceiptStatus) != t.Receipt {
+			if err := s.queries.SetTransactionReceipt(ctx, database.SetTransactionReceiptParams{
+				Receipt:   string(p.ReceiptStatus),
+				PaymentID: p.ID,
+			}); err != nil {
+				return err
+			}
+		}
+		if p.Status == payment.Succeeded && p.ReceiptStatus == payment.Canceled {
+			issues = append(issues, &reconciliationIssue{
+				PaymentID: p.ID,
+				Kind:      IssueReceiptFailed,
+				Detail:    "receipt of the payment was canceled",
+			})
+		}
+	}
+	for _, t := range transactions {
+		if !listed[t.PaymentID] {
+			issues = append(issues, &reconciliationIssue{
+				PaymentID: t.PaymentID,
+				Kind:      IssueMissingPayment,
+				Detail:    fmt.Sprintf("transaction of %d is %s", t.Amount, t.Status),
+			})
+		}
+	}
+
+	var fixed int64
+	for _, issue := range issues {
+		if issue.Fixed {
+			fixed++
+		}
+	}
+
+	return s.withTx(ctx, func(q *database.Queries) error {
+		id, err := q.CreateReconciliationReport(ctx, database.CreateReconciliationReportParams{
+			Provider:     s.payments.Name(),
+			PeriodStart:  job.From,
+			PeriodEnd:    job.To,
+			Payments:     int64(len(payments)),
+			Transactions: int64(len(transactions)),
+			Fixed:        fixed,
+			Flagged:      int64(len(issues)) - fixed,
+			CreatedAt:    time.Now().Unix(),
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, issue := range issues {
+			var isFixed int64
+			if issue.Fixed {
+				isFixed = 1
+			}
+			if err := q.CreateReconciliationIssue(ctx, database.CreateReconciliationIssueParams{
+				ReportID:  id,
+				PaymentID: issue.PaymentID,
+				Kind:      issue.Kind,
+				Detail:    issue.Detail,
+				Fixed:     isFixed,
+			}); err != nil {
+				return err
+			}
+		}
+
+		return scheduleReconcile(ctx, q, time.Unix(job.To, 0))
+	})
+}
+
+// skipReconcile moves on to the next period, the dead job is left for the
+// admins to retry.
+func (s *Server) skipReconcile(ctx context.Context, q *database.Queries, payload []byte) error {
+	job := &reconcileJob{}
+	if err := json.Unmarshal(payload, job); err != nil {
+		return err
+	}
+	return scheduleReconcile(ctx, q, time.Unix(job.To, 0))
+}
+
+// reconcilePayment fixes what processPayment can fix and flags the rest,
+// t is nil if the payment has no transaction.
+func (s *Server) reconcilePayment(ctx context.Context, p *payment.Payment, t *database.Transaction) *reconciliationIssue {
+	issue := &reconciliationIssue{PaymentID: p.ID}
+	credited := t != nil && (t.Status == TransactionCompleted ||
+		t.Status == TransactionPartiallyRefunded ||
+		t.Status == TransactionRefunded)
+
+	switch {
+	case t == nil && p.Status == payment.WaitingForCapture:
+		// processPayment releases the money
+		issue.Kind = IssueUnknownPayment
+		issue.Detail = fmt.Sprintf("%d held without a transaction", p.Amount)
+	case t == nil && p.Status == payment.Succeeded:
+		issue.Kind = IssueUnknownPayment
+		issue.Detail = fmt.Sprintf("%d paid without a transaction", p.Amount)
+		return issue
+	case t == nil:
+		return nil
+	case p.Status == payment.Succeeded && p.Amount != t.Amount:
+		issue.Kind = IssueAmountMismatch
+		issue.Detail = fmt.Sprintf("paid %d instead of %d", p.Amount, t.Amount)
+		return issue
+	case p.Status == payment.WaitingForCapture:
+		issue.Kind = IssueNotCaptured
+		issue.Detail = fmt.Sprintf("%d held", p.Amount)
+	case p.Status == payment.Succeeded && !credited:
+		issue.Kind = IssueNotCredited
+		issue.Detail = fmt.Sprintf("%d paid, transaction is %s", p.Amount, t.Status)
+	case p.Status == payment.Succeeded && p.Refunded > t.Refunded:
+		issue.Kind = IssueRefundNotRecorded
+		issue.Detail = fmt.Sprintf("%d refunded, %d taken from the balance", p.Refunded, t.Refunded)
+		return issue
+	case p.Status != payment.Succeeded && credited:
+		issue.Kind = IssueNotPaid
+		issue.Detail = fmt.Sprintf("payment is %s, transaction is %s", p.Status, t.Status)
+		return issue
+	default:
+		return nil
+	}
+
+	if err := s.processPayment(ctx, p); err != nil {
+		issue.Detail += ": " + err.Error()
+		return issue
+	}
+	issue.Fixed = true
+	return issue
+}
+
+type ReconciliationReportResponse struct {
+	ID           int64                          `json:"id"`
+	Provider     string                         `json:"provider"`
+	PeriodStart  int64                          `json:"period_start"`
+	PeriodEnd    int64                          `json:"period_end"`
+	Payments     int64                          `json:"payments"`
+	Transactions int64                          `json:"transactions"`
+	Fixed        int64                          `json:"fixed"`
+	Flagged      int64                          `json:"flagged"`
+	CreatedAt    int64                          `json:"created_at"`
+	Issues       []*ReconciliationIssueResponse `json:"issues,omitempty"`
+}
+
+func (r *ReconciliationReportResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	return nil
+}
+
+type ReconciliationIssueResponse struct {
+	PaymentID string `json:"payment_id"`
+	Kind      string `json:"kind"`
+	Detail    string `json:"detail,omitempty"`
+	Fixed     bool   `json:"fixed"`
+}
+
+func NewReconciliationReportResponse(report *database.ReconciliationReport) *ReconciliationReportResponse {
+	return &ReconciliationReportResponse{
+		ID:           report.ID,
+		Provider:     report.Provider,
+		PeriodStart:  report.PeriodStart,
+		PeriodEnd:    report.PeriodEnd,
+		Payments:     report.Payments,
+		Transactions: report.Transactions,
+		Fixed:        report.Fixed,
+		Flagged:      report.Flagged,
+		CreatedAt:    report.CreatedAt,
+	}
+}
+
+// ListReconciliations lists the reports newest first without their issues.
+// Older pages are requested with the id of the last report as before.
+func (s *Server) ListReconciliations(w http.ResponseWriter, r *http.Request) {
+	before := int64(math.MaxInt64)
+	if v, err := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64); err == nil && v > 0 {
+		before = v
+	}
+	limit := int64(reportListLimit)
+	if v, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64); err == nil && v > 0 {
+		limit = min(v, reportListMaxLimit)
+	}
+
+	reports, err := s.queries.ListReconciliationReports(r.Context(), database.ListReconciliationReportsParams{
+		ID:    before,
+		Limit: limit,
+	})
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	list := []render.Renderer{}
+	for i := range reports {
+		list = append(list, NewReconciliationReportResponse(&reports[i]))
+	}
+
+	render.RenderList(w, r, list)
+}
+
+func (s *Server) GetReconciliation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorReportNotFound)
+		return
+	}
+
+	report, err := s.queries.GetReconciliationReport(r.Context(), id)
+	if err == sql.ErrNoRows {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorReportNotFound)
+		return
+	}
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	issues, err := s.queries.ListReconciliationIssues(r.Context(), report.ID)
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	res := NewReconciliationReportResponse(&report)
+	for _, issue := range issues {
+		res.Issues = append(res.Issues, &ReconciliationIssueResponse{
+			PaymentID: issue.PaymentID,
+			Kind:      issue.Kind,
+			Detail:    issue.Detail,
+			Fixed:     issue.Fixed > 0,
+		})
+	}
+
+	render.Render(w, r, res)
+}
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/demtoni/tade/internal/config"
+	"github.com/demtoni/tade/internal/database"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+type RefundRequest struct {
+	// everything left of the payment is refunded if zero
+	Amount int64 `json:"amount"`
+}
+
+func (r *RefundRequest) Bind(_ *http.Request) error {
+	if r.Amount < 0 {
+		return errors.New(ErrorBadRefund)
+	}
+	return nil
+}
+
+type RefundResponse struct {
+	ID     string `json:"id"`
+	Amount int64  `json:"amount"`
+	Status string `json:"status"`
+}
+
+func (r *RefundResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	return nil
+}
+
+// RefundTransaction gives the money of a completed top-up back through the
+// payment provider. The balance is debited once the refund succeeds, right
+// away or when the provider notifies about it.
+func (s *Server) RefundTransaction(w http.ResponseWriter, r *http.Request) {
+	data := &RefundRequest{}
+	if err := render.Bind(r, data); err != nil {
+		s.SendError(w, r, nil, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	t, err := s.queries.GetTransaction(r.Context(), chi.URLParam(r, "id"))
+	if err == sql.ErrNoRows {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorTransactionNotFound)
+		return
+	}
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	refundable := t.Status == TransactionCompleted || t.Status == TransactionPartiallyRefunded
+	if !refundable || t.Provider != s.payments.Name() {
+		s.SendError(w, r, nil, http.StatusConflict, ErrorNotRefundable)
+		return
+	}
+
+	left := t.Amount - t.Refunded
+	amount := data.Amount
+	if amount == 0 {
+		amount = left
+	}
+	if amount <= 0 || amount > left {
+		s.SendError(w, r, nil, http.StatusBadRequest, ErrorBadRefund)
+		return
+	}
+
+	// the receipt of the refund matches the one of the payment, retries
+	// made before the refund is recorded get the same refund back
+	key := fmt.Sprintf("refund:%s:%d", t.PaymentID, t.Refunded)
+	rf, err := s.payments.Refund(r.Context(), t.PaymentID, amount, s.receipt(t.ReceiptContact, amount), key)
+	if err != nil {
+		s.SendError(w, r, err, http.StatusBadGateway, ErrorRefundFailed)
+		return
+	}
+	if err := s.processRefund(r.Context(), rf); err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	render.Render(w, r, &RefundResponse{rf.ID, rf.Amount, string(rf.Status)})
+}
+
+// cancellationCredit returns what the customer gets back for the time left
+// of the service under the refund policy.
+func (s *Server) cancellationCredit(srv *database.Service, now int64) int64 {
+	if s.config.RefundPolicy != config.RefundProrated {
+		return 0
+	}
+
+	term := srv.ExpiresAt - srv.PaidAt
+	left := srv.ExpiresAt - now
+	if term <= 0 || left <= 0 {
+		return 0
+	}
+	if left > term {
+		left = term
+	}
+
+	credit := srv.ProlongPrice * left / term
+	return credit * (100 - s.config.RefundFee) / 100
+}
+
+type CancellationResponse struct {
+	ID     int64  `json:"id"`
+	Status string `json:"status"`
+	Credit int64  `json:"credit"`
+}
+
+func (r *CancellationResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	return nil
+}
+
+// CancelService stops the service for good and credits the unused time back
+// to the balance. The record is kept for the ledger, the node is cleaned up
+// by a delete job.
+func (s *Server) CancelService(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value("user").(*database.User)
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorServiceNotFound)
+		return
+	}
+
+	if _, err := s.queries.GetService(r.Context(), database.GetServiceParams{
+		ID:     int64(id),
+		UserID: u.ID,
+	}); err != nil {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorServiceNotFound)
+		return
+	}
+
+	var credit int64
+	err = s.withTx(r.Context(), func(q *database.Queries) error {
+		srv, err := q.CancelService(r.Context(), database.CancelServiceParams{
+			ID:     int64(id),
+			UserID: u.ID,
+		})
+		if err != nil {
+			return err
+		}
+
+		credit = s.cancellationCredit(&srv, time.Now().Unix())
+		if credit > 0 {
+			if _, err := postEntry(r.Context(), q, u.ID, credit, LedgerCancellation, serviceReference(srv.ID)); err != nil {
+				return err
+			}
+		}
+		if err := enqueue(r.Context(), q, JobDelete, jobKey(JobDelete, srv.ID), &deleteJob{
+			ServiceID: srv.ID,
+		}); err != nil {
+			return err
+		}
+		return s.notifyTx(r.Context(), q, u.ID, srv.ID, EventServiceCanceled)
+	})
+	if err == sql.ErrNoRows {
+		// pending, failed or canceled already
+		s.SendError(w, r, nil, http.StatusConflict, ErrorServiceNotActive)
+		return
+	}
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+	s.wakeWorkers()
+
+	render.Render(w, r, &CancellationResponse{int64(id), ServiceCanceled, credit})
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func refundTransaction(t *testing.T, s *Server, paymentID string, amount int64) *RefundResponse {
+	t.Helper()
+
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", paymentID)
+	r := httptest.NewRequest(http.MethodPost, "/admin/transactions/"+paymentID+"/refund",
+		strings.NewReader(fmt.Sprintf(`{"amount": %d}`, amount)))
+	r.Header.Set("Content-Type", "application/json")
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+
+	w := httptest.NewRecorder()
+	s.RefundTransaction(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("refund answered %d: %s", w.Code, w.Body)
+	}
+	res := &RefundResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// The provider made the refund, but its response was lost.
+func TestRefundTransactionLostResponse(t *testing.T) {
+	s, ts := newTestServer(t)
+	ctx := context.Background()
+	user := createTestUser(t, s, "alice")
+
+	p := paySandbox(t, s, ts, createTopUp(t, s, user, 100, false).ID)
+	if err := s.processPayment(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+
+	lost, err := s.payments.Refund(ctx, p.ID, 40, nil, fmt.Sprintf("refund:%s:0", p.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rf := refundTransaction(t, s, p.ID, 40); rf.ID != lost.ID {
+		t.Errorf("retry made refund %s, want %s", rf.ID, lost.ID)
+	}
+	if b := balanceOf(t, s, user); b != 60 {
+		t.Errorf("balance is %d, want 60", b)
+	}
+
+	// a later refund is a new one
+	if rf := refundTransaction(t, s, p.ID, 40); rf.ID == lost.ID {
+		t.Error("second refund wasn't made")
+	}
+	if got, _ := s.payments.Get(ctx, p.ID); got.Refunded != 80 {
+		t.Errorf("refunded %d, want 80", got.Refunded)
+	}
+	if b := balanceOf(t, s, user); b != 20 {
+		t.Errorf("balance is %d, want 20", b)
+	}
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/demtoni/tade/internal/database"
+	manager "github.com/demtoni/tade/internal/manager/sdk"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+// minimal interval customers can ask their service to be rotated at
+const minRotateEvery = 3600
+
+// portRotator is implemented by providers of services that own their port,
+// the rest share the ports of the node and can't be moved.
+type portRotator interface {
+	Rotate(ctx context.Context, c *manager.Client, name string) (*manager.Rotation, error)
+}
+
+type RotationResponse struct {
+	Port      int   `json:"port"`
+	RotatedAt int64 `json:"rotated_at"`
+}
+
+func (r *RotationResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	return nil
+}
+
+// RotateService moves the service of the customer to a new port, e.g. when
+// the current one got blocked.
+func (s *Server) RotateService(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value("user").(*database.User)
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorServiceNotFound)
+		return
+	}
+
+	service, err := s.queries.GetService(r.Context(), database.GetServiceParams{
+		ID:     int64(id),
+		UserID: u.ID,
+	})
+	if err != nil {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorServiceNotFound)
+		return
+	}
+
+	if service.Status != ServiceActive {
+		s.SendError(w, r, nil, http.StatusConflict, ErrorServiceNotActive)
+		return
+	}
+
+	rotator, ok := providers[service.Type].(portRotator)
+	if !ok {
+		s.SendError(w, r, nil, http.StatusBadRequest, ErrorNotRotatable)
+		return
+	}
+
+	if service.Online == 0 {
+		s.SendError(w, r, nil, http.StatusServiceUnavailable, ErrorLocationUnavailable)
+		return
+	}
+
+	rotation, err := rotator.Rotate(r.Context(), s.client(service.Address), service.RemoteName)
+	switch {
+	case errors.Is(err, manager.ErrUnavailable):
+		s.SendError(w, r, err, http.StatusServiceUnavailable, ErrorLocationUnavailable)
+		return
+	case errors.Is(err, manager.ErrRotating):
+		s.SendError(w, r, nil, http.StatusConflict, ErrorRotating)
+		return
+	case err != nil:
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	if err := s.queries.SetServiceRotated(r.Context(), database.SetServiceRotatedParams{
+		RotatedAt:  rotation.RotatedAt,
+		NodeID:     service.NodeID,
+		RemoteName: service.RemoteName,
+	}); err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	render.Render(w, r, &RotationResponse{rotation.Port, rotation.RotatedAt})
+}
+
+// RotateNode moves every service of the node to new ports.
+func (s *Server) RotateNode(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorNodeNotFound)
+		return
+	}
+
+	node, err := s.queries.GetNode(r.Context(), int64(id))
+	if err != nil {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorNodeNotFound)
+		return
+	}
+
+	rotations, err := s.client(node.Address).RotateNode(r.Context())
+	if errors.Is(err, manager.ErrUnavailable) {
+		s.SendError(w, r, err, http.StatusServiceUnavailable, ErrorLocationUnavailable)
+		return
+	}
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	for _, rotation := range rotations {
+		if err := s.queries.SetServiceRotated(r.Context(), database.SetServiceRotatedParams{
+			RotatedAt:  rotation.RotatedAt,
+			NodeID:     node.ID,
+			RemoteName: rotation.Name,
+		}); err != nil {
+			log.Printf("node %d: couldn't save rotation of %s: %s", node.ID, rotation.Name, err)
+		}
+	}
+
+	render.Status(r, http.StatusOK)
+}
+
+type RotationRequest struct {
+	Name      string `json:"name"`
+	Port      int    `json:"port"`
+	RotatedAt int64  `json:"rotated_at"`
+}
+
+func (r *RotationRequest) Bind(_ *http.Request) error {
+	if r.Name == "" {
+		return errors.New(ErrorEmptyField)
+	}
+	return nil
+}
+
+// NodeRotation is called by the managers rotating services on schedule.
+func (s *Server) NodeRotation(w http.ResponseWriter, r *http.Request) {
+	node, err := s.enrolledNode(r)
+	if err != nil {
+		s.SendError(w, r, err, http.StatusUnauthorized, ErrorUnauthorized)
+		return
+	}
+
+	data := &RotationRequest{}
+	if err := render.Bind(r, data); err != nil {
+		s.SendError(w, r, nil, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.queries.SetServiceRotated(r.Context(), database.SetServiceRotatedParams{
+		RotatedAt:  data.RotatedAt,
+		NodeID:     node.ID,
+		RemoteName: data.Name,
+	}); err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+}
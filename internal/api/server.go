@@ -1,45 +1,71 @@
 package api
 
 import (
+	"context"
 	"database/sql"
 	"io/fs"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/demtoni/tade/internal/config"
 	"github.com/demtoni/tade/internal/database"
+	manager "github.com/demtoni/tade/internal/manager/sdk"
+	"github.com/demtoni/tade/internal/payment"
 	"github.com/demtoni/tade/webapp"
-	"github.com/rvinnie/yookassa-sdk-go/yookassa"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
 	"github.com/gorilla/sessions"
-	_ "modernc.org/sqlite"
 )
 
 type Server struct {
-	config  *config.Config
-	router  *chi.Mux
-	queries *database.Queries
-	store   *sessions.CookieStore
-	kassa   *yookassa.PaymentHandler
+	config   *config.Config
+	router   *chi.Mux
+	db       *sql.DB
+	queries  *database.Queries
+	store    *sessions.CookieStore
+	payments payment.Provider
+	infos    *infoCache
+	// node address mapped to its manager client
+	clients sync.Map
+	// wakes an idle job worker up
+	jobWake chan struct{}
 }
 
 func New(cfg *config.Config) (*Server, error) {
 	s := &Server{
-		config: cfg,
-		router: chi.NewRouter(),
+		config:  cfg,
+		router:  chi.NewRouter(),
+		infos:   newInfoCache(),
+		jobWake: make(chan struct{}, 1),
 	}
 
-	db, err := sql.Open("sqlite", s.config.PathToDB)
+	db, err := database.Open(s.config.PathToDB)
 	if err != nil {
 		return nil, err
 	}
+
+	migrator, err := database.NewMigrator(db)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := migrator.Up(context.Background())
+	for _, m := range applied {
+		log.Printf("applied migration %d_%s", m.Version, m.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.db = db
 	s.queries = database.New(db)
 
 	s.store = sessions.NewCookieStore([]byte(s.config.SessionSecret))
 
-	s.kassa = yookassa.NewPaymentHandler(yookassa.NewClient(s.config.YooShopID, s.config.YooApiKey))
+	if s.payments, err = newPaymentProvider(s.config); err != nil {
+		return nil, err
+	}
 
 	s.router.Route("/api", func(r chi.Router) {
 		r.Use(cors.Handler(cors.Options{
@@ -59,28 +85,103 @@ func New(cfg *config.Config) (*Server, error) {
 			r.Route("/services", func(r chi.Router) {
 				r.Get("/", s.ListUserServices)
 				r.Get("/locations", s.ListLocations)
+				r.Get("/prices", s.ListPrices)
 				r.Post("/", s.CreateService)
 				r.Get("/{id}", s.GetService)
+				r.Post("/{id}/traffic", s.BuyTraffic)
+				r.Post("/{id}/rotate", s.RotateService)
+				r.Post("/{id}/cancel", s.CancelService)
 			})
 			r.Post("/balance", s.AddBalance)
+			r.Get("/autopay", s.GetAutopay)
+			r.Put("/autopay", s.SetAutopayLimit)
+			r.Delete("/autopay", s.DeleteAutopay)
 			r.Get("/transactions", s.GetTransactionList)
+			r.Get("/statement", s.GetStatement)
 			r.Post("/invites", s.GenerateInvite)
 			r.Get("/invites", s.ListInvites)
 		})
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(s.AuthCtx)
+			r.Use(s.AdminCtx)
+			r.Post("/locations/tokens", s.GenerateJoinToken)
+			r.Post("/users/{id}/balance", s.AdjustBalance)
+			r.Post("/transactions/{id}/refund", s.RefundTransaction)
+			r.Get("/locations/{id}/hostnames", s.ListLocationHostnames)
+			r.Put("/locations/{id}/hostnames", s.SetLocationHostnames)
+			r.Get("/locations/{id}/acl", s.ListPolicies)
+			r.Put("/locations/{id}/acl/{name}", s.SetPolicy)
+			r.Delete("/locations/{id}/acl/{name}", s.DeletePolicy)
+			r.Get("/nodes", s.ListNodes)
+			r.Put("/nodes/{id}", s.UpdateNode)
+			r.Put("/nodes/{id}/hostnames", s.SetNodeHostnames)
+			r.Post("/nodes/{id}/rotate", s.RotateNode)
+			r.Get("/nodes/{id}/checks", s.ListNodeChecks)
+			r.Get("/jobs", s.ListJobs)
+			r.Post("/jobs/{id}/retry", s.RetryJob)
+			r.Post("/jobs/{id}/cancel", s.CancelJob)
+			r.Get("/reconciliations", s.ListReconciliations)
+			r.Get("/reconciliations/{id}", s.GetReconciliation)
+		})
+		r.Post("/webhooks/{provider}", s.PaymentWebhook)
+		r.Route("/nodes", func(r chi.Router) {
+			r.Post("/join", s.JoinNode)
+			r.Post("/heartbeat", s.NodeHeartbeat)
+			r.Post("/rotations", s.NodeRotation)
+		})
 	})
 
+	if pages, ok := s.payments.(payment.Pages); ok {
+		s.router.Mount("/"+s.payments.Name(), pages.Handler())
+	}
+
 	frontend, _ := fs.Sub(webapp.Content, "dist")
 	s.router.Handle("/*", http.FileServer(http.FS(frontend)))
 
 	return s, nil
 }
 
+// client returns the manager client of the node, clients are kept for the
+// connections to be reused.
+func (s *Server) client(addr string) *manager.Client {
+	if c, ok := s.clients.Load(addr); ok {
+		return c.(*manager.Client)
+	}
+	c, _ := s.clients.LoadOrStore(addr, manager.NewClient(addr))
+	return c.(*manager.Client)
+}
+
+// withTx runs fn inside of a single database transaction, which is rolled
+// back if fn returns an error.
+func (s *Server) withTx(ctx context.Context, fn func(q *database.Queries) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(s.queries.WithTx(tx)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
 func (s *Server) Run() error {
 	paymentsTicker := time.NewTicker(60 * time.Second)
 	serviceTicker := time.NewTicker(60 * time.Second)
+	healthTicker := time.NewTicker(healthCheckInterval)
 
 	defer paymentsTicker.Stop()
 	defer serviceTicker.Stop()
+	defer healthTicker.Stop()
+
+	if err := s.RunJobs(); err != nil {
+		return err
+	}
+	if err := s.ScheduleReconciliation(); err != nil {
+		return err
+	}
 
 	go func() {
 		for {
@@ -93,6 +194,13 @@ func (s *Server) Run() error {
 				if err := s.CheckServices(); err != nil {
 					log.Println(err)
 				}
+				if err := s.DeleteFinishedJobs(); err != nil {
+					log.Println(err)
+				}
+			case <-healthTicker.C:
+				if err := s.CheckNodes(); err != nil {
+					log.Println(err)
+				}
 			}
 		}
 	}()
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/demtoni/tade/internal/config"
+	"github.com/demtoni/tade/internal/database"
+	"github.com/demtoni/tade/internal/manager/sdk/managertest"
+	"github.com/demtoni/tade/internal/payment"
+)
+
+// newTestServer runs the server on a fresh database with the sandbox
+// provider. Notifications of the sandbox are sent nowhere so that tests
+// decide when payments are processed.
+func newTestServer(t *testing.T) (*Server, *httptest.Server) {
+	t.Helper()
+
+	s, err := New(&config.Config{
+		PathToDB:        filepath.Join(t.TempDir(), "db.sqlite"),
+		SessionSecret:   "secret",
+		PublicURL:       "http://127.0.0.1:1",
+		PaymentProvider: "sandbox",
+		JobWorkers:      1,
+		AutopayLimit:    3000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.db.Close() })
+
+	ts := httptest.NewServer(s.router)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+func createTestUser(t *testing.T, s *Server, name string) int64 {
+	t.Helper()
+
+	id, err := s.queries.CreateUser(context.Background(), database.CreateUserParams{
+		Name:         name,
+		PasswordHash: "hash",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// createTopUp creates the payment along with its transaction the way
+// AddBalance does.
+func createTopUp(t *testing.T, s *Server, userID, amount int64, save bool) *payment.Payment {
+	t.Helper()
+	ctx := context.Background()
+
+	p, err := s.payments.Create(ctx, &payment.Request{Amount: amount, Save: save})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.queries.CreateTransaction(ctx, database.CreateTransactionParams{
+		PaymentID: p.ID,
+		Amount:    amount,
+		Status:    TransactionInProcess,
+		Timestamp: p.CreatedAt.Unix(),
+		Url:       p.URL,
+		UserID:    userID,
+		Provider:  s.payments.Name(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// paySandbox confirms the payment on the page of the sandbox and returns
+// it as processPayment would get it.
+func paySandbox(t *testing.T, s *Server, ts *httptest.Server, id string) *payment.Payment {
+	t.Helper()
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		Timeout:       5 * time.Second,
+	}
+	resp, err := client.PostForm(ts.URL+"/sandbox/pay/"+id, url.Values{"action": {"pay"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("paying %s: %s", id, resp.Status)
+	}
+
+	p, err := s.payments.Get(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func balanceOf(t *testing.T, s *Server, userID int64) int64 {
+	t.Helper()
+
+	u, err := s.queries.GetUser(context.Background(), userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Balance
+}
+
+// newTestNode adds the location with a single node run by the fake
+// manager, the client of the node doesn't wait between retries.
+func newTestNode(t *testing.T, s *Server) (*managertest.Server, database.CreateServiceParams) {
+	t.Helper()
+	ctx := context.Background()
+
+	m := managertest.NewServer()
+	t.Cleanup(m.Close)
+	s.clients.Store(m.Addr(), m.Client())
+
+	location, err := s.queries.CreateLocation(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := s.queries.CreateNode(ctx, database.CreateNodeParams{
+		LocationID:   location,
+		Address:      m.Addr(),
+		HeartbeatKey: "key",
+		LastSeen:     time.Now().Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	return m, database.CreateServiceParams{
+		Name:         "test",
+		Type:         "shadowsocks",
+		CreatedAt:    now,
+		PaidAt:       now,
+		ExpiresAt:    now + 30*24*3600,
+		Prolong:      1,
+		ProlongPrice: 100,
+		LocationID:   location,
+		NodeID:       node,
+	}
+}
+
+func setBalance(t *testing.T, s *Server, userID, balance int64) {
+	t.Helper()
+
+	if _, err := s.db.Exec("UPDATE users SET balance = ? WHERE id = ?", balance, userID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runJobs runs the jobs that are due, rescheduled ones are left for the
+// next call.
+func runJobs(t *testing.T, s *Server) {
+	t.Helper()
+
+	for s.runNextJob() {
+	}
+	// failed attempts are retried right away by the next call
+	if _, err := s.db.Exec("UPDATE jobs SET run_at = 0 WHERE status = 'queued'"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func jobStatus(t *testing.T, s *Server, key string) string {
+	t.Helper()
+
+	var status string
+	if err := s.db.QueryRow("SELECT status FROM jobs WHERE unique_key = ? ORDER BY id DESC LIMIT 1", key).Scan(&status); err != nil {
+		t.Fatalf("job %s: %s", key, err)
+	}
+	return status
+}
@@ -4,10 +4,9 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"fmt"
+	"log"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/demtoni/tade/internal/database"
@@ -31,8 +30,6 @@ func (r *ServiceRequest) Bind(_ *http.Request) error {
 		fallthrough
 	case r.Service == "":
 		fallthrough
-	case len(r.Metadata) == 0:
-		fallthrough
 	case r.Name == "":
 		return errors.New(ErrorEmptyField)
 	case len(r.Name) > 72:
@@ -47,8 +44,10 @@ type ServiceResponse struct {
 	ID        int64                  `json:"id,omitempty"`
 	Name      string                 `json:"name,omitempty"`
 	ExpiresAt int64                  `json:"expires_at,omitempty"`
+	RotatedAt int64                  `json:"rotated_at,omitempty"`
 	Location  string                 `json:"location,omitempty"`
 	Service   string                 `json:"service,omitempty"`
+	Status    string                 `json:"status,omitempty"`
 	Metadata  map[string]interface{} `json:"metadata,omitempty"`
 }
 
@@ -74,14 +73,58 @@ func (s *Server) GetService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var meta map[string]interface{}
+	// the node doesn't have it
+	if service.Status == ServicePending || service.Status == ServiceFailed || service.Status == ServiceCanceled {
+		render.Render(w, r, &ServiceResponse{
+			ID:        int64(id),
+			Name:      service.Name,
+			ExpiresAt: service.ExpiresAt,
+			Location:  service.Name_2,
+			Service:   service.Type,
+			Status:    service.Status,
+		})
+		return
+	}
+
+	if service.Online == 0 {
+		s.SendError(w, r, nil, http.StatusServiceUnavailable, ErrorLocationUnavailable)
+		return
+	}
 
-	switch service.Type {
-	case "shadowsocks":
-		meta, err = manager.GetShadowsocks(service.Address, fmt.Sprintf("%s%d", u.Name, service.CreatedAt))
-		if err != nil {
-			s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
-			return
+	provider, ok := providers[service.Type]
+	if !ok {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorServiceUnknown)
+		return
+	}
+
+	cfg, err := provider.Config(r.Context(), s.client(service.Address), service.RemoteName, service.Name)
+	if errors.Is(err, manager.ErrUnavailable) {
+		s.SendError(w, r, err, http.StatusServiceUnavailable, ErrorLocationUnavailable)
+		return
+	}
+	if errors.Is(err, manager.ErrNotFound) {
+		s.SendError(w, r, err, http.StatusNotFound, ErrorServiceNotFound)
+		return
+	}
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	endpoints, err := s.endpoints(r.Context(), service.NodeID, service.LocationID, cfg.URL)
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	meta := cfg.Metadata
+	meta["endpoints"] = endpoints
+	addUsage(meta, cfg.Usage)
+	// customers choose between ipv4, ipv6 and domain variants
+	if e := pickEndpoint(endpoints, r.URL.Query().Get("endpoint")); e != nil {
+		meta["connect_url"] = e.ConnectURL
+		if cfg.Endpoint != nil {
+			cfg.Endpoint(meta, e.Hostname)
 		}
 	}
 
@@ -89,12 +132,72 @@ func (s *Server) GetService(w http.ResponseWriter, r *http.Request) {
 		ID:        int64(id),
 		Name:      service.Name,
 		ExpiresAt: service.ExpiresAt,
+		RotatedAt: service.RotatedAt,
 		Location:  service.Name_2,
 		Service:   service.Type,
+		Status:    service.Status,
 		Metadata:  meta,
 	})
 }
 
+// addUsage adds limits and usage reported by the node, they are the same
+// for every service type.
+func addUsage(meta map[string]interface{}, usage *manager.Usage) {
+	meta["devices"] = usage.Clients
+	meta["max_devices"] = usage.MaxIPs
+	if usage.SuspendedUntil > 0 {
+		meta["suspended_until"] = usage.SuspendedUntil
+	}
+	if usage.Quota > 0 {
+		meta["traffic"] = &TrafficResponse{
+			Quota:     usage.Quota,
+			Used:      usage.Used,
+			Remaining: max(usage.Quota-usage.Used, 0),
+			ResetAt:   usage.ResetAt,
+			Limited:   usage.Limited,
+		}
+	}
+}
+
+type PriceResponse struct {
+	Service string `json:"service"`
+	Amount  int64  `json:"amount"`
+	// maximum number of devices using the service at once, 0 is unlimited
+	MaxDevices int64 `json:"max_devices"`
+	// monthly traffic in bytes, 0 is unlimited
+	Quota            int64  `json:"quota"`
+	QuotaMode        string `json:"quota_mode,omitempty"`
+	TrafficPackSize  int64  `json:"traffic_pack_size,omitempty"`
+	TrafficPackPrice int64  `json:"traffic_pack_price,omitempty"`
+}
+
+func (r *PriceResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	return nil
+}
+
+func (s *Server) ListPrices(w http.ResponseWriter, r *http.Request) {
+	prices, err := s.queries.ListPrices(r.Context())
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	list := []render.Renderer{}
+	for _, p := range prices {
+		list = append(list, &PriceResponse{
+			Service:          p.Type,
+			Amount:           p.Amount,
+			MaxDevices:       p.MaxIps,
+			Quota:            p.Quota,
+			QuotaMode:        p.QuotaMode,
+			TrafficPackSize:  p.TrafficPackSize,
+			TrafficPackPrice: p.TrafficPackPrice,
+		})
+	}
+
+	render.RenderList(w, r, list)
+}
+
 func NewServiceListResponse(services *[]database.ListUserServicesRow) []render.Renderer {
 	list := []render.Renderer{}
 	for _, service := range *services {
@@ -104,6 +207,7 @@ func NewServiceListResponse(services *[]database.ListUserServicesRow) []render.R
 			ExpiresAt: service.ExpiresAt,
 			Location:  service.Name_2,
 			Service:   service.Type,
+			Status:    service.Status,
 		})
 	}
 	return list
@@ -121,35 +225,6 @@ func (s *Server) ListUserServices(w http.ResponseWriter, r *http.Request) {
 	render.RenderList(w, r, NewServiceListResponse(&services))
 }
 
-type LocationResponse struct {
-	Location string   `json:"name"`
-	Services []string `json:"services"`
-}
-
-func (r *LocationResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
-	return nil
-}
-
-func NewLocationListResponse(locations *[]database.ListLocationsRow) []render.Renderer {
-	list := []render.Renderer{}
-	for _, location := range *locations {
-		list = append(list, &LocationResponse{
-			location.Name, strings.Split(location.Services, ","),
-		})
-	}
-	return list
-}
-
-func (s *Server) ListLocations(w http.ResponseWriter, r *http.Request) {
-	locations, err := s.queries.ListLocations(r.Context())
-	if err != nil {
-		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
-		return
-	}
-
-	render.RenderList(w, r, NewLocationListResponse(&locations))
-}
-
 func (s *Server) CreateService(w http.ResponseWriter, r *http.Request) {
 	u := r.Context().Value("user").(*database.User)
 
@@ -159,12 +234,22 @@ func (s *Server) CreateService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	provider, ok := providers[data.Service]
+	if !ok {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorServiceUnknown)
+		return
+	}
+	if err := provider.Validate(data.Metadata); err != nil {
+		s.SendError(w, r, nil, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	price, err := s.queries.GetPrice(r.Context(), data.Service)
 	if err != nil {
 		s.SendError(w, r, nil, http.StatusNotFound, ErrorServiceUnknown)
 		return
 	}
-	prolongPrice := price * int64(data.Months)
+	prolongPrice := price.Amount * int64(data.Months)
 	if prolongPrice > u.Balance {
 		s.SendError(w, r, nil, http.StatusForbidden, ErrorLowBalance)
 		return
@@ -173,32 +258,26 @@ func (s *Server) CreateService(w http.ResponseWriter, r *http.Request) {
 	expiresAt := time.Now().AddDate(0, data.Months, 0).Unix()
 	createdAt := time.Now().Unix()
 
-	location, err := s.queries.GetLocation(r.Context(), database.GetLocationParams{
-		Column1: sql.NullString{data.Service, true},
-		Name:    data.Location,
-	})
+	location, err := s.queries.GetLocation(r.Context(), data.Location)
 	if err != nil || location.ID == 0 {
 		s.SendError(w, r, nil, http.StatusBadRequest, ErrorLocationNotSupported)
 		return
 	}
 
-	switch data.Service {
-	case "shadowsocks":
-		name := fmt.Sprintf("%s%d", u.Name, createdAt)
-		method := data.Metadata["method"].(string)
-		plugin := data.Metadata["plugin"].(string)
-		// TODO: this should be instead placed in a job queue
-		if err := manager.DeployShadowsocks(location.Address, name, method, plugin); err != nil {
+	node, err := s.placeService(r.Context(), location.ID, data.Service, func(info *manager.Info) error {
+		return provider.Supported(info, data.Metadata)
+	})
+	if err != nil {
+		switch err {
+		case errLocationUnavailable:
+			s.SendError(w, r, nil, http.StatusServiceUnavailable, err.Error())
+		case errLocationFull:
+			s.SendError(w, r, nil, http.StatusConflict, err.Error())
+		case errLocationNotSupported, errMethodNotSupported, errPluginNotSupported:
+			s.SendError(w, r, nil, http.StatusBadRequest, err.Error())
+		default:
 			s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
-			return
 		}
-	}
-
-	if err := s.queries.UpdateBalance(r.Context(), database.UpdateBalanceParams{
-		u.Balance - prolongPrice,
-		u.ID,
-	}); err != nil {
-		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
 		return
 	}
 
@@ -207,57 +286,117 @@ func (s *Server) CreateService(w http.ResponseWriter, r *http.Request) {
 		prolong = 1
 	}
 
-	id, err := s.queries.CreateService(r.Context(), database.CreateServiceParams{
+	id, err := s.reservePurchase(r.Context(), database.CreateServiceParams{
 		Name:         data.Name,
 		Type:         data.Service,
 		CreatedAt:    createdAt,
 		ExpiresAt:    expiresAt,
+		PaidAt:       createdAt,
 		Prolong:      prolong,
 		ProlongPrice: prolongPrice,
 		UserID:       u.ID,
 		LocationID:   location.ID,
-	})
+		NodeID:       node.ID,
+		Quota:        price.Quota,
+	}, u.Name, data.Metadata, &price)
+	if err == errLowBalance {
+		s.SendError(w, r, nil, http.StatusForbidden, ErrorLowBalance)
+		return
+	}
 	if err != nil {
 		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
-		if err := s.queries.UpdateBalance(r.Context(), database.UpdateBalanceParams{
-			u.Balance,
-			u.ID,
-		}); err != nil {
-			s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
-			return
-		}
 		return
 	}
 
-	render.Render(w, r, &ServiceResponse{ID: id})
+	// the service is deployed in the background, its status is polled
+	render.Render(w, r, &ServiceResponse{ID: id, Status: ServicePending})
 }
 
+// CheckServices renews expired services, the ones that can't be renewed
+// are suspended until the grace period is over and deleted afterwards. The
+// nodes are updated by jobs.
 func (s *Server) CheckServices() error {
-	expired, err := s.queries.GetExpiredServices(context.TODO(), time.Now().Unix())
+	now := time.Now().Unix()
+	expired, err := s.queries.GetExpiredServices(context.TODO(), now)
 	if err != nil {
 		return err
 	}
 
-	// TODO: process concurrently from worker pool
 	for _, srv := range expired {
-		u, err := s.queries.GetUser(context.TODO(), srv.UserID)
+		err := s.withTx(context.TODO(), func(q *database.Queries) error {
+			if srv.Prolong > 0 {
+				_, err := postEntry(context.TODO(), q, srv.UserID, -srv.ProlongPrice, LedgerRenewal, serviceReference(srv.ID))
+				if err == nil {
+					if _, err := q.ProlongService(context.TODO(), database.ProlongServiceParams{
+						now, srv.ID,
+					}); err != nil {
+						return err
+					}
+					return enqueue(context.TODO(), q, JobRenew, jobKey(JobRenew, srv.ID), &renewJob{ServiceID: srv.ID})
+				}
+				if err != errLowBalance {
+					return err
+				}
+				// the saved method is charged for what is missing
+				if wait, err := s.requestAutopay(context.TODO(), q, &srv, now); err != nil || wait {
+					return err
+				}
+			}
+
+			if srv.ExpiresAt < now-s.config.GracePeriod {
+				return enqueue(context.TODO(), q, JobDelete, jobKey(JobDelete, srv.ID), &deleteJob{
+					ServiceID: srv.ID,
+					Remove:    true,
+				})
+			}
+			n, err := q.SuspendService(context.TODO(), srv.ID)
+			if err != nil || n == 0 {
+				return err
+			}
+			return enqueue(context.TODO(), q, JobSuspend, jobKey(JobSuspend, srv.ID), &suspendJob{ServiceID: srv.ID})
+		})
 		if err != nil {
 			return err
 		}
-		if srv.Prolong > 0 && u.Balance >= srv.ProlongPrice {
-			if err := s.queries.ProlongService(context.TODO(), database.ProlongServiceParams{
-				time.Now().Unix(), srv.ID,
-			}); err != nil {
+	}
+	s.wakeWorkers()
+
+	return nil
+}
+
+// syncExpirations resolves services the node stopped on its own while it
+// couldn't be reached: renewed ones are started again, the rest is deleted.
+func (s *Server) syncExpirations(node *database.ListNodesRow) error {
+	expired, err := s.client(node.Address).Expirations(context.TODO())
+	if err != nil {
+		return err
+	}
+
+	for _, e := range expired {
+		srv, err := s.queries.GetNodeService(context.TODO(), database.GetNodeServiceParams{
+			NodeID:     node.ID,
+			RemoteName: e.Name,
+		})
+		if err == sql.ErrNoRows {
+			log.Printf("node %d: removing unknown service %s", node.ID, e.Name)
+			if err := (nodeService{}).Delete(context.TODO(), s.client(node.Address), e.Name); err != nil {
 				return err
 			}
-			if err := s.queries.UpdateBalance(context.TODO(), database.UpdateBalanceParams{
-				u.Balance - srv.ProlongPrice, u.ID,
-			}); err != nil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if srv.ExpiresAt > time.Now().Unix() {
+			if err := s.client(node.Address).Renew(context.TODO(), e.Name, srv.ExpiresAt, s.config.GracePeriod); err != nil {
 				return err
 			}
 			continue
 		}
-		if err := manager.DeleteShadowsocks(srv.Address, fmt.Sprintf("%s%d", u.Name, srv.CreatedAt)); err != nil {
+
+		log.Printf("node %d: service %s expired at %d", node.ID, e.Name, e.ExpiredAt)
+		if err := serviceProvider(srv.Type).Delete(context.TODO(), s.client(node.Address), e.Name); err != nil && !errors.Is(err, manager.ErrNotFound) {
 			return err
 		}
 		if err := s.queries.DeleteService(context.TODO(), srv.ID); err != nil {
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"context"
+	"errors"
+
+	manager "github.com/demtoni/tade/internal/manager/sdk"
+)
+
+type shadowsocksProvider struct{ nodeService }
+
+func init() {
+	registerProvider("shadowsocks", shadowsocksProvider{})
+}
+
+func (shadowsocksProvider) Validate(meta map[string]interface{}) error {
+	if len(meta) == 0 {
+		return errors.New(ErrorEmptyField)
+	}
+	_, err := rotateEvery(meta)
+	return err
+}
+
+func (shadowsocksProvider) Supported(info *manager.Info, meta map[string]interface{}) error {
+	method, _ := meta["method"].(string)
+	plugin, _ := meta["plugin"].(string)
+
+	switch {
+	case method != "" && !contains(info.Methods, method):
+		return errMethodNotSupported
+	case plugin != "" && !contains(info.Plugins, plugin):
+		return errPluginNotSupported
+	}
+	return nil
+}
+
+func (shadowsocksProvider) Deploy(ctx context.Context, c *manager.Client, d *Deployment) error {
+	method, _ := d.Metadata["method"].(string)
+	plugin, _ := d.Metadata["plugin"].(string)
+	every, _ := rotateEvery(d.Metadata)
+
+	// empty acl makes the node apply default policy of the location
+	return c.DeployShadowsocks(ctx, &manager.Shadowsocks{
+		Name:        d.Name,
+		Method:      method,
+		Plugin:      plugin,
+		MaxIPs:      int(d.Price.MaxIps),
+		Quota:       d.Price.Quota,
+		QuotaMode:   d.Price.QuotaMode,
+		Anchor:      d.Anchor,
+		RotateEvery: every,
+		ExpiresAt:   d.ExpiresAt,
+		Grace:       d.Grace,
+	})
+}
+
+func (shadowsocksProvider) Config(ctx context.Context, c *manager.Client, name, _ string) (*ServiceConfig, error) {
+	cfg, err := c.GetShadowsocks(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ServiceConfig{
+		Metadata: map[string]interface{}{
+			"connect_url": cfg.ConnectURL,
+			"method":      cfg.Method,
+			"port":        cfg.Port,
+			"plugin":      cfg.Plugin,
+		},
+		Usage: &cfg.Usage,
+		URL:   cfg.URL,
+	}, nil
+}
+
+func (shadowsocksProvider) Rotate(ctx context.Context, c *manager.Client, name string) (*manager.Rotation, error) {
+	return c.Rotate(ctx, name)
+}
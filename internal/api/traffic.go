@@ -0,0 +1,179 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/demtoni/tade/internal/database"
+	manager "github.com/demtoni/tade/internal/manager/sdk"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+)
+
+const JobTraffic = "traffic"
+
+// trafficJob sends the packs again when the node didn't answer the
+// purchase, the node adds the traffic of the same key once.
+type trafficJob struct {
+	ServiceID int64  `json:"service_id"`
+	Quota     int64  `json:"quota"`
+	Extra     int64  `json:"extra"`
+	Amount    int64  `json:"amount"`
+	Key       string `json:"key"`
+}
+
+func init() {
+	registerJob(JobTraffic, &jobHandler{
+		run:         (*Server).runTraffic,
+		dead:        (*Server).failTraffic,
+		maxAttempts: 10,
+	})
+}
+
+type TrafficResponse struct {
+	Quota     int64 `json:"quota"`
+	Used      int64 `json:"used"`
+	Remaining int64 `json:"remaining"`
+	ResetAt   int64 `json:"reset_at,omitempty"`
+	Limited   bool  `json:"limited,omitempty"`
+}
+
+type TrafficRequest struct {
+	Packs int64 `json:"packs"`
+}
+
+func (r *TrafficRequest) Bind(_ *http.Request) error {
+	if r.Packs <= 0 {
+		return errors.New(ErrorBadTrafficPacks)
+	}
+	return nil
+}
+
+// BuyTraffic adds traffic packs to the current billing period of the
+// service, unused traffic is lost once the quota is reset. It answers 202
+// when the node didn't respond and the packs are delivered by a job.
+func (s *Server) BuyTraffic(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value("user").(*database.User)
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorServiceNotFound)
+		return
+	}
+
+	data := &TrafficRequest{}
+	if err := render.Bind(r, data); err != nil {
+		s.SendError(w, r, nil, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	service, err := s.queries.GetService(r.Context(), database.GetServiceParams{
+		ID:     int64(id),
+		UserID: u.ID,
+	})
+	if err != nil {
+		s.SendError(w, r, nil, http.StatusNotFound, ErrorServiceNotFound)
+		return
+	}
+
+	if service.Status != ServiceActive {
+		s.SendError(w, r, nil, http.StatusConflict, ErrorServiceNotActive)
+		return
+	}
+
+	price, err := s.queries.GetPrice(r.Context(), service.Type)
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+	if service.Quota == 0 || price.TrafficPackSize == 0 {
+		s.SendError(w, r, nil, http.StatusBadRequest, ErrorNoTrafficPacks)
+		return
+	}
+
+	amount := price.TrafficPackPrice * data.Packs
+	if amount > u.Balance {
+		s.SendError(w, r, nil, http.StatusForbidden, ErrorLowBalance)
+		return
+	}
+
+	if service.Online == 0 {
+		s.SendError(w, r, nil, http.StatusServiceUnavailable, ErrorLocationUnavailable)
+		return
+	}
+
+	reference := serviceReference(service.ID)
+	err = s.post(r.Context(), u.ID, -amount, LedgerTraffic, reference)
+	if err == errLowBalance {
+		s.SendError(w, r, nil, http.StatusForbidden, ErrorLowBalance)
+		return
+	}
+	if err != nil {
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	job := &trafficJob{
+		ServiceID: service.ID,
+		Quota:     service.Quota,
+		Extra:     price.TrafficPackSize * data.Packs,
+		Amount:    amount,
+		Key:       uuid.NewString(),
+	}
+	err = s.client(service.Address).UpdateQuota(r.Context(), service.RemoteName, job.Quota, job.Extra, job.Key)
+	// the node may have added the traffic and the response got lost, so
+	// the packs are delivered later instead of being refunded
+	if errors.Is(err, manager.ErrUnavailable) {
+		if err = s.enqueue(context.TODO(), JobTraffic, JobTraffic+":"+job.Key, job); err == nil {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+	}
+	if err != nil {
+		if err := s.post(context.TODO(), u.ID, amount, LedgerRefund, reference); err != nil {
+			log.Printf("couldn't refund traffic of service %d: %s", service.ID, err)
+		}
+		s.SendError(w, r, err, http.StatusInternalServerError, ErrorInternal)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+}
+
+func (s *Server) runTraffic(ctx context.Context, payload []byte) error {
+	job := &trafficJob{}
+	if err := json.Unmarshal(payload, job); err != nil {
+		return permanent(err)
+	}
+
+	srv, err := s.queries.GetServiceNode(ctx, job.ServiceID)
+	if err != nil {
+		return err
+	}
+
+	err = s.client(srv.Address).UpdateQuota(ctx, srv.RemoteName, job.Quota, job.Extra, job.Key)
+	if err != nil && !errors.Is(err, manager.ErrUnavailable) {
+		return permanent(err)
+	}
+	return err
+}
+
+// failTraffic refunds the packs the node never confirmed.
+func (s *Server) failTraffic(ctx context.Context, q *database.Queries, payload []byte) error {
+	job := &trafficJob{}
+	if err := json.Unmarshal(payload, job); err != nil {
+		return err
+	}
+
+	srv, err := q.GetServiceNode(ctx, job.ServiceID)
+	if err != nil {
+		return err
+	}
+	_, err = postEntry(ctx, q, srv.UserID, job.Amount, LedgerRefund, serviceReference(srv.ID))
+	return err
+}
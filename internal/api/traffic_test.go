@@ -0,0 +1,54 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestRunTraffic(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		failures int
+		status   string
+		extra    int64
+		balance  int64
+	}{
+		{"delivered", 1, "done", 50, 0},
+		{"refunded", 1000, "dead", 0, 30},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			m, user, id := purchaseTestService(t, s)
+			runJobs(t, s)
+
+			// what BuyTraffic leaves when the node doesn't answer
+			key := JobTraffic + ":pack"
+			if err := s.enqueue(context.Background(), JobTraffic, key, &trafficJob{
+				ServiceID: id,
+				Quota:     100,
+				Extra:     50,
+				Amount:    30,
+				Key:       "pack",
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			m.Fail(tt.failures)
+			for i := 0; i < 10; i++ {
+				runJobs(t, s)
+			}
+			m.Fail(0)
+
+			if status := jobStatus(t, s, key); status != tt.status {
+				t.Errorf("traffic job is %s, want %s", status, tt.status)
+			}
+			if srv := m.Service(fmt.Sprintf("alice-%d", id)); srv.Extra != tt.extra {
+				t.Errorf("extra traffic is %d, want %d", srv.Extra, tt.extra)
+			}
+			if b := balanceOf(t, s, user); b != tt.balance {
+				t.Errorf("balance is %d, want %d", b, tt.balance)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"context"
+	manager "github.com/demtoni/tade/internal/manager/sdk"
+)
+
+type wireguardProvider struct{ nodeService }
+
+func init() {
+	registerProvider("wireguard", wireguardProvider{})
+}
+
+func (wireguardProvider) Validate(_ map[string]interface{}) error {
+	return nil
+}
+
+func (wireguardProvider) Deploy(ctx context.Context, c *manager.Client, d *Deployment) error {
+	return c.DeployWireGuard(ctx, &manager.WireGuard{
+		Name:      d.Name,
+		Quota:     d.Price.Quota,
+		Anchor:    d.Anchor,
+		ExpiresAt: d.ExpiresAt,
+		Grace:     d.Grace,
+	})
+}
+
+func (wireguardProvider) Config(ctx context.Context, c *manager.Client, name, _ string) (*ServiceConfig, error) {
+	cfg, err := c.GetWireGuard(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ServiceConfig{
+		Metadata: map[string]interface{}{
+			"address":    cfg.Address,
+			"public_key": cfg.PublicKey,
+			"port":       cfg.Port,
+		},
+		Usage: &cfg.Usage,
+		URL:   cfg.Endpoint,
+		Endpoint: func(meta map[string]interface{}, host string) {
+			conf := cfg.Conf(host)
+			meta["host"] = host
+			meta["conf"] = conf
+			if qr := qrCode(conf); qr != "" {
+				meta["qr"] = qr
+			}
+		},
+	}, nil
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"context"
+	"errors"
+
+	manager "github.com/demtoni/tade/internal/manager/sdk"
+)
+
+type xrayProvider struct{ nodeService }
+
+func init() {
+	registerProvider("xray", xrayProvider{})
+}
+
+func xrayProtocol(meta map[string]interface{}) string {
+	if protocol, _ := meta["protocol"].(string); protocol != "" {
+		return protocol
+	}
+	return "vless"
+}
+
+func (xrayProvider) Validate(meta map[string]interface{}) error {
+	switch xrayProtocol(meta) {
+	case "vless", "vmess":
+		return nil
+	}
+	return errors.New(ErrorBadProtocol)
+}
+
+func (xrayProvider) Deploy(ctx context.Context, c *manager.Client, d *Deployment) error {
+	return c.DeployXray(ctx, &manager.Xray{
+		Name:      d.Name,
+		Protocol:  xrayProtocol(d.Metadata),
+		Quota:     d.Price.Quota,
+		Anchor:    d.Anchor,
+		ExpiresAt: d.ExpiresAt,
+		Grace:     d.Grace,
+	})
+}
+
+func (xrayProvider) Config(ctx context.Context, c *manager.Client, name, label string) (*ServiceConfig, error) {
+	cfg, err := c.GetXray(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := map[string]interface{}{
+		"protocol": cfg.Protocol,
+		"uuid":     cfg.UUID,
+		"port":     cfg.Port,
+	}
+	if cfg.Security != "" {
+		meta["security"] = cfg.Security
+	}
+
+	return &ServiceConfig{
+		Metadata: meta,
+		Usage:    &cfg.Usage,
+		URL:      func(host string) string { return cfg.Link(host, label) },
+		Endpoint: func(meta map[string]interface{}, host string) {
+			meta["host"] = host
+			if qr := qrCode(cfg.Link(host, label)); qr != "" {
+				meta["qr"] = qr
+			}
+		},
+	}, nil
+}
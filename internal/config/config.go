@@ -1,24 +1,178 @@
 package config
 
-import "os"
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// seconds nodes keep expired services running before stopping them on
+// their own
+const defaultGracePeriod = 86400
+
+const defaultJobWorkers = 4
+
+const defaultPaymentProvider = "yookassa"
+
+// most a saved payment method is charged in a month unless the user lowers
+// it
+const defaultAutopayLimit = 3000
+
+// fiscal receipt items describe top-ups with these unless set
+const (
+	defaultReceiptDescription = "Пополнение баланса"
+	// without VAT
+	defaultReceiptVatCode        = 1
+	defaultReceiptPaymentSubject = "service"
+	defaultReceiptPaymentMode    = "full_prepayment"
+)
+
+// what customers get back when they cancel a service
+const (
+	// nothing
+	RefundNone = "none"
+	// the part of the price paid for the time left
+	RefundProrated = "prorated"
+)
 
 type Config struct {
 	ServerAddr    string
 	PathToDB      string
 	SessionSecret string
 	Domain        string
-	YooShopID     string
-	YooApiKey     string
+	// address the server is reachable at from the outside
+	PublicURL string
+	// either yookassa or sandbox, the latter doesn't charge anything
+	PaymentProvider string
+	YooShopID       string
+	YooApiKey       string
+	// networks YooKassa sends notifications from, the official list is
+	// used if empty
+	YooWebhookIPs []string
+	// client address is taken from X-Forwarded-For set by the reverse proxy
+	TrustProxy  bool
+	GracePeriod int64
+	// number of background jobs run at once
+	JobWorkers int
+	// events about services are posted there if set
+	NotifyURL string
+	// either RefundNone or RefundProrated
+	RefundPolicy string
+	// percent of the prorated refund that is kept
+	RefundFee int64
+	// upper bound of the monthly limit of automatic top-ups
+	AutopayLimit int64
+	// fiscal receipts are attached to payments and refunds, customers have
+	// to give an email or phone
+	Receipts           bool
+	ReceiptDescription string
+	// vat_code of YooKassa, 1-12
+	ReceiptVatCode        int
+	ReceiptPaymentSubject string
+	ReceiptPaymentMode    string
+	// tax_system_code of YooKassa, 1-6, left out if zero
+	ReceiptTaxSystem int
 }
 
 func New() (*Config, error) {
 	// TODO: Error-check config parameters
+	grace, err := strconv.ParseInt(os.Getenv("SERVICE_GRACE_PERIOD"), 10, 64)
+	if err != nil {
+		grace = defaultGracePeriod
+	}
+	workers, err := strconv.Atoi(os.Getenv("JOB_WORKERS"))
+	if err != nil || workers <= 0 {
+		workers = defaultJobWorkers
+	}
+
+	provider := os.Getenv("PAYMENT_PROVIDER")
+	if provider == "" {
+		provider = defaultPaymentProvider
+	}
+
+	refundPolicy := os.Getenv("REFUND_POLICY")
+	switch refundPolicy {
+	case "":
+		refundPolicy = RefundProrated
+	case RefundNone, RefundProrated:
+	default:
+		return nil, fmt.Errorf("unknown refund policy %q", refundPolicy)
+	}
+	refundFee, err := strconv.ParseInt(os.Getenv("REFUND_FEE"), 10, 64)
+	if err != nil || refundFee < 0 || refundFee > 100 {
+		refundFee = 0
+	}
+
+	autopayLimit, err := strconv.ParseInt(os.Getenv("AUTOPAY_LIMIT"), 10, 64)
+	if err != nil || autopayLimit < 0 {
+		autopayLimit = defaultAutopayLimit
+	}
+
+	receiptDescription := os.Getenv("RECEIPT_DESCRIPTION")
+	if receiptDescription == "" {
+		receiptDescription = defaultReceiptDescription
+	}
+	receiptVatCode := defaultReceiptVatCode
+	if v := os.Getenv("RECEIPT_VAT_CODE"); v != "" {
+		receiptVatCode, err = strconv.Atoi(v)
+		if err != nil || receiptVatCode < 1 || receiptVatCode > 12 {
+			return nil, fmt.Errorf("invalid receipt vat code %q", v)
+		}
+	}
+	receiptSubject := os.Getenv("RECEIPT_PAYMENT_SUBJECT")
+	if receiptSubject == "" {
+		receiptSubject = defaultReceiptPaymentSubject
+	}
+	receiptMode := os.Getenv("RECEIPT_PAYMENT_MODE")
+	if receiptMode == "" {
+		receiptMode = defaultReceiptPaymentMode
+	}
+	var receiptTaxSystem int
+	if v := os.Getenv("RECEIPT_TAX_SYSTEM"); v != "" {
+		receiptTaxSystem, err = strconv.Atoi(v)
+		if err != nil || receiptTaxSystem < 1 || receiptTaxSystem > 6 {
+			return nil, fmt.Errorf("invalid receipt tax system %q", v)
+		}
+	}
+
+	addr := os.Getenv("SERVER_ADDR")
+	publicURL := strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+	if publicURL == "" {
+		host := addr
+		if strings.HasPrefix(host, ":") {
+			host = "localhost" + host
+		}
+		publicURL = "http://" + host
+	}
+
+	var webhookIPs []string
+	if v := os.Getenv("YOO_WEBHOOK_IPS"); v != "" {
+		webhookIPs = strings.Split(v, ",")
+	}
+
 	return &Config{
-		ServerAddr:    os.Getenv("SERVER_ADDR"),
-		PathToDB:      os.Getenv("DB_PATH"),
-		SessionSecret: os.Getenv("SESSION_SECRET"),
-		Domain:        os.Getenv("DOMAIN_NAME"),
-		YooApiKey:     os.Getenv("YOO_API_KEY"),
-		YooShopID:     os.Getenv("YOO_SHOP_ID"),
+		ServerAddr:            addr,
+		PathToDB:              os.Getenv("DB_PATH"),
+		SessionSecret:         os.Getenv("SESSION_SECRET"),
+		Domain:                os.Getenv("DOMAIN_NAME"),
+		PublicURL:             publicURL,
+		PaymentProvider:       provider,
+		YooApiKey:             os.Getenv("YOO_API_KEY"),
+		YooShopID:             os.Getenv("YOO_SHOP_ID"),
+		YooWebhookIPs:         webhookIPs,
+		TrustProxy:            os.Getenv("TRUST_PROXY") != "",
+		GracePeriod:           grace,
+		JobWorkers:            workers,
+		NotifyURL:             os.Getenv("NOTIFY_URL"),
+		RefundPolicy:          refundPolicy,
+		RefundFee:             refundFee,
+		AutopayLimit:          autopayLimit,
+		Receipts:              os.Getenv("RECEIPTS") != "",
+		ReceiptDescription:    receiptDescription,
+		ReceiptVatCode:        receiptVatCode,
+		ReceiptPaymentSubject: receiptSubject,
+		ReceiptPaymentMode:    receiptMode,
+		ReceiptTaxSystem:      receiptTaxSystem,
 	}, nil
 }
@@ -0,0 +1,264 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/demtoni/tade/sql/migrations"
+)
+
+// ErrSchemaTooNew is returned when the database was migrated by a newer
+// binary, running against it could corrupt the data.
+var ErrSchemaTooNew = errors.New("database schema is newer than the binary")
+
+var migrationFile = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus describes the migration and when it was applied, zero
+// AppliedAt means it is pending.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt int64
+}
+
+// Migrator applies the embedded migrations, the applied versions are kept
+// in the schema_migrations table.
+type Migrator struct {
+	db         *sql.DB
+	migrations []*Migration
+}
+
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	list, err := loadMigrations(migrations.FS)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: list}, nil
+}
+
+func loadMigrations(fsys fs.FS) ([]*Migration, error) {
+	files, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration, 0)
+	for _, f := range files {
+		m := migrationFile.FindStringSubmatch(f.Name())
+		if m == nil {
+			continue
+		}
+		version, _ := strconv.Atoi(m[1])
+
+		data, err := fs.ReadFile(fsys, f.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has different names: %s and %s", version, migration.Name, m[2])
+		}
+		if m[3] == "up" {
+			migration.Up = string(data)
+		} else {
+			migration.Down = string(data)
+		}
+	}
+
+	list := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both up and down files", m.Version, m.Name)
+		}
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+
+	for i, m := range list {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing", i+1)
+		}
+	}
+
+	return list, nil
+}
+
+// Latest returns the version the binary expects.
+func (m *Migrator) Latest() int {
+	return len(m.migrations)
+}
+
+func (m *Migrator) init(ctx context.Context) error {
+	_, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at INTEGER NOT NULL
+)`)
+	return err
+}
+
+// Version returns the last applied version, 0 for an empty database.
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	if err := m.init(ctx); err != nil {
+		return 0, err
+	}
+
+	var version int
+	err := m.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// Up applies every pending migration, each one in its own transaction.
+func (m *Migrator) Up(ctx context.Context) ([]*Migration, error) {
+	version, err := m.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if version > m.Latest() {
+		return nil, fmt.Errorf("%w: %d > %d", ErrSchemaTooNew, version, m.Latest())
+	}
+
+	if version == 0 {
+		if version, err = m.baseline(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	applied := make([]*Migration, 0)
+	for _, migration := range m.migrations[version:] {
+		err := m.apply(ctx, migration.Up, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+				migration.Version, migration.Name, time.Now().Unix())
+			return err
+		})
+		if err != nil {
+			return applied, fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		applied = append(applied, migration)
+	}
+
+	return applied, nil
+}
+
+// baseline records the first migration as applied when the database was
+// created from the schema that preceded migrations, it returns the version
+// to continue from.
+func (m *Migrator) baseline(ctx context.Context) (int, error) {
+	var tables int
+	err := m.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'users'").Scan(&tables)
+	if err != nil || tables == 0 {
+		return 0, err
+	}
+
+	first := m.migrations[0]
+	_, err = m.db.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+		first.Version, first.Name, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	return first.Version, nil
+}
+
+// Down reverts the last applied migration, nil is returned for an empty
+// database.
+func (m *Migrator) Down(ctx context.Context) (*Migration, error) {
+	version, err := m.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if version > m.Latest() {
+		return nil, fmt.Errorf("%w: %d > %d", ErrSchemaTooNew, version, m.Latest())
+	}
+	if version == 0 {
+		return nil, nil
+	}
+
+	migration := m.migrations[version-1]
+	err = m.apply(ctx, migration.Down, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = ?", migration.Version)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+	}
+
+	return migration, nil
+}
+
+func (m *Migrator) apply(ctx context.Context, script string, record func(tx *sql.Tx) error) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if err := record(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Status lists every known migration along with the time it was applied.
+func (m *Migrator) Status(ctx context.Context) ([]*MigrationStatus, error) {
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+
+	rows, err := m.db.QueryContext(ctx, "SELECT version, name, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]*MigrationStatus, 0)
+	for rows.Next() {
+		s := &MigrationStatus{}
+		if err := rows.Scan(&s.Version, &s.Name, &s.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied[s.Version] = s
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	list := make([]*MigrationStatus, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		s := &MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if a, ok := applied[migration.Version]; ok {
+			s.AppliedAt = a.AppliedAt
+			delete(applied, migration.Version)
+		}
+		list = append(list, s)
+	}
+	// applied by a newer binary
+	for _, s := range applied {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+
+	return list, nil
+}
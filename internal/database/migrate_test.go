@@ -0,0 +1,202 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func newTestMigrator(t *testing.T) (*Migrator, *sql.DB) {
+	t.Helper()
+
+	db, err := Open(filepath.Join(t.TempDir(), "db.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	m, err := NewMigrator(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, db
+}
+
+func checkVersion(t *testing.T, m *Migrator, want int) {
+	t.Helper()
+
+	version, err := m.Version(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != want {
+		t.Fatalf("version is %d, want %d", version, want)
+	}
+}
+
+func TestMigratorUpDown(t *testing.T) {
+	m, _ := newTestMigrator(t)
+	ctx := context.Background()
+
+	applied, err := m.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != m.Latest() {
+		t.Fatalf("applied %d migrations, want %d", len(applied), m.Latest())
+	}
+	checkVersion(t, m, m.Latest())
+
+	// nothing is left to apply
+	if applied, err = m.Up(ctx); err != nil || len(applied) != 0 {
+		t.Fatalf("second run applied %d migrations: %v", len(applied), err)
+	}
+
+	for version := m.Latest(); version > 0; version-- {
+		migration, err := m.Down(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if migration.Version != version {
+			t.Fatalf("reverted %d, want %d", migration.Version, version)
+		}
+	}
+	checkVersion(t, m, 0)
+	if migration, err := m.Down(ctx); migration != nil || err != nil {
+		t.Fatalf("empty database was reverted: %v, %v", migration, err)
+	}
+
+	// the down migrations leave nothing behind
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, m, m.Latest())
+}
+
+func TestMigratorStatus(t *testing.T) {
+	m, _ := newTestMigrator(t)
+	ctx := context.Background()
+
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Down(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != m.Latest() {
+		t.Fatalf("listed %d migrations, want %d", len(list), m.Latest())
+	}
+	for i, s := range list {
+		if s.Version != i+1 {
+			t.Errorf("migration %d is listed as %d", i+1, s.Version)
+		}
+		pending := s.Version == m.Latest()
+		if (s.AppliedAt == 0) != pending {
+			t.Errorf("migration %d_%s applied at %d", s.Version, s.Name, s.AppliedAt)
+		}
+	}
+}
+
+func TestMigratorTooNew(t *testing.T) {
+	m, db := newTestMigrator(t)
+	ctx := context.Background()
+
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	newer := m.Latest() + 1
+	if _, err := db.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, 'newer', 1)", newer); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Up(ctx); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("up: got %v, want %v", err, ErrSchemaTooNew)
+	}
+	if _, err := m.Down(ctx); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("down: got %v, want %v", err, ErrSchemaTooNew)
+	}
+	checkVersion(t, m, newer)
+
+	list, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := list[len(list)-1]; last.Version != newer || last.Name != "newer" {
+		t.Errorf("migration of the newer binary is listed as %d_%s", last.Version, last.Name)
+	}
+}
+
+// Databases created before migrations existed have the schema of the first
+// one already.
+func TestMigratorBaseline(t *testing.T) {
+	m, db := newTestMigrator(t)
+	ctx := context.Background()
+
+	if _, err := db.Exec(m.migrations[0].Up); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO users (name, password_hash, balance, invites) VALUES ('alice', 'hash', 100, 0)"); err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := m.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != m.Latest()-1 {
+		t.Fatalf("applied %d migrations, want %d", len(applied), m.Latest()-1)
+	}
+	if applied[0].Version != 2 {
+		t.Fatalf("applied migrations start from %d", applied[0].Version)
+	}
+	checkVersion(t, m, m.Latest())
+
+	var balance int64
+	if err := db.QueryRow("SELECT balance FROM users WHERE name = 'alice'").Scan(&balance); err != nil {
+		t.Fatal(err)
+	}
+	if balance != 100 {
+		t.Errorf("balance is %d, want 100", balance)
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	file := &fstest.MapFile{Data: []byte("SELECT 1;")}
+
+	for name, fsys := range map[string]fstest.MapFS{
+		"gap": {
+			"0001_init.up.sql": file, "0001_init.down.sql": file,
+			"0003_next.up.sql": file, "0003_next.down.sql": file,
+		},
+		"no down": {
+			"0001_init.up.sql": file,
+		},
+		"names differ": {
+			"0001_init.up.sql": file, "0001_other.down.sql": file,
+		},
+	} {
+		if _, err := loadMigrations(fsys); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+
+	list, err := loadMigrations(fstest.MapFS{
+		"0002_next.up.sql": file, "0002_next.down.sql": file,
+		"0001_init.up.sql": file, "0001_init.down.sql": file,
+		"migrations.go": file,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "init" || list[1].Name != "next" {
+		t.Errorf("loaded %v", list)
+	}
+}
@@ -4,6 +4,26 @@
 
 package database
 
+type AclPolicy struct {
+	ID           int64
+	LocationID   int64
+	Name         string
+	BlockedPorts string
+	Cidrs        string
+	Domains      string
+}
+
+type AutopayCharge struct {
+	ID        int64
+	UserID    int64
+	ServiceID int64
+	ExpiresAt int64
+	Amount    int64
+	PaymentID string
+	Status    string
+	CreatedAt int64
+}
+
 type Invite struct {
 	ID     int64
 	Code   string
@@ -11,9 +31,107 @@ type Invite struct {
 	UserID int64
 }
 
+type Job struct {
+	ID          int64
+	Kind        string
+	UniqueKey   string
+	Payload     string
+	Status      string
+	Attempts    int64
+	MaxAttempts int64
+	RunAt       int64
+	LastError   string
+	CreatedAt   int64
+	UpdatedAt   int64
+}
+
+type JoinToken struct {
+	ID        int64
+	Token     string
+	Location  string
+	Used      int64
+	CreatedAt int64
+	ExpiresAt int64
+}
+
+type LedgerEntry struct {
+	ID        int64
+	UserID    int64
+	Amount    int64
+	Balance   int64
+	Reason    string
+	Reference string
+	CreatedAt int64
+}
+
+type LocationHostname struct {
+	ID         int64
+	LocationID int64
+	Kind       string
+	Hostname   string
+}
+
+type Node struct {
+	ID           int64
+	LocationID   int64
+	Address      string
+	HeartbeatKey string
+	LastSeen     int64
+	Online       int64
+	Weight       int64
+	Draining     int64
+}
+
+type NodeCheck struct {
+	ID        int64
+	NodeID    int64
+	Timestamp int64
+	Up        int64
+	Latency   int64
+}
+
+type NodeHostname struct {
+	ID       int64
+	NodeID   int64
+	Kind     string
+	Hostname string
+}
+
+type PaymentMethod struct {
+	ID           int64
+	UserID       int64
+	Provider     string
+	MethodID     string
+	Title        string
+	MonthlyLimit int64
+	CreatedAt    int64
+}
+
+type ReconciliationIssue struct {
+	ID        int64
+	ReportID  int64
+	PaymentID string
+	Kind      string
+	Detail    string
+	Fixed     int64
+}
+
+type ReconciliationReport struct {
+	ID           int64
+	Provider     string
+	PeriodStart  int64
+	PeriodEnd    int64
+	Payments     int64
+	Transactions int64
+	Fixed        int64
+	Flagged      int64
+	CreatedAt    int64
+}
+
 type Service struct {
 	ID           int64
 	Name         string
+	RemoteName   string
 	Type         string
 	CreatedAt    int64
 	ExpiresAt    int64
@@ -21,34 +139,48 @@ type Service struct {
 	ProlongPrice int64
 	UserID       int64
 	LocationID   int64
+	NodeID       int64
+	Quota        int64
+	RotatedAt    int64
+	Status       string
+	PaidAt       int64
 }
 
 type ServiceLocation struct {
-	ID       int64
-	Name     string
-	Address  string
-	Services string
+	ID   int64
+	Name string
 }
 
 type ServicePrice struct {
-	Amount int64
-	Type   string
+	Amount           int64
+	Type             string
+	MaxIps           int64
+	Quota            int64
+	QuotaMode        string
+	TrafficPackSize  int64
+	TrafficPackPrice int64
 }
 
 type Transaction struct {
-	ID        int64
-	PaymentID string
-	Amount    int64
-	Status    string
-	Timestamp int64
-	Url       string
-	UserID    int64
+	ID             int64
+	PaymentID      string
+	Amount         int64
+	Status         string
+	Timestamp      int64
+	Url            string
+	UserID         int64
+	Provider       string
+	Refunded       int64
+	Receipt        string
+	ReceiptContact string
 }
 
 type User struct {
-	ID           int64
-	Name         string
-	PasswordHash string
-	Balance      int64
-	Invites      int64
+	ID             int64
+	Name           string
+	PasswordHash   string
+	Balance        int64
+	Invites        int64
+	Admin          int64
+	ReceiptContact string
 }
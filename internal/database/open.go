@@ -0,0 +1,22 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// Open opens the sqlite database at path. Background jobs and node
+// callbacks write concurrently, every connection waits for the lock instead
+// of failing right away.
+func Open(path string) (*sql.DB, error) {
+	dsn := path
+	if strings.Contains(dsn, "?") {
+		dsn += "&_pragma=busy_timeout(5000)"
+	} else {
+		dsn += "?_pragma=busy_timeout(5000)"
+	}
+
+	return sql.Open("sqlite", dsn)
+}
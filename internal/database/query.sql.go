@@ -7,38 +7,245 @@ package database
 
 import (
 	"context"
-	"database/sql"
 )
 
-const cancelExpiredTransactions = `-- name: CancelExpiredTransactions :many
-UPDATE transactions
-SET status = 'canceled'
-WHERE timestamp < ?
-AND status = 'in_process'
-RETURNING payment_id
+const activateService = `-- name: ActivateService :execrows
+UPDATE services SET status = 'active'
+WHERE id = ? AND status = 'pending'
 `
 
-func (q *Queries) CancelExpiredTransactions(ctx context.Context, timestamp int64) ([]string, error) {
-	rows, err := q.db.QueryContext(ctx, cancelExpiredTransactions, timestamp)
+func (q *Queries) ActivateService(ctx context.Context, id int64) (int64, error) {
+	result, err := q.db.ExecContext(ctx, activateService, id)
 	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	var items []string
-	for rows.Next() {
-		var payment_id string
-		if err := rows.Scan(&payment_id); err != nil {
-			return nil, err
-		}
-		items = append(items, payment_id)
-	}
-	if err := rows.Close(); err != nil {
-		return nil, err
+		return 0, err
 	}
-	if err := rows.Err(); err != nil {
-		return nil, err
+	return result.RowsAffected()
+}
+
+const addBalance = `-- name: AddBalance :one
+UPDATE users
+SET balance = balance + ?1
+WHERE id = ?2 AND balance + ?1 >= 0
+RETURNING balance
+`
+
+type AddBalanceParams struct {
+	Amount int64
+	ID     int64
+}
+
+func (q *Queries) AddBalance(ctx context.Context, arg AddBalanceParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, addBalance, arg.Amount, arg.ID)
+	var balance int64
+	err := row.Scan(&balance)
+	return balance, err
+}
+
+const cancelJob = `-- name: CancelJob :execrows
+UPDATE jobs
+SET status = 'canceled', updated_at = ?
+WHERE id = ? AND status = 'queued'
+`
+
+type CancelJobParams struct {
+	UpdatedAt int64
+	ID        int64
+}
+
+func (q *Queries) CancelJob(ctx context.Context, arg CancelJobParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, cancelJob, arg.UpdatedAt, arg.ID)
+	if err != nil {
+		return 0, err
 	}
-	return items, nil
+	return result.RowsAffected()
+}
+
+const cancelService = `-- name: CancelService :one
+UPDATE services SET status = 'canceled'
+WHERE id = ? AND user_id = ? AND status IN ('active', 'suspended')
+RETURNING id, name, remote_name, type, created_at, expires_at, prolong, prolong_price, user_id, location_id, node_id, quota, rotated_at, status, paid_at
+`
+
+type CancelServiceParams struct {
+	ID     int64
+	UserID int64
+}
+
+func (q *Queries) CancelService(ctx context.Context, arg CancelServiceParams) (Service, error) {
+	row := q.db.QueryRowContext(ctx, cancelService, arg.ID, arg.UserID)
+	var i Service
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.RemoteName,
+		&i.Type,
+		&i.CreatedAt,
+		&i.ExpiresAt,
+		&i.Prolong,
+		&i.ProlongPrice,
+		&i.UserID,
+		&i.LocationID,
+		&i.NodeID,
+		&i.Quota,
+		&i.RotatedAt,
+		&i.Status,
+		&i.PaidAt,
+	)
+	return i, err
+}
+
+const cancelTransaction = `-- name: CancelTransaction :exec
+UPDATE transactions
+SET status = 'canceled'
+WHERE payment_id = ? AND status = 'in_process'
+`
+
+func (q *Queries) CancelTransaction(ctx context.Context, paymentID string) error {
+	_, err := q.db.ExecContext(ctx, cancelTransaction, paymentID)
+	return err
+}
+
+const chargeBalance = `-- name: ChargeBalance :one
+UPDATE users
+SET balance = balance + ?1
+WHERE id = ?2
+RETURNING balance
+`
+
+type ChargeBalanceParams struct {
+	Amount int64
+	ID     int64
+}
+
+func (q *Queries) ChargeBalance(ctx context.Context, arg ChargeBalanceParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, chargeBalance, arg.Amount, arg.ID)
+	var balance int64
+	err := row.Scan(&balance)
+	return balance, err
+}
+
+const claimJob = `-- name: ClaimJob :one
+UPDATE jobs
+SET status = 'running', attempts = attempts + 1, updated_at = ?1
+WHERE id = (
+	SELECT id FROM jobs
+	WHERE status = 'queued' AND run_at <= ?1
+	ORDER BY run_at, id
+	LIMIT 1
+)
+RETURNING id, kind, unique_key, payload, status, attempts, max_attempts, run_at, last_error, created_at, updated_at
+`
+
+func (q *Queries) ClaimJob(ctx context.Context, now int64) (Job, error) {
+	row := q.db.QueryRowContext(ctx, claimJob, now)
+	var i Job
+	err := row.Scan(
+		&i.ID,
+		&i.Kind,
+		&i.UniqueKey,
+		&i.Payload,
+		&i.Status,
+		&i.Attempts,
+		&i.MaxAttempts,
+		&i.RunAt,
+		&i.LastError,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
+const completeTransaction = `-- name: CompleteTransaction :one
+UPDATE transactions
+SET status = 'completed'
+WHERE payment_id = ? AND status IN ('in_process', 'canceled')
+RETURNING user_id, amount
+`
+
+type CompleteTransactionRow struct {
+	UserID int64
+	Amount int64
+}
+
+func (q *Queries) CompleteTransaction(ctx context.Context, paymentID string) (CompleteTransactionRow, error) {
+	row := q.db.QueryRowContext(ctx, completeTransaction, paymentID)
+	var i CompleteTransactionRow
+	err := row.Scan(&i.UserID, &i.Amount)
+	return i, err
+}
+
+const countLedgerEntries = `-- name: CountLedgerEntries :one
+SELECT COUNT(*) FROM ledger_entries
+WHERE reason = ? AND reference = ?
+`
+
+type CountLedgerEntriesParams struct {
+	Reason    string
+	Reference string
+}
+
+func (q *Queries) CountLedgerEntries(ctx context.Context, arg CountLedgerEntriesParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, countLedgerEntries, arg.Reason, arg.Reference)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const countNodeFailures = `-- name: CountNodeFailures :one
+SELECT COUNT(*) FROM node_checks c
+WHERE c.node_id = ?1 AND c.up = FALSE AND c.id > (
+	SELECT CAST(COALESCE(MAX(u.id), 0) AS INTEGER) FROM node_checks u
+	WHERE u.node_id = ?1 AND u.up = TRUE
+)
+`
+
+func (q *Queries) CountNodeFailures(ctx context.Context, nodeID int64) (int64, error) {
+	row := q.db.QueryRowContext(ctx, countNodeFailures, nodeID)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const countUnrecordedAutopayCharges = `-- name: CountUnrecordedAutopayCharges :one
+SELECT COUNT(*) FROM autopay_charges
+WHERE payment_id = '' AND status = 'pending' AND amount = ?
+`
+
+func (q *Queries) CountUnrecordedAutopayCharges(ctx context.Context, amount int64) (int64, error) {
+	row := q.db.QueryRowContext(ctx, countUnrecordedAutopayCharges, amount)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const createAutopayCharge = `-- name: CreateAutopayCharge :one
+INSERT INTO autopay_charges (
+	user_id, service_id, expires_at, amount, status, created_at
+) VALUES (
+	?, ?, ?, ?, 'pending', ?
+)
+RETURNING id
+`
+
+type CreateAutopayChargeParams struct {
+	UserID    int64
+	ServiceID int64
+	ExpiresAt int64
+	Amount    int64
+	CreatedAt int64
+}
+
+func (q *Queries) CreateAutopayCharge(ctx context.Context, arg CreateAutopayChargeParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, createAutopayCharge,
+		arg.UserID,
+		arg.ServiceID,
+		arg.ExpiresAt,
+		arg.Amount,
+		arg.CreatedAt,
+	)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
 }
 
 const createInvite = `-- name: CreateInvite :exec
@@ -60,17 +267,245 @@ func (q *Queries) CreateInvite(ctx context.Context, arg CreateInviteParams) erro
 	return err
 }
 
+const createJoinToken = `-- name: CreateJoinToken :exec
+INSERT INTO join_tokens (
+	token, location, used, created_at, expires_at
+) VALUES (
+	?, ?, FALSE, ?, ?
+)
+`
+
+type CreateJoinTokenParams struct {
+	Token     string
+	Location  string
+	CreatedAt int64
+	ExpiresAt int64
+}
+
+func (q *Queries) CreateJoinToken(ctx context.Context, arg CreateJoinTokenParams) error {
+	_, err := q.db.ExecContext(ctx, createJoinToken,
+		arg.Token,
+		arg.Location,
+		arg.CreatedAt,
+		arg.ExpiresAt,
+	)
+	return err
+}
+
+const createLedgerEntry = `-- name: CreateLedgerEntry :one
+INSERT INTO ledger_entries (
+	user_id, amount, balance, reason, reference, created_at
+) VALUES (
+	?, ?, ?, ?, ?, ?
+)
+RETURNING id
+`
+
+type CreateLedgerEntryParams struct {
+	UserID    int64
+	Amount    int64
+	Balance   int64
+	Reason    string
+	Reference string
+	CreatedAt int64
+}
+
+func (q *Queries) CreateLedgerEntry(ctx context.Context, arg CreateLedgerEntryParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, createLedgerEntry,
+		arg.UserID,
+		arg.Amount,
+		arg.Balance,
+		arg.Reason,
+		arg.Reference,
+		arg.CreatedAt,
+	)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
+const createLocation = `-- name: CreateLocation :one
+INSERT INTO service_locations (
+	name
+) VALUES (
+	?
+)
+RETURNING id
+`
+
+func (q *Queries) CreateLocation(ctx context.Context, name string) (int64, error) {
+	row := q.db.QueryRowContext(ctx, createLocation, name)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
+const createLocationHostname = `-- name: CreateLocationHostname :exec
+INSERT INTO location_hostnames (
+	location_id, kind, hostname
+) VALUES (
+	?, ?, ?
+)
+`
+
+type CreateLocationHostnameParams struct {
+	LocationID int64
+	Kind       string
+	Hostname   string
+}
+
+func (q *Queries) CreateLocationHostname(ctx context.Context, arg CreateLocationHostnameParams) error {
+	_, err := q.db.ExecContext(ctx, createLocationHostname, arg.LocationID, arg.Kind, arg.Hostname)
+	return err
+}
+
+const createNode = `-- name: CreateNode :one
+INSERT INTO nodes (
+	location_id, address, heartbeat_key, last_seen, online, weight, draining
+) VALUES (
+	?, ?, ?, ?, TRUE, 1, FALSE
+)
+RETURNING id
+`
+
+type CreateNodeParams struct {
+	LocationID   int64
+	Address      string
+	HeartbeatKey string
+	LastSeen     int64
+}
+
+func (q *Queries) CreateNode(ctx context.Context, arg CreateNodeParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, createNode,
+		arg.LocationID,
+		arg.Address,
+		arg.HeartbeatKey,
+		arg.LastSeen,
+	)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
+const createNodeCheck = `-- name: CreateNodeCheck :exec
+INSERT INTO node_checks (
+	node_id, timestamp, up, latency
+) VALUES (
+	?, ?, ?, ?
+)
+`
+
+type CreateNodeCheckParams struct {
+	NodeID    int64
+	Timestamp int64
+	Up        int64
+	Latency   int64
+}
+
+func (q *Queries) CreateNodeCheck(ctx context.Context, arg CreateNodeCheckParams) error {
+	_, err := q.db.ExecContext(ctx, createNodeCheck,
+		arg.NodeID,
+		arg.Timestamp,
+		arg.Up,
+		arg.Latency,
+	)
+	return err
+}
+
+const createNodeHostname = `-- name: CreateNodeHostname :exec
+INSERT INTO node_hostnames (
+	node_id, kind, hostname
+) VALUES (
+	?, ?, ?
+)
+`
+
+type CreateNodeHostnameParams struct {
+	NodeID   int64
+	Kind     string
+	Hostname string
+}
+
+func (q *Queries) CreateNodeHostname(ctx context.Context, arg CreateNodeHostnameParams) error {
+	_, err := q.db.ExecContext(ctx, createNodeHostname, arg.NodeID, arg.Kind, arg.Hostname)
+	return err
+}
+
+const createReconciliationIssue = `-- name: CreateReconciliationIssue :exec
+INSERT INTO reconciliation_issues (
+	report_id, payment_id, kind, detail, fixed
+) VALUES (
+	?, ?, ?, ?, ?
+)
+`
+
+type CreateReconciliationIssueParams struct {
+	ReportID  int64
+	PaymentID string
+	Kind      string
+	Detail    string
+	Fixed     int64
+}
+
+func (q *Queries) CreateReconciliationIssue(ctx context.Context, arg CreateReconciliationIssueParams) error {
+	_, err := q.db.ExecContext(ctx, createReconciliationIssue,
+		arg.ReportID,
+		arg.PaymentID,
+		arg.Kind,
+		arg.Detail,
+		arg.Fixed,
+	)
+	return err
+}
+
+const createReconciliationReport = `-- name: CreateReconciliationReport :one
+INSERT INTO reconciliation_reports (
+	provider, period_start, period_end, payments, transactions, fixed, flagged, created_at
+) VALUES (
+	?, ?, ?, ?, ?, ?, ?, ?
+)
+RETURNING id
+`
+
+type CreateReconciliationReportParams struct {
+	Provider     string
+	PeriodStart  int64
+	PeriodEnd    int64
+	Payments     int64
+	Transactions int64
+	Fixed        int64
+	Flagged      int64
+	CreatedAt    int64
+}
+
+func (q *Queries) CreateReconciliationReport(ctx context.Context, arg CreateReconciliationReportParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, createReconciliationReport,
+		arg.Provider,
+		arg.PeriodStart,
+		arg.PeriodEnd,
+		arg.Payments,
+		arg.Transactions,
+		arg.Fixed,
+		arg.Flagged,
+		arg.CreatedAt,
+	)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
 const createService = `-- name: CreateService :one
 INSERT INTO services (
-	name, type, created_at, expires_at, prolong, prolong_price, user_id, location_id
+	name, remote_name, type, created_at, expires_at, prolong, prolong_price, user_id, location_id, node_id, quota, status, paid_at
 ) VALUES (
-	?, ?, ?, ?, ?, ?, ?, ?
+	?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
 )
 RETURNING id
 `
 
 type CreateServiceParams struct {
 	Name         string
+	RemoteName   string
 	Type         string
 	CreatedAt    int64
 	ExpiresAt    int64
@@ -78,11 +513,16 @@ type CreateServiceParams struct {
 	ProlongPrice int64
 	UserID       int64
 	LocationID   int64
+	NodeID       int64
+	Quota        int64
+	Status       string
+	PaidAt       int64
 }
 
 func (q *Queries) CreateService(ctx context.Context, arg CreateServiceParams) (int64, error) {
 	row := q.db.QueryRowContext(ctx, createService,
 		arg.Name,
+		arg.RemoteName,
 		arg.Type,
 		arg.CreatedAt,
 		arg.ExpiresAt,
@@ -90,6 +530,10 @@ func (q *Queries) CreateService(ctx context.Context, arg CreateServiceParams) (i
 		arg.ProlongPrice,
 		arg.UserID,
 		arg.LocationID,
+		arg.NodeID,
+		arg.Quota,
+		arg.Status,
+		arg.PaidAt,
 	)
 	var id int64
 	err := row.Scan(&id)
@@ -98,20 +542,24 @@ func (q *Queries) CreateService(ctx context.Context, arg CreateServiceParams) (i
 
 const createTransaction = `-- name: CreateTransaction :one
 INSERT INTO transactions (
-	payment_id, amount, status, timestamp, url, user_id
+	payment_id, amount, status, timestamp, url, user_id, provider,
+	receipt, receipt_contact
 ) VALUES (
-	?, ?, ?, ?, ?, ?
+	?, ?, ?, ?, ?, ?, ?, ?, ?
 )
 RETURNING id
 `
 
 type CreateTransactionParams struct {
-	PaymentID string
-	Amount    int64
-	Status    string
-	Timestamp int64
-	Url       string
-	UserID    int64
+	PaymentID      string
+	Amount         int64
+	Status         string
+	Timestamp      int64
+	Url            string
+	UserID         int64
+	Provider       string
+	Receipt        string
+	ReceiptContact string
 }
 
 func (q *Queries) CreateTransaction(ctx context.Context, arg CreateTransactionParams) (int64, error) {
@@ -122,6 +570,9 @@ func (q *Queries) CreateTransaction(ctx context.Context, arg CreateTransactionPa
 		arg.Timestamp,
 		arg.Url,
 		arg.UserID,
+		arg.Provider,
+		arg.Receipt,
+		arg.ReceiptContact,
 	)
 	var id int64
 	err := row.Scan(&id)
@@ -156,25 +607,207 @@ func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) (int64,
 	return id, err
 }
 
-const deleteService = `-- name: DeleteService :exec
-DELETE FROM services
-WHERE id = ?
+const deleteFinishedJobs = `-- name: DeleteFinishedJobs :exec
+DELETE FROM jobs
+WHERE status = 'done' AND updated_at < ?
 `
 
-func (q *Queries) DeleteService(ctx context.Context, id int64) error {
+func (q *Queries) DeleteFinishedJobs(ctx context.Context, updatedAt int64) error {
+	_, err := q.db.ExecContext(ctx, deleteFinishedJobs, updatedAt)
+	return err
+}
+
+const deleteLocationHostnames = `-- name: DeleteLocationHostnames :exec
+DELETE FROM location_hostnames
+WHERE location_id = ?
+`
+
+func (q *Queries) DeleteLocationHostnames(ctx context.Context, locationID int64) error {
+	_, err := q.db.ExecContext(ctx, deleteLocationHostnames, locationID)
+	return err
+}
+
+const deleteNodeHostnames = `-- name: DeleteNodeHostnames :exec
+DELETE FROM node_hostnames
+WHERE node_id = ?
+`
+
+func (q *Queries) DeleteNodeHostnames(ctx context.Context, nodeID int64) error {
+	_, err := q.db.ExecContext(ctx, deleteNodeHostnames, nodeID)
+	return err
+}
+
+const deleteOldNodeChecks = `-- name: DeleteOldNodeChecks :exec
+DELETE FROM node_checks
+WHERE timestamp < ?
+`
+
+func (q *Queries) DeleteOldNodeChecks(ctx context.Context, timestamp int64) error {
+	_, err := q.db.ExecContext(ctx, deleteOldNodeChecks, timestamp)
+	return err
+}
+
+const deletePaymentMethod = `-- name: DeletePaymentMethod :execrows
+DELETE FROM payment_methods
+WHERE user_id = ?
+`
+
+func (q *Queries) DeletePaymentMethod(ctx context.Context, userID int64) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deletePaymentMethod, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const deletePolicy = `-- name: DeletePolicy :exec
+DELETE FROM acl_policies
+WHERE location_id = ? AND name = ?
+`
+
+type DeletePolicyParams struct {
+	LocationID int64
+	Name       string
+}
+
+func (q *Queries) DeletePolicy(ctx context.Context, arg DeletePolicyParams) error {
+	_, err := q.db.ExecContext(ctx, deletePolicy, arg.LocationID, arg.Name)
+	return err
+}
+
+const deleteService = `-- name: DeleteService :exec
+DELETE FROM services
+WHERE id = ?
+`
+
+func (q *Queries) DeleteService(ctx context.Context, id int64) error {
 	_, err := q.db.ExecContext(ctx, deleteService, id)
 	return err
 }
 
+const enqueueJob = `-- name: EnqueueJob :execrows
+INSERT INTO jobs (
+	kind, unique_key, payload, status, max_attempts, run_at, created_at, updated_at
+) VALUES (
+	?, ?, ?, 'queued', ?, ?, ?, ?
+)
+ON CONFLICT DO NOTHING
+`
+
+type EnqueueJobParams struct {
+	Kind        string
+	UniqueKey   string
+	Payload     string
+	MaxAttempts int64
+	RunAt       int64
+	CreatedAt   int64
+	UpdatedAt   int64
+}
+
+func (q *Queries) EnqueueJob(ctx context.Context, arg EnqueueJobParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, enqueueJob,
+		arg.Kind,
+		arg.UniqueKey,
+		arg.Payload,
+		arg.MaxAttempts,
+		arg.RunAt,
+		arg.CreatedAt,
+		arg.UpdatedAt,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const enrollNode = `-- name: EnrollNode :exec
+UPDATE nodes
+SET heartbeat_key = ?, last_seen = ?, online = TRUE
+WHERE id = ?
+`
+
+type EnrollNodeParams struct {
+	HeartbeatKey string
+	LastSeen     int64
+	ID           int64
+}
+
+func (q *Queries) EnrollNode(ctx context.Context, arg EnrollNodeParams) error {
+	_, err := q.db.ExecContext(ctx, enrollNode, arg.HeartbeatKey, arg.LastSeen, arg.ID)
+	return err
+}
+
+const failPendingService = `-- name: FailPendingService :execrows
+UPDATE services SET status = 'failed'
+WHERE id = ? AND status = 'pending'
+`
+
+func (q *Queries) FailPendingService(ctx context.Context, id int64) (int64, error) {
+	result, err := q.db.ExecContext(ctx, failPendingService, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const finishJob = `-- name: FinishJob :exec
+UPDATE jobs
+SET status = 'done', last_error = '', updated_at = ?
+WHERE id = ?
+`
+
+type FinishJobParams struct {
+	UpdatedAt int64
+	ID        int64
+}
+
+func (q *Queries) FinishJob(ctx context.Context, arg FinishJobParams) error {
+	_, err := q.db.ExecContext(ctx, finishJob, arg.UpdatedAt, arg.ID)
+	return err
+}
+
+const flagTransaction = `-- name: FlagTransaction :exec
+UPDATE transactions
+SET status = 'flagged'
+WHERE payment_id = ?
+`
+
+func (q *Queries) FlagTransaction(ctx context.Context, paymentID string) error {
+	_, err := q.db.ExecContext(ctx, flagTransaction, paymentID)
+	return err
+}
+
+const getAutopayCharge = `-- name: GetAutopayCharge :one
+SELECT id, user_id, service_id, expires_at, amount, payment_id, status, created_at FROM autopay_charges
+WHERE id = ?
+`
+
+func (q *Queries) GetAutopayCharge(ctx context.Context, id int64) (AutopayCharge, error) {
+	row := q.db.QueryRowContext(ctx, getAutopayCharge, id)
+	var i AutopayCharge
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.ServiceID,
+		&i.ExpiresAt,
+		&i.Amount,
+		&i.PaymentID,
+		&i.Status,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
 const getExpiredServices = `-- name: GetExpiredServices :many
-SELECT services.id, services.name, services.type, services.created_at, services.expires_at, services.prolong, services.prolong_price, services.user_id, services.location_id, service_locations.address FROM services
-JOIN service_locations ON service_locations.id = services.location_id
-WHERE expires_at < ?
+SELECT services.id, services.name, services.remote_name, services.type, services.created_at, services.expires_at, services.prolong, services.prolong_price, services.user_id, services.location_id, services.node_id, services.quota, services.rotated_at, services.status, services.paid_at, nodes.address FROM services
+JOIN nodes ON nodes.id = services.node_id
+WHERE expires_at < ? AND status IN ('active', 'suspended')
 `
 
 type GetExpiredServicesRow struct {
 	ID           int64
 	Name         string
+	RemoteName   string
 	Type         string
 	CreatedAt    int64
 	ExpiresAt    int64
@@ -182,6 +815,11 @@ type GetExpiredServicesRow struct {
 	ProlongPrice int64
 	UserID       int64
 	LocationID   int64
+	NodeID       int64
+	Quota        int64
+	RotatedAt    int64
+	Status       string
+	PaidAt       int64
 	Address      string
 }
 
@@ -197,6 +835,7 @@ func (q *Queries) GetExpiredServices(ctx context.Context, expiresAt int64) ([]Ge
 		if err := rows.Scan(
 			&i.ID,
 			&i.Name,
+			&i.RemoteName,
 			&i.Type,
 			&i.CreatedAt,
 			&i.ExpiresAt,
@@ -204,6 +843,11 @@ func (q *Queries) GetExpiredServices(ctx context.Context, expiresAt int64) ([]Ge
 			&i.ProlongPrice,
 			&i.UserID,
 			&i.LocationID,
+			&i.NodeID,
+			&i.Quota,
+			&i.RotatedAt,
+			&i.Status,
+			&i.PaidAt,
 			&i.Address,
 		); err != nil {
 			return nil, err
@@ -236,39 +880,230 @@ func (q *Queries) GetInvite(ctx context.Context, code string) (Invite, error) {
 	return i, err
 }
 
-const getLocation = `-- name: GetLocation :one
-SELECT id, name, address, services FROM service_locations
-WHERE services LIKE '%' || ? || '%'
-AND name = ? LIMIT 1
+const getJob = `-- name: GetJob :one
+SELECT id, kind, unique_key, payload, status, attempts, max_attempts, run_at, last_error, created_at, updated_at FROM jobs
+WHERE id = ?
 `
 
-type GetLocationParams struct {
-	Column1 sql.NullString
-	Name    string
+func (q *Queries) GetJob(ctx context.Context, id int64) (Job, error) {
+	row := q.db.QueryRowContext(ctx, getJob, id)
+	var i Job
+	err := row.Scan(
+		&i.ID,
+		&i.Kind,
+		&i.UniqueKey,
+		&i.Payload,
+		&i.Status,
+		&i.Attempts,
+		&i.MaxAttempts,
+		&i.RunAt,
+		&i.LastError,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+	return i, err
 }
 
-func (q *Queries) GetLocation(ctx context.Context, arg GetLocationParams) (ServiceLocation, error) {
-	row := q.db.QueryRowContext(ctx, getLocation, arg.Column1, arg.Name)
+const getLocation = `-- name: GetLocation :one
+SELECT id, name FROM service_locations
+WHERE name = ? LIMIT 1
+`
+
+func (q *Queries) GetLocation(ctx context.Context, name string) (ServiceLocation, error) {
+	row := q.db.QueryRowContext(ctx, getLocation, name)
 	var i ServiceLocation
+	err := row.Scan(&i.ID, &i.Name)
+	return i, err
+}
+
+const getNode = `-- name: GetNode :one
+SELECT id, location_id, address, heartbeat_key, last_seen, online, weight, draining FROM nodes
+WHERE id = ?
+`
+
+func (q *Queries) GetNode(ctx context.Context, id int64) (Node, error) {
+	row := q.db.QueryRowContext(ctx, getNode, id)
+	var i Node
 	err := row.Scan(
 		&i.ID,
-		&i.Name,
+		&i.LocationID,
+		&i.Address,
+		&i.HeartbeatKey,
+		&i.LastSeen,
+		&i.Online,
+		&i.Weight,
+		&i.Draining,
+	)
+	return i, err
+}
+
+const getNodeByAddress = `-- name: GetNodeByAddress :one
+SELECT id, location_id, address, heartbeat_key, last_seen, online, weight, draining FROM nodes
+WHERE location_id = ? AND address = ? LIMIT 1
+`
+
+type GetNodeByAddressParams struct {
+	LocationID int64
+	Address    string
+}
+
+func (q *Queries) GetNodeByAddress(ctx context.Context, arg GetNodeByAddressParams) (Node, error) {
+	row := q.db.QueryRowContext(ctx, getNodeByAddress, arg.LocationID, arg.Address)
+	var i Node
+	err := row.Scan(
+		&i.ID,
+		&i.LocationID,
+		&i.Address,
+		&i.HeartbeatKey,
+		&i.LastSeen,
+		&i.Online,
+		&i.Weight,
+		&i.Draining,
+	)
+	return i, err
+}
+
+const getNodeByKey = `-- name: GetNodeByKey :one
+SELECT id, location_id, address, heartbeat_key, last_seen, online, weight, draining FROM nodes
+WHERE heartbeat_key = ? AND heartbeat_key != '' LIMIT 1
+`
+
+func (q *Queries) GetNodeByKey(ctx context.Context, heartbeatKey string) (Node, error) {
+	row := q.db.QueryRowContext(ctx, getNodeByKey, heartbeatKey)
+	var i Node
+	err := row.Scan(
+		&i.ID,
+		&i.LocationID,
 		&i.Address,
-		&i.Services,
+		&i.HeartbeatKey,
+		&i.LastSeen,
+		&i.Online,
+		&i.Weight,
+		&i.Draining,
+	)
+	return i, err
+}
+
+const getNodeService = `-- name: GetNodeService :one
+SELECT id, name, remote_name, type, created_at, expires_at, prolong, prolong_price, user_id, location_id, node_id, quota, rotated_at, status, paid_at FROM services
+WHERE node_id = ? AND remote_name = ? AND status NOT IN ('failed', 'canceled') LIMIT 1
+`
+
+type GetNodeServiceParams struct {
+	NodeID     int64
+	RemoteName string
+}
+
+func (q *Queries) GetNodeService(ctx context.Context, arg GetNodeServiceParams) (Service, error) {
+	row := q.db.QueryRowContext(ctx, getNodeService, arg.NodeID, arg.RemoteName)
+	var i Service
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.RemoteName,
+		&i.Type,
+		&i.CreatedAt,
+		&i.ExpiresAt,
+		&i.Prolong,
+		&i.ProlongPrice,
+		&i.UserID,
+		&i.LocationID,
+		&i.NodeID,
+		&i.Quota,
+		&i.RotatedAt,
+		&i.Status,
+		&i.PaidAt,
+	)
+	return i, err
+}
+
+const getPaymentMethod = `-- name: GetPaymentMethod :one
+SELECT id, user_id, provider, method_id, title, monthly_limit, created_at FROM payment_methods
+WHERE user_id = ?
+`
+
+func (q *Queries) GetPaymentMethod(ctx context.Context, userID int64) (PaymentMethod, error) {
+	row := q.db.QueryRowContext(ctx, getPaymentMethod, userID)
+	var i PaymentMethod
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.Provider,
+		&i.MethodID,
+		&i.Title,
+		&i.MonthlyLimit,
+		&i.CreatedAt,
 	)
 	return i, err
 }
 
 const getPrice = `-- name: GetPrice :one
-SELECT amount FROM service_prices
+SELECT amount, type, max_ips, quota, quota_mode, traffic_pack_size, traffic_pack_price FROM service_prices
 WHERE type = ?
 `
 
-func (q *Queries) GetPrice(ctx context.Context, type_ string) (int64, error) {
+func (q *Queries) GetPrice(ctx context.Context, type_ string) (ServicePrice, error) {
 	row := q.db.QueryRowContext(ctx, getPrice, type_)
-	var amount int64
-	err := row.Scan(&amount)
-	return amount, err
+	var i ServicePrice
+	err := row.Scan(
+		&i.Amount,
+		&i.Type,
+		&i.MaxIps,
+		&i.Quota,
+		&i.QuotaMode,
+		&i.TrafficPackSize,
+		&i.TrafficPackPrice,
+	)
+	return i, err
+}
+
+const getReconciliationReport = `-- name: GetReconciliationReport :one
+SELECT id, provider, period_start, period_end, payments, transactions, fixed, flagged, created_at FROM reconciliation_reports
+WHERE id = ?
+`
+
+func (q *Queries) GetReconciliationReport(ctx context.Context, id int64) (ReconciliationReport, error) {
+	row := q.db.QueryRowContext(ctx, getReconciliationReport, id)
+	var i ReconciliationReport
+	err := row.Scan(
+		&i.ID,
+		&i.Provider,
+		&i.PeriodStart,
+		&i.PeriodEnd,
+		&i.Payments,
+		&i.Transactions,
+		&i.Fixed,
+		&i.Flagged,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getReconciliationReportByPeriod = `-- name: GetReconciliationReportByPeriod :one
+SELECT id, provider, period_start, period_end, payments, transactions, fixed, flagged, created_at FROM reconciliation_reports
+WHERE provider = ? AND period_start = ?
+`
+
+type GetReconciliationReportByPeriodParams struct {
+	Provider    string
+	PeriodStart int64
+}
+
+func (q *Queries) GetReconciliationReportByPeriod(ctx context.Context, arg GetReconciliationReportByPeriodParams) (ReconciliationReport, error) {
+	row := q.db.QueryRowContext(ctx, getReconciliationReportByPeriod, arg.Provider, arg.PeriodStart)
+	var i ReconciliationReport
+	err := row.Scan(
+		&i.ID,
+		&i.Provider,
+		&i.PeriodStart,
+		&i.PeriodEnd,
+		&i.Payments,
+		&i.Transactions,
+		&i.Fixed,
+		&i.Flagged,
+		&i.CreatedAt,
+	)
+	return i, err
 }
 
 const getService = `-- name: GetService :one
@@ -276,11 +1111,15 @@ SELECT
 	services.id, services.name,
 	services.expires_at, services.created_at,
 	services.prolong, services.prolong_price,
-	services.type,
+	services.type, services.location_id, services.node_id,
+	services.remote_name, services.quota, services.rotated_at,
+	services.status,
 	service_locations.name,
-	service_locations.address
+	nodes.address,
+	nodes.online
 FROM services
 JOIN service_locations ON service_locations.id = services.location_id
+JOIN nodes ON nodes.id = services.node_id
 WHERE services.id = ? AND services.user_id = ?
 `
 
@@ -297,8 +1136,15 @@ type GetServiceRow struct {
 	Prolong      int64
 	ProlongPrice int64
 	Type         string
+	LocationID   int64
+	NodeID       int64
+	RemoteName   string
+	Quota        int64
+	RotatedAt    int64
+	Status       string
 	Name_2       string
 	Address      string
+	Online       int64
 }
 
 func (q *Queries) GetService(ctx context.Context, arg GetServiceParams) (GetServiceRow, error) {
@@ -312,67 +1158,769 @@ func (q *Queries) GetService(ctx context.Context, arg GetServiceParams) (GetServ
 		&i.Prolong,
 		&i.ProlongPrice,
 		&i.Type,
+		&i.LocationID,
+		&i.NodeID,
+		&i.RemoteName,
+		&i.Quota,
+		&i.RotatedAt,
+		&i.Status,
 		&i.Name_2,
 		&i.Address,
+		&i.Online,
+	)
+	return i, err
+}
+
+const getServiceNode = `-- name: GetServiceNode :one
+SELECT services.id, services.name, services.remote_name, services.type, services.created_at, services.expires_at, services.prolong, services.prolong_price, services.user_id, services.location_id, services.node_id, services.quota, services.rotated_at, services.status, services.paid_at, nodes.address FROM services
+JOIN nodes ON nodes.id = services.node_id
+WHERE services.id = ?
+`
+
+type GetServiceNodeRow struct {
+	ID           int64
+	Name         string
+	RemoteName   string
+	Type         string
+	CreatedAt    int64
+	ExpiresAt    int64
+	Prolong      int64
+	ProlongPrice int64
+	UserID       int64
+	LocationID   int64
+	NodeID       int64
+	Quota        int64
+	RotatedAt    int64
+	Status       string
+	PaidAt       int64
+	Address      string
+}
+
+func (q *Queries) GetServiceNode(ctx context.Context, id int64) (GetServiceNodeRow, error) {
+	row := q.db.QueryRowContext(ctx, getServiceNode, id)
+	var i GetServiceNodeRow
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.RemoteName,
+		&i.Type,
+		&i.CreatedAt,
+		&i.ExpiresAt,
+		&i.Prolong,
+		&i.ProlongPrice,
+		&i.UserID,
+		&i.LocationID,
+		&i.NodeID,
+		&i.Quota,
+		&i.RotatedAt,
+		&i.Status,
+		&i.PaidAt,
+		&i.Address,
+	)
+	return i, err
+}
+
+const getTermAutopayCharge = `-- name: GetTermAutopayCharge :one
+SELECT id, user_id, service_id, expires_at, amount, payment_id, status, created_at FROM autopay_charges
+WHERE service_id = ? AND expires_at = ?
+`
+
+type GetTermAutopayChargeParams struct {
+	ServiceID int64
+	ExpiresAt int64
+}
+
+func (q *Queries) GetTermAutopayCharge(ctx context.Context, arg GetTermAutopayChargeParams) (AutopayCharge, error) {
+	row := q.db.QueryRowContext(ctx, getTermAutopayCharge, arg.ServiceID, arg.ExpiresAt)
+	var i AutopayCharge
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.ServiceID,
+		&i.ExpiresAt,
+		&i.Amount,
+		&i.PaymentID,
+		&i.Status,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getTransaction = `-- name: GetTransaction :one
+SELECT id, payment_id, amount, status, timestamp, url, user_id, provider, refunded, receipt, receipt_contact FROM transactions
+WHERE payment_id = ?
+`
+
+func (q *Queries) GetTransaction(ctx context.Context, paymentID string) (Transaction, error) {
+	row := q.db.QueryRowContext(ctx, getTransaction, paymentID)
+	var i Transaction
+	err := row.Scan(
+		&i.ID,
+		&i.PaymentID,
+		&i.Amount,
+		&i.Status,
+		&i.Timestamp,
+		&i.Url,
+		&i.UserID,
+		&i.Provider,
+		&i.Refunded,
+		&i.Receipt,
+		&i.ReceiptContact,
 	)
 	return i, err
 }
 
-const getUser = `-- name: GetUser :one
-SELECT id, name, password_hash, balance, invites FROM users
-WHERE id = ? LIMIT 1
+const getUser = `-- name: GetUser :one
+SELECT id, name, password_hash, balance, invites, admin, receipt_contact FROM users
+WHERE id = ? LIMIT 1
+`
+
+func (q *Queries) GetUser(ctx context.Context, id int64) (User, error) {
+	row := q.db.QueryRowContext(ctx, getUser, id)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.PasswordHash,
+		&i.Balance,
+		&i.Invites,
+		&i.Admin,
+		&i.ReceiptContact,
+	)
+	return i, err
+}
+
+const getUserByName = `-- name: GetUserByName :one
+SELECT id, name, password_hash, balance, invites, admin, receipt_contact FROM users
+WHERE name = ? LIMIT 1
+`
+
+func (q *Queries) GetUserByName(ctx context.Context, name string) (User, error) {
+	row := q.db.QueryRowContext(ctx, getUserByName, name)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.PasswordHash,
+		&i.Balance,
+		&i.Invites,
+		&i.Admin,
+		&i.ReceiptContact,
+	)
+	return i, err
+}
+
+const getUserInvites = `-- name: GetUserInvites :many
+SELECT id, code, used, user_id FROM invites
+WHERE user_id = ? AND used = FALSE
+`
+
+func (q *Queries) GetUserInvites(ctx context.Context, userID int64) ([]Invite, error) {
+	rows, err := q.db.QueryContext(ctx, getUserInvites, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Invite
+	for rows.Next() {
+		var i Invite
+		if err := rows.Scan(
+			&i.ID,
+			&i.Code,
+			&i.Used,
+			&i.UserID,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const killJob = `-- name: KillJob :exec
+UPDATE jobs
+SET status = 'dead', last_error = ?, updated_at = ?
+WHERE id = ?
+`
+
+type KillJobParams struct {
+	LastError string
+	UpdatedAt int64
+	ID        int64
+}
+
+func (q *Queries) KillJob(ctx context.Context, arg KillJobParams) error {
+	_, err := q.db.ExecContext(ctx, killJob, arg.LastError, arg.UpdatedAt, arg.ID)
+	return err
+}
+
+const listAvailableNodes = `-- name: ListAvailableNodes :many
+SELECT nodes.id, nodes.location_id, nodes.address, nodes.heartbeat_key, nodes.last_seen, nodes.online, nodes.weight, nodes.draining, service_locations.name AS location FROM nodes
+JOIN service_locations ON service_locations.id = nodes.location_id
+WHERE nodes.online = TRUE AND nodes.draining = FALSE
+`
+
+type ListAvailableNodesRow struct {
+	ID           int64
+	LocationID   int64
+	Address      string
+	HeartbeatKey string
+	LastSeen     int64
+	Online       int64
+	Weight       int64
+	Draining     int64
+	Location     string
+}
+
+func (q *Queries) ListAvailableNodes(ctx context.Context) ([]ListAvailableNodesRow, error) {
+	rows, err := q.db.QueryContext(ctx, listAvailableNodes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListAvailableNodesRow
+	for rows.Next() {
+		var i ListAvailableNodesRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.LocationID,
+			&i.Address,
+			&i.HeartbeatKey,
+			&i.LastSeen,
+			&i.Online,
+			&i.Weight,
+			&i.Draining,
+			&i.Location,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listJobs = `-- name: ListJobs :many
+SELECT id, kind, unique_key, payload, status, attempts, max_attempts, run_at, last_error, created_at, updated_at FROM jobs
+WHERE (CAST(?1 AS TEXT) = '' OR status = ?1) AND id < ?2
+ORDER BY id DESC
+LIMIT ?3
+`
+
+type ListJobsParams struct {
+	Status string
+	Before int64
+	Limit  int64
+}
+
+func (q *Queries) ListJobs(ctx context.Context, arg ListJobsParams) ([]Job, error) {
+	rows, err := q.db.QueryContext(ctx, listJobs, arg.Status, arg.Before, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Job
+	for rows.Next() {
+		var i Job
+		if err := rows.Scan(
+			&i.ID,
+			&i.Kind,
+			&i.UniqueKey,
+			&i.Payload,
+			&i.Status,
+			&i.Attempts,
+			&i.MaxAttempts,
+			&i.RunAt,
+			&i.LastError,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listLedgerEntries = `-- name: ListLedgerEntries :many
+SELECT id, user_id, amount, balance, reason, reference, created_at FROM ledger_entries
+WHERE user_id = ? AND id < ?
+ORDER BY id DESC
+LIMIT ?
+`
+
+type ListLedgerEntriesParams struct {
+	UserID int64
+	ID     int64
+	Limit  int64
+}
+
+func (q *Queries) ListLedgerEntries(ctx context.Context, arg ListLedgerEntriesParams) ([]LedgerEntry, error) {
+	rows, err := q.db.QueryContext(ctx, listLedgerEntries, arg.UserID, arg.ID, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []LedgerEntry
+	for rows.Next() {
+		var i LedgerEntry
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.Amount,
+			&i.Balance,
+			&i.Reason,
+			&i.Reference,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listLocationHostnames = `-- name: ListLocationHostnames :many
+SELECT id, location_id, kind, hostname FROM location_hostnames
+WHERE location_id = ?
+`
+
+func (q *Queries) ListLocationHostnames(ctx context.Context, locationID int64) ([]LocationHostname, error) {
+	rows, err := q.db.QueryContext(ctx, listLocationHostnames, locationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []LocationHostname
+	for rows.Next() {
+		var i LocationHostname
+		if err := rows.Scan(
+			&i.ID,
+			&i.LocationID,
+			&i.Kind,
+			&i.Hostname,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listLocationNodes = `-- name: ListLocationNodes :many
+SELECT id, location_id, address, heartbeat_key, last_seen, online, weight, draining FROM nodes
+WHERE location_id = ? AND online = TRUE AND draining = FALSE
+`
+
+func (q *Queries) ListLocationNodes(ctx context.Context, locationID int64) ([]Node, error) {
+	rows, err := q.db.QueryContext(ctx, listLocationNodes, locationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Node
+	for rows.Next() {
+		var i Node
+		if err := rows.Scan(
+			&i.ID,
+			&i.LocationID,
+			&i.Address,
+			&i.HeartbeatKey,
+			&i.LastSeen,
+			&i.Online,
+			&i.Weight,
+			&i.Draining,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listLocationPolicies = `-- name: ListLocationPolicies :many
+SELECT id, location_id, name, blocked_ports, cidrs, domains FROM acl_policies
+WHERE location_id = ?
+ORDER BY name
+`
+
+func (q *Queries) ListLocationPolicies(ctx context.Context, locationID int64) ([]AclPolicy, error) {
+	rows, err := q.db.QueryContext(ctx, listLocationPolicies, locationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []AclPolicy
+	for rows.Next() {
+		var i AclPolicy
+		if err := rows.Scan(
+			&i.ID,
+			&i.LocationID,
+			&i.Name,
+			&i.BlockedPorts,
+			&i.Cidrs,
+			&i.Domains,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listNodeChecks = `-- name: ListNodeChecks :many
+SELECT id, node_id, timestamp, up, latency FROM node_checks
+WHERE node_id = ? AND timestamp > ?
+ORDER BY timestamp DESC
+`
+
+type ListNodeChecksParams struct {
+	NodeID    int64
+	Timestamp int64
+}
+
+func (q *Queries) ListNodeChecks(ctx context.Context, arg ListNodeChecksParams) ([]NodeCheck, error) {
+	rows, err := q.db.QueryContext(ctx, listNodeChecks, arg.NodeID, arg.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []NodeCheck
+	for rows.Next() {
+		var i NodeCheck
+		if err := rows.Scan(
+			&i.ID,
+			&i.NodeID,
+			&i.Timestamp,
+			&i.Up,
+			&i.Latency,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listNodeHostnames = `-- name: ListNodeHostnames :many
+SELECT id, node_id, kind, hostname FROM node_hostnames
+WHERE node_id = ?
+`
+
+func (q *Queries) ListNodeHostnames(ctx context.Context, nodeID int64) ([]NodeHostname, error) {
+	rows, err := q.db.QueryContext(ctx, listNodeHostnames, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []NodeHostname
+	for rows.Next() {
+		var i NodeHostname
+		if err := rows.Scan(
+			&i.ID,
+			&i.NodeID,
+			&i.Kind,
+			&i.Hostname,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listNodes = `-- name: ListNodes :many
+SELECT nodes.id, nodes.location_id, nodes.address, nodes.heartbeat_key, nodes.last_seen, nodes.online, nodes.weight, nodes.draining, service_locations.name AS location FROM nodes
+JOIN service_locations ON service_locations.id = nodes.location_id
+`
+
+type ListNodesRow struct {
+	ID           int64
+	LocationID   int64
+	Address      string
+	HeartbeatKey string
+	LastSeen     int64
+	Online       int64
+	Weight       int64
+	Draining     int64
+	Location     string
+}
+
+func (q *Queries) ListNodes(ctx context.Context) ([]ListNodesRow, error) {
+	rows, err := q.db.QueryContext(ctx, listNodes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListNodesRow
+	for rows.Next() {
+		var i ListNodesRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.LocationID,
+			&i.Address,
+			&i.HeartbeatKey,
+			&i.LastSeen,
+			&i.Online,
+			&i.Weight,
+			&i.Draining,
+			&i.Location,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listOpenTransactions = `-- name: ListOpenTransactions :many
+SELECT id, payment_id, amount, status, timestamp, url, user_id, provider, refunded, receipt, receipt_contact FROM transactions
+WHERE provider = ? AND status = 'in_process'
+`
+
+func (q *Queries) ListOpenTransactions(ctx context.Context, provider string) ([]Transaction, error) {
+	rows, err := q.db.QueryContext(ctx, listOpenTransactions, provider)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Transaction
+	for rows.Next() {
+		var i Transaction
+		if err := rows.Scan(
+			&i.ID,
+			&i.PaymentID,
+			&i.Amount,
+			&i.Status,
+			&i.Timestamp,
+			&i.Url,
+			&i.UserID,
+			&i.Provider,
+			&i.Refunded,
+			&i.Receipt,
+			&i.ReceiptContact,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listPeriodTransactions = `-- name: ListPeriodTransactions :many
+SELECT id, payment_id, amount, status, timestamp, url, user_id, provider, refunded, receipt, receipt_contact FROM transactions
+WHERE provider = ? AND timestamp >= ?2 AND timestamp < ?3
+`
+
+type ListPeriodTransactionsParams struct {
+	Provider string
+	From     int64
+	To       int64
+}
+
+func (q *Queries) ListPeriodTransactions(ctx context.Context, arg ListPeriodTransactionsParams) ([]Transaction, error) {
+	rows, err := q.db.QueryContext(ctx, listPeriodTransactions, arg.Provider, arg.From, arg.To)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Transaction
+	for rows.Next() {
+		var i Transaction
+		if err := rows.Scan(
+			&i.ID,
+			&i.PaymentID,
+			&i.Amount,
+			&i.Status,
+			&i.Timestamp,
+			&i.Url,
+			&i.UserID,
+			&i.Provider,
+			&i.Refunded,
+			&i.Receipt,
+			&i.ReceiptContact,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listPrices = `-- name: ListPrices :many
+SELECT amount, type, max_ips, quota, quota_mode, traffic_pack_size, traffic_pack_price FROM service_prices
+ORDER BY type
+`
+
+func (q *Queries) ListPrices(ctx context.Context) ([]ServicePrice, error) {
+	rows, err := q.db.QueryContext(ctx, listPrices)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ServicePrice
+	for rows.Next() {
+		var i ServicePrice
+		if err := rows.Scan(
+			&i.Amount,
+			&i.Type,
+			&i.MaxIps,
+			&i.Quota,
+			&i.QuotaMode,
+			&i.TrafficPackSize,
+			&i.TrafficPackPrice,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listReconciliationIssues = `-- name: ListReconciliationIssues :many
+SELECT id, report_id, payment_id, kind, detail, fixed FROM reconciliation_issues
+WHERE report_id = ?
+ORDER BY id
 `
 
-func (q *Queries) GetUser(ctx context.Context, id int64) (User, error) {
-	row := q.db.QueryRowContext(ctx, getUser, id)
-	var i User
-	err := row.Scan(
-		&i.ID,
-		&i.Name,
-		&i.PasswordHash,
-		&i.Balance,
-		&i.Invites,
-	)
-	return i, err
+func (q *Queries) ListReconciliationIssues(ctx context.Context, reportID int64) ([]ReconciliationIssue, error) {
+	rows, err := q.db.QueryContext(ctx, listReconciliationIssues, reportID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ReconciliationIssue
+	for rows.Next() {
+		var i ReconciliationIssue
+		if err := rows.Scan(
+			&i.ID,
+			&i.ReportID,
+			&i.PaymentID,
+			&i.Kind,
+			&i.Detail,
+			&i.Fixed,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
 }
 
-const getUserByName = `-- name: GetUserByName :one
-SELECT id, name, password_hash, balance, invites FROM users
-WHERE name = ? LIMIT 1
+const listReconciliationReports = `-- name: ListReconciliationReports :many
+SELECT id, provider, period_start, period_end, payments, transactions, fixed, flagged, created_at FROM reconciliation_reports
+WHERE id < ?
+ORDER BY id DESC
+LIMIT ?
 `
 
-func (q *Queries) GetUserByName(ctx context.Context, name string) (User, error) {
-	row := q.db.QueryRowContext(ctx, getUserByName, name)
-	var i User
-	err := row.Scan(
-		&i.ID,
-		&i.Name,
-		&i.PasswordHash,
-		&i.Balance,
-		&i.Invites,
-	)
-	return i, err
+type ListReconciliationReportsParams struct {
+	ID    int64
+	Limit int64
 }
 
-const getUserInvites = `-- name: GetUserInvites :many
-SELECT id, code, used, user_id FROM invites
-WHERE user_id = ? AND used = FALSE
-`
-
-func (q *Queries) GetUserInvites(ctx context.Context, userID int64) ([]Invite, error) {
-	rows, err := q.db.QueryContext(ctx, getUserInvites, userID)
+func (q *Queries) ListReconciliationReports(ctx context.Context, arg ListReconciliationReportsParams) ([]ReconciliationReport, error) {
+	rows, err := q.db.QueryContext(ctx, listReconciliationReports, arg.ID, arg.Limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []Invite
+	var items []ReconciliationReport
 	for rows.Next() {
-		var i Invite
+		var i ReconciliationReport
 		if err := rows.Scan(
 			&i.ID,
-			&i.Code,
-			&i.Used,
-			&i.UserID,
+			&i.Provider,
+			&i.PeriodStart,
+			&i.PeriodEnd,
+			&i.Payments,
+			&i.Transactions,
+			&i.Fixed,
+			&i.Flagged,
+			&i.CreatedAt,
 		); err != nil {
 			return nil, err
 		}
@@ -387,25 +1935,34 @@ func (q *Queries) GetUserInvites(ctx context.Context, userID int64) ([]Invite, e
 	return items, nil
 }
 
-const listLocations = `-- name: ListLocations :many
-SELECT name, services FROM service_locations
+const listServiceHostnames = `-- name: ListServiceHostnames :many
+SELECT kind, hostname FROM node_hostnames
+WHERE node_id = ?
+UNION ALL
+SELECT kind, hostname FROM location_hostnames
+WHERE location_id = ?
 `
 
-type ListLocationsRow struct {
-	Name     string
-	Services string
+type ListServiceHostnamesParams struct {
+	NodeID     int64
+	LocationID int64
+}
+
+type ListServiceHostnamesRow struct {
+	Kind     string
+	Hostname string
 }
 
-func (q *Queries) ListLocations(ctx context.Context) ([]ListLocationsRow, error) {
-	rows, err := q.db.QueryContext(ctx, listLocations)
+func (q *Queries) ListServiceHostnames(ctx context.Context, arg ListServiceHostnamesParams) ([]ListServiceHostnamesRow, error) {
+	rows, err := q.db.QueryContext(ctx, listServiceHostnames, arg.NodeID, arg.LocationID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []ListLocationsRow
+	var items []ListServiceHostnamesRow
 	for rows.Next() {
-		var i ListLocationsRow
-		if err := rows.Scan(&i.Name, &i.Services); err != nil {
+		var i ListServiceHostnamesRow
+		if err := rows.Scan(&i.Kind, &i.Hostname); err != nil {
 			return nil, err
 		}
 		items = append(items, i)
@@ -420,7 +1977,7 @@ func (q *Queries) ListLocations(ctx context.Context) ([]ListLocationsRow, error)
 }
 
 const listTransactions = `-- name: ListTransactions :many
-SELECT id, payment_id, amount, status, timestamp, url, user_id FROM transactions
+SELECT id, payment_id, amount, status, timestamp, url, user_id, provider, refunded, receipt, receipt_contact FROM transactions
 WHERE user_id = ?
 `
 
@@ -441,6 +1998,10 @@ func (q *Queries) ListTransactions(ctx context.Context, userID int64) ([]Transac
 			&i.Timestamp,
 			&i.Url,
 			&i.UserID,
+			&i.Provider,
+			&i.Refunded,
+			&i.Receipt,
+			&i.ReceiptContact,
 		); err != nil {
 			return nil, err
 		}
@@ -459,6 +2020,7 @@ const listUserServices = `-- name: ListUserServices :many
 SELECT
 	services.id, services.name,
 	services.expires_at, services.type,
+	services.status,
 	service_locations.name
 FROM services
 JOIN service_locations ON service_locations.id = services.location_id
@@ -470,6 +2032,7 @@ type ListUserServicesRow struct {
 	Name      string
 	ExpiresAt int64
 	Type      string
+	Status    string
 	Name_2    string
 }
 
@@ -487,6 +2050,7 @@ func (q *Queries) ListUserServices(ctx context.Context, userID int64) ([]ListUse
 			&i.Name,
 			&i.ExpiresAt,
 			&i.Type,
+			&i.Status,
 			&i.Name_2,
 		); err != nil {
 			return nil, err
@@ -502,78 +2066,382 @@ func (q *Queries) ListUserServices(ctx context.Context, userID int64) ([]ListUse
 	return items, nil
 }
 
-const prolongService = `-- name: ProlongService :exec
+const prolongService = `-- name: ProlongService :one
 UPDATE services
-SET expires_at = ? + (expires_at - created_at)
-WHERE id = ?
+SET expires_at = ?1 + (expires_at - created_at), paid_at = ?1, status = 'active'
+WHERE id = ?2
+RETURNING expires_at
 `
 
 type ProlongServiceParams struct {
-	ExpiresAt int64
+	Now int64
+	ID  int64
+}
+
+func (q *Queries) ProlongService(ctx context.Context, arg ProlongServiceParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, prolongService, arg.Now, arg.ID)
+	var expires_at int64
+	err := row.Scan(&expires_at)
+	return expires_at, err
+}
+
+const refundTransaction = `-- name: RefundTransaction :exec
+UPDATE transactions
+SET refunded = refunded + ?1,
+	status = CASE WHEN refunded + ?1 >= amount
+		THEN 'refunded' ELSE 'partially_refunded' END
+WHERE payment_id = ?2
+`
+
+type RefundTransactionParams struct {
+	Amount    int64
+	PaymentID string
+}
+
+func (q *Queries) RefundTransaction(ctx context.Context, arg RefundTransactionParams) error {
+	_, err := q.db.ExecContext(ctx, refundTransaction, arg.Amount, arg.PaymentID)
+	return err
+}
+
+const requeueRunningJobs = `-- name: RequeueRunningJobs :exec
+UPDATE jobs
+SET status = 'queued', updated_at = ?
+WHERE status = 'running'
+`
+
+func (q *Queries) RequeueRunningJobs(ctx context.Context, updatedAt int64) error {
+	_, err := q.db.ExecContext(ctx, requeueRunningJobs, updatedAt)
+	return err
+}
+
+const rescheduleJob = `-- name: RescheduleJob :exec
+UPDATE jobs
+SET status = 'queued', run_at = ?, last_error = ?, updated_at = ?
+WHERE id = ?
+`
+
+type RescheduleJobParams struct {
+	RunAt     int64
+	LastError string
+	UpdatedAt int64
 	ID        int64
 }
 
-func (q *Queries) ProlongService(ctx context.Context, arg ProlongServiceParams) error {
-	_, err := q.db.ExecContext(ctx, prolongService, arg.ExpiresAt, arg.ID)
+func (q *Queries) RescheduleJob(ctx context.Context, arg RescheduleJobParams) error {
+	_, err := q.db.ExecContext(ctx, rescheduleJob,
+		arg.RunAt,
+		arg.LastError,
+		arg.UpdatedAt,
+		arg.ID,
+	)
 	return err
 }
 
-const updateBalance = `-- name: UpdateBalance :exec
-UPDATE users
-SET balance = ?
+const retryJob = `-- name: RetryJob :execrows
+UPDATE OR IGNORE jobs
+SET status = 'queued', attempts = 0, run_at = ?1, last_error = '', updated_at = ?1
+WHERE id = ?2 AND status IN ('dead', 'canceled')
+`
+
+type RetryJobParams struct {
+	Now int64
+	ID  int64
+}
+
+func (q *Queries) RetryJob(ctx context.Context, arg RetryJobParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, retryJob, arg.Now, arg.ID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const savePaymentMethod = `-- name: SavePaymentMethod :exec
+INSERT INTO payment_methods (
+	user_id, provider, method_id, title, monthly_limit, created_at
+) VALUES (
+	?, ?, ?, ?, ?, ?
+)
+ON CONFLICT (user_id) DO UPDATE
+SET provider = excluded.provider, method_id = excluded.method_id,
+	title = excluded.title, created_at = excluded.created_at
+`
+
+type SavePaymentMethodParams struct {
+	UserID       int64
+	Provider     string
+	MethodID     string
+	Title        string
+	MonthlyLimit int64
+	CreatedAt    int64
+}
+
+func (q *Queries) SavePaymentMethod(ctx context.Context, arg SavePaymentMethodParams) error {
+	_, err := q.db.ExecContext(ctx, savePaymentMethod,
+		arg.UserID,
+		arg.Provider,
+		arg.MethodID,
+		arg.Title,
+		arg.MonthlyLimit,
+		arg.CreatedAt,
+	)
+	return err
+}
+
+const setAutopayChargePayment = `-- name: SetAutopayChargePayment :exec
+UPDATE autopay_charges SET payment_id = ?
 WHERE id = ?
 `
 
-type UpdateBalanceParams struct {
-	Balance int64
-	ID      int64
+type SetAutopayChargePaymentParams struct {
+	PaymentID string
+	ID        int64
 }
 
-func (q *Queries) UpdateBalance(ctx context.Context, arg UpdateBalanceParams) error {
-	_, err := q.db.ExecContext(ctx, updateBalance, arg.Balance, arg.ID)
+func (q *Queries) SetAutopayChargePayment(ctx context.Context, arg SetAutopayChargePaymentParams) error {
+	_, err := q.db.ExecContext(ctx, setAutopayChargePayment, arg.PaymentID, arg.ID)
 	return err
 }
 
-const updatePassword = `-- name: UpdatePassword :exec
+const setAutopayLimit = `-- name: SetAutopayLimit :execrows
+UPDATE payment_methods SET monthly_limit = ?
+WHERE user_id = ?
+`
+
+type SetAutopayLimitParams struct {
+	MonthlyLimit int64
+	UserID       int64
+}
+
+func (q *Queries) SetAutopayLimit(ctx context.Context, arg SetAutopayLimitParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, setAutopayLimit, arg.MonthlyLimit, arg.UserID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const setNodeOnline = `-- name: SetNodeOnline :exec
+UPDATE nodes
+SET online = ?
+WHERE id = ?
+`
+
+type SetNodeOnlineParams struct {
+	Online int64
+	ID     int64
+}
+
+func (q *Queries) SetNodeOnline(ctx context.Context, arg SetNodeOnlineParams) error {
+	_, err := q.db.ExecContext(ctx, setNodeOnline, arg.Online, arg.ID)
+	return err
+}
+
+const setPolicy = `-- name: SetPolicy :exec
+INSERT INTO acl_policies (
+	location_id, name, blocked_ports, cidrs, domains
+) VALUES (
+	?, ?, ?, ?, ?
+)
+ON CONFLICT (location_id, name) DO UPDATE SET
+	blocked_ports = excluded.blocked_ports,
+	cidrs = excluded.cidrs,
+	domains = excluded.domains
+`
+
+type SetPolicyParams struct {
+	LocationID   int64
+	Name         string
+	BlockedPorts string
+	Cidrs        string
+	Domains      string
+}
+
+func (q *Queries) SetPolicy(ctx context.Context, arg SetPolicyParams) error {
+	_, err := q.db.ExecContext(ctx, setPolicy,
+		arg.LocationID,
+		arg.Name,
+		arg.BlockedPorts,
+		arg.Cidrs,
+		arg.Domains,
+	)
+	return err
+}
+
+const setReceiptContact = `-- name: SetReceiptContact :exec
 UPDATE users
-SET password_hash = ?
+SET receipt_contact = ?
 WHERE id = ?
 `
 
-type UpdatePasswordParams struct {
-	PasswordHash string
-	ID           int64
+type SetReceiptContactParams struct {
+	ReceiptContact string
+	ID             int64
 }
 
-func (q *Queries) UpdatePassword(ctx context.Context, arg UpdatePasswordParams) error {
-	_, err := q.db.ExecContext(ctx, updatePassword, arg.PasswordHash, arg.ID)
+func (q *Queries) SetReceiptContact(ctx context.Context, arg SetReceiptContactParams) error {
+	_, err := q.db.ExecContext(ctx, setReceiptContact, arg.ReceiptContact, arg.ID)
+	return err
+}
+
+const setServiceRemoteName = `-- name: SetServiceRemoteName :exec
+UPDATE services SET remote_name = ?
+WHERE id = ?
+`
+
+type SetServiceRemoteNameParams struct {
+	RemoteName string
+	ID         int64
+}
+
+func (q *Queries) SetServiceRemoteName(ctx context.Context, arg SetServiceRemoteNameParams) error {
+	_, err := q.db.ExecContext(ctx, setServiceRemoteName, arg.RemoteName, arg.ID)
+	return err
+}
+
+const setServiceRotated = `-- name: SetServiceRotated :exec
+UPDATE services SET rotated_at = ?
+WHERE node_id = ? AND remote_name = ?
+`
+
+type SetServiceRotatedParams struct {
+	RotatedAt  int64
+	NodeID     int64
+	RemoteName string
+}
+
+func (q *Queries) SetServiceRotated(ctx context.Context, arg SetServiceRotatedParams) error {
+	_, err := q.db.ExecContext(ctx, setServiceRotated, arg.RotatedAt, arg.NodeID, arg.RemoteName)
 	return err
 }
 
-const updateTransaction = `-- name: UpdateTransaction :one
+const setTransactionReceipt = `-- name: SetTransactionReceipt :exec
 UPDATE transactions
-SET status = ?
+SET receipt = ?
 WHERE payment_id = ?
-RETURNING user_id, amount
 `
 
-type UpdateTransactionParams struct {
-	Status    string
+type SetTransactionReceiptParams struct {
+	Receipt   string
 	PaymentID string
 }
 
-type UpdateTransactionRow struct {
-	UserID int64
-	Amount int64
+func (q *Queries) SetTransactionReceipt(ctx context.Context, arg SetTransactionReceiptParams) error {
+	_, err := q.db.ExecContext(ctx, setTransactionReceipt, arg.Receipt, arg.PaymentID)
+	return err
 }
 
-func (q *Queries) UpdateTransaction(ctx context.Context, arg UpdateTransactionParams) (UpdateTransactionRow, error) {
-	row := q.db.QueryRowContext(ctx, updateTransaction, arg.Status, arg.PaymentID)
-	var i UpdateTransactionRow
-	err := row.Scan(&i.UserID, &i.Amount)
+const settleAutopayCharge = `-- name: SettleAutopayCharge :one
+UPDATE autopay_charges SET status = ?1
+WHERE (id = ?2 OR (payment_id != '' AND payment_id = ?3))
+AND status = 'pending'
+RETURNING id, user_id, service_id, expires_at, amount, payment_id, status, created_at
+`
+
+type SettleAutopayChargeParams struct {
+	Status    string
+	ID        int64
+	PaymentID string
+}
+
+func (q *Queries) SettleAutopayCharge(ctx context.Context, arg SettleAutopayChargeParams) (AutopayCharge, error) {
+	row := q.db.QueryRowContext(ctx, settleAutopayCharge, arg.Status, arg.ID, arg.PaymentID)
+	var i AutopayCharge
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.ServiceID,
+		&i.ExpiresAt,
+		&i.Amount,
+		&i.PaymentID,
+		&i.Status,
+		&i.CreatedAt,
+	)
 	return i, err
 }
 
+const sumAutopayCharges = `-- name: SumAutopayCharges :one
+SELECT CAST(COALESCE(SUM(amount), 0) AS INTEGER) FROM autopay_charges
+WHERE user_id = ? AND created_at >= ?2 AND id != ?3
+AND status IN ('pending', 'succeeded')
+`
+
+type SumAutopayChargesParams struct {
+	UserID  int64
+	Since   int64
+	Exclude int64
+}
+
+func (q *Queries) SumAutopayCharges(ctx context.Context, arg SumAutopayChargesParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, sumAutopayCharges, arg.UserID, arg.Since, arg.Exclude)
+	var column_1 int64
+	err := row.Scan(&column_1)
+	return column_1, err
+}
+
+const suspendService = `-- name: SuspendService :execrows
+UPDATE services SET status = 'suspended'
+WHERE id = ? AND status = 'active'
+`
+
+func (q *Queries) SuspendService(ctx context.Context, id int64) (int64, error) {
+	result, err := q.db.ExecContext(ctx, suspendService, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const updateHeartbeat = `-- name: UpdateHeartbeat :exec
+UPDATE nodes
+SET address = ?, last_seen = ?
+WHERE id = ?
+`
+
+type UpdateHeartbeatParams struct {
+	Address  string
+	LastSeen int64
+	ID       int64
+}
+
+func (q *Queries) UpdateHeartbeat(ctx context.Context, arg UpdateHeartbeatParams) error {
+	_, err := q.db.ExecContext(ctx, updateHeartbeat, arg.Address, arg.LastSeen, arg.ID)
+	return err
+}
+
+const updateNode = `-- name: UpdateNode :exec
+UPDATE nodes
+SET weight = ?, draining = ?
+WHERE id = ?
+`
+
+type UpdateNodeParams struct {
+	Weight   int64
+	Draining int64
+	ID       int64
+}
+
+func (q *Queries) UpdateNode(ctx context.Context, arg UpdateNodeParams) error {
+	_, err := q.db.ExecContext(ctx, updateNode, arg.Weight, arg.Draining, arg.ID)
+	return err
+}
+
+const updatePassword = `-- name: UpdatePassword :exec
+UPDATE users
+SET password_hash = ?
+WHERE id = ?
+`
+
+type UpdatePasswordParams struct {
+	PasswordHash string
+	ID           int64
+}
+
+func (q *Queries) UpdatePassword(ctx context.Context, arg UpdatePasswordParams) error {
+	_, err := q.db.ExecContext(ctx, updatePassword, arg.PasswordHash, arg.ID)
+	return err
+}
+
 const updateUserInvites = `-- name: UpdateUserInvites :exec
 UPDATE users
 SET invites = invites - 1
@@ -595,3 +2463,24 @@ func (q *Queries) UseInvite(ctx context.Context, id int64) error {
 	_, err := q.db.ExecContext(ctx, useInvite, id)
 	return err
 }
+
+const useJoinToken = `-- name: UseJoinToken :one
+UPDATE join_tokens
+SET used = TRUE
+WHERE token = ?
+AND used = FALSE
+AND expires_at > ?
+RETURNING location
+`
+
+type UseJoinTokenParams struct {
+	Token     string
+	ExpiresAt int64
+}
+
+func (q *Queries) UseJoinToken(ctx context.Context, arg UseJoinTokenParams) (string, error) {
+	row := q.db.QueryRowContext(ctx, useJoinToken, arg.Token, arg.ExpiresAt)
+	var location string
+	err := row.Scan(&location)
+	return location, err
+}
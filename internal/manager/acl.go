@@ -0,0 +1,232 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// DefaultPolicy is applied to the services deployed without a policy.
+const DefaultPolicy = "default"
+
+var validPolicyName = regexp.MustCompile(`^[[:word:]-]{1,64}$`)
+
+// Policy restricts where customers are allowed to connect through the
+// node. Services can only use the policies their backend enforces, see
+// enforces.
+type Policy struct {
+	Name         string   `json:"name"`
+	BlockedPorts []int    `json:"blocked_ports,omitempty"`
+	CIDRs        []string `json:"cidrs,omitempty"`
+	Domains      []string `json:"domains,omitempty"`
+}
+
+func (p *Policy) validate() error {
+	if !validPolicyName.MatchString(p.Name) {
+		return fmt.Errorf("bad policy name %q", p.Name)
+	}
+	for _, port := range p.BlockedPorts {
+		if port <= 0 || port > 0xffff {
+			return fmt.Errorf("bad port number %d", port)
+		}
+	}
+	for _, cidr := range p.CIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return err
+		}
+	}
+	for _, domain := range p.Domains {
+		if domain == "" || strings.ContainsAny(domain, " \t\n/") {
+			return fmt.Errorf("bad domain %q", domain)
+		}
+	}
+	return nil
+}
+
+// render returns the policy in the acl format understood by both ssserver
+// and ss-server. Domains are blocked together with their subdomains.
+func (p *Policy) render() string {
+	var b strings.Builder
+
+	b.WriteString("[accept_all]\n\n[outbound_block_list]\n")
+	for _, cidr := range p.CIDRs {
+		b.WriteString(cidr + "\n")
+	}
+	for _, domain := range p.Domains {
+		b.WriteString(`(^|\.)` + regexp.QuoteMeta(domain) + "$\n")
+	}
+
+	return b.String()
+}
+
+func aclPath(name string) string {
+	return filepath.Join(filepath.Dir(PathToState), "acl", name+".acl")
+}
+
+func (p *Policy) save() error {
+	path := aclPath(p.Name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(p.render()), 0644)
+}
+
+// blocks tells whether the destination is forbidden by the policy, it is
+// used by the in-process backends.
+func (p *Policy) blocks(host string, port int) bool {
+	if p == nil {
+		return false
+	}
+	for _, blocked := range p.BlockedPorts {
+		if blocked == port {
+			return true
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, cidr := range p.CIDRs {
+			if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, domain := range p.Domains {
+		domain = strings.ToLower(domain)
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	errPolicyInUse       = errors.New("policy is used by running services")
+	errPolicyUnsupported = errors.New("policy can't be enforced")
+)
+
+// filtered tells whether policies apply to the service, wireguard peers
+// and xray clients aren't restricted by them.
+func (o *Options) filtered() bool {
+	return o.Type != "wireguard" && o.Type != "xray"
+}
+
+// enforces returns an error unless the backend of the service applies every
+// rule of the policy, shadowsocks acl files can't match ports.
+func (o *Options) enforces(p *Policy) error {
+	switch {
+	case !o.filtered():
+		return fmt.Errorf("%w: %s services ignore policies", errPolicyUnsupported, o.Type)
+	case o.Backend != builtinBackend && len(p.BlockedPorts) > 0:
+		return fmt.Errorf("%w: %s can't block ports of policy %s", errPolicyUnsupported, o.Backend, p.Name)
+	}
+	return nil
+}
+
+func (m *Manager) policy(name string) *Policy {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.policies[name]
+}
+
+// setPolicy creates or replaces the policy and restarts the services using
+// it, so that they pick the new acl file up.
+func (m *Manager) setPolicy(p *Policy) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	// the default policy is given to every new shadowsocks service
+	if backend := availableBackend("shadowsocks"); p.Name == DefaultPolicy && backend != "" {
+		if err := (&Options{Type: "shadowsocks", Backend: backend}).enforces(p); err != nil {
+			return err
+		}
+	}
+
+	m.mutex.Lock()
+	for _, s := range m.state {
+		if s == nil || s.opts.ACL != p.Name {
+			continue
+		}
+		if err := s.opts.enforces(p); err != nil {
+			m.mutex.Unlock()
+			return fmt.Errorf("%s: %w", s.opts.Name, err)
+		}
+	}
+	if err := p.save(); err != nil {
+		m.mutex.Unlock()
+		return err
+	}
+	m.policies[p.Name] = p
+	affected := make([]*Server, 0)
+	for _, s := range m.state {
+		if s != nil && s.running() && s.opts.ACL == p.Name && s.opts.Backend != builtinBackend {
+			affected = append(affected, s)
+		}
+	}
+	m.mutex.Unlock()
+
+	for _, s := range affected {
+		if err := m.restart(s, p.Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restart kills the service and spawns it again, unless it was stopped
+// in the meantime.
+func (m *Manager) restart(s *Server, policy string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	m.mutex.RLock()
+	running := s.running() && m.state[s.opts.Port] == s
+	m.mutex.RUnlock()
+	if !running {
+		return nil
+	}
+
+	log.Printf("restarting %s to apply policy %s", s.opts.Name, policy)
+	if err := s.kill(); err != nil {
+		return err
+	}
+	return s.spawn()
+}
+
+func (m *Manager) deletePolicy(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.policies[name]; !ok {
+		return errNotFound
+	}
+	for _, s := range m.state {
+		if s != nil && s.opts.ACL == name {
+			return errPolicyInUse
+		}
+	}
+
+	delete(m.policies, name)
+
+	if err := os.Remove(aclPath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) listPolicies() []*Policy {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	list := make([]*Policy, 0, len(m.policies))
+	for _, p := range m.policies {
+		list = append(list, p)
+	}
+	return list
+}
@@ -0,0 +1,42 @@
+package manager
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicyEnforced(t *testing.T) {
+	state := PathToState
+	PathToState = filepath.Join(t.TempDir(), "state.json")
+	t.Cleanup(func() { PathToState = state })
+
+	m := newTestManager(20000, 20001)
+	m.policies = map[string]*Policy{"strict": {Name: "strict", CIDRs: []string{"10.0.0.0/8"}}}
+	m.state[20000] = &Server{opts: &Options{Name: "ss", Backend: "ssserver", ACL: "strict"}}
+	m.state[20001] = &Server{opts: &Options{Name: "proxy", Backend: builtinBackend, ACL: "strict"}}
+
+	ports := &Policy{Name: "strict", BlockedPorts: []int{25}}
+	if err := m.setPolicy(ports); !errors.Is(err, errPolicyUnsupported) {
+		t.Errorf("ports for ssserver: got %v, want %v", err, errPolicyUnsupported)
+	}
+	if m.policies["strict"] == ports {
+		t.Error("policy was replaced")
+	}
+	if err := m.setPolicy(&Policy{Name: "strict", Domains: []string{"example.com"}}); err != nil {
+		t.Error(err)
+	}
+
+	for _, opts := range []*Options{
+		{Type: "wireguard"},
+		{Type: "xray", Backend: xrayBackend},
+		{Type: "shadowsocks", Backend: "ss-server"},
+	} {
+		if err := opts.enforces(ports); !errors.Is(err, errPolicyUnsupported) {
+			t.Errorf("%s %s: got %v, want %v", opts.Type, opts.Backend, err, errPolicyUnsupported)
+		}
+	}
+	if err := (&Options{Type: "proxy", Backend: builtinBackend}).enforces(ports); err != nil {
+		t.Errorf("proxy: %v", err)
+	}
+}
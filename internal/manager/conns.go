@@ -0,0 +1,94 @@
+package manager
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const tcpEstablished = "01"
+
+type conn struct {
+	port   int
+	remote net.IP
+}
+
+// establishedConns reads the kernel socket tables and returns every
+// established tcp connection, it doesn't depend on the backend in use.
+func establishedConns() ([]conn, error) {
+	conns := make([]conn, 0)
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		list, err := readSocketTable(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		conns = append(conns, list...)
+	}
+	return conns, nil
+}
+
+func readSocketTable(path string) ([]conn, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	conns := make([]conn, 0)
+
+	scanner := bufio.NewScanner(in)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] != tcpEstablished {
+			continue
+		}
+
+		_, port, err := parseSocketAddr(fields[1])
+		if err != nil {
+			continue
+		}
+		remote, _, err := parseSocketAddr(fields[2])
+		if err != nil {
+			continue
+		}
+
+		conns = append(conns, conn{port, remote})
+	}
+
+	return conns, scanner.Err()
+}
+
+// parseSocketAddr decodes address in the /proc/net/tcp format, e.g.
+// 0100007F:1F90, where ip is stored as a sequence of host order words.
+func parseSocketAddr(s string) (net.IP, int, error) {
+	addr, port, _ := strings.Cut(s, ":")
+
+	p, err := strconv.ParseUint(port, 16, 16)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	raw, err := hex.DecodeString(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ip := make(net.IP, len(raw))
+	for i := 0; i+4 <= len(raw); i += 4 {
+		binary.BigEndian.PutUint32(ip[i:], binary.LittleEndian.Uint32(raw[i:]))
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	return ip, int(p), nil
+}
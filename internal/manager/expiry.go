@@ -0,0 +1,132 @@
+package manager
+
+import (
+	"log"
+	"time"
+)
+
+const expiryCheckInterval = 60 * time.Second
+
+// Expiration is reported to the api server for every service stopped by the
+// manager itself, so that it can either delete or renew the service.
+type Expiration struct {
+	Name      string `json:"name"`
+	ExpiresAt int64  `json:"expires_at"`
+	ExpiredAt int64  `json:"expired_at"`
+}
+
+func (o *Options) expired(now int64) bool {
+	return o.ExpiresAt > 0 && now > o.ExpiresAt+o.Grace
+}
+
+// enforceExpiry stops services whose expiry date and grace period are over,
+// it keeps customers from using the node for free when the api server can't
+// reach it.
+func (m *Manager) enforceExpiry() {
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now().Unix()
+		changed := false
+
+		m.mutex.RLock()
+		expired := make([]*Server, 0)
+		for _, s := range m.state {
+			if s != nil && s.opts.ExpiredAt == 0 && s.opts.expired(now) {
+				expired = append(expired, s)
+			}
+		}
+		m.mutex.RUnlock()
+
+		for _, s := range expired {
+			if m.expire(s, now) {
+				changed = true
+			}
+		}
+
+		if changed {
+			if err := m.saveState(); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// expire stops the service unless it was renewed or removed since the
+// check, it reports whether the service was stopped.
+func (m *Manager) expire(s *Server, now int64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	m.mutex.RLock()
+	expired := m.state[s.opts.Port] == s && s.opts.ExpiredAt == 0 && s.opts.expired(now)
+	m.mutex.RUnlock()
+	if !expired {
+		return false
+	}
+
+	log.Printf("service %s expired at %d, stopping it", s.opts.Name, s.opts.ExpiresAt)
+	if err := s.kill(); err != nil {
+		log.Printf("couldn't stop %s: %s", s.opts.Name, err)
+		return false
+	}
+	m.mutex.Lock()
+	s.opts.ExpiredAt = now
+	m.mutex.Unlock()
+
+	return true
+}
+
+// renew updates expiry date of the service and starts it again if it was
+// stopped by the manager.
+func (m *Manager) renew(name string, expiresAt, grace int64) error {
+	s := m.get(name)
+	if s == nil {
+		return errNotFound
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	m.mutex.Lock()
+	s.opts.ExpiresAt = expiresAt
+	s.opts.Grace = grace
+	restart := s.opts.ExpiredAt > 0 && !s.opts.expired(time.Now().Unix())
+	// service without traffic is started once its quota allows it, the
+	// suspended one once the suspension is over
+	if restart && (s.opts.suspended() || !s.suspendedUntil.IsZero()) {
+		s.opts.ExpiredAt = 0
+		restart = false
+	}
+	restart = restart && m.state[s.opts.Port] == s
+	m.mutex.Unlock()
+
+	if !restart {
+		return nil
+	}
+
+	log.Printf("service %s was renewed, starting it again", name)
+	if err := s.spawn(); err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	s.opts.ExpiredAt = 0
+	m.mutex.Unlock()
+
+	return nil
+}
+
+func (m *Manager) expirations() []*Expiration {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	list := make([]*Expiration, 0)
+	for _, s := range m.state {
+		if s != nil && s.opts.ExpiredAt > 0 {
+			list = append(list, &Expiration{s.opts.Name, s.opts.ExpiresAt, s.opts.ExpiredAt})
+		}
+	}
+	return list
+}
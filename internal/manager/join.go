@@ -0,0 +1,138 @@
+package manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultHeartbeatInterval = 30 * time.Second
+
+var (
+	APIAddr     string
+	JoinToken   string
+	ControlAddr string
+)
+
+// Enrollment is stored in the state file once the manager joined the api
+// server, so the join token is only needed for the very first start.
+type Enrollment struct {
+	API               string `json:"api"`
+	ID                int64  `json:"id"`
+	Key               string `json:"key"`
+	HeartbeatInterval int64  `json:"heartbeat_interval"`
+}
+
+type nodeRequest struct {
+	Token    string `json:"token,omitempty"`
+	Hostname string `json:"hostname"`
+	Address  string `json:"address"`
+	Info     *Info  `json:"info"`
+}
+
+// controlAddress returns the url the api server should use to reach the
+// manager, secret included.
+func controlAddress() string {
+	base := ControlAddr
+	if base == "" {
+		_, port, _ := net.SplitHostPort(Addr)
+		base = "http://" + net.JoinHostPort(Hostname, port)
+	}
+	return strings.TrimSuffix(base, "/") + "/" + Secret + "/"
+}
+
+func (m *Manager) post(endpoint, key string, data any) (*http.Response, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(APIAddr, "/")+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	return client.Do(req)
+}
+
+// Join registers the manager in the api server unless it was already
+// enrolled and starts sending heartbeats.
+func (m *Manager) Join() error {
+	if m.enrollment == nil || m.enrollment.API != APIAddr {
+		if JoinToken == "" {
+			return fmt.Errorf("manager is not enrolled in %s, join token is required", APIAddr)
+		}
+
+		resp, err := m.post("/api/nodes/join", "", &nodeRequest{
+			Token:    JoinToken,
+			Hostname: Hostname,
+			Address:  controlAddress(),
+			Info:     m.info(),
+		})
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusCreated {
+			return fmt.Errorf("couldn't join %s: unexpected status code %d", APIAddr, resp.StatusCode)
+		}
+
+		enrollment := &Enrollment{API: APIAddr}
+		if err := json.NewDecoder(resp.Body).Decode(enrollment); err != nil {
+			return err
+		}
+
+		m.mutex.Lock()
+		m.enrollment = enrollment
+		m.mutex.Unlock()
+
+		log.Printf("joined %s as node %d", APIAddr, enrollment.ID)
+
+		if err := m.saveState(); err != nil {
+			return err
+		}
+	}
+
+	go m.heartbeat()
+
+	return nil
+}
+
+func (m *Manager) heartbeat() {
+	interval := time.Duration(m.enrollment.HeartbeatInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultHeartbeatInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		resp, err := m.post("/api/nodes/heartbeat", m.enrollment.Key, &nodeRequest{
+			Hostname: Hostname,
+			Address:  controlAddress(),
+			Info:     m.info(),
+		})
+		if err != nil {
+			log.Printf("heartbeat failed: %s", err)
+		} else {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				log.Printf("heartbeat failed: unexpected status code %d", resp.StatusCode)
+			}
+		}
+
+		<-ticker.C
+	}
+}
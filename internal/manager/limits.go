@@ -0,0 +1,116 @@
+package manager
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	clientCheckInterval = 10 * time.Second
+	// client is counted as active for this long after its last connection
+	clientWindow = 5 * time.Minute
+	// how long the key stays disabled once the limit was exceeded
+	suspendDuration = 5 * time.Minute
+)
+
+func (s *Server) pruneClients(now time.Time) {
+	for ip, seen := range s.clients {
+		if now.Sub(seen) > clientWindow {
+			delete(s.clients, ip)
+		}
+	}
+}
+
+// enforceLimits tracks distinct source addresses of every service over a
+// sliding window and suspends keys used from more addresses than allowed.
+// Socket tables are used instead of backend hooks, so every backend is
+// covered the same way.
+func (m *Manager) enforceLimits() {
+	ticker := time.NewTicker(clientCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.trackClients(time.Now())
+	}
+}
+
+func (m *Manager) trackClients(now time.Time) {
+	conns, err := establishedConns()
+	if err != nil {
+		log.Printf("couldn't track clients: %s", err)
+		return
+	}
+
+	m.mutex.Lock()
+	for _, c := range conns {
+		s := m.state[c.port]
+		if r, ok := m.retiring[c.port]; ok {
+			s = r.server
+		}
+		if s == nil || !s.running() {
+			continue
+		}
+		if s.clients == nil {
+			s.clients = make(map[string]time.Time, 0)
+		}
+		s.clients[c.remote.String()] = now
+	}
+
+	over := make([]*Server, 0)
+	resume := make([]*Server, 0)
+	for _, s := range m.state {
+		if s == nil {
+			continue
+		}
+		s.pruneClients(now)
+		switch {
+		case !s.suspendedUntil.IsZero() && now.After(s.suspendedUntil):
+			resume = append(resume, s)
+		case s.running() && s.opts.MaxIPs > 0 && len(s.clients) > s.opts.MaxIPs:
+			over = append(over, s)
+		}
+	}
+	m.mutex.Unlock()
+
+	for _, s := range over {
+		m.suspend(s, now.Add(suspendDuration))
+	}
+	for _, s := range resume {
+		m.resume(s)
+	}
+}
+
+func (m *Manager) suspend(s *Server, until time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	log.Printf("service %s is used from too many addresses, suspending it", s.opts.Name)
+	if err := s.kill(); err != nil {
+		log.Printf("couldn't suspend %s: %s", s.opts.Name, err)
+		return
+	}
+	m.mutex.Lock()
+	s.suspendedUntil = until
+	s.clients = nil
+	m.mutex.Unlock()
+}
+
+func (m *Manager) resume(s *Server) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	m.mutex.Lock()
+	s.suspendedUntil = time.Time{}
+	// service could have been removed, expired or used up its traffic
+	// while it was suspended
+	start := s.startable() && !s.running()
+	m.mutex.Unlock()
+
+	if !start {
+		return
+	}
+	log.Printf("resuming suspended service %s", s.opts.Name)
+	if err := s.spawn(); err != nil {
+		log.Printf("couldn't resume %s: %s", s.opts.Name, err)
+	}
+}
@@ -3,17 +3,25 @@ package manager
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/sethvargo/go-password/password"
+	"github.com/skip2/go-qrcode"
 )
 
 const (
@@ -23,6 +31,7 @@ const (
 )
 
 var (
+	Version     = "dev"
 	Hostname    string
 	PathToState string
 	Secret      string
@@ -34,17 +43,38 @@ type Manager struct {
 	portRange [2]int
 	state     map[int]*Server
 	mutex     sync.RWMutex
+	startedAt time.Time
+	// serializes applyQuota
+	quotaMutex sync.Mutex
+
+	enrollment *Enrollment
+	policies   map[string]*Policy
+	// previous ports of the rotated services
+	retiring map[int]*retired
+	// services being deployed, their ports, names and peer addresses are
+	// taken until they are added to the state
+	reserved map[int]*Options
+	// nil unless wireguard subnet is configured
+	wg      *wireguard
+	wgState *WireGuardState
+	// nil unless xray is installed
+	xray      *xray
+	xrayState *XrayState
 }
 
 func New() (*Manager, error) {
-	m := &Manager{}
+	m := &Manager{startedAt: time.Now()}
 
 	return m, m.loadState()
 }
 
 type LocalState struct {
-	PortRange [2]int     `json:"port_range"`
-	State     []*Options `json:"state,omitempty"`
+	PortRange  [2]int          `json:"port_range"`
+	State      []*Options      `json:"state,omitempty"`
+	Enrollment *Enrollment     `json:"enrollment,omitempty"`
+	Policies   []*Policy       `json:"policies,omitempty"`
+	WireGuard  *WireGuardState `json:"wireguard,omitempty"`
+	Xray       *XrayState      `json:"xray,omitempty"`
 }
 
 func (m *Manager) loadState() error {
@@ -58,6 +88,8 @@ func (m *Manager) loadState() error {
 	}
 
 	m.state = make(map[int]*Server, 0)
+	m.retiring = make(map[int]*retired, 0)
+	m.reserved = make(map[int]*Options, 0)
 
 	local := &LocalState{}
 
@@ -66,13 +98,46 @@ func (m *Manager) loadState() error {
 	}
 
 	m.portRange = local.PortRange
+	m.enrollment = local.Enrollment
+
+	m.policies = make(map[string]*Policy, 0)
+	for _, p := range local.Policies {
+		if err := p.save(); err != nil {
+			return err
+		}
+		m.policies[p.Name] = p
+	}
+
+	m.wgState = local.WireGuard
+	if WGSubnet != "" {
+		if m.wgState == nil {
+			m.wgState = &WireGuardState{}
+		}
+		if m.wg, err = newWireGuard(m.wgState); err != nil {
+			return fmt.Errorf("wireguard: %s", err)
+		}
+	}
+
+	m.xrayState = local.Xray
+	if xrayAvailable() {
+		if m.xrayState == nil {
+			m.xrayState = &XrayState{}
+		}
+		if m.xray, err = newXray(m.xrayState); err != nil {
+			return fmt.Errorf("xray: %s", err)
+		}
+	}
 
 	for i := m.portRange[0]; i < m.portRange[1]; i++ {
 		m.state[i] = nil
 	}
 
 	for k := range local.State {
-		s := &Server{local.State[k], nil}
+		s := &Server{opts: local.State[k], manager: m}
+		// the default policy used to be given to every service
+		if !s.opts.filtered() {
+			s.opts.ACL = ""
+		}
 
 		if s.opts.Port < 0 || s.opts.Port > 0xffff {
 			return fmt.Errorf("%s: %s: bad port number\n", PathToState, s.opts.Name)
@@ -87,7 +152,7 @@ func (m *Manager) loadState() error {
 	for _, s := range m.state {
 		wg.Add(1)
 		go func(s *Server, wg *sync.WaitGroup) {
-			if s == nil {
+			if s == nil || s.opts.ExpiredAt > 0 || s.opts.suspended() {
 				wg.Done()
 				return
 			}
@@ -120,30 +185,39 @@ func (m *Manager) loadState() error {
 	return nil
 }
 
+// saveState writes the state to a temporary file and moves it into place,
+// the file is never left half written.
 func (m *Manager) saveState() error {
 	log.Println("saving current state")
-	out, err := os.Create(PathToState)
-	if err != nil {
-		return err
-	}
 
 	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
-	local := &LocalState{PortRange: m.portRange}
+	local := &LocalState{PortRange: m.portRange, Enrollment: m.enrollment, WireGuard: m.wgState, Xray: m.xrayState}
 	local.State = make([]*Options, 0)
 	for _, v := range m.state {
 		if v != nil {
 			local.State = append(local.State, v.opts)
 		}
 	}
+	for _, p := range m.policies {
+		local.Policies = append(local.Policies, p)
+	}
 
-	if err := json.NewEncoder(out).Encode(local); err != nil {
+	out, err := os.CreateTemp(filepath.Dir(PathToState), filepath.Base(PathToState)+".*")
+	if err != nil {
 		return err
 	}
+	defer os.Remove(out.Name())
+	defer out.Close()
 
-	m.mutex.Unlock()
-
-	return nil
+	if err := json.NewEncoder(out).Encode(local); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), PathToState)
 }
 
 func (m *Manager) get(name string) *Server {
@@ -157,24 +231,49 @@ func (m *Manager) get(name string) *Server {
 	return nil
 }
 
-func (m *Manager) getFreePort() (int, error) {
-	m.mutex.RLock()
-
-	port := 0
+// freePort returns a port that isn't used, retiring or reserved, the lock
+// must be held.
+func (m *Manager) freePort() (int, error) {
 	for k, v := range m.state {
-		if v == nil {
-			port = k
-			break
+		_, retiring := m.retiring[k]
+		_, reserved := m.reserved[k]
+		if v == nil && !retiring && !reserved {
+			return k, nil
 		}
 	}
+	return 0, fmt.Errorf("couldn't find free port")
+}
 
-	m.mutex.RUnlock()
+// reserve checks the name and picks the port and the peer address of the
+// new service in one go, so concurrent deploys never get the same ones.
+func (m *Manager) reserve(opts *Options) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
-	if port == 0 {
-		return 0, fmt.Errorf("couldn't find free port")
+	for _, v := range m.state {
+		if v != nil && v.opts.Name == opts.Name {
+			return errNameTaken
+		}
+	}
+	for _, v := range m.reserved {
+		if v.Name == opts.Name {
+			return errNameTaken
+		}
+	}
+
+	port, err := m.freePort()
+	if err != nil {
+		return err
+	}
+	if opts.Type == "wireguard" {
+		if opts.PeerIP, err = m.allocatePeerIP(); err != nil {
+			return err
+		}
 	}
 
-	return port, nil
+	opts.Port = port
+	m.reserved[port] = opts
+	return nil
 }
 
 func (m *Manager) add(opts *Options) error {
@@ -187,44 +286,111 @@ func (m *Manager) add(opts *Options) error {
 	if opts.Addr == "" {
 		opts.Addr = defaultAddress
 	}
-	if opts.Method == "" {
-		opts.Method = defaultMethod
+	if opts.Type == "" {
+		opts.Type = "shadowsocks"
+	}
+	if _, ok := services[opts.Type]; !ok {
+		return fmt.Errorf("unsupported service %s", opts.Type)
 	}
 	if opts.Backend == "" {
-		opts.Backend = defaultBackend
+		opts.Backend = availableBackend(opts.Type)
 	}
 
 	var err error
 
-	opts.Port, err = m.getFreePort()
-	if err != nil {
-		return err
+	switch opts.Type {
+	case "shadowsocks":
+		if opts.Method == "" {
+			opts.Method = defaultMethod
+		}
+		if opts.Plugin == "" {
+			opts.Plugin = "none"
+		}
+		if !isSupported(methods, opts.Method) {
+			return fmt.Errorf("unsupported method %s", opts.Method)
+		}
+		if _, ok := plugins[opts.Plugin]; !ok {
+			return fmt.Errorf("unsupported plugin %s", opts.Plugin)
+		}
+	case "proxy":
+		if opts.User == "" {
+			return fmt.Errorf("user is empty")
+		}
+	case "wireguard":
+		if m.wg == nil {
+			return fmt.Errorf("wireguard is not configured")
+		}
+		opts.Backend = wgBackend
+		// traffic of the peers can't be relayed
+		opts.QuotaMode = QuotaSuspend
+		opts.RotateEvery = 0
+		if opts.PrivateKey, opts.PublicKey, err = newKeyPair(); err != nil {
+			return err
+		}
+	case "xray":
+		if m.xray == nil {
+			return fmt.Errorf("xray is not installed")
+		}
+		if opts.Protocol == "" {
+			opts.Protocol = "vless"
+		}
+		if !isSupported(xrayProtocols, opts.Protocol) {
+			return fmt.Errorf("unsupported protocol %s", opts.Protocol)
+		}
+		opts.Backend = xrayBackend
+		opts.QuotaMode = QuotaSuspend
+		opts.RotateEvery = 0
+		opts.UUID = uuid.NewString()
 	}
-
-	if m.get(opts.Name) != nil {
-		return fmt.Errorf("name is already taken")
+	if opts.ACL == "" && opts.filtered() && m.policy(DefaultPolicy) != nil {
+		opts.ACL = DefaultPolicy
+	}
+	if opts.ACL != "" {
+		p := m.policy(opts.ACL)
+		if p == nil {
+			return fmt.Errorf("unknown policy %s", opts.ACL)
+		}
+		if err := opts.enforces(p); err != nil {
+			return err
+		}
 	}
 
-	s := &Server{opts, nil}
-	if err = s.spawn(); err != nil {
+	if err = m.reserve(opts); err != nil {
 		return err
 	}
 
+	opts.RotatedAt = time.Now().Unix()
+
+	s := &Server{opts: opts, manager: m}
+	err = s.spawn()
+
 	m.mutex.Lock()
 
-	m.state[opts.Port] = s
+	delete(m.reserved, opts.Port)
+	if err == nil {
+		m.state[opts.Port] = s
+	}
 
 	m.mutex.Unlock()
 
-	return nil
+	return err
 }
 
+var (
+	errNotFound  = errors.New("server doesn't exist")
+	errNameTaken = errors.New("name is already taken")
+)
+
 func (m *Manager) remove(name string) error {
 	s := m.get(name)
 	if s == nil {
-		return fmt.Errorf("server is not running for %s", name)
+		return errNotFound
 	}
 	log.Println("stopping server for", name)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	if err := s.kill(); err != nil {
 		return err
 	}
@@ -232,6 +398,12 @@ func (m *Manager) remove(name string) error {
 	m.mutex.Lock()
 
 	m.state[s.opts.Port] = nil
+	for port, r := range m.retiring {
+		if r.server == s {
+			r.kill()
+			delete(m.retiring, port)
+		}
+	}
 
 	m.mutex.Unlock()
 
@@ -239,62 +411,489 @@ func (m *Manager) remove(name string) error {
 }
 
 type Server struct {
-	opts *Options
-	cmd  *exec.Cmd
+	opts    *Options
+	manager *Manager
+	// held while the service is started or stopped, the fields of the
+	// running backend are only written under the lock of the manager too
+	mutex sync.Mutex
+	cmd   *exec.Cmd
+	proxy *proxy
+	// source addresses seen recently, see enforceLimits
+	clients        map[string]time.Time
+	suspendedUntil time.Time
+	// port the backend listens on, it differs from the public one while
+	// the service is throttled
+	port     int
+	reported int64
+	relay    *relay
+	// set while the wireguard peer is on the interface
+	peer bool
+	// set while the service is a client of the xray inbound
+	inbound bool
 }
 
 type Options struct {
+	// shadowsocks when empty
+	Type    string `json:"type,omitempty"`
 	Name    string `json:"name"`
+	User    string `json:"user,omitempty"`
 	Port    int    `json:"port"`
 	Pass    string `json:"password"`
 	Addr    string `json:"addr"`
 	Method  string `json:"method"`
 	Backend string `json:"backend"`
 	Plugin  string `json:"plugin"`
+	ACL     string `json:"acl,omitempty"`
+	// maximum number of distinct client addresses, 0 means unlimited
+	MaxIPs int `json:"max_ips,omitempty"`
+	// unix time after which service is stopped unless renewed, grace
+	// period in seconds is added on top of it
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	Grace     int64 `json:"grace,omitempty"`
+	// set when service was stopped by the manager itself
+	ExpiredAt int64 `json:"expired_at,omitempty"`
+	// monthly traffic allowance in bytes, 0 means unlimited, extra traffic
+	// is bought on top of it and dropped on reset
+	Quota int64 `json:"quota,omitempty"`
+	Extra int64 `json:"extra,omitempty"`
+	Used  int64 `json:"used,omitempty"`
+	// key of the last extra traffic added, the same purchase sent again
+	// isn't added twice
+	ExtraKey string `json:"extra_key,omitempty"`
+	// billing anchor, traffic is reset on the same day every month
+	Anchor    int64  `json:"anchor,omitempty"`
+	ResetAt   int64  `json:"reset_at,omitempty"`
+	QuotaMode string `json:"quota_mode,omitempty"`
+	// set while the traffic is used up
+	Limited bool `json:"limited,omitempty"`
+	// port rotation interval in seconds, node default is used when unset
+	RotateEvery int64 `json:"rotate_every,omitempty"`
+	RotatedAt   int64 `json:"rotated_at,omitempty"`
+	// wireguard peer address and the key pair of the client
+	PeerIP     string `json:"peer_ip,omitempty"`
+	PrivateKey string `json:"private_key,omitempty"`
+	PublicKey  string `json:"public_key,omitempty"`
+	// xray client id and the inbound it belongs to
+	Protocol string `json:"protocol,omitempty"`
+	UUID     string `json:"uuid,omitempty"`
 }
 
 var backends = map[string]string{
-	"ssserver": "-s %s:%d -k %s -m %s",
+	"ssserver":  "-s %s:%d -k %s -m %s",
+	"ss-server": "-s %s -p %d -k %s -m %s",
+}
+
+// services maps every service type to the backends able to serve it, in
+// the order of preference.
+var services = map[string][]string{
+	"shadowsocks": {"ssserver", "ss-server"},
+	"proxy":       {builtinBackend},
+	"wireguard":   {wgBackend},
+	"xray":        {xrayBackend},
+}
+
+// availableBackend returns the first backend of the service installed on
+// the node.
+func availableBackend(service string) string {
+	for _, name := range services[service] {
+		if name == builtinBackend {
+			return name
+		}
+		if name == wgBackend {
+			if wgAvailable() {
+				return name
+			}
+			continue
+		}
+		if name == xrayBackend {
+			if xrayAvailable() {
+				return name
+			}
+			continue
+		}
+		if _, err := exec.LookPath(name); err == nil {
+			return name
+		}
+	}
+	return defaultBackend
+}
+
+var methods = []string{
+	"aes-128-gcm",
+	"aes-256-gcm",
+	"chacha20-ietf-poly1305",
+}
+
+type plugin struct {
+	bin  string
+	opts string
 }
 
-var plugins = map[string]string{
-	"v2ray": "--plugin v2ray-plugin --plugin-opts server",
-	"none":  "",
+var plugins = map[string]plugin{
+	"v2ray": {"v2ray-plugin", "server"},
+	"none":  {},
+}
+
+func isSupported(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Config is everything a client needs to connect to the server. ConnectURL
+// is built for the -hostname of the manager, the api server builds its own
+// for every public hostname of the node.
+type Config struct {
+	Type       string `json:"type"`
+	ConnectURL string `json:"connect_url"`
+	Method     string `json:"method,omitempty"`
+	Username   string `json:"username,omitempty"`
+	Password   string `json:"password"`
+	Port       int    `json:"port"`
+	Plugin     string `json:"plugin,omitempty"`
+	ExpiresAt  int64  `json:"expires_at,omitempty"`
+	Expired    bool   `json:"expired,omitempty"`
+	// traffic allowance of the current period including extra traffic
+	Quota     int64  `json:"quota,omitempty"`
+	Used      int64  `json:"used"`
+	ResetAt   int64  `json:"reset_at,omitempty"`
+	QuotaMode string `json:"quota_mode,omitempty"`
+	Limited   bool   `json:"limited,omitempty"`
+	// distinct client addresses seen within the tracking window
+	Clients        int   `json:"clients"`
+	MaxIPs         int   `json:"max_ips,omitempty"`
+	SuspendedUntil int64 `json:"suspended_until,omitempty"`
+	RotatedAt      int64 `json:"rotated_at,omitempty"`
+	// wireguard only, Conf is the complete config of the client
+	Address   string `json:"address,omitempty"`
+	PublicKey string `json:"public_key,omitempty"`
+	DNS       string `json:"dns,omitempty"`
+	Conf      string `json:"conf,omitempty"`
+	// xray only, PublicKey and ShortID are set for reality
+	Protocol string `json:"protocol,omitempty"`
+	Security string `json:"security,omitempty"`
+	SNI      string `json:"sni,omitempty"`
+	ShortID  string `json:"short_id,omitempty"`
+	Flow     string `json:"flow,omitempty"`
+}
+
+func (s *Server) config() *Config {
+	host := net.JoinHostPort(Hostname, strconv.Itoa(s.opts.Port))
+
+	var uri string
+	switch s.opts.Type {
+	case "wireguard":
+		uri = net.JoinHostPort(Hostname, strconv.Itoa(WGPort))
+	case "xray":
+		uri = s.shareLink(Hostname)
+	case "proxy":
+		uri = (&url.URL{Scheme: "socks5", User: url.UserPassword(s.opts.User, s.opts.Pass), Host: host}).String()
+	default:
+		uri = "ss://" + base64.StdEncoding.WithPadding(base64.NoPadding).
+			EncodeToString([]byte(fmt.Sprintf("%s:%s@%s", s.opts.Method, s.opts.Pass, host)))
+	}
+
+	c := &Config{
+		Type:       s.opts.Type,
+		ConnectURL: uri,
+		Method:     s.opts.Method,
+		Username:   s.opts.User,
+		Password:   s.opts.Pass,
+		Port:       s.opts.Port,
+		Plugin:     plugins[s.opts.Plugin].bin,
+		ExpiresAt:  s.opts.ExpiresAt,
+		Expired:    s.opts.ExpiredAt > 0,
+		Used:       s.opts.Used,
+		ResetAt:    s.opts.ResetAt,
+		QuotaMode:  s.opts.QuotaMode,
+		Limited:    s.opts.Limited,
+		Clients:    len(s.clients),
+		MaxIPs:     s.opts.MaxIPs,
+		RotatedAt:  s.opts.RotatedAt,
+	}
+	if s.opts.Type == "wireguard" {
+		c.Password = s.opts.PrivateKey
+		c.Port = WGPort
+		c.Address = s.opts.PeerIP
+		c.PublicKey = s.manager.wg.publicKey
+		c.DNS = WGDNS
+		c.Conf = s.clientConf(Hostname)
+	}
+	if s.opts.Type == "xray" {
+		c.Password = s.opts.UUID
+		c.Port = xrayPort(s.opts.Protocol)
+		c.Protocol = s.opts.Protocol
+		if c.Protocol == "vless" {
+			c.Security = xraySecurity()
+			c.Flow = xrayFlow
+			if XrayCert == "" {
+				c.SNI = XraySNI
+				c.PublicKey = s.manager.xray.publicKey
+				c.ShortID = s.manager.xray.shortID
+			}
+		}
+	}
+	if s.opts.Quota > 0 {
+		c.Quota = s.opts.Quota + s.opts.Extra
+	}
+	if !s.suspendedUntil.IsZero() {
+		c.SuspendedUntil = s.suspendedUntil.Unix()
+	}
+	return c
+}
+
+func (s *Server) running() bool {
+	return s.cmd != nil || s.proxy != nil || s.peer || s.inbound
+}
+
+// startable tells whether the service is still in the state and nothing
+// keeps it stopped, the caller holds both locks.
+func (s *Server) startable() bool {
+	return s.manager.state[s.opts.Port] == s && s.opts.ExpiredAt == 0 &&
+		s.suspendedUntil.IsZero() && !s.opts.suspended()
 }
 
 func (s *Server) spawn() error {
+	var err error
+
+	if s.opts.Type == "wireguard" {
+		if err = s.manager.wg.addPeer(s.opts.PublicKey, s.opts.PeerIP); err != nil {
+			return err
+		}
+		s.manager.mutex.Lock()
+		s.peer, s.reported = true, 0
+		s.manager.mutex.Unlock()
+		return nil
+	}
+	if s.opts.Type == "xray" {
+		if err = s.manager.xray.addClient(s.opts.Name, xrayClient{s.opts.Protocol, s.opts.UUID}); err != nil {
+			return err
+		}
+		s.manager.mutex.Lock()
+		s.inbound = true
+		s.manager.mutex.Unlock()
+		return nil
+	}
+
+	addr, port := s.opts.Addr, s.opts.Port
+	if s.opts.throttled() {
+		if port, err = freeLocalPort(); err != nil {
+			return err
+		}
+		addr = "127.0.0.1"
+	}
+
+	if s.opts.Backend == builtinBackend {
+		err = s.startProxy(addr, port)
+	} else {
+		err = s.exec(addr, port)
+	}
+	if err != nil {
+		return err
+	}
+	s.manager.mutex.Lock()
+	s.port, s.reported = port, 0
+	s.manager.mutex.Unlock()
+
+	if s.opts.throttled() {
+		public := net.JoinHostPort(s.opts.Addr, strconv.Itoa(s.opts.Port))
+		r, err := startRelay(public, net.JoinHostPort(addr, strconv.Itoa(port)), ThrottleRate)
+		if err != nil {
+			s.kill()
+			return err
+		}
+		s.manager.mutex.Lock()
+		s.relay = r
+		s.manager.mutex.Unlock()
+	}
+
+	return nil
+}
+
+func (s *Server) startProxy(addr string, port int) error {
+	p, err := startProxy(net.JoinHostPort(addr, strconv.Itoa(port)), s.opts.User, s.opts.Pass, func() *Policy {
+		if s.opts.ACL == "" {
+			return nil
+		}
+		return s.manager.policy(s.opts.ACL)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.manager.mutex.Lock()
+	s.proxy = p
+	s.manager.mutex.Unlock()
+
+	return nil
+}
+
+func (s *Server) exec(addr string, port int) error {
 	name, err := exec.LookPath(s.opts.Backend)
 	if err != nil {
 		return fmt.Errorf("couldn't find the location of %s", s.opts.Backend)
 	}
 
-	argv := strings.Split(fmt.Sprintf(backends[s.opts.Backend], s.opts.Addr,
-		s.opts.Port, s.opts.Pass, s.opts.Method), " ")
-	if plugins[s.opts.Plugin] != "" {
-		argv = append(argv, plugins[s.opts.Plugin])
+	argv := strings.Split(fmt.Sprintf(backends[s.opts.Backend], addr,
+		port, s.opts.Pass, s.opts.Method), " ")
+	if p := plugins[s.opts.Plugin]; p.bin != "" {
+		argv = append(argv, "--plugin", p.bin, "--plugin-opts", p.opts)
+	}
+	if s.opts.ACL != "" {
+		argv = append(argv, "--acl", aclPath(s.opts.ACL))
+	}
+	if flag := statFlags[s.opts.Backend]; flag != "" {
+		argv = append(argv, flag, statsAddr())
 	}
 	log.Printf("name: %s, argv: %v", name, argv)
 
-	s.cmd = exec.Command(name, argv...)
-	if err := s.cmd.Start(); err != nil {
-		s.cmd = nil
+	cmd := exec.Command(name, argv...)
+	if err := cmd.Start(); err != nil {
 		return err
 	}
 
+	s.manager.mutex.Lock()
+	s.cmd = cmd
+	s.manager.mutex.Unlock()
+
 	return nil
 }
 
 func (s *Server) kill() error {
+	m := s.manager
+
+	m.mutex.Lock()
+	relay, proxy := s.relay, s.proxy
+	s.relay, s.proxy = nil, nil
+	m.mutex.Unlock()
+
+	if relay != nil {
+		relay.close()
+	}
+	if proxy != nil {
+		proxy.close()
+	}
+	if s.peer {
+		if err := m.wg.removePeer(s.opts.PublicKey); err != nil {
+			return err
+		}
+		m.mutex.Lock()
+		s.peer = false
+		m.mutex.Unlock()
+	}
+	if s.inbound {
+		if err := m.xray.removeClient(s.opts.Name); err != nil {
+			return err
+		}
+		m.mutex.Lock()
+		s.inbound = false
+		m.mutex.Unlock()
+	}
+	if s.cmd == nil {
+		return nil
+	}
+
 	err := s.cmd.Process.Kill()
 	if err != nil {
 		return err
 	}
 
 	s.cmd.Wait()
+	m.mutex.Lock()
+	s.cmd = nil
+	m.mutex.Unlock()
 
 	return nil
 }
 
+type PortInfo struct {
+	Total int `json:"total"`
+	Used  int `json:"used"`
+}
+
+// Info describes what this node is able to run, it is consumed by the api
+// server to validate orders and to build the list of locations.
+type Info struct {
+	Version  string   `json:"version"`
+	Services []string `json:"services"`
+	Backends []string `json:"backends"`
+	Methods  []string `json:"methods"`
+	Plugins  []string `json:"plugins"`
+	Ports    PortInfo `json:"ports"`
+	// number of established connections to the running services
+	Connections int   `json:"connections"`
+	Uptime      int64 `json:"uptime"`
+}
+
+func (m *Manager) info() *Info {
+	info := &Info{
+		Version:  Version,
+		Services: make([]string, 0),
+		Backends: make([]string, 0),
+		Methods:  methods,
+		Plugins:  make([]string, 0),
+		Uptime:   int64(time.Since(m.startedAt).Seconds()),
+	}
+
+	for name := range backends {
+		if _, err := exec.LookPath(name); err == nil {
+			info.Backends = append(info.Backends, name)
+		}
+	}
+	info.Backends = append(info.Backends, builtinBackend)
+	if m.wg != nil && wgAvailable() {
+		info.Backends = append(info.Backends, wgBackend)
+	}
+	if m.xray != nil {
+		info.Backends = append(info.Backends, xrayBackend)
+	}
+	sort.Strings(info.Backends)
+
+	for service, list := range services {
+		for _, name := range list {
+			if isSupported(info.Backends, name) {
+				info.Services = append(info.Services, service)
+				break
+			}
+		}
+	}
+	sort.Strings(info.Services)
+
+	for name, p := range plugins {
+		if p.bin != "" {
+			if _, err := exec.LookPath(p.bin); err != nil {
+				continue
+			}
+		}
+		info.Plugins = append(info.Plugins, name)
+	}
+	sort.Strings(info.Plugins)
+
+	conns, err := establishedConns()
+	if err != nil {
+		log.Printf("couldn't count connections: %s", err)
+	}
+
+	m.mutex.RLock()
+	for _, v := range m.state {
+		info.Ports.Total++
+		if v != nil {
+			info.Ports.Used++
+		}
+	}
+	for _, c := range conns {
+		if m.state[c.port] != nil {
+			info.Connections++
+		}
+	}
+	m.mutex.RUnlock()
+
+	return info
+}
+
 func (m *Manager) Serve() error {
 	http.HandleFunc(fmt.Sprintf("POST /%s/", Secret), func(w http.ResponseWriter, r *http.Request) {
 		if err := r.ParseForm(); err != nil {
@@ -309,14 +908,50 @@ func (m *Manager) Serve() error {
 		}
 
 		opts := &Options{
+			Type:   r.PostFormValue("type"),
 			Name:   r.PostFormValue("name"),
+			User:   r.PostFormValue("user"),
 			Pass:   pass,
 			Method: r.PostFormValue("method"),
 			Plugin: r.PostFormValue("plugin"),
+			ACL:    r.PostFormValue("acl"),
+			// xray only
+			Protocol: r.PostFormValue("protocol"),
+		}
+		if opts.Type == "proxy" && opts.User == "" {
+			if opts.User, err = password.Generate(10, 3, 0, true, false); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := parseExpiry(r, opts); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := parseQuota(r, opts); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if v := r.PostFormValue("rotate_every"); v != "" {
+			if opts.RotateEvery, err = strconv.ParseInt(v, 10, 64); err != nil || opts.RotateEvery < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		if v := r.PostFormValue("max_ips"); v != "" {
+			if opts.MaxIPs, err = strconv.Atoi(v); err != nil || opts.MaxIPs < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
 		}
 		log.Println(*opts)
 		if err := m.add(opts); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			if errors.Is(err, errNameTaken) {
+				w.WriteHeader(http.StatusConflict)
+			} else {
+				w.WriteHeader(http.StatusBadRequest)
+			}
 			log.Println(err)
 			w.Write([]byte(err.Error()))
 			return
@@ -326,6 +961,176 @@ func (m *Manager) Serve() error {
 		m.saveState()
 	})
 
+	http.HandleFunc(fmt.Sprintf("GET /%s/info", Secret), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(m.info())
+	})
+
+	http.HandleFunc(fmt.Sprintf("GET /%s/acl", Secret), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(m.listPolicies())
+	})
+
+	http.HandleFunc(fmt.Sprintf("PUT /%s/acl/{name}", Secret), func(w http.ResponseWriter, r *http.Request) {
+		p := &Policy{}
+		if err := json.NewDecoder(r.Body).Decode(p); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		p.Name = r.PathValue("name")
+
+		if err := m.setPolicy(p); err != nil {
+			if errors.Is(err, errPolicyUnsupported) {
+				w.WriteHeader(http.StatusConflict)
+			} else {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		m.saveState()
+	})
+
+	http.HandleFunc(fmt.Sprintf("DELETE /%s/acl/{name}", Secret), func(w http.ResponseWriter, r *http.Request) {
+		err := m.deletePolicy(r.PathValue("name"))
+		switch {
+		case errors.Is(err, errNotFound):
+			w.WriteHeader(http.StatusNotFound)
+			return
+		case errors.Is(err, errPolicyInUse):
+			w.WriteHeader(http.StatusConflict)
+			return
+		case err != nil:
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		m.saveState()
+	})
+
+	http.HandleFunc(fmt.Sprintf("PUT /%s/quota/{name}", Secret), func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		quota, err := strconv.ParseInt(r.PostFormValue("quota"), 10, 64)
+		if err != nil || quota < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		extra := int64(0)
+		if v := r.PostFormValue("extra"); v != "" {
+			if extra, err = strconv.ParseInt(v, 10, 64); err != nil || extra < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		err = m.setQuota(r.PathValue("name"), quota, extra, r.PostFormValue("key"))
+		if errors.Is(err, errNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		m.saveState()
+	})
+
+	http.HandleFunc(fmt.Sprintf("POST /%s/rotate/{name}", Secret), func(w http.ResponseWriter, r *http.Request) {
+		rotation, err := m.rotate(r.PathValue("name"))
+		switch {
+		case errors.Is(err, errNotFound):
+			w.WriteHeader(http.StatusNotFound)
+			return
+		case errors.Is(err, errRotating):
+			w.WriteHeader(http.StatusConflict)
+			return
+		case errors.Is(err, errNotRotatable):
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		case err != nil:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		m.saveState()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(rotation)
+	})
+
+	http.HandleFunc(fmt.Sprintf("POST /%s/rotate", Secret), func(w http.ResponseWriter, r *http.Request) {
+		m.mutex.RLock()
+		names := make([]string, 0)
+		for _, s := range m.state {
+			if s != nil && s.opts.rotatable() {
+				names = append(names, s.opts.Name)
+			}
+		}
+		m.mutex.RUnlock()
+
+		list := make([]*Rotation, 0)
+		for _, name := range names {
+			rotation, err := m.rotate(name)
+			if err != nil {
+				log.Printf("couldn't rotate %s: %s", name, err)
+				continue
+			}
+			list = append(list, rotation)
+		}
+
+		m.saveState()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(list)
+	})
+
+	http.HandleFunc(fmt.Sprintf("GET /%s/expired", Secret), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(m.expirations())
+	})
+
+	http.HandleFunc(fmt.Sprintf("PUT /%s/{name}", Secret), func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		opts := &Options{}
+		if err := parseExpiry(r, opts); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		err := m.renew(r.PathValue("name"), opts.ExpiresAt, opts.Grace)
+		if errors.Is(err, errNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		m.saveState()
+	})
+
 	http.HandleFunc(fmt.Sprintf("GET /%s/{name}", Secret), func(w http.ResponseWriter, r *http.Request) {
 		s := m.get(r.PathValue("name"))
 		if s == nil {
@@ -333,15 +1138,53 @@ func (m *Manager) Serve() error {
 			return
 		}
 
-		uri := "ss://" + base64.StdEncoding.WithPadding(base64.NoPadding).
-			EncodeToString([]byte(fmt.Sprintf("%s:%s@%s:%d", s.opts.Method, s.opts.Pass, Hostname, s.opts.Port)))
+		m.mutex.RLock()
+		config := s.config()
+		m.mutex.RUnlock()
+
+		switch r.URL.Query().Get("format") {
+		case "", "json":
+		case "conf":
+			if config.Conf == "" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", s.opts.Name+".conf"))
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(config.Conf))
+			return
+		case "qr":
+			if config.Conf == "" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			png, err := qrcode.Encode(config.Conf, qrcode.Medium, 512)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "image/png")
+			w.WriteHeader(http.StatusOK)
+			w.Write(png)
+			return
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(fmt.Sprintf("{\"connect_url\":\"%s\"}", uri)))
+		json.NewEncoder(w).Encode(config)
 	})
 
 	http.HandleFunc(fmt.Sprintf("DELETE /%s/{name}", Secret), func(w http.ResponseWriter, r *http.Request) {
-		if err := m.remove(r.PathValue("name")); err != nil {
+		err := m.remove(r.PathValue("name"))
+		if errors.Is(err, errNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -354,5 +1197,35 @@ func (m *Manager) Serve() error {
 		w.WriteHeader(http.StatusOK)
 	})
 
+	// tells the api server apart a wrong secret from a missing route
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/"+Secret+"/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+
+	go m.enforceExpiry()
+	go m.enforceLimits()
+	go m.enforceQuota()
+	go m.collectStats()
+	go m.rotatePorts()
+
 	return http.ListenAndServe(Addr, nil)
 }
+
+func parseExpiry(r *http.Request, opts *Options) error {
+	var err error
+	if v := r.PostFormValue("expires_at"); v != "" {
+		if opts.ExpiresAt, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return err
+		}
+	}
+	if v := r.PostFormValue("grace"); v != "" {
+		if opts.Grace, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,387 @@
+package manager
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// builtinBackend serves the services implemented by the manager itself.
+const builtinBackend = "builtin"
+
+const (
+	proxyDialTimeout      = 10 * time.Second
+	proxyHandshakeTimeout = 30 * time.Second
+)
+
+// proxy is an authenticated SOCKS5 and HTTP CONNECT proxy, both protocols
+// are served on the same port and told apart by the first byte.
+type proxy struct {
+	ln       net.Listener
+	user     string
+	pass     string
+	policy   func() *Policy
+	traffic  atomic.Int64
+	conns    map[net.Conn]struct{}
+	mutex    sync.Mutex
+	resolver *net.Resolver
+	// tells the addresses customers can never reach
+	forbidden func(ip net.IP) bool
+}
+
+func startProxy(addr, user, pass string, policy func() *Policy) (*proxy, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &proxy{
+		ln:        ln,
+		user:      user,
+		pass:      pass,
+		policy:    policy,
+		conns:     make(map[net.Conn]struct{}, 0),
+		resolver:  net.DefaultResolver,
+		forbidden: internalIP,
+	}
+	go p.serve()
+
+	return p, nil
+}
+
+func (p *proxy) serve() {
+	for {
+		c, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(c)
+	}
+}
+
+func (p *proxy) track(c net.Conn, add bool) {
+	p.mutex.Lock()
+	if add {
+		p.conns[c] = struct{}{}
+	} else {
+		delete(p.conns, c)
+	}
+	p.mutex.Unlock()
+}
+
+func (p *proxy) close() {
+	p.ln.Close()
+
+	p.mutex.Lock()
+	for c := range p.conns {
+		c.Close()
+	}
+	p.mutex.Unlock()
+}
+
+func (p *proxy) authorized(user, pass string) bool {
+	u := subtle.ConstantTimeCompare([]byte(user), []byte(p.user))
+	k := subtle.ConstantTimeCompare([]byte(pass), []byte(p.pass))
+	return u&k == 1
+}
+
+func (p *proxy) handle(c net.Conn) {
+	defer c.Close()
+
+	p.track(c, true)
+	defer p.track(c, false)
+
+	c.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
+
+	r := bufio.NewReader(c)
+	first, err := r.Peek(1)
+	if err != nil {
+		return
+	}
+
+	var upstream net.Conn
+	if first[0] == socksVersion {
+		upstream, err = p.socks(r, c)
+	} else {
+		upstream, err = p.connect(r, c)
+	}
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+
+	c.SetDeadline(time.Time{})
+
+	done := make(chan struct{}, 2)
+	go func() {
+		// client could have sent data right after the handshake
+		p.copy(upstream, r)
+		done <- struct{}{}
+	}()
+	go func() {
+		p.copy(c, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func (p *proxy) copy(dst io.Writer, src io.Reader) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			p.traffic.Add(int64(n))
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+var errBlocked = errors.New("destination is blocked by the policy")
+
+// internalIP tells whether the address belongs to the node or its networks,
+// such as the local apis of the backends and the metadata service of the
+// cloud. Customers are never let there whatever the policy says.
+func internalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		// can't tell, so better not
+		return true
+	}
+	for _, addr := range addrs {
+		if network, ok := addr.(*net.IPNet); ok && network.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dial connects to the destination unless it is internal or forbidden by
+// the policy of the service, domains are checked both by name and by their
+// addresses.
+func (p *proxy) dial(host string, port int) (net.Conn, error) {
+	policy := p.policy()
+	if policy.blocks(host, port) {
+		return nil, errBlocked
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), proxyDialTimeout)
+	defer cancel()
+
+	addrs, err := p.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		if p.forbidden(addr.IP) || policy.blocks(addr.IP.String(), port) {
+			continue
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", net.JoinHostPort(addr.IP.String(), strconv.Itoa(port)))
+	}
+
+	return nil, errBlocked
+}
+
+const (
+	socksVersion     = 0x05
+	socksAuthVersion = 0x01
+
+	socksAuthPassword     = 0x02
+	socksAuthUnacceptable = 0xff
+
+	socksConnect = 0x01
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+
+	socksSucceeded       = 0x00
+	socksFailure         = 0x01
+	socksNotAllowed      = 0x02
+	socksHostUnreachable = 0x04
+	socksNotSupported    = 0x07
+)
+
+// socks performs RFC 1928 handshake with RFC 1929 authentication, only the
+// CONNECT command is supported.
+func (p *proxy) socks(r *bufio.Reader, w net.Conn) (net.Conn, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, err
+	}
+	if bytes.IndexByte(methods, socksAuthPassword) < 0 {
+		w.Write([]byte{socksVersion, socksAuthUnacceptable})
+		return nil, errors.New("client doesn't support password authentication")
+	}
+	if _, err := w.Write([]byte{socksVersion, socksAuthPassword}); err != nil {
+		return nil, err
+	}
+
+	// username/password subnegotiation
+	if _, err := io.ReadFull(r, head[:2]); err != nil {
+		return nil, err
+	}
+	user := make([]byte, head[1])
+	if _, err := io.ReadFull(r, user); err != nil {
+		return nil, err
+	}
+	size, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	pass := make([]byte, size)
+	if _, err := io.ReadFull(r, pass); err != nil {
+		return nil, err
+	}
+	if !p.authorized(string(user), string(pass)) {
+		w.Write([]byte{socksAuthVersion, 0x01})
+		return nil, errors.New("bad credentials")
+	}
+	if _, err := w.Write([]byte{socksAuthVersion, 0x00}); err != nil {
+		return nil, err
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil {
+		return nil, err
+	}
+
+	var host string
+	switch req[3] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, 4)
+		if req[3] == socksIPv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	case socksDomain:
+		size, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		domain := make([]byte, size)
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return nil, err
+		}
+		host = string(domain)
+	default:
+		socksReply(w, socksNotSupported)
+		return nil, errors.New("unknown address type")
+	}
+
+	portBuf := make([]byte, 2)
+	if _, err := io.ReadFull(r, portBuf); err != nil {
+		return nil, err
+	}
+	port := int(binary.BigEndian.Uint16(portBuf))
+
+	if req[1] != socksConnect {
+		socksReply(w, socksNotSupported)
+		return nil, errors.New("unsupported command")
+	}
+
+	upstream, err := p.dial(host, port)
+	switch {
+	case errors.Is(err, errBlocked):
+		socksReply(w, socksNotAllowed)
+		return nil, err
+	case err != nil:
+		socksReply(w, socksHostUnreachable)
+		return nil, err
+	}
+
+	if err := socksReply(w, socksSucceeded); err != nil {
+		upstream.Close()
+		return nil, err
+	}
+
+	return upstream, nil
+}
+
+// socksReply answers the request, bound address isn't reported since
+// clients don't need it for CONNECT.
+func socksReply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socksVersion, code, 0x00, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// connect serves HTTP CONNECT requests authenticated with basic auth.
+func (p *proxy) connect(r *bufio.Reader, w net.Conn) (net.Conn, error) {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Method != http.MethodConnect {
+		io.WriteString(w, "HTTP/1.1 405 Method Not Allowed\r\nAllow: CONNECT\r\nConnection: close\r\n\r\n")
+		return nil, errors.New("only CONNECT is supported")
+	}
+
+	auth, ok := strings.CutPrefix(req.Header.Get("Proxy-Authorization"), "Basic ")
+	credentials, err := base64.StdEncoding.DecodeString(auth)
+	user, pass, _ := strings.Cut(string(credentials), ":")
+	if !ok || err != nil || !p.authorized(user, pass) {
+		io.WriteString(w, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"proxy\"\r\nConnection: close\r\n\r\n")
+		return nil, errors.New("bad credentials")
+	}
+
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		io.WriteString(w, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+		return nil, err
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		io.WriteString(w, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+		return nil, err
+	}
+
+	upstream, err := p.dial(host, portNum)
+	switch {
+	case errors.Is(err, errBlocked):
+		io.WriteString(w, "HTTP/1.1 403 Forbidden\r\nConnection: close\r\n\r\n")
+		return nil, err
+	case err != nil:
+		log.Printf("proxy: %s", err)
+		io.WriteString(w, "HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\n\r\n")
+		return nil, err
+	}
+
+	if _, err := io.WriteString(w, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		upstream.Close()
+		return nil, err
+	}
+
+	return upstream, nil
+}
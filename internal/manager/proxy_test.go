@@ -0,0 +1,260 @@
+package manager
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startTestProxy runs the proxy of user:pass on a random port.
+func startTestProxy(t *testing.T, policy *Policy) *proxy {
+	t.Helper()
+
+	p, err := startProxy("127.0.0.1:0", "user", "pass", func() *Policy { return policy })
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.close)
+	return p
+}
+
+// startEcho runs the server every test connects through the proxy to, it
+// listens on the loopback so the proxy has to be told to allow it.
+func startEcho(t *testing.T) (string, int) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func dialProxy(t *testing.T, p *proxy) net.Conn {
+	t.Helper()
+
+	c, err := net.Dial("tcp", p.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func checkEcho(t *testing.T, c net.Conn, r io.Reader) {
+	t.Helper()
+
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("echoed %q", buf)
+	}
+}
+
+// socksHandshake authenticates and asks for the domain, it returns the
+// status of the authentication and the reply to the request.
+func socksHandshake(t *testing.T, c net.Conn, user, pass, host string, port int) (byte, byte) {
+	t.Helper()
+
+	if _, err := c.Write([]byte{socksVersion, 1, socksAuthPassword}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socksAuthPassword {
+		t.Fatalf("method %#x was chosen", reply[1])
+	}
+
+	auth := []byte{socksAuthVersion, byte(len(user))}
+	auth = append(auth, user...)
+	auth = append(auth, byte(len(pass)))
+	auth = append(auth, pass...)
+	if _, err := c.Write(auth); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0 {
+		return reply[1], 0
+	}
+
+	req := []byte{socksVersion, socksConnect, 0, socksDomain, byte(len(host))}
+	req = append(req, host...)
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := c.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, 10)
+	if _, err := io.ReadFull(c, resp); err != nil {
+		t.Fatal(err)
+	}
+	return 0, resp[1]
+}
+
+func TestSocks(t *testing.T) {
+	host, port := startEcho(t)
+
+	t.Run("bad credentials", func(t *testing.T) {
+		p := startTestProxy(t, nil)
+		if status, _ := socksHandshake(t, dialProxy(t, p), "user", "wrong", host, port); status == 0 {
+			t.Error("wrong password was accepted")
+		}
+	})
+
+	t.Run("no password", func(t *testing.T) {
+		c := dialProxy(t, startTestProxy(t, nil))
+		c.Write([]byte{socksVersion, 1, 0x00})
+		reply := make([]byte, 2)
+		if _, err := io.ReadFull(c, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply[1] != socksAuthUnacceptable {
+			t.Errorf("method %#x was chosen", reply[1])
+		}
+	})
+
+	for _, target := range []string{host, "localhost"} {
+		t.Run("loopback "+target, func(t *testing.T) {
+			p := startTestProxy(t, nil)
+			if _, code := socksHandshake(t, dialProxy(t, p), "user", "pass", target, port); code != socksNotAllowed {
+				t.Errorf("got reply %#x, want %#x", code, socksNotAllowed)
+			}
+		})
+	}
+
+	t.Run("blocked port", func(t *testing.T) {
+		p := startTestProxy(t, &Policy{BlockedPorts: []int{port}})
+		p.forbidden = func(net.IP) bool { return false }
+		if _, code := socksHandshake(t, dialProxy(t, p), "user", "pass", host, port); code != socksNotAllowed {
+			t.Errorf("got reply %#x, want %#x", code, socksNotAllowed)
+		}
+	})
+
+	t.Run("connected", func(t *testing.T) {
+		p := startTestProxy(t, nil)
+		p.forbidden = func(net.IP) bool { return false }
+		c := dialProxy(t, p)
+		if _, code := socksHandshake(t, c, "user", "pass", host, port); code != socksSucceeded {
+			t.Fatalf("got reply %#x", code)
+		}
+		checkEcho(t, c, c)
+	})
+}
+
+// httpConnect sends the CONNECT request, empty user sends no credentials.
+func httpConnect(t *testing.T, c net.Conn, method, user, pass, target string) (*http.Response, *bufio.Reader) {
+	t.Helper()
+
+	req, _ := http.NewRequest(method, "http://"+target, nil)
+	req.Host = target
+	if user != "" {
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+	}
+	if err := req.Write(c); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, r
+}
+
+func TestConnect(t *testing.T) {
+	host, port := startEcho(t)
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+
+	for _, tt := range []struct {
+		name       string
+		method     string
+		user, pass string
+		target     string
+		policy     *Policy
+		allowLocal bool
+		status     int
+	}{
+		{"no credentials", http.MethodConnect, "", "", target, nil, true, http.StatusProxyAuthRequired},
+		{"bad credentials", http.MethodConnect, "user", "wrong", target, nil, true, http.StatusProxyAuthRequired},
+		{"not connect", http.MethodGet, "user", "pass", target, nil, true, http.StatusMethodNotAllowed},
+		{"loopback", http.MethodConnect, "user", "pass", target, nil, false, http.StatusForbidden},
+		{"loopback name", http.MethodConnect, "user", "pass", net.JoinHostPort("localhost", strconv.Itoa(port)), nil, false, http.StatusForbidden},
+		{"metadata", http.MethodConnect, "user", "pass", "169.254.169.254:80", nil, false, http.StatusForbidden},
+		{"blocked cidr", http.MethodConnect, "user", "pass", target, &Policy{CIDRs: []string{"127.0.0.0/8"}}, true, http.StatusForbidden},
+		{"connected", http.MethodConnect, "user", "pass", target, nil, true, http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := startTestProxy(t, tt.policy)
+			if tt.allowLocal {
+				p.forbidden = func(net.IP) bool { return false }
+			}
+
+			c := dialProxy(t, p)
+			resp, r := httpConnect(t, c, tt.method, tt.user, tt.pass, tt.target)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("got %s, want %d", resp.Status, tt.status)
+			}
+			if tt.status == http.StatusOK {
+				checkEcho(t, c, r)
+			}
+		})
+	}
+}
+
+func TestInternalIP(t *testing.T) {
+	for _, tt := range []struct {
+		ip       string
+		internal bool
+	}{
+		{"127.0.0.1", true},
+		{"127.8.8.8", true},
+		{"::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"0.0.0.0", true},
+		{"::", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"fd00::1", true},
+		{"169.254.169.254", true},
+		{"fe80::1", true},
+		{"1.1.1.1", false},
+		{"2606:4700:4700::1111", false},
+	} {
+		if got := internalIP(net.ParseIP(tt.ip)); got != tt.internal {
+			t.Errorf("%s: got %t, want %t", tt.ip, got, tt.internal)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	QuotaSuspend  = "suspend"
+	QuotaThrottle = "throttle"
+
+	quotaCheckInterval = 30 * time.Second
+)
+
+// ThrottleRate is the speed in bytes per second of services which used up
+// their traffic in throttle mode.
+var ThrottleRate int64 = 128 * 1024
+
+// statFlags maps backends to their flag used to report traffic in the
+// ss-manager format.
+var statFlags = map[string]string{
+	"ssserver":  "--manager-addr",
+	"ss-server": "--manager-address",
+}
+
+// statsAddr is where the backends send their traffic counters to, it is the
+// udp counterpart of the manager api on loopback.
+func statsAddr() string {
+	_, port, _ := net.SplitHostPort(Addr)
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+func (o *Options) throttled() bool {
+	return o.Limited && o.QuotaMode == QuotaThrottle
+}
+
+func (o *Options) suspended() bool {
+	return o.Limited && o.QuotaMode != QuotaThrottle
+}
+
+// nextReset returns the first monthly anniversary of the billing anchor
+// after now.
+func (o *Options) nextReset(now time.Time) int64 {
+	anchor := time.Unix(o.Anchor, 0)
+	if o.Anchor == 0 {
+		anchor = now
+	}
+	for months := 1; ; months++ {
+		if t := anchor.AddDate(0, months, 0); t.After(now) {
+			return t.Unix()
+		}
+	}
+}
+
+// collectStats receives traffic counters from the backends. Backends send
+// the total amount of bytes since they were started, e.g.
+// stat: {"8388":1024}, so only the difference is accounted.
+func (m *Manager) collectStats() {
+	conn, err := net.ListenUDP("udp", m.addr)
+	if err != nil {
+		log.Printf("couldn't receive traffic stats: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("couldn't receive traffic stats: %s", err)
+			return
+		}
+		// counters are only trusted from the backends on this machine
+		if !from.IP.IsLoopback() {
+			continue
+		}
+
+		data, ok := strings.CutPrefix(string(buf[:n]), "stat:")
+		if !ok {
+			continue
+		}
+
+		stats := make(map[string]int64, 0)
+		if err := json.Unmarshal([]byte(data), &stats); err != nil {
+			continue
+		}
+
+		for port, total := range stats {
+			if p, err := strconv.Atoi(port); err == nil {
+				m.account(p, total)
+			}
+		}
+	}
+}
+
+func (m *Manager) account(port int, total int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, s := range m.state {
+		if s == nil || !s.running() || s.port != port {
+			continue
+		}
+		s.opts.Used += delta(&s.reported, total)
+		return
+	}
+	// backend left on the previous port of the rotated service
+	for _, r := range m.retiring {
+		if r.port == port {
+			r.server.opts.Used += delta(&r.reported, total)
+			return
+		}
+	}
+}
+
+// delta returns traffic since the last report, counters start from zero
+// when the backend is restarted.
+func delta(reported *int64, total int64) int64 {
+	d := total - *reported
+	if d < 0 {
+		d = total
+	}
+	*reported = total
+	return d
+}
+
+// enforceQuota resets traffic on the billing date and limits services that
+// used up their traffic.
+func (m *Manager) enforceQuota() {
+	ticker := time.NewTicker(quotaCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.applyQuota(time.Now())
+		if err := m.saveState(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (m *Manager) applyQuota(now time.Time) {
+	// the loop and setQuota must not limit the same service twice
+	m.quotaMutex.Lock()
+	defer m.quotaMutex.Unlock()
+
+	var peers map[string]int64
+	if m.wg != nil {
+		var err error
+		if peers, err = m.wg.transfer(); err != nil {
+			log.Printf("couldn't read wireguard transfer: %s", err)
+		}
+	}
+	var clients map[string]int64
+	if m.xray != nil {
+		var err error
+		if clients, err = m.xray.traffic(); err != nil {
+			log.Printf("couldn't query xray stats: %s", err)
+		}
+	}
+
+	m.mutex.Lock()
+	for _, s := range m.state {
+		if s == nil || !s.peer {
+			continue
+		}
+		if total, ok := peers[s.opts.PublicKey]; ok {
+			s.opts.Used += delta(&s.reported, total)
+		}
+	}
+	// xray resets its counters on every query
+	for _, s := range m.state {
+		if s != nil && s.inbound {
+			s.opts.Used += clients[s.opts.Name]
+		}
+	}
+	// builtin backends count traffic themselves
+	for _, s := range m.state {
+		if s != nil && s.proxy != nil {
+			s.opts.Used += delta(&s.reported, s.proxy.traffic.Load())
+		}
+	}
+	for _, r := range m.retiring {
+		if r.proxy != nil {
+			r.server.opts.Used += delta(&r.reported, r.proxy.traffic.Load())
+		}
+	}
+
+	type change struct {
+		server    *Server
+		exhausted bool
+	}
+	changed := make([]change, 0)
+	for _, s := range m.state {
+		if s == nil {
+			continue
+		}
+		if s.opts.Quota > 0 && s.opts.ResetAt == 0 {
+			s.opts.ResetAt = s.opts.nextReset(now)
+		}
+		if s.opts.ResetAt > 0 && now.Unix() >= s.opts.ResetAt {
+			s.opts.Used, s.opts.Extra = 0, 0
+			s.opts.ResetAt = s.opts.nextReset(now)
+		}
+		exhausted := s.opts.Quota > 0 && s.opts.Used >= s.opts.Quota+s.opts.Extra
+		if exhausted != s.opts.Limited {
+			changed = append(changed, change{s, exhausted})
+		}
+	}
+	m.mutex.Unlock()
+
+	for _, c := range changed {
+		if err := m.setLimited(c.server, c.exhausted); err != nil {
+			log.Printf("couldn't apply quota of %s: %s", c.server.opts.Name, err)
+		}
+	}
+}
+
+// setLimited restarts the service in the mode matching its quota.
+func (m *Manager) setLimited(s *Server, limited bool) error {
+	if limited {
+		log.Printf("service %s used up its traffic, applying %s mode", s.opts.Name, s.opts.QuotaMode)
+	} else {
+		log.Printf("service %s has traffic again", s.opts.Name)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.kill(); err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	s.opts.Limited = limited
+	start := s.startable()
+	m.mutex.Unlock()
+
+	if !start {
+		return nil
+	}
+	return s.spawn()
+}
+
+// setQuota changes the monthly allowance of the service, extra traffic is
+// added on top of it until the next reset. Extra traffic of the same non
+// empty key is added once.
+func (m *Manager) setQuota(name string, quota, extra int64, key string) error {
+	s := m.get(name)
+	if s == nil {
+		return errNotFound
+	}
+
+	m.mutex.Lock()
+	s.opts.Quota = quota
+	if key == "" || key != s.opts.ExtraKey {
+		s.opts.Extra += extra
+		s.opts.ExtraKey = key
+	}
+	m.mutex.Unlock()
+
+	m.applyQuota(time.Now())
+
+	return nil
+}
+
+func parseQuota(r *http.Request, opts *Options) error {
+	var err error
+	if v := r.PostFormValue("quota"); v != "" {
+		if opts.Quota, err = strconv.ParseInt(v, 10, 64); err != nil || opts.Quota < 0 {
+			return fmt.Errorf("bad quota %q", v)
+		}
+	}
+	if v := r.PostFormValue("anchor"); v != "" {
+		if opts.Anchor, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return fmt.Errorf("bad anchor %q", v)
+		}
+	}
+	switch opts.QuotaMode = r.PostFormValue("quota_mode"); opts.QuotaMode {
+	case "":
+		opts.QuotaMode = QuotaSuspend
+	case QuotaSuspend, QuotaThrottle:
+	default:
+		return fmt.Errorf("bad quota mode %q", opts.QuotaMode)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package manager
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTestService runs the builtin proxy of a service with a throttled
+// quota on a free local port.
+func startTestService(t *testing.T) (*Manager, *Server) {
+	t.Helper()
+
+	port, err := freeLocalPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newTestManager(port, port)
+	s := &Server{manager: m, opts: &Options{
+		Name:      "alice",
+		Backend:   builtinBackend,
+		Addr:      "127.0.0.1",
+		Port:      port,
+		User:      "user",
+		Pass:      "pass",
+		Quota:     100,
+		QuotaMode: QuotaThrottle,
+	}}
+	if err := s.spawn(); err != nil {
+		t.Fatal(err)
+	}
+	m.state[port] = s
+	t.Cleanup(func() { s.kill() })
+
+	return m, s
+}
+
+func setUsed(m *Manager, s *Server, used int64) {
+	m.mutex.Lock()
+	s.opts.Used = used
+	m.mutex.Unlock()
+}
+
+func TestApplyQuota(t *testing.T) {
+	m, s := startTestService(t)
+
+	setUsed(m, s, 100)
+	m.applyQuota(time.Now())
+	if !s.opts.Limited || s.relay == nil || s.port == s.opts.Port {
+		t.Fatalf("exhausted service isn't throttled: limited %t, backend on %d", s.opts.Limited, s.port)
+	}
+
+	if err := m.setQuota("alice", 100, 50, "pack-1"); err != nil {
+		t.Fatal(err)
+	}
+	if s.opts.Limited || s.relay != nil || s.port != s.opts.Port {
+		t.Fatalf("service with extra traffic is throttled: limited %t, backend on %d", s.opts.Limited, s.port)
+	}
+
+	// the same purchase sent again
+	if err := m.setQuota("alice", 100, 50, "pack-1"); err != nil {
+		t.Fatal(err)
+	}
+	if s.opts.Extra != 50 {
+		t.Errorf("extra traffic is %d, want 50", s.opts.Extra)
+	}
+}
+
+// Loops of the manager stop and start the same service concurrently, it
+// must end up running only if nothing keeps it stopped.
+func TestLifecycleRace(t *testing.T) {
+	m, s := startTestService(t)
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			setUsed(m, s, int64(i%2)*1000)
+			m.applyQuota(time.Now())
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			now := time.Now().Unix()
+			m.renew("alice", now-10, 0)
+			m.expire(s, now)
+			m.renew("alice", now+3600, 0)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			m.account(s.opts.Port, int64(i))
+		}
+	}()
+	wg.Wait()
+
+	m.mutex.RLock()
+	running, startable := s.running(), s.startable()
+	m.mutex.RUnlock()
+	if running != startable {
+		t.Errorf("service is running: %t, should be: %t", running, startable)
+	}
+
+	if err := m.remove("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if s.running() {
+		t.Error("removed service is running")
+	}
+}
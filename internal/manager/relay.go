@@ -0,0 +1,141 @@
+package manager
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// limiter paces the traffic of all connections sharing it to the given
+// number of bytes per second.
+type limiter struct {
+	rate  int64
+	next  time.Time
+	mutex sync.Mutex
+}
+
+func (l *limiter) wait(n int) {
+	l.mutex.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.mutex.Unlock()
+
+	time.Sleep(delay)
+}
+
+// relay listens on the public port of the service and forwards connections
+// to the backend moved to a loopback port, it is used to throttle services
+// since the backends have no rate limiting of their own. Only tcp is
+// relayed, udp is unavailable while the service is throttled.
+type relay struct {
+	ln     net.Listener
+	target string
+	lim    *limiter
+	conns  map[net.Conn]struct{}
+	mutex  sync.Mutex
+}
+
+func startRelay(listen, target string, rate int64) (*relay, error) {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &relay{
+		ln:     ln,
+		target: target,
+		lim:    &limiter{rate: rate},
+		conns:  make(map[net.Conn]struct{}, 0),
+	}
+	go r.serve()
+
+	return r, nil
+}
+
+func (r *relay) serve() {
+	for {
+		c, err := r.ln.Accept()
+		if err != nil {
+			return
+		}
+		go r.handle(c)
+	}
+}
+
+func (r *relay) track(c net.Conn, add bool) {
+	r.mutex.Lock()
+	if add {
+		r.conns[c] = struct{}{}
+	} else {
+		delete(r.conns, c)
+	}
+	r.mutex.Unlock()
+}
+
+func (r *relay) handle(c net.Conn) {
+	defer c.Close()
+
+	upstream, err := net.Dial("tcp", r.target)
+	if err != nil {
+		log.Printf("relay: %s", err)
+		return
+	}
+	defer upstream.Close()
+
+	r.track(c, true)
+	defer r.track(c, false)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		r.copy(upstream, c)
+		done <- struct{}{}
+	}()
+	go func() {
+		r.copy(c, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func (r *relay) copy(dst io.Writer, src io.Reader) {
+	buf := make([]byte, 16*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			r.lim.wait(n)
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *relay) close() {
+	r.ln.Close()
+
+	r.mutex.Lock()
+	for c := range r.conns {
+		c.Close()
+	}
+	r.mutex.Unlock()
+}
+
+// freeLocalPort asks the kernel for an unused loopback port.
+func freeLocalPort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
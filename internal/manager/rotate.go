@@ -0,0 +1,204 @@
+package manager
+
+import (
+	"errors"
+	"log"
+	"os/exec"
+	"time"
+)
+
+const (
+	rotationCheckInterval = 60 * time.Second
+	// old port keeps serving connected clients for this long
+	rotationOverlap = 10 * time.Minute
+)
+
+// RotateEvery is the rotation interval in seconds of the services deployed
+// without one, 0 disables scheduled rotation.
+var RotateEvery int64
+
+var (
+	errRotating     = errors.New("previous port of the service is still in use")
+	errNotRotatable = errors.New("service can't be rotated")
+)
+
+// retired is the backend left on the previous port of the rotated service
+// until the overlap window is over.
+type retired struct {
+	server   *Server
+	cmd      *exec.Cmd
+	proxy    *proxy
+	relay    *relay
+	port     int
+	reported int64
+}
+
+func (r *retired) kill() {
+	if r.relay != nil {
+		r.relay.close()
+	}
+	if r.proxy != nil {
+		r.proxy.close()
+	}
+	if r.cmd != nil {
+		r.cmd.Process.Kill()
+		r.cmd.Wait()
+	}
+}
+
+// Rotation is reported to the api server whenever the service moves to a
+// new port.
+type Rotation struct {
+	Name      string `json:"name"`
+	Port      int    `json:"port"`
+	RotatedAt int64  `json:"rotated_at"`
+}
+
+// rotatable reports whether the service owns its port, wireguard peers
+// and xray clients share the ports of the node.
+func (o *Options) rotatable() bool {
+	return o.Type != "wireguard" && o.Type != "xray"
+}
+
+func (o *Options) rotateEvery() int64 {
+	if !o.rotatable() {
+		return 0
+	}
+	if o.RotateEvery > 0 {
+		return o.RotateEvery
+	}
+	return RotateEvery
+}
+
+// rotate moves the service to a new free port keeping its password, the
+// old port is closed once the overlap window is over.
+func (m *Manager) rotate(name string) (*Rotation, error) {
+	s := m.get(name)
+	if s == nil {
+		return nil, errNotFound
+	}
+	if !s.opts.rotatable() {
+		return nil, errNotRotatable
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	m.mutex.Lock()
+	if m.state[s.opts.Port] != s {
+		m.mutex.Unlock()
+		return nil, errNotFound
+	}
+	for _, r := range m.retiring {
+		if r.server == s {
+			m.mutex.Unlock()
+			return nil, errRotating
+		}
+	}
+
+	port, err := m.freePort()
+	if err != nil {
+		m.mutex.Unlock()
+		return nil, err
+	}
+
+	prev, rotatedAt := s.opts.Port, s.opts.RotatedAt
+	old := &retired{s, s.cmd, s.proxy, s.relay, s.port, s.reported}
+	running := s.running()
+
+	s.cmd, s.proxy, s.relay = nil, nil, nil
+	s.opts.Port = port
+	s.opts.RotatedAt = time.Now().Unix()
+	m.state[port] = s
+	m.state[prev] = nil
+	if running {
+		m.retiring[prev] = old
+	}
+	m.mutex.Unlock()
+
+	log.Printf("rotating %s from port %d to %d", name, prev, port)
+
+	if running {
+		if err := s.spawn(); err != nil {
+			// keep the service on its previous port
+			m.mutex.Lock()
+			s.cmd, s.proxy, s.relay = old.cmd, old.proxy, old.relay
+			s.port, s.reported = old.port, old.reported
+			s.opts.Port, s.opts.RotatedAt = prev, rotatedAt
+			m.state[prev] = s
+			m.state[port] = nil
+			delete(m.retiring, prev)
+			m.mutex.Unlock()
+			return nil, err
+		}
+		time.AfterFunc(rotationOverlap, func() {
+			m.mutex.Lock()
+			// service could have been removed in the meantime
+			current := m.retiring[prev] == old
+			if current {
+				delete(m.retiring, prev)
+			}
+			m.mutex.Unlock()
+			if current {
+				old.kill()
+				log.Printf("closed previous port %d of %s", prev, name)
+			}
+		})
+	}
+
+	rotation := &Rotation{name, port, s.opts.RotatedAt}
+	go m.notifyRotation(rotation)
+
+	return rotation, nil
+}
+
+func (m *Manager) notifyRotation(r *Rotation) {
+	m.mutex.RLock()
+	enrollment := m.enrollment
+	m.mutex.RUnlock()
+
+	if enrollment == nil {
+		return
+	}
+
+	resp, err := m.post("/api/nodes/rotations", enrollment.Key, r)
+	if err != nil {
+		log.Printf("couldn't report rotation of %s: %s", r.Name, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// rotatePorts rotates services on their schedule.
+func (m *Manager) rotatePorts() {
+	ticker := time.NewTicker(rotationCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now().Unix()
+
+		m.mutex.RLock()
+		due := make([]string, 0)
+		for _, s := range m.state {
+			if s == nil || !s.running() {
+				continue
+			}
+			every := s.opts.rotateEvery()
+			if every > 0 && now-s.opts.RotatedAt >= every {
+				due = append(due, s.opts.Name)
+			}
+		}
+		m.mutex.RUnlock()
+
+		for _, name := range due {
+			if _, err := m.rotate(name); err != nil && !errors.Is(err, errRotating) {
+				log.Printf("couldn't rotate %s: %s", name, err)
+			}
+		}
+		if len(due) > 0 {
+			if err := m.saveState(); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
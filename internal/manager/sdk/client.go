@@ -0,0 +1,239 @@
+package managerapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTimeout = 10 * time.Second
+	defaultRetries = 2
+	defaultBackoff = 250 * time.Millisecond
+	pingTimeout    = 5 * time.Second
+)
+
+var (
+	// ErrUnavailable is returned when the manager couldn't be reached at all
+	// or kept failing on its side.
+	ErrUnavailable  = errors.New("manager is unavailable")
+	ErrNotFound     = errors.New("not found")
+	ErrConflict     = errors.New("conflict")
+	ErrUnauthorized = errors.New("unauthorized")
+)
+
+// Error is returned for every response the manager rejected, it wraps one
+// of the sentinel errors when the status has one.
+type Error struct {
+	Method string
+	Path   string
+	Status int
+	// body of the response, the manager explains bad requests there
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("manager: %s /%s: %d %s", e.Method, e.Path, e.Status, http.StatusText(e.Status))
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// transport is shared by every client so that connections to the nodes
+// are reused.
+var transport = &http.Transport{
+	Proxy:               http.ProxyFromEnvironment,
+	MaxIdleConnsPerHost: 4,
+	IdleConnTimeout:     90 * time.Second,
+}
+
+// Client talks to the manager of a single node. Addr is the base url of the
+// api including the secret, e.g. http://10.0.0.1:9000/secret/.
+type Client struct {
+	Addr string
+	// Retries is the number of extra attempts made by idempotent calls, the
+	// delay starts at Backoff and doubles every time
+	Retries int
+	Backoff time.Duration
+
+	http *http.Client
+}
+
+func NewClient(addr string) *Client {
+	if !strings.HasSuffix(addr, "/") {
+		addr += "/"
+	}
+	return &Client{
+		Addr:    addr,
+		Retries: defaultRetries,
+		Backoff: defaultBackoff,
+		http:    &http.Client{Transport: transport, Timeout: defaultTimeout},
+	}
+}
+
+// request is a single call to the manager, body is either url.Values sent
+// as a form or anything else sent as json.
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	body   interface{}
+	// expected status of the successful response
+	status int
+	// set for calls that aren't safe to repeat whatever the method is
+	noRetry bool
+}
+
+func (r *request) idempotent() bool {
+	return r.method != http.MethodPost && !r.noRetry
+}
+
+func (c *Client) do(ctx context.Context, r *request, out interface{}) error {
+	var (
+		payload     []byte
+		contentType string
+	)
+	switch body := r.body.(type) {
+	case nil:
+	case url.Values:
+		payload, contentType = []byte(body.Encode()), "application/x-www-form-urlencoded"
+	default:
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+		contentType = "application/json"
+	}
+
+	attempts := 1
+	if r.idempotent() {
+		attempts += c.Retries
+	}
+
+	var err error
+	delay := c.Backoff
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+
+		var retry bool
+		retry, err = c.try(ctx, r, payload, contentType, out)
+		if !retry {
+			return err
+		}
+	}
+
+	return err
+}
+
+// try makes a single attempt and reports whether it is worth repeating.
+func (c *Client) try(ctx context.Context, r *request, payload []byte, contentType string, out interface{}) (bool, error) {
+	u := c.Addr + r.path
+	if len(r.query) > 0 {
+		u += "?" + r.query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, r.method, u, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		return true, fmt.Errorf("%w: %s", ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	status := r.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	if resp.StatusCode != status {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		e := &Error{
+			Method:  r.method,
+			Path:    r.path,
+			Status:  resp.StatusCode,
+			Message: strings.TrimSpace(string(msg)),
+		}
+		switch {
+		case resp.StatusCode == http.StatusNotFound:
+			e.Err = ErrNotFound
+		case resp.StatusCode == http.StatusConflict:
+			e.Err = ErrConflict
+		case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+			e.Err = ErrUnauthorized
+		case resp.StatusCode >= http.StatusInternalServerError:
+			e.Err = ErrUnavailable
+			return true, e
+		}
+		return false, e
+	}
+
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return false, fmt.Errorf("manager: %s /%s: %w", r.method, r.path, err)
+	}
+
+	return false, nil
+}
+
+// Ping checks that the manager is alive and returns the round trip time,
+// it isn't retried.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	u, err := url.Parse(c.Addr)
+	if err != nil {
+		return 0, err
+	}
+	u.Path = "/ping"
+
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, ErrUnavailable
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, ErrUnavailable
+	}
+
+	return time.Since(start), nil
+}
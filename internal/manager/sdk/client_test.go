@@ -0,0 +1,194 @@
+package managerapi_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	managerapi "github.com/demtoni/tade/internal/manager/sdk"
+	"github.com/demtoni/tade/internal/manager/sdk/managertest"
+)
+
+func newTestManager(t *testing.T) (*managertest.Server, *managerapi.Client) {
+	t.Helper()
+
+	m := managertest.NewServer()
+	t.Cleanup(m.Close)
+	return m, m.Client()
+}
+
+func TestShadowsocks(t *testing.T) {
+	m, c := newTestManager(t)
+	ctx := context.Background()
+
+	expires := time.Now().Add(time.Hour).Unix()
+	if err := c.DeployShadowsocks(ctx, &managerapi.Shadowsocks{Name: "alice-1", Method: "aes-256-gcm", ExpiresAt: expires}); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := c.GetShadowsocks(ctx, "alice-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := m.Service("alice-1")
+	if config.Method != "aes-256-gcm" || config.Port != srv.Port || config.Password != srv.Password || config.ExpiresAt != expires {
+		t.Errorf("got %+v for %+v", config, srv)
+	}
+
+	if err := c.Renew(ctx, "alice-1", expires+3600, 60); err != nil {
+		t.Fatal(err)
+	}
+	if srv := m.Service("alice-1"); srv.ExpiresAt != expires+3600 || srv.Grace != 60 {
+		t.Errorf("renewed until %d with grace %d", srv.ExpiresAt, srv.Grace)
+	}
+
+	if err := c.Delete(ctx, "alice-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetShadowsocks(ctx, "alice-1"); !errors.Is(err, managerapi.ErrNotFound) {
+		t.Errorf("deleted service: got %v, want %v", err, managerapi.ErrNotFound)
+	}
+}
+
+func TestDeployConflict(t *testing.T) {
+	_, c := newTestManager(t)
+	ctx := context.Background()
+
+	ss := &managerapi.Shadowsocks{Name: "alice-1"}
+	if err := c.DeployShadowsocks(ctx, ss); err != nil {
+		t.Fatal(err)
+	}
+	err := c.DeployShadowsocks(ctx, ss)
+	if !errors.Is(err, managerapi.ErrConflict) {
+		t.Fatalf("got %v, want %v", err, managerapi.ErrConflict)
+	}
+	var e *managerapi.Error
+	if !errors.As(err, &e) || e.Message != "name is already taken" {
+		t.Errorf("error doesn't carry the reason: %v", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	m, c := newTestManager(t)
+	ctx := context.Background()
+
+	// idempotent calls are repeated
+	m.Fail(c.Retries)
+	if _, err := c.Info(ctx); err != nil {
+		t.Fatal(err)
+	}
+	m.Fail(c.Retries + 1)
+	if _, err := c.Info(ctx); !errors.Is(err, managerapi.ErrUnavailable) {
+		t.Errorf("got %v, want %v", err, managerapi.ErrUnavailable)
+	}
+
+	// deploys aren't
+	m.Fail(1)
+	before := len(m.Requests())
+	if err := c.DeployShadowsocks(ctx, &managerapi.Shadowsocks{Name: "alice-1"}); !errors.Is(err, managerapi.ErrUnavailable) {
+		t.Errorf("got %v, want %v", err, managerapi.ErrUnavailable)
+	}
+	if n := len(m.Requests()) - before; n != 1 {
+		t.Errorf("deploy was sent %d times", n)
+	}
+}
+
+func TestUpdateQuota(t *testing.T) {
+	m, c := newTestManager(t)
+	ctx := context.Background()
+
+	if err := c.DeployShadowsocks(ctx, &managerapi.Shadowsocks{Name: "alice-1", Quota: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	// extra traffic without a key would be added on every attempt
+	m.Fail(1)
+	before := len(m.Requests())
+	if err := c.UpdateQuota(ctx, "alice-1", 100, 50, ""); !errors.Is(err, managerapi.ErrUnavailable) {
+		t.Errorf("got %v, want %v", err, managerapi.ErrUnavailable)
+	}
+	if n := len(m.Requests()) - before; n != 1 {
+		t.Errorf("quota was sent %d times", n)
+	}
+
+	m.Fail(1)
+	if err := c.UpdateQuota(ctx, "alice-1", 100, 50, "pack-1"); err != nil {
+		t.Fatal(err)
+	}
+	// the response of the purchase was lost and it is sent again
+	if err := c.UpdateQuota(ctx, "alice-1", 100, 50, "pack-1"); err != nil {
+		t.Fatal(err)
+	}
+	if srv := m.Service("alice-1"); srv.Extra != 50 {
+		t.Errorf("extra traffic is %d, want 50", srv.Extra)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	m, _ := newTestManager(t)
+
+	c := managerapi.NewClient(m.URL + "/wrong")
+	c.Backoff = 0
+	if _, err := c.Info(context.Background()); !errors.Is(err, managerapi.ErrUnauthorized) {
+		t.Errorf("got %v, want %v", err, managerapi.ErrUnauthorized)
+	}
+}
+
+func TestNewClientAddr(t *testing.T) {
+	m, _ := newTestManager(t)
+
+	c := managerapi.NewClient(strings.TrimSuffix(m.Addr(), "/"))
+	if c.Addr != m.Addr() {
+		t.Errorf("address is %s, want %s", c.Addr, m.Addr())
+	}
+	if _, err := c.Info(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	_, c := newTestManager(t)
+	ctx := context.Background()
+
+	p := &managerapi.Policy{Name: "strict", CIDRs: []string{"10.0.0.0/8"}}
+	if err := c.PutPolicy(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	list, err := c.ListPolicies(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name != "strict" || len(list[0].CIDRs) != 1 {
+		t.Fatalf("listed %+v", list)
+	}
+
+	if err := c.DeployShadowsocks(ctx, &managerapi.Shadowsocks{Name: "alice-1", ACL: "strict"}); err != nil {
+		t.Fatal(err)
+	}
+	// shadowsocks backends can't block ports
+	p.BlockedPorts = []int{25}
+	if err := c.PutPolicy(ctx, p); err != managerapi.ErrPolicyUnsupported {
+		t.Errorf("got %v, want %v", err, managerapi.ErrPolicyUnsupported)
+	}
+	if err := c.DeletePolicy(ctx, "strict"); err != managerapi.ErrPolicyInUse {
+		t.Errorf("got %v, want %v", err, managerapi.ErrPolicyInUse)
+	}
+	if err := c.DeletePolicy(ctx, "unknown"); err != nil {
+		t.Errorf("deleting unknown policy: %v", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	m, c := newTestManager(t)
+	ctx := context.Background()
+
+	if _, err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+	if _, err := c.Ping(ctx); err != managerapi.ErrUnavailable {
+		t.Errorf("got %v, want %v", err, managerapi.ErrUnavailable)
+	}
+}
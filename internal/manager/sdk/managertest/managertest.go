@@ -0,0 +1,526 @@
+// Package managertest provides an in-memory manager served by httptest for
+// the tests of the api server.
+package managertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	managerapi "github.com/demtoni/tade/internal/manager/sdk"
+)
+
+const (
+	// Secret protects the api of every fake manager
+	Secret = "secret"
+
+	firstPort = 20000
+	portCount = 100
+)
+
+// Service is the state of the deployed service, Form holds the fields the
+// service was deployed with.
+type Service struct {
+	Type      string
+	Form      url.Values
+	Port      int
+	Password  string
+	ExpiresAt int64
+	Grace     int64
+	ExpiredAt int64
+	Quota     int64
+	Extra     int64
+	ExtraKey  string
+	Used      int64
+	RotatedAt int64
+}
+
+// Server is a fake manager. It keeps services and policies in memory and
+// answers the same way the real one does, without starting any backend.
+type Server struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	info     managerapi.Info
+	services map[string]*Service
+	policies map[string]*managerapi.Policy
+	// number of upcoming requests answered with 503
+	failures int
+	requests []string
+}
+
+func NewServer() *Server {
+	s := &Server{
+		info: managerapi.Info{
+			Version:  "test",
+			Services: []string{"proxy", "shadowsocks", "wireguard", "xray"},
+			Backends: []string{"builtin", "ssserver", "wg", "xray"},
+			Methods:  []string{"aes-128-gcm", "aes-256-gcm", "chacha20-ietf-poly1305"},
+			Plugins:  []string{"none", "v2ray"},
+		},
+		services: make(map[string]*Service, 0),
+		policies: make(map[string]*managerapi.Policy, 0),
+	}
+	s.Server = httptest.NewServer(s.handler())
+	return s
+}
+
+// Addr returns the base url of the api the way it is stored for the node.
+func (s *Server) Addr() string {
+	return s.URL + "/" + Secret + "/"
+}
+
+// Client returns the client of the fake manager without delays between
+// retries.
+func (s *Server) Client() *managerapi.Client {
+	c := managerapi.NewClient(s.Addr())
+	c.Backoff = 0
+	return c
+}
+
+// SetInfo replaces the capabilities reported by the node, port counters are
+// always computed from the deployed services.
+func (s *Server) SetInfo(info managerapi.Info) {
+	s.mutex.Lock()
+	s.info = info
+	s.mutex.Unlock()
+}
+
+// Fail makes the next n requests fail with 503.
+func (s *Server) Fail(n int) {
+	s.mutex.Lock()
+	s.failures = n
+	s.mutex.Unlock()
+}
+
+// Requests returns every request received so far as "METHOD /path".
+func (s *Server) Requests() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// Service returns copy of the deployed service or nil.
+func (s *Server) Service(name string) *Service {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	srv, ok := s.services[name]
+	if !ok {
+		return nil
+	}
+	c := *srv
+	return &c
+}
+
+// Services returns names of the deployed services.
+func (s *Server) Services() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	names := make([]string, 0, len(s.services))
+	for name := range s.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Expire stops the service as the manager does once its grace period is
+// over.
+func (s *Server) Expire(name string) {
+	s.mutex.Lock()
+	if srv, ok := s.services[name]; ok {
+		srv.ExpiredAt = time.Now().Unix()
+	}
+	s.mutex.Unlock()
+}
+
+// AddTraffic accounts traffic used by the service.
+func (s *Server) AddTraffic(name string, n int64) {
+	s.mutex.Lock()
+	if srv, ok := s.services[name]; ok {
+		srv.Used += n
+	}
+	s.mutex.Unlock()
+}
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	prefix := "/" + Secret
+
+	mux.HandleFunc("GET /ping", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("GET "+prefix+"/info", s.getInfo)
+	mux.HandleFunc("POST "+prefix+"/", s.deploy)
+	mux.HandleFunc("GET "+prefix+"/acl", s.listPolicies)
+	mux.HandleFunc("PUT "+prefix+"/acl/{name}", s.putPolicy)
+	mux.HandleFunc("DELETE "+prefix+"/acl/{name}", s.deletePolicy)
+	mux.HandleFunc("PUT "+prefix+"/quota/{name}", s.updateQuota)
+	mux.HandleFunc("POST "+prefix+"/rotate/{name}", s.rotate)
+	mux.HandleFunc("POST "+prefix+"/rotate", s.rotateAll)
+	mux.HandleFunc("GET "+prefix+"/expired", s.expirations)
+	mux.HandleFunc("GET "+prefix+"/{name}", s.config)
+	mux.HandleFunc("PUT "+prefix+"/{name}", s.renew)
+	mux.HandleFunc("DELETE "+prefix+"/{name}", s.remove)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, prefix+"/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+		fail := s.failures > 0
+		if fail {
+			s.failures--
+		}
+		s.mutex.Unlock()
+
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(v)
+}
+
+func formInt(r *http.Request, key string) int64 {
+	v, _ := strconv.ParseInt(r.PostFormValue(key), 10, 64)
+	return v
+}
+
+func (s *Server) freePort() int {
+	used := make(map[int]bool, len(s.services))
+	for _, srv := range s.services {
+		used[srv.Port] = true
+	}
+	for port := firstPort; port < firstPort+portCount; port++ {
+		if !used[port] {
+			return port
+		}
+	}
+	return 0
+}
+
+func (s *Server) getInfo(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	info := s.info
+	info.Ports = managerapi.PortInfo{Total: portCount, Used: len(s.services)}
+	s.mutex.Unlock()
+
+	writeJSON(w, info)
+}
+
+func (s *Server) deploy(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostFormValue("name") == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name := r.PostFormValue("name")
+	if _, ok := s.services[name]; ok {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("name is already taken"))
+		return
+	}
+	if acl := r.PostFormValue("acl"); acl != "" {
+		p := s.policies[acl]
+		if p == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "unknown policy %s", acl)
+			return
+		}
+		if !enforces(r.PostFormValue("type"), p) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "policy %s can't be enforced", acl)
+			return
+		}
+	}
+
+	port := s.freePort()
+	if port == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("couldn't find free port"))
+		return
+	}
+
+	srv := &Service{
+		Type:      r.PostFormValue("type"),
+		Form:      r.PostForm,
+		Port:      port,
+		Password:  fmt.Sprintf("password-%s", name),
+		ExpiresAt: formInt(r, "expires_at"),
+		Grace:     formInt(r, "grace"),
+		Quota:     formInt(r, "quota"),
+		RotatedAt: time.Now().Unix(),
+	}
+	if srv.Type == "" {
+		srv.Type = "shadowsocks"
+	}
+	s.services[name] = srv
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) config(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	s.mutex.Lock()
+	srv, ok := s.services[name]
+	if !ok {
+		s.mutex.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	config := map[string]interface{}{
+		"type":       srv.Type,
+		"password":   srv.Password,
+		"port":       srv.Port,
+		"expires_at": srv.ExpiresAt,
+		"expired":    srv.ExpiredAt > 0,
+		"used":       srv.Used,
+		"clients":    0,
+		"rotated_at": srv.RotatedAt,
+		"quota_mode": srv.Form.Get("quota_mode"),
+	}
+	if srv.Quota > 0 {
+		config["quota"] = srv.Quota + srv.Extra
+		config["limited"] = srv.Used >= srv.Quota+srv.Extra
+	}
+
+	switch srv.Type {
+	case "shadowsocks":
+		method := srv.Form.Get("method")
+		if method == "" {
+			method = "chacha20-ietf-poly1305"
+		}
+		config["method"] = method
+		config["connect_url"] = (&managerapi.ShadowsocksConfig{Method: method, Password: srv.Password, Port: srv.Port}).URL("127.0.0.1")
+	case "proxy":
+		config["username"] = name
+	case "wireguard":
+		config["address"] = fmt.Sprintf("10.8.0.%d", srv.Port-firstPort+2)
+		config["public_key"] = "c2VydmVyLXB1YmxpYy1rZXktMDEyMzQ1Njc4OWFiY2Q="
+		config["port"] = 51820
+	case "xray":
+		protocol := srv.Form.Get("protocol")
+		if protocol == "" {
+			protocol = "vless"
+		}
+		config["protocol"] = protocol
+		config["port"] = 443
+	}
+	s.mutex.Unlock()
+
+	writeJSON(w, config)
+}
+
+func (s *Server) renew(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	srv, ok := s.services[r.PathValue("name")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	srv.ExpiresAt, srv.Grace = formInt(r, "expires_at"), formInt(r, "grace")
+	if srv.ExpiresAt+srv.Grace > time.Now().Unix() {
+		srv.ExpiredAt = 0
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) remove(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name := r.PathValue("name")
+	if _, ok := s.services[name]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	delete(s.services, name)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) listPolicies(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	list := make([]*managerapi.Policy, 0, len(s.policies))
+	for _, p := range s.policies {
+		list = append(list, p)
+	}
+	s.mutex.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSON(w, list)
+}
+
+func (s *Server) putPolicy(w http.ResponseWriter, r *http.Request) {
+	p := &managerapi.Policy{}
+	if err := json.NewDecoder(r.Body).Decode(p); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	p.Name = r.PathValue("name")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, srv := range s.services {
+		if srv.Form.Get("acl") == p.Name && !enforces(srv.Type, p) {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "policy %s can't be enforced", p.Name)
+			return
+		}
+	}
+	s.policies[p.Name] = p
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// enforces matches the manager running shadowsocks with ssserver, which
+// can't block ports, wireguard and xray services don't use policies.
+func enforces(typ string, p *managerapi.Policy) bool {
+	switch typ {
+	case "wireguard", "xray":
+		return false
+	case "", "shadowsocks":
+		return len(p.BlockedPorts) == 0
+	}
+	return true
+}
+
+func (s *Server) deletePolicy(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name := r.PathValue("name")
+	if _, ok := s.policies[name]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	for _, srv := range s.services {
+		if srv.Form.Get("acl") == name {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+	}
+	delete(s.policies, name)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) updateQuota(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	srv, ok := s.services[r.PathValue("name")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	srv.Quota = formInt(r, "quota")
+	if key := r.PostFormValue("key"); key == "" || key != srv.ExtraKey {
+		srv.Extra += formInt(r, "extra")
+		srv.ExtraKey = key
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// rotatable matches the manager, services sharing the ports of the node
+// can't be moved.
+func (srv *Service) rotatable() bool {
+	return srv.Type != "wireguard" && srv.Type != "xray"
+}
+
+func (s *Server) rotateLocked(name string) (*managerapi.Rotation, int) {
+	srv, ok := s.services[name]
+	switch {
+	case !ok:
+		return nil, http.StatusNotFound
+	case !srv.rotatable():
+		return nil, http.StatusBadRequest
+	}
+
+	port := s.freePort()
+	if port == 0 {
+		return nil, http.StatusInternalServerError
+	}
+	srv.Port, srv.RotatedAt = port, time.Now().Unix()
+
+	return &managerapi.Rotation{Name: name, Port: srv.Port, RotatedAt: srv.RotatedAt}, http.StatusOK
+}
+
+func (s *Server) rotate(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	rotation, status := s.rotateLocked(r.PathValue("name"))
+	s.mutex.Unlock()
+
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+	writeJSON(w, rotation)
+}
+
+func (s *Server) rotateAll(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	list := make([]*managerapi.Rotation, 0)
+	for name := range s.services {
+		if rotation, status := s.rotateLocked(name); status == http.StatusOK {
+			list = append(list, rotation)
+		}
+	}
+	s.mutex.Unlock()
+
+	writeJSON(w, list)
+}
+
+func (s *Server) expirations(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	list := make([]*managerapi.Expiration, 0)
+	for name, srv := range s.services {
+		if srv.ExpiredAt > 0 {
+			list = append(list, &managerapi.Expiration{Name: name, ExpiresAt: srv.ExpiresAt, ExpiredAt: srv.ExpiredAt})
+		}
+	}
+	s.mutex.Unlock()
+
+	writeJSON(w, list)
+}
@@ -0,0 +1,144 @@
+package managerapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+type PortInfo struct {
+	Total int `json:"total"`
+	Used  int `json:"used"`
+}
+
+type Info struct {
+	Version     string   `json:"version"`
+	Services    []string `json:"services"`
+	Backends    []string `json:"backends"`
+	Methods     []string `json:"methods"`
+	Plugins     []string `json:"plugins"`
+	Ports       PortInfo `json:"ports"`
+	Connections int      `json:"connections"`
+	Uptime      int64    `json:"uptime"`
+}
+
+func (c *Client) Info(ctx context.Context) (*Info, error) {
+	info := &Info{}
+	if err := c.get(ctx, "info", info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Usage is reported by the manager for every service regardless of its
+// type.
+type Usage struct {
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	Expired   bool  `json:"expired,omitempty"`
+	// traffic allowance of the current period in bytes, 0 is unlimited
+	Quota     int64  `json:"quota,omitempty"`
+	Used      int64  `json:"used"`
+	ResetAt   int64  `json:"reset_at,omitempty"`
+	QuotaMode string `json:"quota_mode,omitempty"`
+	Limited   bool   `json:"limited,omitempty"`
+	// distinct client addresses seen recently
+	Clients        int   `json:"clients"`
+	MaxIPs         int   `json:"max_ips,omitempty"`
+	SuspendedUntil int64 `json:"suspended_until,omitempty"`
+	RotatedAt      int64 `json:"rotated_at,omitempty"`
+}
+
+func (c *Client) get(ctx context.Context, path string, out interface{}) error {
+	return c.do(ctx, &request{method: http.MethodGet, path: path}, out)
+}
+
+// deploy creates the service described by the form, ErrConflict is
+// returned when the name is already taken.
+func (c *Client) deploy(ctx context.Context, form url.Values) error {
+	return c.do(ctx, &request{method: http.MethodPost, body: form, status: http.StatusCreated}, nil)
+}
+
+// Renew sends new expiry date of the service, the node starts it again if
+// it was stopped because of the expiry.
+func (c *Client) Renew(ctx context.Context, name string, expiresAt, grace int64) error {
+	return c.do(ctx, &request{
+		method: http.MethodPut,
+		path:   url.PathEscape(name),
+		body: url.Values{
+			"expires_at": {strconv.FormatInt(expiresAt, 10)},
+			"grace":      {strconv.FormatInt(grace, 10)},
+		},
+	}, nil)
+}
+
+// Delete removes the service of any type from the node.
+func (c *Client) Delete(ctx context.Context, name string) error {
+	return c.do(ctx, &request{method: http.MethodDelete, path: url.PathEscape(name)}, nil)
+}
+
+// UpdateQuota changes monthly traffic of the service, extra traffic is added
+// to the current period only. The node adds extra traffic of the same key
+// once, the call is only repeated when the key is given.
+func (c *Client) UpdateQuota(ctx context.Context, name string, quota, extra int64, key string) error {
+	return c.do(ctx, &request{
+		method: http.MethodPut,
+		path:   "quota/" + url.PathEscape(name),
+		body: url.Values{
+			"quota": {strconv.FormatInt(quota, 10)},
+			"extra": {strconv.FormatInt(extra, 10)},
+			"key":   {key},
+		},
+		noRetry: extra > 0 && key == "",
+	}, nil)
+}
+
+type Rotation struct {
+	Name      string `json:"name"`
+	Port      int    `json:"port"`
+	RotatedAt int64  `json:"rotated_at"`
+}
+
+// ErrRotating is returned when the previous port of the service is still
+// open after the last rotation.
+var ErrRotating = fmt.Errorf("service was rotated recently: %w", ErrConflict)
+
+// Rotate moves the service to a new port keeping its password.
+func (c *Client) Rotate(ctx context.Context, name string) (*Rotation, error) {
+	rotation := &Rotation{}
+	err := c.do(ctx, &request{method: http.MethodPost, path: "rotate/" + url.PathEscape(name)}, rotation)
+	if errors.Is(err, ErrConflict) {
+		return nil, ErrRotating
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rotation, nil
+}
+
+// RotateNode moves every service of the node to new ports, e.g. when the
+// whole port range got blocked.
+func (c *Client) RotateNode(ctx context.Context) ([]*Rotation, error) {
+	list := make([]*Rotation, 0)
+	if err := c.do(ctx, &request{method: http.MethodPost, path: "rotate"}, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+type Expiration struct {
+	Name      string `json:"name"`
+	ExpiresAt int64  `json:"expires_at"`
+	ExpiredAt int64  `json:"expired_at"`
+}
+
+// Expirations lists services the manager stopped on its own.
+func (c *Client) Expirations(ctx context.Context) ([]*Expiration, error) {
+	list := make([]*Expiration, 0)
+	if err := c.get(ctx, "expired", &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
@@ -0,0 +1,56 @@
+package managerapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Policy is a named set of outbound restrictions applied to the services
+// deployed with it.
+type Policy struct {
+	Name         string   `json:"name"`
+	BlockedPorts []int    `json:"blocked_ports,omitempty"`
+	CIDRs        []string `json:"cidrs,omitempty"`
+	Domains      []string `json:"domains,omitempty"`
+}
+
+// ErrPolicyInUse is returned when the policy is still used by services.
+var ErrPolicyInUse = fmt.Errorf("policy is used by services: %w", ErrConflict)
+
+// ErrPolicyUnsupported is returned when services using the policy can't
+// enforce it, shadowsocks backends can't block ports.
+var ErrPolicyUnsupported = fmt.Errorf("policy can't be enforced by services: %w", ErrConflict)
+
+// PutPolicy creates or replaces the policy on the node, services using it
+// are restarted by the manager.
+func (c *Client) PutPolicy(ctx context.Context, p *Policy) error {
+	err := c.do(ctx, &request{method: http.MethodPut, path: "acl/" + url.PathEscape(p.Name), body: p}, nil)
+	if errors.Is(err, ErrConflict) {
+		return ErrPolicyUnsupported
+	}
+	return err
+}
+
+// ListPolicies returns every policy known to the node.
+func (c *Client) ListPolicies(ctx context.Context) ([]*Policy, error) {
+	list := make([]*Policy, 0)
+	if err := c.get(ctx, "acl", &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// DeletePolicy removes the policy, deleting unknown policy isn't an error.
+func (c *Client) DeletePolicy(ctx context.Context, name string) error {
+	err := c.do(ctx, &request{method: http.MethodDelete, path: "acl/" + url.PathEscape(name)}, nil)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return nil
+	case errors.Is(err, ErrConflict):
+		return ErrPolicyInUse
+	}
+	return err
+}
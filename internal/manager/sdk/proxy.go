@@ -0,0 +1,59 @@
+package managerapi
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// Proxy describes authenticated SOCKS5 and HTTP CONNECT proxy served by
+// the manager itself, both protocols share the same port.
+type Proxy struct {
+	Name        string `json:"name"`
+	ACL         string `json:"acl,omitempty"`
+	MaxIPs      int    `json:"max_ips,omitempty"`
+	Quota       int64  `json:"quota,omitempty"`
+	QuotaMode   string `json:"quota_mode,omitempty"`
+	Anchor      int64  `json:"anchor,omitempty"`
+	RotateEvery int64  `json:"rotate_every,omitempty"`
+	ExpiresAt   int64  `json:"expires_at,omitempty"`
+	Grace       int64  `json:"grace,omitempty"`
+}
+
+type ProxyConfig struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Port     int    `json:"port"`
+	Usage
+}
+
+// URL builds proxy url with credentials, scheme is either socks5 or http.
+func (c *ProxyConfig) URL(scheme, host string) string {
+	return (&url.URL{
+		Scheme: scheme,
+		User:   url.UserPassword(c.Username, c.Password),
+		Host:   net.JoinHostPort(host, strconv.Itoa(c.Port)),
+	}).String()
+}
+
+func (c *Client) GetProxy(ctx context.Context, name string) (*ProxyConfig, error) {
+	data := &ProxyConfig{}
+	if err := c.get(ctx, name, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (c *Client) DeployProxy(ctx context.Context, p *Proxy) error {
+	return c.deploy(ctx, url.Values{
+		"type": {"proxy"}, "name": {p.Name}, "acl": {p.ACL},
+		"max_ips":      {strconv.Itoa(p.MaxIPs)},
+		"quota":        {strconv.FormatInt(p.Quota, 10)},
+		"quota_mode":   {p.QuotaMode},
+		"anchor":       {strconv.FormatInt(p.Anchor, 10)},
+		"rotate_every": {strconv.FormatInt(p.RotateEvery, 10)},
+		"expires_at":   {strconv.FormatInt(p.ExpiresAt, 10)},
+		"grace":        {strconv.FormatInt(p.Grace, 10)},
+	})
+}
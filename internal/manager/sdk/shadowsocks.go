@@ -1,75 +1,68 @@
 package managerapi
 
 import (
-	"encoding/json"
-	"errors"
-	"io"
-	"log"
-	"net/http"
+	"context"
+	"encoding/base64"
+	"net"
 	"net/url"
+	"strconv"
 )
 
+// Shadowsocks describes the service to deploy, zero values are filled in
+// with the defaults of the manager.
 type Shadowsocks struct {
 	Name   string `json:"name"`
 	Method string `json:"method"`
 	Plugin string `json:"plugin"`
+	ACL    string `json:"acl,omitempty"`
+	MaxIPs int    `json:"max_ips,omitempty"`
+	// monthly traffic in bytes reset on the anniversaries of the anchor,
+	// QuotaMode is either suspend or throttle
+	Quota     int64  `json:"quota,omitempty"`
+	QuotaMode string `json:"quota_mode,omitempty"`
+	Anchor    int64  `json:"anchor,omitempty"`
+	// port rotation interval in seconds, node default is used when unset
+	RotateEvery int64 `json:"rotate_every,omitempty"`
+	ExpiresAt   int64 `json:"expires_at,omitempty"`
+	Grace       int64 `json:"grace,omitempty"`
 }
 
-func GetShadowsocks(addr, name string) (map[string]interface{}, error) {
-	resp, err := http.Get(addr + name)
-	// TODO: send that server is down if no status code
-	if err != nil {
-		return nil, errors.New("couldn't get configuration: server is down?")
-	}
-	defer resp.Body.Close()
+type ShadowsocksConfig struct {
+	ConnectURL string `json:"connect_url"`
+	Method     string `json:"method"`
+	Password   string `json:"password"`
+	Port       int    `json:"port"`
+	Plugin     string `json:"plugin,omitempty"`
+	Usage
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, errors.New("failed to read response body.")
+// URL builds SIP002 connect url for the given public hostname of the node.
+func (c *ShadowsocksConfig) URL(host string) string {
+	userinfo := base64.RawURLEncoding.EncodeToString([]byte(c.Method + ":" + c.Password))
+	uri := "ss://" + userinfo + "@" + net.JoinHostPort(host, strconv.Itoa(c.Port)) + "/"
+	if c.Plugin != "" {
+		uri += "?plugin=" + url.QueryEscape(c.Plugin+";host="+host)
 	}
+	return uri
+}
 
-	data := make(map[string]interface{}, 0)
-
-	log.Println(string(body))
-	if err := json.Unmarshal(body, &data); err != nil {
-		log.Println(err)
-		return nil, errors.New("failed to unmarshal json.")
+func (c *Client) GetShadowsocks(ctx context.Context, name string) (*ShadowsocksConfig, error) {
+	data := &ShadowsocksConfig{}
+	if err := c.get(ctx, name, data); err != nil {
+		return nil, err
 	}
-
 	return data, nil
 }
 
-func DeployShadowsocks(addr, name, method, plugin string) error {
-	resp, err := http.PostForm(addr, url.Values{
-		"name": {name}, "method": {method}, "plugin": {plugin},
+func (c *Client) DeployShadowsocks(ctx context.Context, ss *Shadowsocks) error {
+	return c.deploy(ctx, url.Values{
+		"name": {ss.Name}, "method": {ss.Method}, "plugin": {ss.Plugin}, "acl": {ss.ACL},
+		"max_ips":      {strconv.Itoa(ss.MaxIPs)},
+		"quota":        {strconv.FormatInt(ss.Quota, 10)},
+		"quota_mode":   {ss.QuotaMode},
+		"anchor":       {strconv.FormatInt(ss.Anchor, 10)},
+		"rotate_every": {strconv.FormatInt(ss.RotateEvery, 10)},
+		"expires_at":   {strconv.FormatInt(ss.ExpiresAt, 10)},
+		"grace":        {strconv.FormatInt(ss.Grace, 10)},
 	})
-	if err != nil {
-		return err
-	}
-
-	// TODO: send that server is down if no status code
-	if resp.StatusCode != http.StatusCreated {
-		return errors.New("couldn't create new service: name is probably already taken.")
-	}
-
-	return nil
-}
-
-func DeleteShadowsocks(addr, name string) error {
-	req, err := http.NewRequest(http.MethodDelete, addr+name, nil)
-	if err != nil {
-		return errors.New("couldn't build request")
-	}
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return errors.New("couldn't delete configuration: server is down?")
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("couldn't delete service: it doesn't exist")
-	}
-
-	return nil
 }
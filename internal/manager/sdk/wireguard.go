@@ -0,0 +1,66 @@
+package managerapi
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// WireGuard describes a peer of the wireguard interface of the node, the
+// key pair of the client is generated by the manager.
+type WireGuard struct {
+	Name      string `json:"name"`
+	Quota     int64  `json:"quota,omitempty"`
+	Anchor    int64  `json:"anchor,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	Grace     int64  `json:"grace,omitempty"`
+}
+
+type WireGuardConfig struct {
+	PrivateKey string `json:"password"`
+	Address    string `json:"address"`
+	PublicKey  string `json:"public_key"`
+	Port       int    `json:"port"`
+	DNS        string `json:"dns,omitempty"`
+	Usage
+}
+
+// Endpoint returns address of the node interface for the given hostname.
+func (c *WireGuardConfig) Endpoint(host string) string {
+	return net.JoinHostPort(host, strconv.Itoa(c.Port))
+}
+
+// Conf renders complete client config connecting to the given hostname.
+func (c *WireGuardConfig) Conf(host string) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "[Interface]\nPrivateKey = %s\nAddress = %s/32\n", c.PrivateKey, c.Address)
+	if c.DNS != "" {
+		fmt.Fprintf(&b, "DNS = %s\n", c.DNS)
+	}
+	fmt.Fprintf(&b, "\n[Peer]\nPublicKey = %s\nEndpoint = %s\nAllowedIPs = 0.0.0.0/0, ::/0\nPersistentKeepalive = 25\n",
+		c.PublicKey, c.Endpoint(host))
+
+	return b.String()
+}
+
+func (c *Client) GetWireGuard(ctx context.Context, name string) (*WireGuardConfig, error) {
+	data := &WireGuardConfig{}
+	if err := c.get(ctx, name, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (c *Client) DeployWireGuard(ctx context.Context, p *WireGuard) error {
+	return c.deploy(ctx, url.Values{
+		"type": {"wireguard"}, "name": {p.Name},
+		"quota":      {strconv.FormatInt(p.Quota, 10)},
+		"anchor":     {strconv.FormatInt(p.Anchor, 10)},
+		"expires_at": {strconv.FormatInt(p.ExpiresAt, 10)},
+		"grace":      {strconv.FormatInt(p.Grace, 10)},
+	})
+}
@@ -0,0 +1,86 @@
+package managerapi
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// Xray describes a client of the vless or vmess inbound of the node, the
+// client id is generated by the manager.
+type Xray struct {
+	Name      string `json:"name"`
+	Protocol  string `json:"protocol"`
+	Quota     int64  `json:"quota,omitempty"`
+	Anchor    int64  `json:"anchor,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	Grace     int64  `json:"grace,omitempty"`
+}
+
+type XrayConfig struct {
+	UUID     string `json:"password"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+	Security string `json:"security,omitempty"`
+	SNI      string `json:"sni,omitempty"`
+	// reality only
+	PublicKey string `json:"public_key,omitempty"`
+	ShortID   string `json:"short_id,omitempty"`
+	Flow      string `json:"flow,omitempty"`
+	Usage
+}
+
+// Link builds vless:// or vmess:// share link for the given hostname, name
+// is shown by the clients.
+func (c *XrayConfig) Link(host, name string) string {
+	if c.Protocol == "vmess" {
+		data, _ := json.Marshal(map[string]string{
+			"v": "2", "ps": name, "add": host, "port": strconv.Itoa(c.Port),
+			"id": c.UUID, "aid": "0", "scy": "auto", "net": "tcp", "type": "none",
+		})
+		return "vmess://" + base64.StdEncoding.EncodeToString(data)
+	}
+
+	q := url.Values{}
+	q.Set("encryption", "none")
+	q.Set("flow", c.Flow)
+	q.Set("type", "tcp")
+	q.Set("security", c.Security)
+	if c.PublicKey != "" {
+		q.Set("sni", c.SNI)
+		q.Set("fp", "chrome")
+		q.Set("pbk", c.PublicKey)
+		q.Set("sid", c.ShortID)
+	} else {
+		q.Set("sni", host)
+	}
+
+	return (&url.URL{
+		Scheme:   "vless",
+		User:     url.User(c.UUID),
+		Host:     net.JoinHostPort(host, strconv.Itoa(c.Port)),
+		RawQuery: q.Encode(),
+		Fragment: name,
+	}).String()
+}
+
+func (c *Client) GetXray(ctx context.Context, name string) (*XrayConfig, error) {
+	data := &XrayConfig{}
+	if err := c.get(ctx, name, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (c *Client) DeployXray(ctx context.Context, p *Xray) error {
+	return c.deploy(ctx, url.Values{
+		"type": {"xray"}, "name": {p.Name}, "protocol": {p.Protocol},
+		"quota":      {strconv.FormatInt(p.Quota, 10)},
+		"anchor":     {strconv.FormatInt(p.Anchor, 10)},
+		"expires_at": {strconv.FormatInt(p.ExpiresAt, 10)},
+		"grace":      {strconv.FormatInt(p.Grace, 10)},
+	})
+}
@@ -0,0 +1,255 @@
+package manager
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const wgBackend = "wg"
+
+// WireGuard settings of the node. The interface itself has to be brought up
+// by the admin, e.g. with wg-quick, the manager only owns its peers.
+var (
+	WGCommand   = "wg"
+	WGInterface = "wg0"
+	WGSubnet    string
+	WGPort      = 51820
+	WGDNS       = "1.1.1.1"
+)
+
+// WireGuardState is the key pair of the node interface kept in the state
+// file.
+type WireGuardState struct {
+	PrivateKey string `json:"private_key"`
+}
+
+func wgAvailable() bool {
+	if WGSubnet == "" {
+		return false
+	}
+	_, err := exec.LookPath(WGCommand)
+	return err == nil
+}
+
+// x25519 generates raw Curve25519 key pair.
+func x25519() ([]byte, []byte, error) {
+	private := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(private); err != nil {
+		return nil, nil, err
+	}
+	// clamping as done by wg genkey
+	private[0] &= 248
+	private[31] = (private[31] & 127) | 64
+
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return private, public, nil
+}
+
+// newKeyPair generates Curve25519 key pair in the base64 form used by wg.
+func newKeyPair() (string, string, error) {
+	private, public, err := x25519()
+	if err != nil {
+		return "", "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(private), base64.StdEncoding.EncodeToString(public), nil
+}
+
+func publicKey(private string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(private)
+	if err != nil {
+		return "", err
+	}
+	public, err := curve25519.X25519(raw, curve25519.Basepoint)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(public), nil
+}
+
+type wireguard struct {
+	privateKey string
+	publicKey  string
+	// public key of every peer mapped to its address
+	peers map[string]string
+	mutex sync.Mutex
+}
+
+func newWireGuard(state *WireGuardState) (*wireguard, error) {
+	w := &wireguard{
+		privateKey: state.PrivateKey,
+		peers:      make(map[string]string, 0),
+	}
+
+	var err error
+	if w.privateKey == "" {
+		w.privateKey, w.publicKey, err = newKeyPair()
+		state.PrivateKey = w.privateKey
+	} else {
+		w.publicKey, err = publicKey(w.privateKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return w, w.sync()
+}
+
+func wgConfPath() string {
+	return filepath.Join(filepath.Dir(PathToState), "wireguard", WGInterface+".conf")
+}
+
+// render returns the interface config in the format of wg setconf.
+func (w *wireguard) render() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "[Interface]\nPrivateKey = %s\nListenPort = %d\n", w.privateKey, WGPort)
+
+	keys := make([]string, 0, len(w.peers))
+	for key := range w.peers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(&b, "\n[Peer]\nPublicKey = %s\nAllowedIPs = %s/32\n", key, w.peers[key])
+	}
+
+	return b.String()
+}
+
+// sync applies the config without disrupting the sessions of the peers
+// that didn't change.
+func (w *wireguard) sync() error {
+	path := wgConfPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(w.render()), 0600); err != nil {
+		return err
+	}
+
+	out, err := exec.Command(WGCommand, "syncconf", WGInterface, path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s syncconf: %s: %s", WGCommand, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (w *wireguard) addPeer(key, ip string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.peers[key] = ip
+	return w.sync()
+}
+
+func (w *wireguard) removePeer(key string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	delete(w.peers, key)
+	return w.sync()
+}
+
+// transfer returns the amount of bytes received and sent by every peer
+// since it was added to the interface.
+func (w *wireguard) transfer() (map[string]int64, error) {
+	out, err := exec.Command(WGCommand, "show", WGInterface, "transfer").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	totals := make(map[string]int64, 0)
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		rx, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		tx, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		totals[fields[0]] = rx + tx
+	}
+
+	return totals, scanner.Err()
+}
+
+var errSubnetFull = errors.New("no free addresses left in the wireguard subnet")
+
+// allocatePeerIP returns the first free address of the subnet, the first
+// host address belongs to the node itself. The lock must be held.
+func (m *Manager) allocatePeerIP() (string, error) {
+	prefix, err := netip.ParsePrefix(WGSubnet)
+	if err != nil {
+		return "", err
+	}
+	prefix = prefix.Masked()
+
+	used := make(map[string]bool, 0)
+	for _, s := range m.state {
+		if s != nil && s.opts.PeerIP != "" {
+			used[s.opts.PeerIP] = true
+		}
+	}
+	for _, opts := range m.reserved {
+		if opts.PeerIP != "" {
+			used[opts.PeerIP] = true
+		}
+	}
+
+	// skip network and node addresses
+	addr := prefix.Addr().Next().Next()
+	for ; prefix.Contains(addr); addr = addr.Next() {
+		// broadcast address of ipv4 subnets
+		if addr.Is4() && !prefix.Contains(addr.Next()) {
+			break
+		}
+		if !used[addr.String()] {
+			return addr.String(), nil
+		}
+	}
+
+	return "", errSubnetFull
+}
+
+// clientConf renders complete config of the client for the given public
+// hostname of the node.
+func (s *Server) clientConf(host string) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "[Interface]\nPrivateKey = %s\nAddress = %s/32\n", s.opts.PrivateKey, s.opts.PeerIP)
+	if WGDNS != "" {
+		fmt.Fprintf(&b, "DNS = %s\n", WGDNS)
+	}
+	fmt.Fprintf(&b, "\n[Peer]\nPublicKey = %s\nEndpoint = %s\nAllowedIPs = 0.0.0.0/0, ::/0\nPersistentKeepalive = 25\n",
+		s.manager.wg.publicKey, net.JoinHostPort(host, strconv.Itoa(WGPort)))
+
+	return b.String()
+}
@@ -0,0 +1,186 @@
+package manager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// stubWG replaces the wg command with a script that logs its arguments,
+// keeps a copy of the config given to syncconf and prints transfer stats.
+func stubWG(t *testing.T, exit int) (log, conf string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	log = filepath.Join(dir, "wg.log")
+	conf = filepath.Join(dir, "synced.conf")
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$@" >> %s
+case "$1" in
+syncconf) cp "$3" %s ;;
+show) printf 'peer-a\t100\t200\npeer-b\tbad\t1\n' ;;
+esac
+echo "stub failed" >&2
+exit %d
+`, log, conf, exit)
+	path := filepath.Join(dir, "wg")
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	command, state := WGCommand, PathToState
+	WGCommand, PathToState = path, filepath.Join(dir, "state.json")
+	t.Cleanup(func() { WGCommand, PathToState = command, state })
+
+	return log, conf
+}
+
+func setSubnet(t *testing.T, subnet string) {
+	t.Helper()
+
+	old := WGSubnet
+	WGSubnet = subnet
+	t.Cleanup(func() { WGSubnet = old })
+}
+
+// newTestManager returns the manager owning the ports of the range, none of
+// them is used.
+func newTestManager(from, to int) *Manager {
+	m := &Manager{
+		portRange: [2]int{from, to},
+		state:     make(map[int]*Server, 0),
+		retiring:  make(map[int]*retired, 0),
+		reserved:  make(map[int]*Options, 0),
+	}
+	for port := from; port <= to; port++ {
+		m.state[port] = nil
+	}
+	return m
+}
+
+func TestAllocatePeerIP(t *testing.T) {
+	// .1 is the node, .7 is the broadcast address
+	setSubnet(t, "10.8.0.0/29")
+
+	m := newTestManager(20000, 20010)
+	m.state[20000] = &Server{opts: &Options{Name: "a", PeerIP: "10.8.0.2"}}
+	m.reserved[20001] = &Options{Name: "b", PeerIP: "10.8.0.3"}
+
+	for i, want := range []string{"10.8.0.4", "10.8.0.5", "10.8.0.6"} {
+		ip, err := m.allocatePeerIP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip != want {
+			t.Fatalf("allocated %s, want %s", ip, want)
+		}
+		m.reserved[20002+i] = &Options{PeerIP: ip}
+	}
+
+	if ip, err := m.allocatePeerIP(); err != errSubnetFull {
+		t.Errorf("full subnet: got %s, %v", ip, err)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	setSubnet(t, "10.8.0.0/24")
+	m := newTestManager(20000, 20009)
+
+	var wg sync.WaitGroup
+	list := make([]*Options, 10)
+	errs := make([]error, 10)
+	for i := range list {
+		list[i] = &Options{Type: "wireguard", Name: fmt.Sprintf("peer-%d", i)}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = m.reserve(list[i])
+		}(i)
+	}
+	wg.Wait()
+
+	ports := make(map[int]bool, 0)
+	ips := make(map[string]bool, 0)
+	for i, opts := range list {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if ports[opts.Port] || ips[opts.PeerIP] {
+			t.Errorf("%s got taken port %d or address %s", opts.Name, opts.Port, opts.PeerIP)
+		}
+		ports[opts.Port], ips[opts.PeerIP] = true, true
+	}
+
+	if err := m.reserve(&Options{Name: "peer-0"}); err != errNameTaken {
+		t.Errorf("reserved name: got %v, want %v", err, errNameTaken)
+	}
+	if err := m.reserve(&Options{Name: "other"}); err == nil {
+		t.Error("port was reserved out of the full range")
+	}
+}
+
+func TestWireGuardSync(t *testing.T) {
+	log, conf := stubWG(t, 0)
+
+	state := &WireGuardState{}
+	w, err := newWireGuard(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.PrivateKey == "" || w.privateKey != state.PrivateKey {
+		t.Fatal("generated key isn't kept in the state")
+	}
+	public, err := publicKey(state.PrivateKey)
+	if err != nil || public != w.publicKey {
+		t.Fatalf("public key %s doesn't match the private one: %v", w.publicKey, err)
+	}
+
+	if err := w.addPeer("peer-b", "10.8.0.3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.addPeer("peer-a", "10.8.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.removePeer("peer-b"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[Interface]\nPrivateKey = " + w.privateKey + "\nListenPort = 51820\n" +
+		"\n[Peer]\nPublicKey = peer-a\nAllowedIPs = 10.8.0.2/32\n"
+	if string(data) != want {
+		t.Errorf("synced config:\n%s\nwant:\n%s", data, want)
+	}
+
+	calls, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(calls)), "\n")
+	if len(lines) != 4 || lines[3] != "syncconf wg0 "+wgConfPath() {
+		t.Errorf("wg was called with:\n%s", calls)
+	}
+
+	totals, err := w.transfer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(totals) != 1 || totals["peer-a"] != 300 {
+		t.Errorf("transfer is %v", totals)
+	}
+}
+
+func TestWireGuardSyncError(t *testing.T) {
+	stubWG(t, 1)
+
+	_, err := newWireGuard(&WireGuardState{})
+	if err == nil || !strings.Contains(err.Error(), "stub failed") {
+		t.Errorf("got %v, want the output of wg", err)
+	}
+}
@@ -0,0 +1,449 @@
+package manager
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	xrayBackend = "xray"
+	xrayFlow    = "xtls-rprx-vision"
+)
+
+var xrayProtocols = []string{"vless", "vmess"}
+
+// Xray settings of the node. VLESS inbound uses TLS when the certificate is
+// given and Reality pretending to be XrayDest otherwise.
+var (
+	XrayCommand   = "xray"
+	XrayAPIPort   = 10085
+	XrayVLESSPort = 443
+	XrayVMessPort = 8443
+	XrayDest      = "www.microsoft.com:443"
+	XraySNI       = "www.microsoft.com"
+	XrayCert      string
+	XrayKey       string
+)
+
+// xray is started again this long after it exits on its own, the delay
+// doubles up to xrayMaxRestartDelay while it keeps failing.
+var (
+	xrayRestartDelay    = time.Second
+	xrayMaxRestartDelay = time.Minute
+)
+
+// XrayState is the Reality key pair of the node kept in the state file.
+type XrayState struct {
+	PrivateKey string `json:"private_key"`
+	ShortID    string `json:"short_id"`
+}
+
+func xrayAvailable() bool {
+	_, err := exec.LookPath(XrayCommand)
+	return err == nil
+}
+
+func xraySecurity() string {
+	if XrayCert != "" {
+		return "tls"
+	}
+	return "reality"
+}
+
+func xrayPort(protocol string) int {
+	if protocol == "vmess" {
+		return XrayVMessPort
+	}
+	return XrayVLESSPort
+}
+
+type xrayClient struct {
+	protocol string
+	id       string
+}
+
+// xray owns the single xray process of the node, every service is a client
+// of one of its inbounds identified by the service name.
+type xray struct {
+	privateKey string
+	publicKey  string
+	shortID    string
+	clients    map[string]xrayClient
+	cmd        *exec.Cmd
+	// closed once the running xray exits
+	exited chan struct{}
+	// before the next start after xray exited on its own
+	delay time.Duration
+	mutex sync.Mutex
+}
+
+func newXray(state *XrayState) (*xray, error) {
+	x := &xray{clients: make(map[string]xrayClient, 0)}
+
+	if state.PrivateKey == "" {
+		private, _, err := x25519()
+		if err != nil {
+			return nil, err
+		}
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		state.PrivateKey = base64.RawURLEncoding.EncodeToString(private)
+		state.ShortID = hex.EncodeToString(id)
+	}
+
+	private, err := base64.RawURLEncoding.DecodeString(state.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	public, err := publicKey(base64.StdEncoding.EncodeToString(private))
+	if err != nil {
+		return nil, err
+	}
+	raw, _ := base64.StdEncoding.DecodeString(public)
+
+	x.privateKey = state.PrivateKey
+	x.publicKey = base64.RawURLEncoding.EncodeToString(raw)
+	x.shortID = state.ShortID
+
+	return x, nil
+}
+
+func xrayConfPath() string {
+	return filepath.Join(filepath.Dir(PathToState), "xray", "config.json")
+}
+
+func (x *xray) apiAddr() string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(XrayAPIPort))
+}
+
+func (x *xray) inbound(protocol string, clients []map[string]string) map[string]interface{} {
+	in := map[string]interface{}{
+		"tag":      protocol,
+		"port":     xrayPort(protocol),
+		"protocol": protocol,
+	}
+
+	switch protocol {
+	case "vless":
+		in["settings"] = map[string]interface{}{"clients": clients, "decryption": "none"}
+
+		stream := map[string]interface{}{"network": "tcp", "security": xraySecurity()}
+		if XrayCert != "" {
+			stream["tlsSettings"] = map[string]interface{}{
+				"certificates": []map[string]string{{"certificateFile": XrayCert, "keyFile": XrayKey}},
+			}
+		} else {
+			stream["realitySettings"] = map[string]interface{}{
+				"dest":        XrayDest,
+				"serverNames": []string{XraySNI},
+				"privateKey":  x.privateKey,
+				"shortIds":    []string{x.shortID},
+			}
+		}
+		in["streamSettings"] = stream
+	case "vmess":
+		in["settings"] = map[string]interface{}{"clients": clients}
+	}
+
+	return in
+}
+
+func (x *xray) client(name string, c xrayClient) map[string]string {
+	client := map[string]string{"id": c.id, "email": name}
+	if c.protocol == "vless" {
+		client["flow"] = xrayFlow
+	}
+	return client
+}
+
+// render returns the complete xray config with every client of the node
+// and the api used to change them on the fly.
+func (x *xray) render() ([]byte, error) {
+	names := make([]string, 0, len(x.clients))
+	for name := range x.clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	inbounds := []interface{}{
+		map[string]interface{}{
+			"tag":      "api",
+			"listen":   "127.0.0.1",
+			"port":     XrayAPIPort,
+			"protocol": "dokodemo-door",
+			"settings": map[string]string{"address": "127.0.0.1"},
+		},
+	}
+	for _, protocol := range xrayProtocols {
+		clients := make([]map[string]string, 0)
+		for _, name := range names {
+			if c := x.clients[name]; c.protocol == protocol {
+				clients = append(clients, x.client(name, c))
+			}
+		}
+		inbounds = append(inbounds, x.inbound(protocol, clients))
+	}
+
+	return json.MarshalIndent(map[string]interface{}{
+		"log":   map[string]string{"loglevel": "warning"},
+		"api":   map[string]interface{}{"tag": "api", "services": []string{"HandlerService", "StatsService"}},
+		"stats": map[string]string{},
+		"policy": map[string]interface{}{
+			"levels": map[string]interface{}{
+				"0": map[string]bool{"statsUserUplink": true, "statsUserDownlink": true},
+			},
+		},
+		"inbounds": inbounds,
+		"outbounds": []map[string]string{
+			{"tag": "direct", "protocol": "freedom"},
+			{"tag": "block", "protocol": "blackhole"},
+		},
+		"routing": map[string]interface{}{
+			"rules": []map[string]interface{}{
+				{"type": "field", "inboundTag": []string{"api"}, "outboundTag": "api"},
+			},
+		},
+	}, "", "  ")
+}
+
+func (x *xray) save() error {
+	data, err := x.render()
+	if err != nil {
+		return err
+	}
+
+	path := xrayConfPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func (x *xray) command(args ...string) error {
+	out, err := exec.Command(XrayCommand, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %s: %s", XrayCommand, args[0], err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// restart reloads the config from the disk, connections of every client
+// are dropped so it is only used when the api fails.
+func (x *xray) restart() error {
+	if x.cmd != nil {
+		cmd, exited := x.cmd, x.exited
+		x.cmd = nil
+		cmd.Process.Kill()
+		<-exited
+	}
+	if len(x.clients) == 0 {
+		return nil
+	}
+
+	cmd := exec.Command(XrayCommand, "run", "-c", xrayConfPath())
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	x.cmd, x.exited = cmd, make(chan struct{})
+
+	go x.watch(cmd, x.exited)
+
+	return nil
+}
+
+// watch waits for xray to exit and starts it again unless it was stopped
+// on purpose, clients stay down until then.
+func (x *xray) watch(cmd *exec.Cmd, exited chan struct{}) {
+	started := time.Now()
+	err := cmd.Wait()
+	close(exited)
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if x.cmd != cmd {
+		return
+	}
+	log.Printf("xray exited: %v", err)
+	x.cmd = nil
+
+	if time.Since(started) > xrayMaxRestartDelay {
+		x.delay = 0
+	}
+	x.schedule()
+}
+
+// schedule starts xray again after the delay, it is called with the lock
+// held.
+func (x *xray) schedule() {
+	x.delay = min(max(2*x.delay, xrayRestartDelay), xrayMaxRestartDelay)
+
+	time.AfterFunc(x.delay, func() {
+		x.mutex.Lock()
+		defer x.mutex.Unlock()
+		// started by a change of the clients in the meantime
+		if x.cmd != nil || len(x.clients) == 0 {
+			return
+		}
+		log.Println("starting xray again")
+		if err := x.restart(); err != nil {
+			log.Printf("couldn't start xray: %s", err)
+			x.schedule()
+		}
+	})
+}
+
+func (x *xray) addClient(name string, c xrayClient) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	x.clients[name] = c
+	if err := x.save(); err != nil {
+		return err
+	}
+	if x.cmd == nil {
+		return x.restart()
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"inbounds": []interface{}{x.inbound(c.protocol, []map[string]string{x.client(name, c)})},
+	})
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp("", "xray-user-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	f.Write(data)
+	f.Close()
+
+	if err := x.command("api", "adu", "-s", x.apiAddr(), f.Name()); err != nil {
+		log.Printf("%s, reloading xray config", err)
+		return x.restart()
+	}
+	return nil
+}
+
+func (x *xray) removeClient(name string) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	c, ok := x.clients[name]
+	if !ok {
+		return nil
+	}
+	delete(x.clients, name)
+	if err := x.save(); err != nil {
+		return err
+	}
+	if x.cmd == nil {
+		return nil
+	}
+	if len(x.clients) == 0 {
+		return x.restart()
+	}
+
+	if err := x.command("api", "rmu", "-s", x.apiAddr(), "-tag="+c.protocol, name); err != nil {
+		log.Printf("%s, reloading xray config", err)
+		return x.restart()
+	}
+	return nil
+}
+
+// traffic returns bytes sent and received by every client since the
+// previous call, the counters are reset by xray on every query.
+func (x *xray) traffic() (map[string]int64, error) {
+	x.mutex.Lock()
+	running := x.cmd != nil
+	x.mutex.Unlock()
+	if !running {
+		return nil, nil
+	}
+
+	out, err := exec.Command(XrayCommand, "api", "statsquery", "-s", x.apiAddr(), "-pattern", "user>>>", "-reset").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Stat []struct {
+			Name  string          `json:"name"`
+			Value json.RawMessage `json:"value"`
+		} `json:"stat"`
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return nil, err
+	}
+
+	totals := make(map[string]int64, 0)
+	for _, stat := range resp.Stat {
+		// user>>>name>>>traffic>>>uplink
+		parts := strings.Split(stat.Name, ">>>")
+		if len(parts) != 4 {
+			continue
+		}
+		// int64 values are quoted in the json form of protobuf
+		v, err := strconv.ParseInt(strings.Trim(string(stat.Value), `"`), 10, 64)
+		if err != nil {
+			continue
+		}
+		totals[parts[1]] += v
+	}
+
+	return totals, nil
+}
+
+// shareLink builds vless:// or vmess:// link understood by the common
+// clients.
+func (s *Server) shareLink(host string) string {
+	x := s.manager.xray
+	port := xrayPort(s.opts.Protocol)
+
+	if s.opts.Protocol == "vmess" {
+		data, _ := json.Marshal(map[string]string{
+			"v": "2", "ps": s.opts.Name, "add": host, "port": strconv.Itoa(port),
+			"id": s.opts.UUID, "aid": "0", "scy": "auto", "net": "tcp", "type": "none",
+		})
+		return "vmess://" + base64.StdEncoding.EncodeToString(data)
+	}
+
+	q := url.Values{}
+	q.Set("encryption", "none")
+	q.Set("flow", xrayFlow)
+	q.Set("type", "tcp")
+	q.Set("security", xraySecurity())
+	if XrayCert != "" {
+		q.Set("sni", host)
+	} else {
+		q.Set("sni", XraySNI)
+		q.Set("fp", "chrome")
+		q.Set("pbk", x.publicKey)
+		q.Set("sid", x.shortID)
+	}
+
+	return (&url.URL{
+		Scheme:   "vless",
+		User:     url.User(s.opts.UUID),
+		Host:     net.JoinHostPort(host, strconv.Itoa(port)),
+		RawQuery: q.Encode(),
+		Fragment: s.opts.Name,
+	}).String()
+}
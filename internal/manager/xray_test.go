@@ -0,0 +1,227 @@
+package manager
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestXray(t *testing.T) *xray {
+	t.Helper()
+
+	x, err := newXray(&XrayState{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return x
+}
+
+func setXrayCert(t *testing.T, cert string) {
+	t.Helper()
+
+	old := XrayCert
+	XrayCert = cert
+	t.Cleanup(func() { XrayCert = old })
+}
+
+// xrayInbound is the part of the rendered config checked by the tests.
+type xrayInbound struct {
+	Tag      string `json:"tag"`
+	Port     int    `json:"port"`
+	Settings struct {
+		Clients []map[string]string `json:"clients"`
+	} `json:"settings"`
+	StreamSettings struct {
+		Security        string `json:"security"`
+		RealitySettings *struct {
+			PrivateKey string   `json:"privateKey"`
+			ShortIDs   []string `json:"shortIds"`
+		} `json:"realitySettings"`
+		TLSSettings *struct{} `json:"tlsSettings"`
+	} `json:"streamSettings"`
+}
+
+func TestXrayRender(t *testing.T) {
+	x := newTestXray(t)
+	x.clients["bob"] = xrayClient{"vmess", "id-bob"}
+	x.clients["alice"] = xrayClient{"vless", "id-alice"}
+	x.clients["carol"] = xrayClient{"vless", "id-carol"}
+
+	for _, tt := range []struct {
+		cert     string
+		security string
+	}{
+		{"", "reality"},
+		{"/etc/xray/cert.pem", "tls"},
+	} {
+		setXrayCert(t, tt.cert)
+
+		data, err := x.render()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var config struct {
+			Inbounds []xrayInbound `json:"inbounds"`
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			t.Fatal(err)
+		}
+		if len(config.Inbounds) != 3 || config.Inbounds[0].Tag != "api" || config.Inbounds[0].Port != XrayAPIPort {
+			t.Fatalf("inbounds are %+v", config.Inbounds)
+		}
+
+		vless, vmess := config.Inbounds[1], config.Inbounds[2]
+		if vless.Tag != "vless" || vless.Port != XrayVLESSPort || vmess.Tag != "vmess" || vmess.Port != XrayVMessPort {
+			t.Fatalf("inbounds are %+v", config.Inbounds)
+		}
+		// clients are sorted by name
+		clients := vless.Settings.Clients
+		if len(clients) != 2 || clients[0]["email"] != "alice" || clients[0]["id"] != "id-alice" ||
+			clients[0]["flow"] != xrayFlow || clients[1]["email"] != "carol" {
+			t.Errorf("vless clients are %v", clients)
+		}
+		if clients := vmess.Settings.Clients; len(clients) != 1 || clients[0]["email"] != "bob" || clients[0]["flow"] != "" {
+			t.Errorf("vmess clients are %v", clients)
+		}
+
+		stream := vless.StreamSettings
+		if stream.Security != tt.security {
+			t.Errorf("security is %s, want %s", stream.Security, tt.security)
+		}
+		if tt.cert == "" && (stream.RealitySettings == nil || stream.RealitySettings.PrivateKey != x.privateKey ||
+			len(stream.RealitySettings.ShortIDs) != 1 || stream.RealitySettings.ShortIDs[0] != x.shortID) {
+			t.Errorf("reality settings are %+v", stream.RealitySettings)
+		}
+		if tt.cert != "" && (stream.TLSSettings == nil || stream.RealitySettings != nil) {
+			t.Errorf("tls inbound has %+v", stream)
+		}
+	}
+}
+
+func TestXrayShareLink(t *testing.T) {
+	x := newTestXray(t)
+	m := &Manager{xray: x}
+
+	for _, tt := range []struct {
+		name     string
+		protocol string
+		cert     string
+		want     url.Values
+	}{
+		{"reality", "vless", "", url.Values{
+			"security": {"reality"}, "sni": {XraySNI}, "pbk": {x.publicKey}, "sid": {x.shortID},
+			"flow": {xrayFlow}, "fp": {"chrome"},
+		}},
+		{"tls", "vless", "/etc/xray/cert.pem", url.Values{
+			"security": {"tls"}, "sni": {"node.example.com"}, "flow": {xrayFlow},
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setXrayCert(t, tt.cert)
+
+			s := &Server{manager: m, opts: &Options{Name: "alice-1", Protocol: tt.protocol, UUID: "id-alice"}}
+			u, err := url.Parse(s.shareLink("node.example.com"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Scheme != "vless" || u.User.Username() != "id-alice" || u.Host != "node.example.com:443" || u.Fragment != "alice-1" {
+				t.Errorf("link is %s", u)
+			}
+			q := u.Query()
+			for key := range tt.want {
+				if q.Get(key) != tt.want.Get(key) {
+					t.Errorf("%s is %q, want %q", key, q.Get(key), tt.want.Get(key))
+				}
+			}
+			if tt.cert != "" && q.Has("pbk") {
+				t.Error("tls link has the reality key")
+			}
+		})
+	}
+
+	t.Run("vmess", func(t *testing.T) {
+		s := &Server{manager: m, opts: &Options{Name: "bob-1", Protocol: "vmess", UUID: "id-bob"}}
+		link, ok := strings.CutPrefix(s.shareLink("node.example.com"), "vmess://")
+		if !ok {
+			t.Fatalf("link is %s", link)
+		}
+		data, err := base64.StdEncoding.DecodeString(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := make(map[string]string, 0)
+		if err := json.Unmarshal(data, &config); err != nil {
+			t.Fatal(err)
+		}
+		if config["add"] != "node.example.com" || config["port"] != "8443" || config["id"] != "id-bob" || config["ps"] != "bob-1" {
+			t.Errorf("config is %v", config)
+		}
+	})
+}
+
+// stubXray replaces xray with a script that logs every start and exits
+// right away.
+func stubXray(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	log := filepath.Join(dir, "xray.log")
+	// the config is kept in the xray directory next to the state
+	path := filepath.Join(dir, "xray-stub")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\necho \"$@\" >> "+log+"\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	command, state := XrayCommand, PathToState
+	delay, maxDelay := xrayRestartDelay, xrayMaxRestartDelay
+	XrayCommand, PathToState = path, filepath.Join(dir, "state.json")
+	xrayRestartDelay, xrayMaxRestartDelay = 10*time.Millisecond, 40*time.Millisecond
+	t.Cleanup(func() {
+		XrayCommand, PathToState = command, state
+		xrayRestartDelay, xrayMaxRestartDelay = delay, maxDelay
+	})
+
+	return log
+}
+
+func countStarts(t *testing.T, log string) int {
+	t.Helper()
+
+	data, err := os.ReadFile(log)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "run -c")
+}
+
+func TestXrayRestart(t *testing.T) {
+	log := stubXray(t)
+	x := newTestXray(t)
+
+	if err := x.addClient("alice-1", xrayClient{"vless", "id-alice"}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for countStarts(t, log) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("xray was started %d times", countStarts(t, log))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// nothing is started once the last client is gone
+	if err := x.removeClient("alice-1"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	starts := countStarts(t, log)
+	time.Sleep(100 * time.Millisecond)
+	if n := countStarts(t, log); n != starts {
+		t.Errorf("xray was started %d times without clients", n-starts)
+	}
+}
@@ -0,0 +1,142 @@
+// Package payment implements payment providers used to top the balance up.
+package payment
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+type Status string
+
+const (
+	// waiting for the customer to pay
+	Pending Status = "pending"
+	// paid, the money is held until the payment is captured
+	WaitingForCapture Status = "waiting_for_capture"
+	Succeeded         Status = "succeeded"
+	Canceled          Status = "canceled"
+)
+
+var (
+	ErrNotFound = errors.New("payment not found")
+	// ErrForbidden is returned for notifications that weren't sent by the
+	// provider
+	ErrForbidden       = errors.New("notification isn't trusted")
+	ErrBadNotification = errors.New("notification is malformed")
+)
+
+// Payment amounts are in whole rubles.
+type Payment struct {
+	ID     string
+	Status Status
+	Amount int64
+	// part of the amount given back
+	Refunded int64
+	// confirmation page the customer is sent to
+	URL       string
+	CreatedAt time.Time
+	// set once the method the customer paid with is saved
+	SavedMethod *SavedMethod
+	// registration of the fiscal receipt, empty if none was sent
+	ReceiptStatus Status
+}
+
+// SavedMethod can be charged without the customer.
+type SavedMethod struct {
+	ID string
+	// shown to the customer, e.g. the masked card number
+	Title string
+}
+
+type Refund struct {
+	ID        string
+	PaymentID string
+	Status    Status
+	Amount    int64
+	// registration of the fiscal receipt, empty if none was sent
+	ReceiptStatus Status
+}
+
+// Receipt is the fiscal receipt required by 54-FZ, the provider registers
+// it and sends it to the customer.
+type Receipt struct {
+	// the customer is reached by either
+	Email string
+	Phone string
+	// sales tax system of the shop, left out if zero
+	TaxSystem int
+	Items     []*ReceiptItem
+}
+
+type ReceiptItem struct {
+	Description string
+	Amount      int64
+	VatCode     int
+	// e.g. service or payment
+	PaymentSubject string
+	// e.g. full_prepayment or advance
+	PaymentMode string
+}
+
+type Request struct {
+	Amount int64
+	// method chosen by the customer, providers may ignore it
+	Method    string
+	ReturnURL string
+	// asks for the method to be saved for charges without the customer
+	Save bool
+	// charges the saved method instead, no confirmation is needed
+	MethodID string
+	// requests with the same key create the payment only once
+	IdempotenceKey string
+	// sent unless nil
+	Receipt *Receipt
+}
+
+// Provider is the payment system, payments are captured by the server once
+// the customer has paid.
+type Provider interface {
+	// Name identifies the provider in transactions and webhook urls.
+	Name() string
+	Create(ctx context.Context, r *Request) (*Payment, error)
+	Get(ctx context.Context, id string) (*Payment, error)
+	Capture(ctx context.Context, id string) (*Payment, error)
+	Cancel(ctx context.Context, id string) (*Payment, error)
+	// Refund gives the amount back, the receipt is sent unless nil.
+	// Refunds with the same key are made only once.
+	Refund(ctx context.Context, paymentID string, amount int64, receipt *Receipt, key string) (*Refund, error)
+	GetRefund(ctx context.Context, id string) (*Refund, error)
+	// ListPending lists payments created since then that are waiting to be
+	// captured.
+	ListPending(ctx context.Context, since time.Time) ([]*Payment, error)
+	// List lists every payment created in [from, to).
+	List(ctx context.Context, from, to time.Time) ([]*Payment, error)
+}
+
+const (
+	PaymentEvent = "payment"
+	RefundEvent  = "refund"
+)
+
+// Notification tells which object has changed, the object itself should be
+// fetched from the provider.
+type Notification struct {
+	// either PaymentEvent or RefundEvent
+	Event string
+	ID    string
+}
+
+// Notifier is implemented by providers that report changes on their own.
+type Notifier interface {
+	// ParseNotification authenticates the request, nil notification is
+	// returned for events that don't matter.
+	ParseNotification(r *http.Request) (*Notification, error)
+}
+
+// Pages is implemented by providers serving pages to the customer, the
+// handler is mounted under /<name>/.
+type Pages interface {
+	Handler() http.Handler
+}
@@ -0,0 +1,377 @@
+package payment
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	sandboxSecretHeader = "X-Sandbox-Secret"
+	sandboxCardTitle    = "Sandbox card *4242"
+)
+
+var (
+	errBadState  = errors.New("payment can't be changed in its state")
+	errNoContact = errors.New("receipt has neither email nor phone")
+)
+
+var sandboxPage = template.Must(template.New("pay").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sandbox payment</title></head>
+<body>
+<h1>Sandbox payment</h1>
+<p>Payment {{.ID}}: {{.Amount}} RUB, {{.Status}}</p>
+{{if .Save}}<p>The card will be saved for automatic payments.</p>{{end}}
+{{if eq .Status "pending"}}
+<form method="post">
+<button name="action" value="pay">Pay</button>
+<button name="action" value="cancel">Cancel</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+type sandboxPayment struct {
+	Payment
+	returnURL string
+	// the card is saved once paid
+	Save bool
+}
+
+// Sandbox keeps payments in memory and serves the confirmation page itself,
+// nothing is charged and receipts are only checked for a contact. Payments
+// and saved cards are lost on restart, charges of the cards it doesn't know
+// are declined.
+type Sandbox struct {
+	// url the server is reachable at
+	publicURL string
+	// sent along with notifications
+	secret string
+	client *http.Client
+
+	mu       sync.Mutex
+	payments map[string]*sandboxPayment
+	refunds  map[string]*Refund
+	// saved method ids mapped to their titles
+	methods map[string]string
+	// idempotence keys mapped to the payments they created
+	keys map[string]string
+	// and to the refunds
+	refundKeys map[string]string
+}
+
+func NewSandbox(publicURL string) *Sandbox {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return &Sandbox{
+		publicURL:  publicURL,
+		secret:     hex.EncodeToString(b),
+		client:     &http.Client{Timeout: 10 * time.Second},
+		payments:   make(map[string]*sandboxPayment),
+		refunds:    make(map[string]*Refund),
+		methods:    make(map[string]string),
+		keys:       make(map[string]string),
+		refundKeys: make(map[string]string),
+	}
+}
+
+func (s *Sandbox) Name() string {
+	return "sandbox"
+}
+
+func (s *Sandbox) Create(_ context.Context, r *Request) (*Payment, error) {
+	if r.Amount <= 0 {
+		return nil, errors.New("amount must be positive")
+	}
+	if r.Receipt != nil && r.Receipt.Email == "" && r.Receipt.Phone == "" {
+		return nil, errNoContact
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id, ok := s.keys[r.IdempotenceKey]; ok && r.IdempotenceKey != "" {
+		res := s.payments[id].Payment
+		return &res, nil
+	}
+
+	id := uuid.NewString()
+	p := &sandboxPayment{
+		Payment: Payment{
+			ID:        id,
+			Status:    Pending,
+			Amount:    r.Amount,
+			URL:       s.publicURL + "/sandbox/pay/" + id,
+			CreatedAt: time.Now(),
+		},
+		returnURL: r.ReturnURL,
+		Save:      r.Save,
+	}
+	if r.Receipt != nil {
+		p.ReceiptStatus = Pending
+	}
+
+	// saved cards are charged right away
+	if r.MethodID != "" {
+		p.URL = ""
+		p.Save = false
+		if title, ok := s.methods[r.MethodID]; ok {
+			p.Status = WaitingForCapture
+			p.SavedMethod = &SavedMethod{ID: r.MethodID, Title: title}
+		} else {
+			p.Status = Canceled
+		}
+		go s.notify(PaymentEvent, id)
+	}
+
+	s.payments[id] = p
+	if r.IdempotenceKey != "" {
+		s.keys[r.IdempotenceKey] = id
+	}
+
+	res := p.Payment
+	return &res, nil
+}
+
+func (s *Sandbox) Get(_ context.Context, id string) (*Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.payments[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	res := p.Payment
+	return &res, nil
+}
+
+// move changes the status of the payment if it's in one of the states, the
+// receipt is registered once the payment succeeds.
+func (s *Sandbox) move(id string, to Status, from ...Status) (*Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.payments[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	for _, v := range from {
+		if p.Status == v {
+			p.Status = to
+			if to == Succeeded && p.ReceiptStatus == Pending {
+				p.ReceiptStatus = Succeeded
+			}
+			res := p.Payment
+			return &res, nil
+		}
+	}
+	return nil, errBadState
+}
+
+func (s *Sandbox) Capture(_ context.Context, id string) (*Payment, error) {
+	return s.move(id, Succeeded, WaitingForCapture)
+}
+
+func (s *Sandbox) Cancel(_ context.Context, id string) (*Payment, error) {
+	return s.move(id, Canceled, Pending, WaitingForCapture)
+}
+
+// Refund succeeds right away, the notification is sent as well.
+func (s *Sandbox) Refund(_ context.Context, paymentID string, amount int64, receipt *Receipt, key string) (*Refund, error) {
+	if receipt != nil && receipt.Email == "" && receipt.Phone == "" {
+		return nil, errNoContact
+	}
+
+	s.mu.Lock()
+	if id, ok := s.refundKeys[key]; ok && key != "" {
+		res := *s.refunds[id]
+		s.mu.Unlock()
+		return &res, nil
+	}
+	p, ok := s.payments[paymentID]
+	if !ok {
+		s.mu.Unlock()
+		return nil, ErrNotFound
+	}
+	if p.Status != Succeeded || amount <= 0 || amount > p.Amount-p.Refunded {
+		s.mu.Unlock()
+		return nil, errBadState
+	}
+	rf := &Refund{
+		ID:        uuid.NewString(),
+		PaymentID: paymentID,
+		Status:    Succeeded,
+		Amount:    amount,
+	}
+	if receipt != nil {
+		rf.ReceiptStatus = Succeeded
+	}
+	s.refunds[rf.ID] = rf
+	if key != "" {
+		s.refundKeys[key] = rf.ID
+	}
+	p.Refunded += amount
+	s.mu.Unlock()
+
+	go s.notify(RefundEvent, rf.ID)
+
+	res := *rf
+	return &res, nil
+}
+
+func (s *Sandbox) GetRefund(_ context.Context, id string) (*Refund, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rf, ok := s.refunds[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	res := *rf
+	return &res, nil
+}
+
+func (s *Sandbox) ListPending(_ context.Context, since time.Time) ([]*Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []*Payment
+	for _, p := range s.payments {
+		if p.Status == WaitingForCapture && !p.CreatedAt.Before(since) {
+			res := p.Payment
+			list = append(list, &res)
+		}
+	}
+	return list, nil
+}
+
+func (s *Sandbox) List(_ context.Context, from, to time.Time) ([]*Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []*Payment
+	for _, p := range s.payments {
+		if !p.CreatedAt.Before(from) && p.CreatedAt.Before(to) {
+			res := p.Payment
+			list = append(list, &res)
+		}
+	}
+	return list, nil
+}
+
+// ParseNotification accepts notifications sent by this instance only.
+func (s *Sandbox) ParseNotification(r *http.Request) (*Notification, error) {
+	secret := r.Header.Get(sandboxSecretHeader)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(s.secret)) != 1 {
+		return nil, ErrForbidden
+	}
+
+	n := &Notification{}
+	if err := json.NewDecoder(r.Body).Decode(n); err != nil || n.ID == "" {
+		return nil, ErrBadNotification
+	}
+	return n, nil
+}
+
+// notify posts the notification to the webhook of the server, it isn't
+// sent again if that fails.
+func (s *Sandbox) notify(event, id string) {
+	body, _ := json.Marshal(&Notification{Event: event, ID: id})
+
+	req, err := http.NewRequest(http.MethodPost, s.publicURL+"/api/webhooks/"+s.Name(), bytes.NewReader(body))
+	if err != nil {
+		log.Printf("sandbox notification: %s", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(sandboxSecretHeader, s.secret)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Printf("sandbox notification: %s", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("sandbox notification %s %s: %s", event, id, resp.Status)
+	}
+}
+
+// Handler serves the confirmation page, paying holds the money until the
+// payment is captured like the real providers do.
+func (s *Sandbox) Handler() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/pay/{id}", s.showPayment)
+	r.Post("/pay/{id}", s.confirmPayment)
+	return r
+}
+
+func (s *Sandbox) showPayment(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	p, ok := s.payments[chi.URLParam(r, "id")]
+	var page sandboxPayment
+	if ok {
+		page = *p
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	sandboxPage.Execute(w, &page)
+}
+
+func (s *Sandbox) confirmPayment(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	var err error
+	switch r.FormValue("action") {
+	case "pay":
+		_, err = s.move(id, WaitingForCapture, Pending)
+	case "cancel":
+		_, err = s.move(id, Canceled, Pending)
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+	if err == ErrNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	s.mu.Lock()
+	p := s.payments[id]
+	if p.Status == WaitingForCapture && p.Save {
+		method := &SavedMethod{ID: uuid.NewString(), Title: sandboxCardTitle}
+		s.methods[method.ID] = method.Title
+		p.SavedMethod = method
+	}
+	returnURL := p.returnURL
+	s.mu.Unlock()
+
+	go s.notify(PaymentEvent, id)
+
+	http.Redirect(w, r, returnURL, http.StatusSeeOther)
+}
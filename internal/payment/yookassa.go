@@ -0,0 +1,435 @@
+package payment
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rvinnie/yookassa-sdk-go/yookassa"
+	yoocommon "github.com/rvinnie/yookassa-sdk-go/yookassa/common"
+	yooerrors "github.com/rvinnie/yookassa-sdk-go/yookassa/errors"
+	yoopayment "github.com/rvinnie/yookassa-sdk-go/yookassa/payment"
+	yoorefund "github.com/rvinnie/yookassa-sdk-go/yookassa/refund"
+)
+
+// https://yookassa.ru/developers/using-api/webhooks#ip
+var yooWebhookIPs = []string{
+	"185.71.76.0/27",
+	"185.71.77.0/27",
+	"77.75.153.0/25",
+	"77.75.156.11/32",
+	"77.75.156.35/32",
+	"77.75.154.128/25",
+	"2a02:5180::/32",
+}
+
+const (
+	yooListLimit = 100
+	yooTimeout   = 30 * time.Second
+)
+
+type YooKassa struct {
+	shopID string
+	apiKey string
+	// payments and refunds are created without the sdk
+	client   *http.Client
+	payments *yookassa.PaymentHandler
+	refunds  *yookassa.RefundHandler
+	// networks allowed to send notifications
+	nets []*net.IPNet
+	// client address is taken from X-Forwarded-For
+	trustProxy bool
+}
+
+// NewYooKassa creates the provider, the official list of networks is used
+// if webhookIPs is empty.
+func NewYooKassa(shopID, apiKey string, webhookIPs []string, trustProxy bool) (*YooKassa, error) {
+	if len(webhookIPs) == 0 {
+		webhookIPs = yooWebhookIPs
+	}
+	nets, err := parseNetworks(webhookIPs)
+	if err != nil {
+		return nil, err
+	}
+
+	client := yookassa.NewClient(shopID, apiKey)
+	return &YooKassa{
+		shopID:     shopID,
+		apiKey:     apiKey,
+		client:     &http.Client{Timeout: yooTimeout},
+		payments:   yookassa.NewPaymentHandler(client),
+		refunds:    yookassa.NewRefundHandler(client),
+		nets:       nets,
+		trustProxy: trustProxy,
+	}, nil
+}
+
+func (y *YooKassa) Name() string {
+	return "yookassa"
+}
+
+type yooMethodData struct {
+	Type string `json:"type"`
+}
+
+type yooRedirect struct {
+	Type      string `json:"type"`
+	ReturnURL string `json:"return_url"`
+}
+
+type yooCustomer struct {
+	Email string `json:"email,omitempty"`
+	Phone string `json:"phone,omitempty"`
+}
+
+type yooReceiptItem struct {
+	Description    string            `json:"description"`
+	Quantity       string            `json:"quantity"`
+	Amount         *yoocommon.Amount `json:"amount"`
+	VatCode        int               `json:"vat_code"`
+	PaymentSubject string            `json:"payment_subject,omitempty"`
+	PaymentMode    string            `json:"payment_mode,omitempty"`
+}
+
+type yooReceipt struct {
+	Customer      *yooCustomer      `json:"customer"`
+	Items         []*yooReceiptItem `json:"items"`
+	TaxSystemCode int               `json:"tax_system_code,omitempty"`
+}
+
+type yooPaymentRequest struct {
+	Amount            *yoocommon.Amount `json:"amount"`
+	PaymentMethodData *yooMethodData    `json:"payment_method_data,omitempty"`
+	Confirmation      *yooRedirect      `json:"confirmation,omitempty"`
+	SavePaymentMethod bool              `json:"save_payment_method,omitempty"`
+	PaymentMethodID   string            `json:"payment_method_id,omitempty"`
+	Receipt           *yooReceipt       `json:"receipt,omitempty"`
+}
+
+type yooRefundRequest struct {
+	PaymentID string            `json:"payment_id"`
+	Amount    *yoocommon.Amount `json:"amount"`
+	Receipt   *yooReceipt       `json:"receipt,omitempty"`
+}
+
+func (y *YooKassa) Create(ctx context.Context, r *Request) (*Payment, error) {
+	data := &yooPaymentRequest{Amount: rubles(r.Amount), Receipt: yooReceiptOf(r.Receipt)}
+	if r.MethodID != "" {
+		data.PaymentMethodID = r.MethodID
+	} else {
+		if r.Method != "" {
+			data.PaymentMethodData = &yooMethodData{Type: r.Method}
+		}
+		data.Confirmation = &yooRedirect{Type: "redirect", ReturnURL: r.ReturnURL}
+		data.SavePaymentMethod = r.Save
+	}
+
+	p := &yoopayment.Payment{}
+	if err := y.post(ctx, yookassa.PaymentEndpoint, r.IdempotenceKey, data, p); err != nil {
+		return nil, err
+	}
+	return y.fromPayment(p)
+}
+
+// post makes the request without the sdk, it has no way to send receipts
+// or to save payment methods. A random idempotence key is used if key is
+// empty.
+func (y *YooKassa) post(ctx context.Context, endpoint, key string, data, res any) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, yookassa.BaseURL+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	if key == "" {
+		key = uuid.NewString()
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotence-Key", key)
+	req.SetBasicAuth(y.shopID, y.apiKey)
+
+	resp, err := y.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		e, err := yooerrors.GetError(resp.Body)
+		if err != nil {
+			return err
+		}
+		return yooError(e)
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+func (y *YooKassa) Get(_ context.Context, id string) (*Payment, error) {
+	p, err := y.payments.FindPayment(id)
+	if err != nil {
+		return nil, yooError(err)
+	}
+	return y.fromPayment(p)
+}
+
+func (y *YooKassa) Capture(_ context.Context, id string) (*Payment, error) {
+	p, err := y.payments.CapturePayment(&yoopayment.Payment{ID: id})
+	if err != nil {
+		return nil, yooError(err)
+	}
+	return y.fromPayment(p)
+}
+
+func (y *YooKassa) Cancel(_ context.Context, id string) (*Payment, error) {
+	p, err := y.payments.CancelPayment(id)
+	if err != nil {
+		return nil, yooError(err)
+	}
+	return y.fromPayment(p)
+}
+
+func (y *YooKassa) Refund(ctx context.Context, paymentID string, amount int64, receipt *Receipt, key string) (*Refund, error) {
+	rf := &yoorefund.Refund{}
+	err := y.post(ctx, yookassa.RefundEndpoint, key, &yooRefundRequest{
+		PaymentID: paymentID,
+		Amount:    rubles(amount),
+		Receipt:   yooReceiptOf(receipt),
+	}, rf)
+	if err != nil {
+		return nil, err
+	}
+	return fromYooRefund(rf)
+}
+
+func (y *YooKassa) GetRefund(_ context.Context, id string) (*Refund, error) {
+	rf, err := y.refunds.FindRefund(id)
+	if err != nil {
+		return nil, yooError(err)
+	}
+	return fromYooRefund(rf)
+}
+
+func (y *YooKassa) ListPending(_ context.Context, since time.Time) ([]*Payment, error) {
+	return y.list(&yoopayment.PaymentListFilter{
+		CreatedAtGTE: &since,
+		Status:       yoopayment.WaitingForCapture,
+	})
+}
+
+func (y *YooKassa) List(_ context.Context, from, to time.Time) ([]*Payment, error) {
+	return y.list(&yoopayment.PaymentListFilter{
+		CreatedAtGTE: &from,
+		CreatedAtLT:  &to,
+	})
+}
+
+// list goes through every page of the payments matching the filter.
+func (y *YooKassa) list(filter *yoopayment.PaymentListFilter) ([]*Payment, error) {
+	filter.Limit = yooListLimit
+
+	var list []*Payment
+	for {
+		batch, err := y.payments.FindPayments(filter)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range batch.Items {
+			p, err := y.fromPayment(&batch.Items[i])
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, p)
+		}
+
+		if batch.NextCursor == "" {
+			return list, nil
+		}
+		filter.Cursor = batch.NextCursor
+	}
+}
+
+type yooNotification struct {
+	Type   string `json:"type"`
+	Event  string `json:"event"`
+	Object struct {
+		ID string `json:"id"`
+	} `json:"object"`
+}
+
+// ParseNotification only trusts the body for the id of the object, the
+// sender is checked by its address as YooKassa doesn't sign notifications.
+func (y *YooKassa) ParseNotification(r *http.Request) (*Notification, error) {
+	if !y.allowed(r) {
+		return nil, ErrForbidden
+	}
+
+	n := &yooNotification{}
+	if err := json.NewDecoder(r.Body).Decode(n); err != nil || n.Object.ID == "" {
+		return nil, ErrBadNotification
+	}
+
+	switch n.Event {
+	case "payment.waiting_for_capture", "payment.succeeded", "payment.canceled":
+		return &Notification{Event: PaymentEvent, ID: n.Object.ID}, nil
+	case "refund.succeeded":
+		return &Notification{Event: RefundEvent, ID: n.Object.ID}, nil
+	}
+	return nil, nil
+}
+
+// clientIP returns the address of the client, the last address of
+// X-Forwarded-For is the one added by the proxy in front of the server.
+func (y *YooKassa) clientIP(r *http.Request) net.IP {
+	if y.trustProxy {
+		if v := r.Header.Get("X-Forwarded-For"); v != "" {
+			list := strings.Split(v, ",")
+			return net.ParseIP(strings.TrimSpace(list[len(list)-1]))
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func (y *YooKassa) allowed(r *http.Request) bool {
+	ip := y.clientIP(r)
+	if ip == nil {
+		return false
+	}
+	for _, n := range y.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, v := range list {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			if strings.Contains(v, ":") {
+				v += "/128"
+			} else {
+				v += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func yooError(err error) error {
+	var e *yooerrors.YoomoneyError
+	if errors.As(err, &e) && e.Code == "not_found" {
+		return ErrNotFound
+	}
+	return err
+}
+
+func rubles(amount int64) *yoocommon.Amount {
+	return &yoocommon.Amount{
+		Value:    strconv.FormatInt(amount, 10),
+		Currency: "RUB",
+	}
+}
+
+// parseAmount converts the amount in rubles, kopecks are dropped.
+func parseAmount(a *yoocommon.Amount) (int64, error) {
+	if a == nil {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(a.Value, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(math.Floor(f)), nil
+}
+
+// yooReceiptOf converts the receipt, nil stays nil.
+func yooReceiptOf(r *Receipt) *yooReceipt {
+	if r == nil {
+		return nil
+	}
+	res := &yooReceipt{
+		Customer:      &yooCustomer{Email: r.Email, Phone: r.Phone},
+		TaxSystemCode: r.TaxSystem,
+	}
+	for _, item := range r.Items {
+		res.Items = append(res.Items, &yooReceiptItem{
+			Description:    item.Description,
+			Quantity:       "1",
+			Amount:         rubles(item.Amount),
+			VatCode:        item.VatCode,
+			PaymentSubject: item.PaymentSubject,
+			PaymentMode:    item.PaymentMode,
+		})
+	}
+	return res
+}
+
+func (y *YooKassa) fromPayment(p *yoopayment.Payment) (*Payment, error) {
+	amount, err := parseAmount(p.Amount)
+	if err != nil {
+		return nil, err
+	}
+	refunded, err := parseAmount(p.RefundedAmount)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Payment{
+		ID:       p.ID,
+		Status:   Status(p.Status),
+		Amount:   amount,
+		Refunded: refunded,
+		// pending until the receipt is registered
+		ReceiptStatus: Status(p.ReceiptRegistration),
+	}
+	if p.CreatedAt != nil {
+		res.CreatedAt = *p.CreatedAt
+	}
+	// only payments waiting for the customer have it
+	if p.Confirmation != nil {
+		res.URL, _ = y.payments.ParsePaymentLink(p)
+	}
+	if m, ok := p.PaymentMethod.(map[string]interface{}); ok && m["saved"] == true {
+		id, _ := m["id"].(string)
+		title, _ := m["title"].(string)
+		res.SavedMethod = &SavedMethod{ID: id, Title: title}
+	}
+	return res, nil
+}
+
+func fromYooRefund(rf *yoorefund.Refund) (*Refund, error) {
+	amount, err := parseAmount(rf.Amount)
+	if err != nil {
+		return nil, err
+	}
+	return &Refund{
+		ID:            rf.Id,
+		PaymentID:     rf.PaymentId,
+		Status:        Status(rf.Status),
+		Amount:        amount,
+		ReceiptStatus: Status(rf.ReceiptRegistration),
+	}, nil
+}
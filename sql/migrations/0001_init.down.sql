@@ -0,0 +1,6 @@
+DROP TABLE invites;
+DROP TABLE transactions;
+DROP TABLE service_prices;
+DROP TABLE services;
+DROP TABLE service_locations;
+DROP TABLE users;
@@ -0,0 +1,58 @@
+-- every node becomes a location again, services named by the newer scheme
+-- can't be found on their node by the old one so the downgrade is refused
+CREATE TEMP TABLE downgrade_check (renamed_services INTEGER CHECK (renamed_services = 0));
+INSERT INTO downgrade_check
+SELECT COUNT(*) FROM services s
+JOIN users u ON u.id = s.user_id
+WHERE s.remote_name != u.name || s.created_at;
+DROP TABLE downgrade_check;
+
+DROP TABLE join_tokens;
+DROP TABLE node_checks;
+DROP TABLE node_hostnames;
+DROP TABLE location_hostnames;
+
+ALTER TABLE services RENAME TO services_new;
+ALTER TABLE service_locations RENAME TO service_locations_new;
+
+CREATE TABLE service_locations (
+	id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	address TEXT NOT NULL,
+	services TEXT NOT NULL
+);
+
+INSERT INTO service_locations (id, name, address, services)
+SELECT n.id, l.name, n.address, (SELECT COALESCE(GROUP_CONCAT(p.type, ','), '') FROM service_prices p)
+FROM nodes n
+JOIN service_locations_new l ON l.id = n.location_id;
+
+CREATE TABLE services (
+	id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	type TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL,
+	prolong INTEGER NOT NULL,
+	prolong_price INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	location_id INTEGER NOT NULL,
+	FOREIGN KEY (user_id)
+	REFERENCES users (id),
+	FOREIGN KEY (location_id)
+	REFERENCES service_locations (id)
+);
+
+INSERT INTO services (
+	id, name, type, created_at, expires_at, prolong,
+	prolong_price, user_id, location_id
+)
+SELECT id, name, type, created_at, expires_at, prolong,
+	prolong_price, user_id, node_id
+FROM services_new;
+
+DROP TABLE services_new;
+DROP TABLE nodes;
+DROP TABLE service_locations_new;
+
+ALTER TABLE users DROP COLUMN admin;
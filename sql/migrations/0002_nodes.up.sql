@@ -0,0 +1,106 @@
+-- every location of the baseline schema becomes a node, locations sharing
+-- a name are merged into one with several nodes
+
+ALTER TABLE users ADD COLUMN admin INTEGER NOT NULL DEFAULT FALSE;
+
+ALTER TABLE service_locations RENAME TO service_locations_old;
+
+CREATE TABLE service_locations (
+	id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE
+);
+
+INSERT INTO service_locations (id, name)
+SELECT MIN(id), name FROM service_locations_old
+GROUP BY name;
+
+CREATE TABLE nodes (
+	id INTEGER PRIMARY KEY,
+	location_id INTEGER NOT NULL,
+	address TEXT NOT NULL,
+	heartbeat_key TEXT NOT NULL DEFAULT '',
+	last_seen INTEGER NOT NULL DEFAULT 0,
+	online INTEGER NOT NULL DEFAULT TRUE,
+	weight INTEGER NOT NULL DEFAULT 1,
+	draining INTEGER NOT NULL DEFAULT FALSE,
+	FOREIGN KEY (location_id)
+	REFERENCES service_locations (id)
+);
+
+INSERT INTO nodes (id, location_id, address)
+SELECT o.id, l.id, CASE WHEN o.address LIKE '%/' THEN o.address ELSE o.address || '/' END
+FROM service_locations_old o
+JOIN service_locations l ON l.name = o.name;
+
+ALTER TABLE services RENAME TO services_old;
+
+CREATE TABLE services (
+	id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	remote_name TEXT NOT NULL,
+	type TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL,
+	prolong INTEGER NOT NULL,
+	prolong_price INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	location_id INTEGER NOT NULL,
+	node_id INTEGER NOT NULL,
+	FOREIGN KEY (user_id)
+	REFERENCES users (id),
+	FOREIGN KEY (location_id)
+	REFERENCES service_locations (id),
+	FOREIGN KEY (node_id)
+	REFERENCES nodes (id)
+);
+
+-- services were named after their owner and creation time on the node
+INSERT INTO services (
+	id, name, remote_name, type, created_at, expires_at, prolong,
+	prolong_price, user_id, location_id, node_id
+)
+SELECT s.id, s.name, u.name || s.created_at, s.type, s.created_at, s.expires_at, s.prolong,
+	s.prolong_price, s.user_id, n.location_id, n.id
+FROM services_old s
+JOIN users u ON u.id = s.user_id
+JOIN nodes n ON n.id = s.location_id;
+
+DROP TABLE services_old;
+DROP TABLE service_locations_old;
+
+CREATE TABLE location_hostnames (
+	id INTEGER PRIMARY KEY,
+	location_id INTEGER NOT NULL,
+	kind TEXT NOT NULL,
+	hostname TEXT NOT NULL,
+	FOREIGN KEY (location_id)
+	REFERENCES service_locations (id)
+);
+
+CREATE TABLE node_hostnames (
+	id INTEGER PRIMARY KEY,
+	node_id INTEGER NOT NULL,
+	kind TEXT NOT NULL,
+	hostname TEXT NOT NULL,
+	FOREIGN KEY (node_id)
+	REFERENCES nodes (id)
+);
+
+CREATE TABLE node_checks (
+	id INTEGER PRIMARY KEY,
+	node_id INTEGER NOT NULL,
+	timestamp INTEGER NOT NULL,
+	up INTEGER NOT NULL,
+	latency INTEGER NOT NULL,
+	FOREIGN KEY (node_id)
+	REFERENCES nodes (id)
+);
+
+CREATE TABLE join_tokens (
+	id INTEGER PRIMARY KEY,
+	token TEXT NOT NULL UNIQUE,
+	location TEXT NOT NULL,
+	used INTEGER NOT NULL,
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL
+);
@@ -0,0 +1,10 @@
+ALTER TABLE service_prices DROP COLUMN traffic_pack_price;
+ALTER TABLE service_prices DROP COLUMN traffic_pack_size;
+ALTER TABLE service_prices DROP COLUMN quota_mode;
+ALTER TABLE service_prices DROP COLUMN quota;
+ALTER TABLE service_prices DROP COLUMN max_ips;
+
+ALTER TABLE services DROP COLUMN rotated_at;
+ALTER TABLE services DROP COLUMN quota;
+
+DROP TABLE acl_policies;
@@ -0,0 +1,20 @@
+CREATE TABLE acl_policies (
+	id INTEGER PRIMARY KEY,
+	location_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	blocked_ports TEXT NOT NULL DEFAULT '[]',
+	cidrs TEXT NOT NULL DEFAULT '[]',
+	domains TEXT NOT NULL DEFAULT '[]',
+	UNIQUE (location_id, name),
+	FOREIGN KEY (location_id)
+	REFERENCES service_locations (id)
+);
+
+ALTER TABLE services ADD COLUMN quota INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE services ADD COLUMN rotated_at INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE service_prices ADD COLUMN max_ips INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE service_prices ADD COLUMN quota INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE service_prices ADD COLUMN quota_mode TEXT NOT NULL DEFAULT 'suspend';
+ALTER TABLE service_prices ADD COLUMN traffic_pack_size INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE service_prices ADD COLUMN traffic_pack_price INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,22 @@
+CREATE TABLE ledger_entries (
+	id INTEGER PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	amount INTEGER NOT NULL,
+	balance INTEGER NOT NULL,
+	reason TEXT NOT NULL,
+	reference TEXT NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL,
+	FOREIGN KEY (user_id)
+	REFERENCES users (id)
+);
+
+CREATE INDEX ledger_entries_user ON ledger_entries (user_id, id);
+
+-- a payment is credited only once
+CREATE UNIQUE INDEX ledger_entries_topup ON ledger_entries (reference)
+WHERE reason = 'topup';
+
+INSERT INTO ledger_entries (user_id, amount, balance, reason, reference, created_at)
+SELECT id, balance, balance, 'opening', '', CAST(strftime('%s', 'now') AS INTEGER)
+FROM users
+WHERE balance != 0;
@@ -0,0 +1,7 @@
+-- the old schema can't tell suspended services from active ones, the
+-- downgrade is refused rather than dropping them
+CREATE TEMP TABLE downgrade_check (inactive_services INTEGER CHECK (inactive_services = 0));
+INSERT INTO downgrade_check SELECT COUNT(*) FROM services WHERE status != 'active';
+DROP TABLE downgrade_check;
+
+ALTER TABLE services DROP COLUMN status;
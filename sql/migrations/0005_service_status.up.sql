@@ -0,0 +1 @@
+ALTER TABLE services ADD COLUMN status TEXT NOT NULL DEFAULT 'active';
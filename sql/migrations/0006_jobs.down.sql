@@ -0,0 +1,4 @@
+DROP TABLE jobs;
+
+UPDATE services SET status = 'canceled' WHERE status = 'failed';
+UPDATE services SET status = 'active' WHERE status = 'suspended';
@@ -0,0 +1,21 @@
+CREATE TABLE jobs (
+	id INTEGER PRIMARY KEY,
+	kind TEXT NOT NULL,
+	unique_key TEXT NOT NULL DEFAULT '',
+	payload TEXT NOT NULL DEFAULT '{}',
+	status TEXT NOT NULL DEFAULT 'queued',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	max_attempts INTEGER NOT NULL,
+	run_at INTEGER NOT NULL,
+	last_error TEXT NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL
+);
+
+CREATE INDEX jobs_queued ON jobs (status, run_at);
+
+-- only one unfinished job may have the key
+CREATE UNIQUE INDEX jobs_unique_key ON jobs (unique_key)
+WHERE unique_key != '' AND status IN ('queued', 'running');
+
+UPDATE services SET status = 'failed' WHERE status = 'canceled';
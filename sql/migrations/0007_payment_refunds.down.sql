@@ -0,0 +1 @@
+DROP INDEX ledger_entries_payment_refund;
@@ -0,0 +1,3 @@
+-- a refund made by the payment provider is debited only once
+CREATE UNIQUE INDEX ledger_entries_payment_refund ON ledger_entries (reference)
+WHERE reason = 'payment_refund';
@@ -0,0 +1,2 @@
+-- payments made before were all made with YooKassa
+ALTER TABLE transactions ADD COLUMN provider TEXT NOT NULL DEFAULT 'yookassa';
@@ -0,0 +1,6 @@
+UPDATE services SET status = 'failed' WHERE status = 'canceled';
+ALTER TABLE services DROP COLUMN paid_at;
+
+UPDATE transactions SET status = 'completed'
+WHERE status IN ('refunded', 'partially_refunded');
+ALTER TABLE transactions DROP COLUMN refunded;
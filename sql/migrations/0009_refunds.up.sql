@@ -0,0 +1,11 @@
+ALTER TABLE transactions ADD COLUMN refunded INTEGER NOT NULL DEFAULT 0;
+
+-- start of the period the service was last paid for, the unused part of it
+-- is credited back when the service is canceled
+ALTER TABLE services ADD COLUMN paid_at INTEGER NOT NULL DEFAULT 0;
+
+UPDATE services SET paid_at = COALESCE((
+	SELECT MAX(created_at) FROM ledger_entries
+	WHERE reason IN ('purchase', 'renewal')
+	AND reference = 'service:' || services.id
+), created_at);
@@ -0,0 +1,3 @@
+DROP INDEX transactions_timestamp;
+DROP TABLE reconciliation_issues;
+DROP TABLE reconciliation_reports;
@@ -0,0 +1,29 @@
+-- payments of the provider compared with transactions over a period
+CREATE TABLE reconciliation_reports (
+	id INTEGER PRIMARY KEY,
+	provider TEXT NOT NULL,
+	period_start INTEGER NOT NULL,
+	period_end INTEGER NOT NULL,
+	payments INTEGER NOT NULL,
+	transactions INTEGER NOT NULL,
+	fixed INTEGER NOT NULL,
+	flagged INTEGER NOT NULL,
+	created_at INTEGER NOT NULL
+);
+
+CREATE UNIQUE INDEX reconciliation_reports_period ON reconciliation_reports (provider, period_start);
+
+CREATE TABLE reconciliation_issues (
+	id INTEGER PRIMARY KEY,
+	report_id INTEGER NOT NULL,
+	payment_id TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	detail TEXT NOT NULL DEFAULT '',
+	fixed INTEGER NOT NULL DEFAULT 0,
+	FOREIGN KEY (report_id)
+	REFERENCES reconciliation_reports (id)
+);
+
+CREATE INDEX reconciliation_issues_report ON reconciliation_issues (report_id);
+
+CREATE INDEX transactions_timestamp ON transactions (provider, timestamp);
@@ -0,0 +1,2 @@
+DROP TABLE autopay_charges;
+DROP TABLE payment_methods;
@@ -0,0 +1,33 @@
+-- payment method the user let us charge when a renewal lacks money
+CREATE TABLE payment_methods (
+	id INTEGER PRIMARY KEY,
+	user_id INTEGER NOT NULL UNIQUE,
+	provider TEXT NOT NULL,
+	method_id TEXT NOT NULL,
+	title TEXT NOT NULL DEFAULT '',
+	-- most that can be charged in a calendar month
+	monthly_limit INTEGER NOT NULL,
+	created_at INTEGER NOT NULL,
+	FOREIGN KEY (user_id)
+	REFERENCES users (id)
+);
+
+-- charges of the saved method, one per term of the service
+CREATE TABLE autopay_charges (
+	id INTEGER PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	service_id INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL,
+	amount INTEGER NOT NULL,
+	payment_id TEXT NOT NULL DEFAULT '',
+	status TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	FOREIGN KEY (user_id)
+	REFERENCES users (id),
+	FOREIGN KEY (service_id)
+	REFERENCES services (id)
+);
+
+CREATE UNIQUE INDEX autopay_charges_term ON autopay_charges (service_id, expires_at);
+CREATE INDEX autopay_charges_user ON autopay_charges (user_id, created_at);
+CREATE INDEX autopay_charges_payment ON autopay_charges (payment_id);
@@ -0,0 +1,3 @@
+ALTER TABLE transactions DROP COLUMN receipt_contact;
+ALTER TABLE transactions DROP COLUMN receipt;
+ALTER TABLE users DROP COLUMN receipt_contact;
@@ -0,0 +1,6 @@
+-- email or phone fiscal receipts are sent to
+ALTER TABLE users ADD COLUMN receipt_contact TEXT NOT NULL DEFAULT '';
+-- registration status of the receipt, empty if none was sent
+ALTER TABLE transactions ADD COLUMN receipt TEXT NOT NULL DEFAULT '';
+-- refunds send their receipts to the same contact
+ALTER TABLE transactions ADD COLUMN receipt_contact TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,9 @@
+// Package migrations embeds the schema migrations of the api server. Every
+// version is a pair of NNNN_name.up.sql and NNNN_name.down.sql files, sqlc
+// builds the schema from the up migrations.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
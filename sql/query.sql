@@ -19,11 +19,41 @@ UPDATE users
 SET password_hash = ?
 WHERE id = ?;
 
--- name: UpdateBalance :exec
+-- name: SetReceiptContact :exec
 UPDATE users
-SET balance = ?
+SET receipt_contact = ?
 WHERE id = ?;
 
+-- name: AddBalance :one
+UPDATE users
+SET balance = balance + sqlc.arg(amount)
+WHERE id = sqlc.arg(id) AND balance + sqlc.arg(amount) >= 0
+RETURNING balance;
+
+-- name: CreateLedgerEntry :one
+INSERT INTO ledger_entries (
+	user_id, amount, balance, reason, reference, created_at
+) VALUES (
+	?, ?, ?, ?, ?, ?
+)
+RETURNING id;
+
+-- name: ChargeBalance :one
+UPDATE users
+SET balance = balance + sqlc.arg(amount)
+WHERE id = sqlc.arg(id)
+RETURNING balance;
+
+-- name: CountLedgerEntries :one
+SELECT COUNT(*) FROM ledger_entries
+WHERE reason = ? AND reference = ?;
+
+-- name: ListLedgerEntries :many
+SELECT * FROM ledger_entries
+WHERE user_id = ? AND id < ?
+ORDER BY id DESC
+LIMIT ?;
+
 -- name: GetInvite :one
 SELECT * FROM invites
 WHERE code = ? LIMIT 1;
@@ -53,6 +83,7 @@ WHERE id = ?;
 SELECT
 	services.id, services.name,
 	services.expires_at, services.type,
+	services.status,
 	service_locations.name
 FROM services
 JOIN service_locations ON service_locations.id = services.location_id
@@ -63,40 +94,80 @@ SELECT
 	services.id, services.name,
 	services.expires_at, services.created_at,
 	services.prolong, services.prolong_price,
-	services.type,
+	services.type, services.location_id, services.node_id,
+	services.remote_name, services.quota, services.rotated_at,
+	services.status,
 	service_locations.name,
-	service_locations.address
+	nodes.address,
+	nodes.online
 FROM services
 JOIN service_locations ON service_locations.id = services.location_id
+JOIN nodes ON nodes.id = services.node_id
 WHERE services.id = ? AND services.user_id = ?;
 
 -- name: CreateService :one
 INSERT INTO services (
-	name, type, created_at, expires_at, prolong, prolong_price, user_id, location_id
+	name, remote_name, type, created_at, expires_at, prolong, prolong_price, user_id, location_id, node_id, quota, status, paid_at
 ) VALUES (
-	?, ?, ?, ?, ?, ?, ?, ?
+	?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
 )
 RETURNING id;
 
+-- name: SetServiceRemoteName :exec
+UPDATE services SET remote_name = ?
+WHERE id = ?;
+
+-- name: ActivateService :execrows
+UPDATE services SET status = 'active'
+WHERE id = ? AND status = 'pending';
+
+-- name: FailPendingService :execrows
+UPDATE services SET status = 'failed'
+WHERE id = ? AND status = 'pending';
+
+-- name: SuspendService :execrows
+UPDATE services SET status = 'suspended'
+WHERE id = ? AND status = 'active';
+
+-- name: CancelService :one
+UPDATE services SET status = 'canceled'
+WHERE id = ? AND user_id = ? AND status IN ('active', 'suspended')
+RETURNING *;
+
+-- name: GetServiceNode :one
+SELECT services.*, nodes.address FROM services
+JOIN nodes ON nodes.id = services.node_id
+WHERE services.id = ?;
+
+-- name: GetNodeService :one
+SELECT * FROM services
+WHERE node_id = ? AND remote_name = ? AND status NOT IN ('failed', 'canceled') LIMIT 1;
+
+-- name: SetServiceRotated :exec
+UPDATE services SET rotated_at = ?
+WHERE node_id = ? AND remote_name = ?;
+
 -- name: DeleteService :exec
 DELETE FROM services
 WHERE id = ?;
 
 -- name: GetExpiredServices :many
-SELECT services.*, service_locations.address FROM services
-JOIN service_locations ON service_locations.id = services.location_id
-WHERE expires_at < ?;
+SELECT services.*, nodes.address FROM services
+JOIN nodes ON nodes.id = services.node_id
+WHERE expires_at < ? AND status IN ('active', 'suspended');
 
--- name: ProlongService :exec
+-- name: ProlongService :one
 UPDATE services
-SET expires_at = ? + (expires_at - created_at)
-WHERE id = ?;
+SET expires_at = sqlc.arg(now) + (expires_at - created_at), paid_at = sqlc.arg(now), status = 'active'
+WHERE id = sqlc.arg(id)
+RETURNING expires_at;
 
 -- name: CreateTransaction :one
 INSERT INTO transactions (
-	payment_id, amount, status, timestamp, url, user_id
+	payment_id, amount, status, timestamp, url, user_id, provider,
+	receipt, receipt_contact
 ) VALUES (
-	?, ?, ?, ?, ?, ?
+	?, ?, ?, ?, ?, ?, ?, ?, ?
 )
 RETURNING id;
 
@@ -104,27 +175,364 @@ RETURNING id;
 SELECT * FROM transactions
 WHERE user_id = ?;
 
--- name: CancelExpiredTransactions :many
-UPDATE transactions
-SET status = 'canceled'
-WHERE timestamp < ?
-AND status = 'in_process'
-RETURNING payment_id;
+-- name: ListOpenTransactions :many
+SELECT * FROM transactions
+WHERE provider = ? AND status = 'in_process';
+
+-- name: GetTransaction :one
+SELECT * FROM transactions
+WHERE payment_id = ?;
 
--- name: UpdateTransaction :one
+-- name: CompleteTransaction :one
 UPDATE transactions
-SET status = ?
-WHERE payment_id = ?
+SET status = 'completed'
+WHERE payment_id = ? AND status IN ('in_process', 'canceled')
 RETURNING user_id, amount;
 
--- name: ListLocations :many
-SELECT name, services FROM service_locations;
+-- name: FlagTransaction :exec
+UPDATE transactions
+SET status = 'flagged'
+WHERE payment_id = ?;
+
+-- name: RefundTransaction :exec
+UPDATE transactions
+SET refunded = refunded + sqlc.arg(amount),
+	status = CASE WHEN refunded + sqlc.arg(amount) >= amount
+		THEN 'refunded' ELSE 'partially_refunded' END
+WHERE payment_id = sqlc.arg(payment_id);
+
+-- name: SetTransactionReceipt :exec
+UPDATE transactions
+SET receipt = ?
+WHERE payment_id = ?;
+
+-- name: CancelTransaction :exec
+UPDATE transactions
+SET status = 'canceled'
+WHERE payment_id = ? AND status = 'in_process';
 
 -- name: GetLocation :one
 SELECT * FROM service_locations
-WHERE services LIKE '%' || ? || '%'
-AND name = ? LIMIT 1;
+WHERE name = ? LIMIT 1;
 
 -- name: GetPrice :one
-SELECT amount FROM service_prices
+SELECT * FROM service_prices
 WHERE type = ?;
+
+-- name: ListPrices :many
+SELECT * FROM service_prices
+ORDER BY type;
+
+-- name: CreateLocation :one
+INSERT INTO service_locations (
+	name
+) VALUES (
+	?
+)
+RETURNING id;
+
+-- name: CreateNode :one
+INSERT INTO nodes (
+	location_id, address, heartbeat_key, last_seen, online, weight, draining
+) VALUES (
+	?, ?, ?, ?, TRUE, 1, FALSE
+)
+RETURNING id;
+
+-- name: EnrollNode :exec
+UPDATE nodes
+SET heartbeat_key = ?, last_seen = ?, online = TRUE
+WHERE id = ?;
+
+-- name: GetNodeByAddress :one
+SELECT * FROM nodes
+WHERE location_id = ? AND address = ? LIMIT 1;
+
+-- name: GetNode :one
+SELECT * FROM nodes
+WHERE id = ?;
+
+-- name: GetNodeByKey :one
+SELECT * FROM nodes
+WHERE heartbeat_key = ? AND heartbeat_key != '' LIMIT 1;
+
+-- name: UpdateHeartbeat :exec
+UPDATE nodes
+SET address = ?, last_seen = ?
+WHERE id = ?;
+
+-- name: ListNodes :many
+SELECT nodes.*, service_locations.name AS location FROM nodes
+JOIN service_locations ON service_locations.id = nodes.location_id;
+
+-- name: ListAvailableNodes :many
+SELECT nodes.*, service_locations.name AS location FROM nodes
+JOIN service_locations ON service_locations.id = nodes.location_id
+WHERE nodes.online = TRUE AND nodes.draining = FALSE;
+
+-- name: ListLocationNodes :many
+SELECT * FROM nodes
+WHERE location_id = ? AND online = TRUE AND draining = FALSE;
+
+-- name: UpdateNode :exec
+UPDATE nodes
+SET weight = ?, draining = ?
+WHERE id = ?;
+
+-- name: SetNodeOnline :exec
+UPDATE nodes
+SET online = ?
+WHERE id = ?;
+
+-- name: ListServiceHostnames :many
+SELECT kind, hostname FROM node_hostnames
+WHERE node_id = ?
+UNION ALL
+SELECT kind, hostname FROM location_hostnames
+WHERE location_id = ?;
+
+-- name: ListNodeHostnames :many
+SELECT * FROM node_hostnames
+WHERE node_id = ?;
+
+-- name: CreateNodeHostname :exec
+INSERT INTO node_hostnames (
+	node_id, kind, hostname
+) VALUES (
+	?, ?, ?
+);
+
+-- name: DeleteNodeHostnames :exec
+DELETE FROM node_hostnames
+WHERE node_id = ?;
+
+-- name: ListLocationHostnames :many
+SELECT * FROM location_hostnames
+WHERE location_id = ?;
+
+-- name: CreateLocationHostname :exec
+INSERT INTO location_hostnames (
+	location_id, kind, hostname
+) VALUES (
+	?, ?, ?
+);
+
+-- name: DeleteLocationHostnames :exec
+DELETE FROM location_hostnames
+WHERE location_id = ?;
+
+-- name: ListLocationPolicies :many
+SELECT * FROM acl_policies
+WHERE location_id = ?
+ORDER BY name;
+
+-- name: SetPolicy :exec
+INSERT INTO acl_policies (
+	location_id, name, blocked_ports, cidrs, domains
+) VALUES (
+	?, ?, ?, ?, ?
+)
+ON CONFLICT (location_id, name) DO UPDATE SET
+	blocked_ports = excluded.blocked_ports,
+	cidrs = excluded.cidrs,
+	domains = excluded.domains;
+
+-- name: DeletePolicy :exec
+DELETE FROM acl_policies
+WHERE location_id = ? AND name = ?;
+
+-- name: CreateNodeCheck :exec
+INSERT INTO node_checks (
+	node_id, timestamp, up, latency
+) VALUES (
+	?, ?, ?, ?
+);
+
+-- name: ListNodeChecks :many
+SELECT * FROM node_checks
+WHERE node_id = ? AND timestamp > ?
+ORDER BY timestamp DESC;
+
+-- name: CountNodeFailures :one
+SELECT COUNT(*) FROM node_checks c
+WHERE c.node_id = sqlc.arg(node_id) AND c.up = FALSE AND c.id > (
+	SELECT CAST(COALESCE(MAX(u.id), 0) AS INTEGER) FROM node_checks u
+	WHERE u.node_id = sqlc.arg(node_id) AND u.up = TRUE
+);
+
+-- name: DeleteOldNodeChecks :exec
+DELETE FROM node_checks
+WHERE timestamp < ?;
+
+-- name: CreateJoinToken :exec
+INSERT INTO join_tokens (
+	token, location, used, created_at, expires_at
+) VALUES (
+	?, ?, FALSE, ?, ?
+);
+
+-- name: UseJoinToken :one
+UPDATE join_tokens
+SET used = TRUE
+WHERE token = ?
+AND used = FALSE
+AND expires_at > ?
+RETURNING location;
+
+-- name: EnqueueJob :execrows
+INSERT INTO jobs (
+	kind, unique_key, payload, status, max_attempts, run_at, created_at, updated_at
+) VALUES (
+	?, ?, ?, 'queued', ?, ?, ?, ?
+)
+ON CONFLICT DO NOTHING;
+
+-- name: ClaimJob :one
+UPDATE jobs
+SET status = 'running', attempts = attempts + 1, updated_at = sqlc.arg(now)
+WHERE id = (
+	SELECT id FROM jobs
+	WHERE status = 'queued' AND run_at <= sqlc.arg(now)
+	ORDER BY run_at, id
+	LIMIT 1
+)
+RETURNING *;
+
+-- name: FinishJob :exec
+UPDATE jobs
+SET status = 'done', last_error = '', updated_at = ?
+WHERE id = ?;
+
+-- name: RescheduleJob :exec
+UPDATE jobs
+SET status = 'queued', run_at = ?, last_error = ?, updated_at = ?
+WHERE id = ?;
+
+-- name: KillJob :exec
+UPDATE jobs
+SET status = 'dead', last_error = ?, updated_at = ?
+WHERE id = ?;
+
+-- name: RequeueRunningJobs :exec
+UPDATE jobs
+SET status = 'queued', updated_at = ?
+WHERE status = 'running';
+
+-- name: GetJob :one
+SELECT * FROM jobs
+WHERE id = ?;
+
+-- name: ListJobs :many
+SELECT * FROM jobs
+WHERE (CAST(sqlc.arg(status) AS TEXT) = '' OR status = sqlc.arg(status)) AND id < sqlc.arg(before)
+ORDER BY id DESC
+LIMIT sqlc.arg(limit);
+
+-- name: RetryJob :execrows
+UPDATE OR IGNORE jobs
+SET status = 'queued', attempts = 0, run_at = sqlc.arg(now), last_error = '', updated_at = sqlc.arg(now)
+WHERE id = sqlc.arg(id) AND status IN ('dead', 'canceled');
+
+-- name: CancelJob :execrows
+UPDATE jobs
+SET status = 'canceled', updated_at = ?
+WHERE id = ? AND status = 'queued';
+
+-- name: DeleteFinishedJobs :exec
+DELETE FROM jobs
+WHERE status = 'done' AND updated_at < ?;
+
+-- name: ListPeriodTransactions :many
+SELECT * FROM transactions
+WHERE provider = ? AND timestamp >= sqlc.arg(from) AND timestamp < sqlc.arg(to);
+
+-- name: GetReconciliationReportByPeriod :one
+SELECT * FROM reconciliation_reports
+WHERE provider = ? AND period_start = ?;
+
+-- name: CreateReconciliationReport :one
+INSERT INTO reconciliation_reports (
+	provider, period_start, period_end, payments, transactions, fixed, flagged, created_at
+) VALUES (
+	?, ?, ?, ?, ?, ?, ?, ?
+)
+RETURNING id;
+
+-- name: CreateReconciliationIssue :exec
+INSERT INTO reconciliation_issues (
+	report_id, payment_id, kind, detail, fixed
+) VALUES (
+	?, ?, ?, ?, ?
+);
+
+-- name: ListReconciliationReports :many
+SELECT * FROM reconciliation_reports
+WHERE id < ?
+ORDER BY id DESC
+LIMIT ?;
+
+-- name: GetReconciliationReport :one
+SELECT * FROM reconciliation_reports
+WHERE id = ?;
+
+-- name: ListReconciliationIssues :many
+SELECT * FROM reconciliation_issues
+WHERE report_id = ?
+ORDER BY id;
+
+-- name: GetPaymentMethod :one
+SELECT * FROM payment_methods
+WHERE user_id = ?;
+
+-- name: SavePaymentMethod :exec
+INSERT INTO payment_methods (
+	user_id, provider, method_id, title, monthly_limit, created_at
+) VALUES (
+	?, ?, ?, ?, ?, ?
+)
+ON CONFLICT (user_id) DO UPDATE
+SET provider = excluded.provider, method_id = excluded.method_id,
+	title = excluded.title, created_at = excluded.created_at;
+
+-- name: SetAutopayLimit :execrows
+UPDATE payment_methods SET monthly_limit = ?
+WHERE user_id = ?;
+
+-- name: DeletePaymentMethod :execrows
+DELETE FROM payment_methods
+WHERE user_id = ?;
+
+-- name: GetAutopayCharge :one
+SELECT * FROM autopay_charges
+WHERE id = ?;
+
+-- name: GetTermAutopayCharge :one
+SELECT * FROM autopay_charges
+WHERE service_id = ? AND expires_at = ?;
+
+-- name: CreateAutopayCharge :one
+INSERT INTO autopay_charges (
+	user_id, service_id, expires_at, amount, status, created_at
+) VALUES (
+	?, ?, ?, ?, 'pending', ?
+)
+RETURNING id;
+
+-- name: SetAutopayChargePayment :exec
+UPDATE autopay_charges SET payment_id = ?
+WHERE id = ?;
+
+-- name: CountUnrecordedAutopayCharges :one
+SELECT COUNT(*) FROM autopay_charges
+WHERE payment_id = '' AND status = 'pending' AND amount = ?;
+
+-- name: SettleAutopayCharge :one
+UPDATE autopay_charges SET status = sqlc.arg(status)
+WHERE (id = sqlc.arg(id) OR (payment_id != '' AND payment_id = sqlc.arg(payment_id)))
+AND status = 'pending'
+RETURNING *;
+
+-- name: SumAutopayCharges :one
+SELECT CAST(COALESCE(SUM(amount), 0) AS INTEGER) FROM autopay_charges
+WHERE user_id = ? AND created_at >= sqlc.arg(since) AND id != sqlc.arg(exclude)
+AND status IN ('pending', 'succeeded');